@@ -0,0 +1,39 @@
+// Package admin serves runtime diagnostics, such as profiles and goroutine
+// dumps, on a listener of its own so that they are never exposed alongside
+// the API.
+package admin
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+)
+
+// Handler returns a handler serving:
+//
+//	/debug/pprof/      profiles, as served by net/http/pprof
+//	/debug/vars        expvar variables, including memory statistics
+//	/debug/goroutines  the stacks of every goroutine as text
+//
+// The handlers are registered on a mux of their own rather than
+// http.DefaultServeMux, which the pprof and expvar packages add them to.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", goroutines)
+	return mux
+}
+
+// goroutines writes the stacks of all goroutines in the same format as an
+// unrecovered panic, which is easier to search for leaked workers than the
+// aggregated goroutine profile.
+func goroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync"
+)
+
+// APIKeys authenticates requests using static API keys, presented either as
+// a bearer token or in the X-API-Key header. The map is keyed by API key.
+type APIKeys map[string]*Identity
+
+// Authenticate implements Authenticator.
+func (k APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	for candidate, id := range k {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return id, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// KeyRing is a set of API keys that can be replaced while serving, such as
+// keys resolved from a secret store that rotates them.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys APIKeys
+}
+
+// NewKeyRing returns a key ring holding keys.
+func NewKeyRing(keys APIKeys) *KeyRing {
+	return &KeyRing{keys: keys}
+}
+
+// Set replaces the keys.
+func (r *KeyRing) Set(keys APIKeys) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+}
+
+// Authenticate implements Authenticator.
+func (r *KeyRing) Authenticate(req *http.Request) (*Identity, error) {
+	r.mu.RLock()
+	keys := r.keys
+	r.mu.RUnlock()
+	return keys.Authenticate(req)
+}
@@ -0,0 +1,86 @@
+// Package auth authenticates callers of the urlfetcher HTTP endpoints and
+// carries their identity through request contexts.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Identity describes an authenticated caller.
+type Identity struct {
+	Subject string // Unique name of the caller, e.g. the JWT "sub" claim
+	Tenant  string // Tenant the caller belongs to, may be empty
+	Owner   string // Owner recorded on jobs created by the caller
+	Role    string // RoleViewer, RoleSubmitter or RoleAdmin
+}
+
+// Authenticator validates the credentials presented on an HTTP request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// ErrNoCredentials is returned when a request carries no credentials at all.
+var ErrNoCredentials = errors.New("auth: no credentials presented")
+
+// ErrInvalidCredentials is returned when the presented credentials are not valid.
+var ErrInvalidCredentials = errors.New("auth: invalid credentials")
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Identity {
+	if ctx == nil {
+		return nil
+	}
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// Middleware rejects requests that a does not authenticate, and stores the
+// identity of accepted requests in the request context.
+func Middleware(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="urlfetcher"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// RequireSubjects rejects requests whose authenticated caller, as stored by
+// Middleware, is not one of subjects.
+func RequireSubjects(subjects []string, next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, s := range subjects {
+		allowed[s] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := FromContext(r.Context())
+		if id == nil || !allowed[id.Subject] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(h) > len(prefix) && strings.ToLower(h[:len(prefix)]) == prefix {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+)
+
+// ClientCertificates authenticates requests by the verified TLS client
+// certificate presented on the connection. The listener must be configured
+// to request and verify client certificates.
+type ClientCertificates struct {
+	// Identities maps certificate subject common names to identities. If
+	// nil, any verified certificate is accepted and its identity is derived
+	// from the subject.
+	Identities map[string]*Identity
+	// TenantField selects the subject field used as the tenant of derived
+	// identities: "O" (organization) or "OU" (organizational unit).
+	TenantField string
+}
+
+// Authenticate implements Authenticator.
+func (c *ClientCertificates) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if c.Identities != nil {
+		id, ok := c.Identities[subject.CommonName]
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+		return id, nil
+	}
+	return &Identity{
+		Subject: subject.CommonName,
+		Tenant:  c.tenant(subject),
+		Owner:   subject.CommonName,
+	}, nil
+}
+
+func (c *ClientCertificates) tenant(subject pkix.Name) string {
+	var values []string
+	switch c.TenantField {
+	case "O":
+		values = subject.Organization
+	case "OU":
+		values = subject.OrganizationalUnit
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,373 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures validation of JWTs issued by an OIDC provider.
+type OIDCConfig struct {
+	Issuer          string        // Expected "iss" claim, also used for discovery
+	Audience        string        // Expected "aud" claim, not checked if empty
+	JWKSURL         string        // Optional, discovered from the issuer if empty
+	RefreshInterval time.Duration // How often the key set is refreshed
+	TenantClaim     string        // Claim mapped to Identity.Tenant, may be empty
+	OwnerClaim      string        // Claim mapped to Identity.Owner, defaults to "sub"
+	// RoleClaim is mapped to Identity.Role, may be empty. It may hold a
+	// role or a list of them, of which the highest is taken.
+	RoleClaim string
+}
+
+// OIDC authenticates requests carrying a bearer JWT signed by an OIDC
+// provider's published keys.
+type OIDC struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+
+	// Serializes refreshes for unknown key IDs, so that a burst of tokens
+	// with bogus IDs asks the provider at most once per minRefreshGap,
+	// even when the refreshes fail.
+	refreshMu   sync.Mutex
+	lastAttempt time.Time
+}
+
+// clockSkew is the leeway allowed when checking exp and nbf.
+const clockSkew = time.Minute
+
+// minRefreshGap throttles key set refreshes caused by unknown key IDs.
+const minRefreshGap = 30 * time.Second
+
+// NewOIDC creates an OIDC authenticator and fetches the provider's key set.
+// A background goroutine refreshes the key set every RefreshInterval.
+func NewOIDC(config OIDCConfig) (*OIDC, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("auth: OIDC issuer is required")
+	}
+	if config.OwnerClaim == "" {
+		config.OwnerClaim = "sub"
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = time.Hour
+	}
+	o := &OIDC{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if o.config.JWKSURL == "" {
+		if err := o.discover(); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.refresh(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(o.config.RefreshInterval) {
+			if err := o.refresh(); err != nil {
+				fmt.Println("failed to refresh JWKS:", err)
+			}
+		}
+	}()
+	return o, nil
+}
+
+// Authenticate implements Authenticator.
+func (o *OIDC) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	claims, err := o.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Owner, _ = claims[o.config.OwnerClaim].(string)
+	if o.config.TenantClaim != "" {
+		id.Tenant, _ = claims[o.config.TenantClaim].(string)
+	}
+	if o.config.RoleClaim != "" {
+		switch v := claims[o.config.RoleClaim].(type) {
+		case string:
+			id.Role = highestRole([]string{v})
+		case []interface{}:
+			var roles []string
+			for _, r := range v {
+				if s, ok := r.(string); ok {
+					roles = append(roles, s)
+				}
+			}
+			id.Role = highestRole(roles)
+		}
+	}
+	return id, nil
+}
+
+func (o *OIDC) discover() error {
+	url := strings.TrimSuffix(o.config.Issuer, "/") + "/.well-known/openid-configuration"
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(url, &doc); err != nil {
+		return fmt.Errorf("auth: OIDC discovery failed: %v", err)
+	}
+	if doc.JWKSURI == "" {
+		return errors.New("auth: OIDC discovery document has no jwks_uri")
+	}
+	o.config.JWKSURL = doc.JWKSURI
+	return nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (o *OIDC) refresh() error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(o.config.JWKSURL, &set); err != nil {
+		return fmt.Errorf("auth: fetching JWKS failed: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			fmt.Println("skipping JWKS key", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	o.mu.Lock()
+	o.keys = keys
+	o.lastRefresh = time.Now()
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *OIDC) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the public key with the given ID, refreshing the key set once
+// if the ID is unknown, to pick up keys rotated in since the last refresh.
+func (o *OIDC) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := o.cachedKey(kid); ok {
+		return key, nil
+	}
+	o.refreshMu.Lock()
+	defer o.refreshMu.Unlock()
+	// Another request may have refreshed while this one waited.
+	key, ok := o.cachedKey(kid)
+	if ok {
+		return key, nil
+	}
+	o.mu.RLock()
+	stale := time.Since(o.lastRefresh) > minRefreshGap
+	o.mu.RUnlock()
+	if stale && time.Since(o.lastAttempt) > minRefreshGap {
+		o.lastAttempt = time.Now()
+		if err := o.refresh(); err != nil {
+			return nil, err
+		}
+		if key, ok := o.cachedKey(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("auth: unknown signing key %q", kid)
+}
+
+func (o *OIDC) cachedKey(kid string) (crypto.PublicKey, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+func (o *OIDC) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if iss, _ := claims["iss"].(string); iss != o.config.Issuer {
+		return nil, fmt.Errorf("auth: unexpected issuer %q", iss)
+	}
+	if o.config.Audience != "" && !hasAudience(claims["aud"], o.config.Audience) {
+		return nil, errors.New("auth: token not issued for this audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("auth: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("auth: token not yet valid")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if s, _ := a.(string); s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("auth: unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("auth: unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			if rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+				return nil
+			}
+		} else if strings.HasPrefix(alg, "PS") {
+			if rsa.VerifyPSS(key, hash, digest, sig, nil) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidCredentials
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Roles of callers. Each role may do what the roles before it may.
+const (
+	RoleViewer    = "viewer"    // Query jobs and results
+	RoleSubmitter = "submitter" // Add jobs, and change and delete their own
+	RoleAdmin     = "admin"     // Change server settings, and act on the jobs of every tenant
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleSubmitter: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the roles.
+func ValidRole(role string) bool {
+	return roleRanks[role] != 0
+}
+
+// Allows reports whether id may act with role. A nil identity, as when
+// authentication is disabled, may do anything; an identity without a valid
+// role nothing.
+func (id *Identity) Allows(role string) bool {
+	if id == nil {
+		return true
+	}
+	return roleRanks[id.Role] != 0 && roleRanks[id.Role] >= roleRanks[role]
+}
+
+// ForbiddenError is returned when a caller lacks the role an action needs.
+type ForbiddenError struct {
+	Role string // Role needed
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("forbidden: requires the %s role", e.Role)
+}
+
+// highestRole returns the highest of the valid roles in roles, or "".
+func highestRole(roles []string) string {
+	highest := ""
+	for _, r := range roles {
+		if roleRanks[r] > roleRanks[highest] {
+			highest = r
+		}
+	}
+	return highest
+}
+
+// WithDefaultRole returns an authenticator giving the identities a does not
+// assign a role to role.
+func WithDefaultRole(a Authenticator, role string) Authenticator {
+	return defaultRole{next: a, role: role}
+}
+
+type defaultRole struct {
+	next Authenticator
+	role string
+}
+
+func (d defaultRole) Authenticate(r *http.Request) (*Identity, error) {
+	id, err := d.next.Authenticate(r)
+	if err != nil || id.Role != "" {
+		return id, err
+	}
+	// Identities may be shared between requests, so change a copy.
+	copied := *id
+	copied.Role = d.role
+	return &copied, nil
+}
+
+// RequireRole rejects requests whose authenticated caller, as stored by
+// Middleware, may not act with role.
+func RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !FromContext(r.Context()).Allows(role) {
+			http.Error(w, (&ForbiddenError{Role: role}).Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,268 @@
+// Package bench drives load against a running urlfetcher instance and
+// reports job throughput and latency.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures a benchmark run.
+type Config struct {
+	Endpoint string        // GraphQL endpoint of the instance under test
+	APIKey   string        // Sent as X-API-Key if set
+	Rate     float64       // Jobs submitted per second
+	Duration time.Duration // How long to keep submitting jobs
+	Timeout  time.Duration // How long to wait for outstanding jobs afterwards
+	// Target is the URL every job fetches. If empty, a local stub server is
+	// started and used instead.
+	Target string
+	// Unique appends a distinct query string to every job's URL so the
+	// server cannot answer from its cache.
+	Unique bool
+	// StubDelay and StubSize shape the responses of the local stub target.
+	StubDelay time.Duration
+	StubSize  int
+}
+
+// Percentiles summarises a latency distribution.
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	Submitted  int
+	Completed  int
+	Failed     int
+	Elapsed    time.Duration
+	Throughput float64 // Completed jobs per second
+	Latency    Percentiles
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("submitted %d, completed %d, failed %d in %v (%.1f jobs/s)\n"+
+		"latency p50 %v, p90 %v, p99 %v, max %v",
+		r.Submitted, r.Completed, r.Failed, r.Elapsed.Round(time.Millisecond), r.Throughput,
+		r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+}
+
+// NewStubTarget starts an HTTP server that answers every request with size
+// bytes after waiting delay.
+func NewStubTarget(delay time.Duration, size int) *httptest.Server {
+	body := bytes.Repeat([]byte("x"), size)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write(body)
+	}))
+}
+
+// Run submits jobs at the configured rate, waits for them to finish and
+// reports the results. Latency is measured from submission until the job
+// is first seen in a terminal state.
+func Run(ctx context.Context, c Config) (*Result, error) {
+	if c.Rate <= 0 {
+		return nil, errors.New("bench: rate must be positive")
+	}
+	target := c.Target
+	if target == "" {
+		stub := NewStubTarget(c.StubDelay, c.StubSize)
+		defer stub.Close()
+		target = stub.URL
+	}
+	client := &client{endpoint: c.Endpoint, apiKey: c.APIKey, http: &http.Client{Timeout: 30 * time.Second}}
+
+	var mu sync.Mutex
+	submitted := map[int64]time.Time{}
+	var latencies []time.Duration
+	failed := 0
+
+	start := time.Now()
+	done := make(chan struct{})
+	pollErr := make(chan error, 1)
+	go func() {
+		pollErr <- poll(ctx, client, done, func(statuses map[int64]string) {
+			mu.Lock()
+			defer mu.Unlock()
+			now := time.Now()
+			for id, at := range submitted {
+				status, ok := statuses[id]
+				if !ok || !terminal(status) {
+					continue
+				}
+				if strings.HasPrefix(status, "error") {
+					failed++
+				}
+				latencies = append(latencies, now.Sub(at))
+				delete(submitted, id)
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.Rate))
+	n := 0
+submit:
+	for time.Since(start) < c.Duration {
+		select {
+		case <-ctx.Done():
+			break submit
+		case <-ticker.C:
+		}
+		url := target
+		if c.Unique {
+			url += "?n=" + strconv.Itoa(n)
+		}
+		n++
+		id, err := client.addJob(url)
+		if err != nil {
+			ticker.Stop()
+			close(done)
+			return nil, err
+		}
+		mu.Lock()
+		submitted[id] = time.Now()
+		mu.Unlock()
+	}
+	ticker.Stop()
+
+	deadline := time.Now().Add(c.Timeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		mu.Lock()
+		outstanding := len(submitted)
+		mu.Unlock()
+		if outstanding == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(done)
+	if err := <-pollErr; err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	r := &Result{
+		Submitted: n,
+		Completed: len(latencies),
+		Failed:    failed,
+		Elapsed:   time.Since(start),
+		Latency:   percentiles(latencies),
+	}
+	r.Throughput = float64(r.Completed) / r.Elapsed.Seconds()
+	return r, nil
+}
+
+// poll repeatedly fetches the status of all jobs until done is closed.
+func poll(ctx context.Context, c *client, done chan struct{}, update func(map[int64]string)) error {
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(50 * time.Millisecond):
+		}
+		statuses, err := c.statuses()
+		if err != nil {
+			return err
+		}
+		update(statuses)
+	}
+}
+
+func terminal(status string) bool {
+	return status != "waiting" && status != "parked" && status != "fetching"
+}
+
+func percentiles(d []time.Duration) Percentiles {
+	if len(d) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(q float64) time.Duration {
+		return d[int(q*float64(len(d)-1))]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: d[len(d)-1]}
+}
+
+// client is a minimal GraphQL client for the instance under test.
+type client struct {
+	endpoint string
+	apiKey   string
+	http     *http.Client
+}
+
+func (c *client) query(query string, variables map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bench: %s returned %s", c.endpoint, resp.Status)
+	}
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return errors.New("bench: " + result.Errors[0].Message)
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+func (c *client) addJob(url string) (int64, error) {
+	var data struct {
+		AddJob struct {
+			ID int64 `json:"id"`
+		} `json:"addJob"`
+	}
+	err := c.query(`mutation($url: String!) { addJob(url: $url) { id } }`,
+		map[string]interface{}{"url": url}, &data)
+	return data.AddJob.ID, err
+}
+
+func (c *client) statuses() (map[int64]string, error) {
+	var data struct {
+		Jobs []struct {
+			ID     int64  `json:"id"`
+			Status string `json:"status"`
+		} `json:"jobs"`
+	}
+	if err := c.query(`{ jobs { id status } }`, nil, &data); err != nil {
+		return nil, err
+	}
+	statuses := make(map[int64]string, len(data.Jobs))
+	for _, j := range data.Jobs {
+		statuses[j.ID] = j.Status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,465 @@
+// Package client is a Go client for urlfetcher. It talks to the REST API
+// and event stream of a running instance, and to its GraphQL endpoint for
+// anything else.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of a urlfetcher instance.
+type Client struct {
+	endpoint string
+	apiKey   string
+	// HTTP sends the requests. Streams are not subject to its timeout.
+	HTTP *http.Client
+	// PollInterval is how often WaitForJob checks on a job.
+	PollInterval time.Duration
+	// Header holds extra headers sent with every request.
+	Header http.Header
+}
+
+// NewClient returns a client for the instance at endpoint, its base URL such
+// as "http://localhost:8080". If apiKey is set it is sent as X-API-Key.
+func NewClient(endpoint, apiKey string) *Client {
+	return &Client{
+		endpoint:     strings.TrimRight(endpoint, "/"),
+		apiKey:       apiKey,
+		HTTP:         &http.Client{Timeout: 30 * time.Second},
+		PollInterval: 250 * time.Millisecond,
+	}
+}
+
+// Job is a fetch job.
+type Job struct {
+	ID       int64             `json:"id"`
+	URL      string            `json:"url"`
+	Status   string            `json:"status"`
+	Tenant   string            `json:"tenant"`
+	Owner    string            `json:"owner"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	BatchID  int64             `json:"batchId"`
+	WorkerID int               `json:"workerId"`
+	Attempts int               `json:"attempts"`
+	Error    *JobError         `json:"error"`
+	Response *Response         `json:"response"`
+	Events   []Event           `json:"events"`
+	Version  int64             `json:"version"` // Pass to changes so they fail if the job changed meanwhile
+}
+
+// Done reports whether the job has reached a final status.
+func (j *Job) Done() bool {
+	return j.Status == "error" || strings.HasPrefix(j.Status, "done")
+}
+
+// JobError describes why a job failed.
+type JobError struct {
+	Category  string `json:"category"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *JobError) Error() string {
+	return e.Category + ": " + e.Message
+}
+
+// Response describes a fetched response. Its body is downloaded with Body.
+type Response struct {
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode"`
+	Size       int       `json:"size"`
+	SHA256     string    `json:"sha256"`
+	BLAKE3     string    `json:"blake3"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Event is an entry in a job's timeline.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+// JobOptions are the optional settings of a new job.
+type JobOptions struct {
+	Preset         string        `json:"preset,omitempty"` // Server-side preset the other options override
+	Type           string        `json:"type,omitempty"`   // "certificate" to only check the host's TLS certificates
+	Tags           []string      `json:"tags,omitempty"`
+	Notify         string        `json:"notify,omitempty"`
+	MaxBytes       int64         `json:"maxBytes,omitempty"`
+	MaxDuration    time.Duration `json:"-"`
+	Deadline       time.Time     `json:"-"` // When the job should have run by
+	NotBefore      time.Time     `json:"-"` // When the job may run at the earliest
+	ClientCert     string        `json:"clientCert,omitempty"`
+	HostHeader     string        `json:"hostHeader,omitempty"`
+	ServerName     string        `json:"serverName,omitempty"`
+	ConnectAddress string        `json:"connectAddress,omitempty"`
+	Tunnel         string        `json:"tunnel,omitempty"`
+	Egress         string        `json:"egress,omitempty"`
+	Pool           string        `json:"pool,omitempty"` // Worker pool to run the job
+	Debug          bool          `json:"debug,omitempty"`
+	// Metadata holds the client's own key/values for the job.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Error is returned for requests the server refused.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("urlfetcher: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// AddJob submits a job to fetch rawURL. opts may be nil.
+func (c *Client) AddJob(ctx context.Context, rawURL string, opts *JobOptions) (*Job, error) {
+	body := struct {
+		URL string `json:"url"`
+		JobOptions
+		MaxDuration string `json:"maxDuration,omitempty"`
+		Deadline    string `json:"deadline,omitempty"`
+		NotBefore   string `json:"notBefore,omitempty"`
+	}{URL: rawURL}
+	if opts != nil {
+		body.JobOptions = *opts
+		if opts.MaxDuration != 0 {
+			body.MaxDuration = opts.MaxDuration.String()
+		}
+		if !opts.Deadline.IsZero() {
+			body.Deadline = opts.Deadline.Format(time.RFC3339)
+		}
+		if !opts.NotBefore.IsZero() {
+			body.NotBefore = opts.NotBefore.Format(time.RFC3339)
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := c.do(ctx, "POST", "/api/jobs", bytes.NewReader(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Annotate sets metadata on a job. Keys with an empty value are removed.
+// It fails with a 409 error if the job is no longer at version.
+func (c *Client) Annotate(ctx context.Context, id, version int64, metadata map[string]string) (*Job, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := c.do(ctx, "PATCH", fmt.Sprintf("/api/jobs/%d/metadata?version=%d", id, version), bytes.NewReader(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJob returns the job with the given ID.
+func (c *Client) GetJob(ctx context.Context, id int64) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, "GET", fmt.Sprintf("/api/jobs/%d", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitForJob polls the job until it is done or ctx ends, and returns it in
+// its final state.
+func (c *Client) WaitForJob(ctx context.Context, id int64) (*Job, error) {
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.PollInterval):
+		}
+	}
+}
+
+// GetResponse returns the cached response for rawURL, or an error for
+// which IsNotFound is true if there is none.
+func (c *Client) GetResponse(ctx context.Context, rawURL string) (*Response, error) {
+	var r Response
+	if err := c.do(ctx, "GET", "/api/responses?url="+url.QueryEscape(rawURL), nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Body downloads the body of the job's response.
+func (c *Client) Body(ctx context.Context, id int64) ([]byte, error) {
+	var body []byte
+	err := c.do(ctx, "GET", fmt.Sprintf("/api/jobs/%d/body", id), nil, &body)
+	return body, err
+}
+
+// BodyLink is a signed URL from which the body of a job's response can be
+// downloaded without credentials until it expires.
+type BodyLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// BodyLink returns a signed URL for the body of the job's response, valid
+// for ttl, or the server's default if 0. The server must have signed
+// downloads enabled.
+func (c *Client) BodyLink(ctx context.Context, id int64, ttl time.Duration) (*BodyLink, error) {
+	path := fmt.Sprintf("/api/jobs/%d/body/link", id)
+	if ttl > 0 {
+		path += "?ttl=" + strconv.FormatInt(int64(ttl/time.Second), 10)
+	}
+	var link BodyLink
+	if err := c.do(ctx, "GET", path, nil, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// OpenBody streams the body of a job's response starting at offset, e.g.
+// to resume an interrupted download, without holding it all in memory.
+// The caller must close the returned reader.
+func (c *Client) OpenBody(ctx context.Context, id, offset int64) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("/api/jobs/%d/body", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("urlfetcher: server ignored the range request")
+	}
+	return resp.Body, nil
+}
+
+// Query runs a GraphQL query and decodes its data into out.
+func (c *Client) Query(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := c.do(ctx, "POST", "/graphql", bytes.NewReader(data), &result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return errors.New("urlfetcher: " + result.Errors[0].Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+type headerKey struct{}
+
+// WithHeader returns a context whose requests carry header in addition to
+// Client.Header.
+func WithHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, header)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	extra, _ := ctx.Value(headerKey{}).(http.Header)
+	for name, values := range extra {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	return req, nil
+}
+
+// do sends a request and decodes the JSON response into out, or stores
+// the raw body if out is a *[]byte.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError returns the error for a failed response.
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+		e.Message = body.Error
+	}
+	return e
+}
+
+// JobEvent is a job lifecycle event from the event stream.
+type JobEvent struct {
+	Seq     int64     `json:"seq"`
+	JobID   int64     `json:"jobId"`
+	URL     string    `json:"url"`
+	Host    string    `json:"host"`
+	Status  string    `json:"status"`
+	Tags    []string  `json:"tags"`
+	Type    string    `json:"type"` // queued, dequeued, parked, request, redirect, retry, completed, or gap
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Filter selects the events to watch. Empty fields match everything.
+type Filter struct {
+	Statuses []string
+	Hosts    []string // Host names or *.domain wildcards
+	Tags     []string
+}
+
+// Watch streams job events matching the filter to fn until ctx ends or fn
+// returns an error, which Watch then returns. Dropped connections are
+// resumed from the last event seen; a "gap" event tells fn that some
+// events were missed.
+func (c *Client) Watch(ctx context.Context, f Filter, fn func(JobEvent) error) error {
+	q := url.Values{"status": f.Statuses, "host": f.Hosts, "tag": f.Tags}
+	var last int64
+	for {
+		if last > 0 {
+			q.Set("since", strconv.FormatInt(last, 10))
+		}
+		err := c.stream(ctx, q, func(e JobEvent) error {
+			if e.Seq > 0 {
+				last = e.Seq
+			}
+			return fn(e)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var stop stopError
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+		var refused *Error
+		if errors.As(err, &refused) {
+			return err
+		}
+		// The connection dropped; reconnect after a moment.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// stopError wraps an error that ends Watch instead of reconnecting.
+type stopError struct{ err error }
+
+func (e stopError) Error() string { return e.err.Error() }
+
+// stream reads the SSE feed once, until the connection ends.
+func (c *Client) stream(ctx context.Context, q url.Values, fn func(JobEvent) error) error {
+	req, err := c.newRequest(ctx, "GET", "/events?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// The shared client's timeout would cut the stream off.
+	resp, err := (&http.Client{Transport: c.HTTP.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var eventType, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			eventType = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		case line == "" && data != "":
+			var e JobEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return stopError{err}
+			}
+			if e.Type == "" {
+				e.Type = eventType
+			}
+			if err := fn(e); err != nil {
+				return stopError{err}
+			}
+			eventType, data = "", ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,125 @@
+// Package cluster spreads work over several urlfetcher instances. Jobs for
+// a host are routed to the instance that owns the host on a consistent
+// hash ring, so per-host state such as rate limits and circuit breakers
+// lives in one place.
+package cluster
+
+import (
+	"context"
+	"crypto/subtle"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dsoo/urlfetcher/auth"
+)
+
+// replicas is the number of points each instance has on the ring. More
+// points spread hosts more evenly.
+const replicas = 100
+
+// Ring assigns hosts to instances by consistent hashing, so adding or
+// removing an instance only moves the hosts it gains or loses.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewRing returns a ring of the given instances, identified by their base
+// URLs.
+func NewRing(instances []string) *Ring {
+	r := &Ring{owners: map[uint32]string{}}
+	for _, instance := range instances {
+		instance = strings.TrimRight(instance, "/")
+		for i := 0; i < replicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(instance + "#" + strconv.Itoa(i)))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+			r.points = append(r.points, p)
+			r.owners[p] = instance
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the instance that owns host, or "" if the ring is empty.
+func (r *Ring) Owner(host string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(strings.ToLower(host)))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// ForwardedHeader marks requests one instance sends to another, which
+// must not be forwarded again.
+const ForwardedHeader = "X-Urlfetcher-Forwarded"
+
+type forwardedKey struct{}
+
+// Middleware records in the request context whether the request was
+// forwarded by another instance.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForwardedHeader) != "" {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Forwarded reports whether the request of ctx came from another instance.
+func Forwarded(ctx context.Context) bool {
+	forwarded, _ := ctx.Value(forwardedKey{}).(bool)
+	return forwarded
+}
+
+// Headers carrying the tenant and owner of the caller who submitted a
+// forwarded job. They are only trusted on requests authenticated with the
+// cluster's API key.
+const (
+	TenantHeader = "X-Urlfetcher-Tenant"
+	OwnerHeader  = "X-Urlfetcher-Owner"
+)
+
+// IdentityHeader returns the headers forwarding the tenant and owner of a
+// job's submitter.
+func IdentityHeader(tenant, owner string) http.Header {
+	return http.Header{TenantHeader: {tenant}, OwnerHeader: {owner}}
+}
+
+// Authenticator returns an authenticator that authenticates requests with
+// a, and gives those forwarded by another instance with the API key key
+// the tenant and owner in their TenantHeader and OwnerHeader, so forwarded
+// jobs keep the identity of their submitter rather than the cluster's.
+func Authenticator(a auth.Authenticator, key string) auth.Authenticator {
+	return forwardingAuthenticator{next: a, key: key}
+}
+
+type forwardingAuthenticator struct {
+	next auth.Authenticator
+	key  string
+}
+
+func (f forwardingAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	id, err := f.next.Authenticate(r)
+	if err != nil || id == nil || r.Header.Get(ForwardedHeader) == "" || len(r.Header[TenantHeader]) == 0 {
+		return id, err
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(f.key)) != 1 {
+		return id, nil
+	}
+	// Identities may be shared between requests, so change a copy.
+	copied := *id
+	copied.Tenant = r.Header.Get(TenantHeader)
+	copied.Owner = r.Header.Get(OwnerHeader)
+	return &copied, nil
+}
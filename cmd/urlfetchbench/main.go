@@ -0,0 +1,32 @@
+// Command urlfetchbench load tests a running urlfetcher instance.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dsoo/urlfetcher/bench"
+)
+
+func main() {
+	var c bench.Config
+	flag.StringVar(&c.Endpoint, "endpoint", "http://localhost:8080/graphql", "GraphQL endpoint of the instance under test")
+	flag.StringVar(&c.APIKey, "api-key", "", "API key sent with every request")
+	flag.Float64Var(&c.Rate, "rate", 50, "jobs submitted per second")
+	flag.DurationVar(&c.Duration, "duration", 10*time.Second, "how long to submit jobs for")
+	flag.DurationVar(&c.Timeout, "timeout", 30*time.Second, "how long to wait for outstanding jobs")
+	flag.StringVar(&c.Target, "target", "", "URL fetched by every job (default: a local stub server)")
+	flag.BoolVar(&c.Unique, "unique", true, "make every URL unique to bypass the cache")
+	flag.DurationVar(&c.StubDelay, "stub-delay", 10*time.Millisecond, "response delay of the stub target")
+	flag.IntVar(&c.StubSize, "stub-size", 16*1024, "response size in bytes of the stub target")
+	flag.Parse()
+
+	result, err := bench.Run(context.Background(), c)
+	if err != nil {
+		log.Fatalf("benchmark failed, error: %v", err)
+	}
+	fmt.Println(result)
+}
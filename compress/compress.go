@@ -0,0 +1,216 @@
+// Package compress compresses HTTP responses with gzip or deflate for
+// clients that accept it.
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Config selects which responses are compressed.
+type Config struct {
+	// MinSize is the smallest body, in bytes, worth compressing. Zero
+	// means DefaultMinSize.
+	MinSize int
+	// ContentTypes are the media types to compress, or prefixes ending in
+	// "/" such as "text/". Empty means DefaultContentTypes.
+	ContentTypes []string
+}
+
+// DefaultMinSize is the MinSize used if none is configured.
+const DefaultMinSize = 1024
+
+// DefaultContentTypes are the content types compressed by default.
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Middleware compresses the responses of next according to c. Event
+// streams are never compressed, so they are not held back by buffering.
+func Middleware(c Config, next http.Handler) http.Handler {
+	if c.MinSize == 0 {
+		c.MinSize = DefaultMinSize
+	}
+	if len(c.ContentTypes) == 0 {
+		c.ContentTypes = DefaultContentTypes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == "HEAD" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &writer{ResponseWriter: w, config: &c, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate returns the encoding to use for an Accept-Encoding header,
+// preferring gzip, or "" if neither gzip nor deflate is acceptable.
+func negotiate(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					ok = false
+				}
+			}
+		}
+		accepted[name] = ok
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[encoding]; ok || !listed && accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// writer buffers the start of a response until it can tell whether to
+// compress it.
+type writer struct {
+	http.ResponseWriter
+	config   *Config
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	out      io.WriteCloser // Compressor, if compressing
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.config.MinSize && !w.unbuffered() {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.out != nil {
+		return w.out.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// unbuffered reports whether the response must be passed through as it
+// is written.
+func (w *writer) unbuffered() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// decide chooses whether to compress once enough of the body is known, and
+// writes the header and buffered data.
+func (w *writer) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if len(w.buf) >= w.config.MinSize && h.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified && w.status != http.StatusPartialContent &&
+		w.compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.out = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.out, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.out != nil {
+		_, err = w.out.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *writer) compressible(contentType string) bool {
+	if contentType == "text/event-stream" || strings.HasPrefix(contentType, "text/event-stream;") {
+		return false
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range w.config.ContentTypes {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush sends what has been written so far.
+func (w *writer) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.decide()
+	}
+	if f, ok := w.out.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection.
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Close finishes the response.
+func (w *writer) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written, leave the response to net/http.
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.out != nil {
+		return w.out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,668 @@
+// Package config loads the urlfetcher server configuration from a JSON file.
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config is the top level server configuration.
+type Config struct {
+	Listen string `json:"listen"` // Address to listen on, defaults to ":8080"
+	TLS    TLS    `json:"tls"`
+	Auth   Auth   `json:"auth"`
+	Admin  Admin  `json:"admin"`
+
+	Compression Compression `json:"compression"`
+	// Redaction hides secrets in URLs and headers from logs, job
+	// timelines and debug information.
+	Redaction Redaction `json:"redaction"`
+
+	Checksums   Checksums    `json:"checksums"`
+	Sanitize    Sanitize     `json:"sanitize"`
+	Encryption  Encryption   `json:"encryption"`
+	Downloads   Downloads    `json:"downloads"`
+	Thumbnails  Thumbnails   `json:"thumbnails"`
+	Snapshots   Snapshots    `json:"snapshots"`
+	Credentials []Credential `json:"credentials"`
+	// Processors are Go plugins finding facts in fetched responses.
+	Processors []Processor `json:"processors"`
+	Fetch      Fetch       `json:"fetch"`
+	Cache      Cache       `json:"cache"`
+	// Secrets configures resolving the secrets of credentials and API keys
+	// from Vault or AWS KMS.
+	Secrets Secrets `json:"secrets"`
+
+	// PublicURL is the externally reachable base URL of the server, used
+	// for links in notifications.
+	PublicURL string      `json:"publicURL"`
+	Notifiers []Notifier  `json:"notifiers"`
+	Alerts    []AlertRule `json:"alerts"`
+	// Presets are named sets of job options that jobs can start from.
+	Presets map[string]Preset `json:"presets"`
+	// Routing rules set the options of the jobs they match.
+	Routing []RoutingRule `json:"routing"`
+	// Hooks are webhook endpoints external systems post events to, to
+	// add jobs.
+	Hooks []Hook `json:"hooks"`
+
+	Metrics Metrics `json:"metrics"`
+	// RemoteWrite sends the outcome of monitor checks to a Prometheus
+	// remote write endpoint. It is enabled when URL is set.
+	RemoteWrite RemoteWrite `json:"remoteWrite"`
+
+	Queue Queue `json:"queue"`
+	// Pools are named sets of workers with queues of their own, besides
+	// the default workers.
+	Pools []WorkerPool `json:"pools"`
+	// LoadShedding refuses new jobs while the server is short of memory or
+	// has too many queued.
+	LoadShedding LoadShedding `json:"loadShedding"`
+	Seed         Seed         `json:"seed"`
+	Archive      Archive      `json:"archive"`
+	Trash        Trash        `json:"trash"`
+	Persistence  Persistence  `json:"persistence"`
+	Leader       Leader       `json:"leader"`
+	Cluster      Cluster      `json:"cluster"`
+}
+
+// Queue selects where jobs wait for a worker.
+type Queue struct {
+	Type string `json:"type"` // memory (the default), sqs or rabbitmq
+	// URL is the SQS queue URL or the RabbitMQ server URL.
+	URL string `json:"url"`
+	// Credential names a credential holding the SQS access key ID and
+	// secret as username and password, or the RabbitMQ login.
+	Credential string `json:"credential"`
+	Region     string `json:"region"` // SQS region, taken from the URL if empty
+	Name       string `json:"name"`   // RabbitMQ queue name, "urlfetcher" by default
+	// VisibilityTimeout is how long a dequeued job is hidden from other
+	// workers until it is handed out again, unless acknowledged.
+	VisibilityTimeout Duration `json:"visibilityTimeout"`
+	// Scheduler is "fair" (the default) to share the memory queue fairly
+	// between tenants, or "deadline" to run jobs with the earliest
+	// deadline first.
+	Scheduler string `json:"scheduler"`
+	// TenantWeights sets the share of the workers each tenant gets from
+	// the memory queue. Other tenants have weight 1.
+	TenantWeights map[string]float64 `json:"tenantWeights"`
+	// MaxRedeliveries is how many times a job whose worker was lost
+	// mid-fetch is started again before it fails, 3 by default.
+	MaxRedeliveries int `json:"maxRedeliveries"`
+}
+
+// WorkerPool configures a named pool of workers, which runs the jobs that
+// name it or that routing rules send to it.
+type WorkerPool struct {
+	Name                 string   `json:"name"`
+	Workers              int      `json:"workers"`
+	Timeout              Duration `json:"timeout"`              // Default maxDuration of the pool's jobs
+	MaxRequestsPerSecond float64  `json:"maxRequestsPerSecond"` // On top of the global limit
+	// Queue holds the pool's jobs. Without one they wait in memory,
+	// scheduled like the main queue.
+	Queue *Queue `json:"queue"`
+}
+
+// Cluster configures routing jobs between instances by host. It is
+// enabled when Instances is set.
+type Cluster struct {
+	Self      string   `json:"self"`      // Base URL of this instance, as listed in Instances
+	Instances []string `json:"instances"` // Base URLs of all instances
+	// Credential names a credential whose password is the API key used
+	// when forwarding jobs to other instances.
+	Credential string `json:"credential"`
+}
+
+// Leader configures leader election between instances sharing a Redis
+// server, so only one of them runs the seed schedule. It is enabled when
+// Redis is set.
+type Leader struct {
+	Redis      string   `json:"redis"`      // Address of the Redis server
+	Credential string   `json:"credential"` // Credential holding the Redis password
+	Key        string   `json:"key"`        // Key of the lock, "urlfetcher:leader" by default
+	TTL        Duration `json:"ttl"`        // How soon another instance takes over, 15s by default
+}
+
+// Persistence configures the journal that lets jobs survive restarts.
+// It is enabled when Path is set.
+type Persistence struct {
+	Path string `json:"path"`
+	// Replica makes the instance a read-only replica that serves queries
+	// from the journal at Path, written by another instance, and never
+	// runs jobs or accepts changes.
+	Replica bool `json:"replica"`
+	// RefreshInterval is how often a replica reads new journal entries,
+	// 5s by default.
+	RefreshInterval Duration `json:"refreshInterval"`
+}
+
+// Archive configures moving finished jobs out of memory into a file.
+// Archiving is enabled when Path is set.
+type Archive struct {
+	Path     string   `json:"path"`
+	After    Duration `json:"after"`    // Age after finishing, 24h by default
+	Interval Duration `json:"interval"` // How often to archive, 1m by default
+}
+
+// LoadShedding configures the thresholds above which new jobs are refused.
+// Zero thresholds are not checked.
+type LoadShedding struct {
+	MaxHeapBytes  uint64 `json:"maxHeapBytes"`
+	MaxQueueDepth int    `json:"maxQueueDepth"`
+	// RetryAfter is how long refused callers are told to wait, 30s if 0.
+	RetryAfter Duration `json:"retryAfter"`
+}
+
+// Processor configures a processor loaded from a Go plugin, built with
+// -buildmode=plugin. Its findings are attributed to Name.
+type Processor struct {
+	Name   string `json:"name"`
+	Plugin string `json:"plugin"` // Path of the .so file
+}
+
+// Trash configures how long deleted jobs can be restored.
+type Trash struct {
+	Retention Duration `json:"retention"` // 168h (seven days) by default
+}
+
+// Seed lists URLs fetched when the server starts.
+type Seed struct {
+	URLs []string `json:"urls"`
+	// Interval, if set, fetches the URLs again at this interval.
+	Interval Duration `json:"interval"`
+}
+
+// Notifier is a named destination for notifications.
+type Notifier struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // webhook, slack, discord or email
+	URL  string `json:"url"`  // Webhook URL to post to
+	// Credential names a credential holding the webhook URL instead, to
+	// keep it out of the main configuration. For email it holds the SMTP
+	// username and password.
+	Credential string `json:"credential"`
+	Email      Email  `json:"email"`
+}
+
+// Email configures an email notifier. Empty templates use the defaults.
+type Email struct {
+	Server          string   `json:"server"` // SMTP server as host:port
+	From            string   `json:"from"`
+	To              []string `json:"to"`
+	SubjectTemplate string   `json:"subjectTemplate"`
+	BodyTemplate    string   `json:"bodyTemplate"`
+}
+
+// AlertRule fires when more than FailureRate of the jobs to a host fail
+// within Window.
+type AlertRule struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host"` // Host or *.domain wildcard, empty for all hosts
+	FailureRate float64  `json:"failureRate"`
+	MinJobs     int      `json:"minJobs"`
+	Window      Duration `json:"window"`
+	Notify      []string `json:"notify"` // Names of the notifiers to tell
+}
+
+// RoutingRule sets the priority, egress route, worker pool, processors and
+// retention of the jobs matching all of its conditions. The first matching
+// rule that gives a setting decides it.
+type RoutingRule struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host"` // Host or *.domain wildcard
+	Tag         string   `json:"tag"`
+	Tenant      string   `json:"tenant"`
+	ContentType string   `json:"contentType"` // Media type of the response, or "type/*"
+	Priority    int      `json:"priority"`
+	Egress      string   `json:"egress"`
+	Pool        string   `json:"pool"`
+	Processors  []string `json:"processors"`
+	Retention   Duration `json:"retention"` // How long finished jobs are kept
+}
+
+// Credential is a named secret that jobs and other settings refer to.
+type Credential struct {
+	Name           string `json:"name"`
+	CertFile       string `json:"certFile"`
+	KeyFile        string `json:"keyFile"`
+	Username       string `json:"username"`
+	PrivateKeyFile string `json:"privateKeyFile"`
+	Password       string `json:"password"`
+	WebhookURL     string `json:"webhookURL"`
+	// Tenants whose callers may name the credential as the clientCert of
+	// a job; only admins may if empty.
+	Tenants []string `json:"tenants"`
+}
+
+// Secrets configures where the passwords, usernames and webhook URLs of
+// credentials, and API keys, are resolved when they are references:
+// vault:<path>#<field> or awskms:<base64 ciphertext>.
+type Secrets struct {
+	Vault Vault `json:"vault"`
+	KMS   KMS   `json:"kms"`
+	// RefreshInterval is how often references are resolved again, to pick
+	// up rotated secrets. They are only resolved on startup if 0.
+	RefreshInterval Duration `json:"refreshInterval"`
+}
+
+// Vault configures a HashiCorp Vault server. It is enabled when Address is
+// set.
+type Vault struct {
+	Address   string `json:"address"`
+	Token     string `json:"token"`     // Taken from VAULT_TOKEN if empty
+	Namespace string `json:"namespace"` // Vault Enterprise namespace, if any
+}
+
+// KMS configures decrypting secrets with AWS KMS, using the access keys in
+// the environment. It is enabled when Region is set.
+type KMS struct {
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"` // For KMS compatible services
+}
+
+// Fetch configures outbound requests.
+type Fetch struct {
+	// ClientCert names the credential whose TLS client certificate is
+	// presented to every host, unless overridden per host or per job.
+	ClientCert string `json:"clientCert"`
+	// HostClientCerts maps host names or "*.domain" wildcards to credentials.
+	HostClientCerts map[string]string `json:"hostClientCerts"`
+	// Tunnels are SSH jump hosts that jobs can be fetched through.
+	Tunnels []Tunnel `json:"tunnels"`
+	// Egress routes are proxies, e.g. in other regions, that jobs can be
+	// fetched through.
+	Egress []Egress `json:"egress"`
+	// Targets limits the schemes and ports jobs may fetch.
+	Targets Targets `json:"targets"`
+	Pool    Pool    `json:"pool"`
+	// DoH looks up the hosts jobs fetch from through DNS over HTTPS.
+	DoH DoH `json:"doh"`
+	// Rewrites change the URLs of matching jobs when they are fetched.
+	Rewrites []Rewrite `json:"rewrites"`
+	// HostProfiles maps host names or "*.domain" wildcards to the defaults
+	// of the jobs fetching from them.
+	HostProfiles map[string]HostProfile `json:"hostProfiles"`
+	// CircuitBreaker stops sending requests to hosts that keep failing.
+	CircuitBreaker CircuitBreaker `json:"circuitBreaker"`
+	Politeness     Politeness     `json:"politeness"`
+	// MaxRequestsPerSecond limits the requests sent by all workers
+	// together. 0 means no limit.
+	MaxRequestsPerSecond float64 `json:"maxRequestsPerSecond"`
+	// MaxBytes is the byte budget of jobs that do not set their own.
+	// 0 means no limit.
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxHeaderBytes limits the size of response headers, 256 KiB if 0.
+	MaxHeaderBytes int64 `json:"maxHeaderBytes"`
+	// MaxConcurrentLookups limits the DNS lookups in progress at once,
+	// 100 if 0.
+	MaxConcurrentLookups int `json:"maxConcurrentLookups"`
+	// MaxConnections limits the outbound connections open at once, not at
+	// all if 0. -1 means three quarters of the open file limit.
+	MaxConnections int `json:"maxConnections"`
+}
+
+// Cache configures the response cache. Canonical turns URLs into cache
+// keys, so that URLs which differ only superficially share an entry, and
+// HostCanonical overrides it for host names or "*.domain" wildcards.
+type Cache struct {
+	Canonical     *Canonical           `json:"canonical"`
+	HostCanonical map[string]Canonical `json:"hostCanonical"`
+}
+
+// Canonical configures URL canonicalization. The scheme and host are always
+// lower cased.
+type Canonical struct {
+	StripParams   []string `json:"stripParams"`   // Query parameters to drop, "utm_*" style prefixes allowed
+	TrailingSlash string   `json:"trailingSlash"` // "strip" or "add", or "" to leave paths alone
+	SortQuery     bool     `json:"sortQuery"`
+}
+
+// Politeness configures per-host request pacing and the backoff after 429
+// and 503 responses. Zero values keep the defaults.
+type Politeness struct {
+	// LatencyFactor spaces out requests to a host by this multiple of its
+	// average response latency.
+	LatencyFactor float64  `json:"latencyFactor"`
+	MaxDelay      Duration `json:"maxDelay"`
+	// MaxRetries is how often a job with a retryable error is retried,
+	// 3 if 0. -1 disables retries.
+	MaxRetries int `json:"maxRetries"`
+	// Backoff is the initial wait before a retry, doubled on each attempt.
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"maxBackoff"`
+}
+
+// CircuitBreaker configures the per-host circuit breaker. A zero Threshold
+// disables it.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures that opens a circuit.
+	Threshold int `json:"threshold"`
+	// Cooldown is how long a circuit stays open before a trial request.
+	Cooldown Duration `json:"cooldown"`
+	// Mode is "fail" (the default) to fail jobs for an open circuit
+	// immediately, or "delay" to hold them until the cooldown ends.
+	Mode string `json:"mode"`
+}
+
+// Pool configures the outbound connection pool. Zero values keep the
+// net/http defaults.
+type Pool struct {
+	MaxIdleConns        int      `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int      `json:"maxConnsPerHost"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout"`
+	// FallbackDelay is the Happy Eyeballs delay before racing IPv4 against IPv6.
+	FallbackDelay Duration `json:"fallbackDelay"`
+}
+
+// DoH configures DNS-over-HTTPS resolution. It is enabled when URL is set.
+type DoH struct {
+	URL string `json:"url"`
+	// BootstrapAddress is the IP address to connect to for URL, so that
+	// finding the DoH server does not depend on the local DNS.
+	BootstrapAddress string `json:"bootstrapAddress"`
+}
+
+// Tunnel configures an SSH jump host.
+type Tunnel struct {
+	Name           string   `json:"name"`
+	Address        string   `json:"address"`
+	Credential     string   `json:"credential"`
+	KnownHostsFile string   `json:"knownHostsFile"`
+	Hosts          []string `json:"hosts"`
+	Tenants        []string `json:"tenants"` // Tenants whose callers may name the tunnel; only admins may if empty
+}
+
+// Egress configures a named egress route through a proxy. Credential names
+// the credential holding the proxy's username and password, if it needs
+// them.
+type Egress struct {
+	Name       string   `json:"name"`
+	Proxy      string   `json:"proxy"`
+	Credential string   `json:"credential"`
+	Hosts      []string `json:"hosts"`
+}
+
+// Targets configures the schemes, ports and networks jobs may fetch from,
+// http and https on ports 80 and 443 of public addresses if empty. Tenants maps trusted tenants to their own,
+// whose empty fields keep these.
+type Targets struct {
+	TargetPolicy
+	Tenants map[string]TargetPolicy `json:"tenants"`
+}
+
+// TargetPolicy lists schemes, ports and the networks other than public
+// ones. Port 0 allows any port.
+type TargetPolicy struct {
+	Schemes  []string `json:"schemes"`
+	Ports    []int    `json:"ports"`
+	Networks []string `json:"networks"` // CIDRs, e.g. 10.0.0.0/8
+}
+
+// Rewrite configures a URL rewrite rule. Match is a regular expression
+// replaced in the whole URL by Replace; Query and QueryCredentials set query
+// parameters, the latter to the password of the named credential.
+type Rewrite struct {
+	Host             string            `json:"host"`
+	Match            string            `json:"match"`
+	Replace          string            `json:"replace"`
+	Query            map[string]string `json:"query"`
+	QueryCredentials map[string]string `json:"queryCredentials"`
+}
+
+// HostProfile configures the defaults of the jobs for a host. Options given
+// with a job take precedence.
+type HostProfile struct {
+	Headers              map[string]string `json:"headers"`
+	MaxRequestsPerSecond float64           `json:"maxRequestsPerSecond"`
+	MaxDuration          Duration          `json:"maxDuration"`
+	MaxBytes             int64             `json:"maxBytes"`
+	ClientCert           string            `json:"clientCert"`
+	Tunnel               string            `json:"tunnel"`
+	Egress               string            `json:"egress"`
+	// Credential is sent in the Authorization header, as basic auth or,
+	// without a username, as a bearer token.
+	Credential string  `json:"credential"`
+	Scripts    Scripts `json:"scripts"`
+}
+
+// Metrics selects where server metrics go besides the Prometheus endpoint,
+// which is always served.
+type Metrics struct {
+	// Sink is "prometheus" (the default) for the endpoint alone, or
+	// "statsd" or "dogstatsd" to also push them to Address over UDP.
+	Sink     string   `json:"sink"`
+	Address  string   `json:"address"`  // host:port of the StatsD agent, 127.0.0.1:8125 by default
+	Prefix   string   `json:"prefix"`   // Prepended to metric names pushed
+	Interval Duration `json:"interval"` // How often metrics are pushed, 10s by default
+}
+
+// RemoteWrite configures a Prometheus remote write endpoint.
+type RemoteWrite struct {
+	URL string `json:"url"`
+	// Credential names a credential whose username and password are sent
+	// with basic authentication, or whose password alone is sent as a
+	// bearer token.
+	Credential string   `json:"credential"`
+	Interval   Duration `json:"interval"` // How often samples are sent, 15s by default
+}
+
+// Hook configures a webhook endpoint, POST /hooks/{name}.
+type Hook struct {
+	Name string `json:"name"`
+	// URL is a Go template executed with the JSON payload, giving the URLs
+	// of the jobs to add one per line, e.g. "{{.repository.html_url}}".
+	URL string `json:"url"`
+	// Credential names a credential whose password payloads must be
+	// signed with, as GitHub does, or sent with in X-Hook-Secret.
+	Credential string `json:"credential"`
+	Preset     string `json:"preset"` // Preset the jobs start from
+	Tenant     string `json:"tenant"` // Tenant the jobs belong to
+}
+
+// Preset configures a named set of job options.
+type Preset struct {
+	Type           string   `json:"type"` // "certificate", or "" to fetch
+	ClientCert     string   `json:"clientCert"`
+	HostHeader     string   `json:"hostHeader"`
+	ServerName     string   `json:"serverName"`
+	ConnectAddress string   `json:"connectAddress"`
+	Tunnel         string   `json:"tunnel"`
+	Egress         string   `json:"egress"`
+	Pool           string   `json:"pool"`
+	MaxBytes       int64    `json:"maxBytes"`
+	MaxDuration    Duration `json:"maxDuration"`
+	Notify         string   `json:"notify"`
+	Tags           []string `json:"tags"`
+	Scripts        Scripts  `json:"scripts"`
+}
+
+// Scripts configures expressions, in Go syntax, evaluated for each job.
+type Scripts struct {
+	// Fields maps finding names to expressions giving their values.
+	Fields map[string]string `json:"fields"`
+	Retry  string            `json:"retry"`  // Whether a failed fetch is retried
+	Notify string            `json:"notify"` // Name of the notifier told, "" for none
+}
+
+// Compression configures gzip and deflate compression of API responses.
+type Compression struct {
+	Disabled     bool     `json:"disabled"`
+	MinSize      int      `json:"minSize"`      // Smallest body compressed, 1024 bytes by default
+	ContentTypes []string `json:"contentTypes"` // Media types or "type/" prefixes to compress
+}
+
+// Checksums configures the digests computed for stored bodies. SHA-256 is
+// always computed.
+type Checksums struct {
+	BLAKE3 bool `json:"blake3"`
+}
+
+// Sanitize configures sanitizing what is stored.
+type Sanitize struct {
+	// HTML stores the bodies of HTML responses without scripts, frames,
+	// plugins, event handlers and javascript: URLs, so that they are safe
+	// to display.
+	HTML bool `json:"html"`
+}
+
+// Thumbnails configures making thumbnails of image responses. It is
+// enabled when Size is set.
+type Thumbnails struct {
+	Size int `json:"size"` // Side of the square thumbnails fit in, in pixels
+	// Dir is the directory of the blob store the thumbnails are kept in;
+	// they are kept in memory if empty.
+	Dir string `json:"dir"`
+}
+
+// Redaction names the query parameters and headers whose values are never
+// logged or recorded. Authorization headers and passwords in URLs are
+// always redacted.
+type Redaction struct {
+	QueryParams []string `json:"queryParams"` // e.g. token, api_key, sig
+	Headers     []string `json:"headers"`     // e.g. Cookie, X-API-Key
+}
+
+// Encryption configures encrypting the response bodies kept in the
+// journal, the archive and the blob store.
+type Encryption struct {
+	// Keys name credentials whose passwords are base64 encoded AES keys of
+	// 16, 24 or 32 bytes; the credential name is the key ID. The first key
+	// encrypts what is stored from now on, the others only decrypt what
+	// was stored with them.
+	Keys []string `json:"keys"`
+}
+
+// Downloads configures signed URLs from which the bodies of responses can
+// be downloaded without credentials until they expire.
+type Downloads struct {
+	// Keys name credentials whose passwords are the HMAC keys signing the
+	// URLs. The first key signs new URLs, the others only verify URLs
+	// signed with them.
+	Keys []string `json:"keys"`
+	// MaxTTL is the longest a URL may stay valid, 7 days by default.
+	MaxTTL Duration `json:"maxTTL"`
+}
+
+// Snapshots configures submitting the URLs fetched successfully to a web
+// archive, such as the Internet Archive's Save Page Now.
+type Snapshots struct {
+	Enabled bool `json:"enabled"`
+	// Endpoint is what the URL to archive is appended to,
+	// https://web.archive.org/save/ by default.
+	Endpoint string `json:"endpoint"`
+	// Credential names a credential whose username and password are the
+	// archive's access and secret keys, if it needs them.
+	Credential string   `json:"credential"`
+	Timeout    Duration `json:"timeout"` // For each submission, 2m by default
+}
+
+// TLS configures TLS on the listener. TLS is enabled when CertFile is set.
+type TLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile holds the CAs used to verify client certificates. When
+	// set, clients may present certificates; auth mode "mtls" requires them.
+	ClientCAFile string `json:"clientCaFile"`
+}
+
+// Auth configures how callers of the API are authenticated.
+type Auth struct {
+	// Mode is one of "" (no authentication), "apikey", "oidc" or "mtls".
+	Mode    string   `json:"mode"`
+	APIKeys []APIKey `json:"apiKeys"`
+	OIDC    OIDC     `json:"oidc"`
+	MTLS    MTLS     `json:"mtls"`
+	// DefaultRole is the role, "viewer", "submitter" or "admin", of
+	// callers not given one by their key, token or certificate identity.
+	// It is "admin" if empty, as before roles existed.
+	DefaultRole string `json:"defaultRole"`
+}
+
+// Admin configures the listener serving profiles and other runtime
+// diagnostics. It is disabled unless Listen is set.
+type Admin struct {
+	Listen string `json:"listen"`
+	// Subjects are the authenticated callers allowed to use the listener.
+	// Required when auth is enabled; without auth, Listen must be a
+	// loopback address.
+	Subjects []string `json:"subjects"`
+}
+
+// APIKey is a static API key and the identity it maps to.
+type APIKey struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"`
+	Owner   string `json:"owner"`
+	Role    string `json:"role"`
+}
+
+// OIDC configures validation of JWTs issued by an OIDC provider.
+type OIDC struct {
+	Issuer          string   `json:"issuer"`
+	Audience        string   `json:"audience"`
+	JWKSURL         string   `json:"jwksUrl"`
+	RefreshInterval Duration `json:"refreshInterval"`
+	TenantClaim     string   `json:"tenantClaim"`
+	OwnerClaim      string   `json:"ownerClaim"`
+	// RoleClaim names the claim holding the caller's role, or a list of
+	// roles of which the highest counts.
+	RoleClaim string `json:"roleClaim"`
+}
+
+// MTLS configures identities for TLS client certificate authentication.
+type MTLS struct {
+	// Identities maps certificate common names to identities. If empty,
+	// any certificate signed by the client CA is accepted.
+	Identities []CertIdentity `json:"identities"`
+	// TenantField is the subject field ("O" or "OU") used as the tenant
+	// when identities are derived from the certificate.
+	TenantField string `json:"tenantField"`
+}
+
+// CertIdentity maps a client certificate common name to an identity.
+type CertIdentity struct {
+	CommonName string `json:"commonName"`
+	Tenant     string `json:"tenant"`
+	Owner      string `json:"owner"`
+	Role       string `json:"role"`
+}
+
+// Duration is a time.Duration that is written as a string such as "90s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Load reads the configuration file at path.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
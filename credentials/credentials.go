@@ -0,0 +1,89 @@
+// Package credentials holds named secrets that jobs and configuration refer
+// to by name, so the secrets themselves never travel through the API.
+package credentials
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// Credential is a named secret. Which fields are set depends on what the
+// credential is used for.
+type Credential struct {
+	Name string
+
+	// TLS client certificate and key, as PEM file paths.
+	CertFile string
+	KeyFile  string
+
+	// SSH login, authenticated by the private key in PrivateKeyFile, or
+	// another login such as SMTP, authenticated by Password.
+	Username       string
+	PrivateKeyFile string
+	Password       string
+
+	// Webhook URL of a chat integration, which embeds its own secret.
+	WebhookURL string
+
+	// Tenants whose callers may name the credential as the client
+	// certificate of a job. Only admins may name it if empty.
+	Tenants []string
+}
+
+// Store is a concurrency safe set of credentials keyed by name.
+type Store struct {
+	mu    sync.RWMutex
+	creds map[string]*Credential
+	certs map[string]*tls.Certificate
+}
+
+// NewStore returns an empty credential store.
+func NewStore() *Store {
+	return &Store{
+		creds: make(map[string]*Credential),
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Add adds or replaces a credential.
+func (s *Store) Add(c Credential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds[c.Name] = &c
+	delete(s.certs, c.Name)
+}
+
+// Get returns the credential with the given name.
+func (s *Store) Get(name string) (*Credential, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.creds[name]
+	return c, ok
+}
+
+// Certificate returns the TLS client certificate of the named credential,
+// loading it from disk on first use.
+func (s *Store) Certificate(name string) (*tls.Certificate, error) {
+	s.mu.RLock()
+	cert, ok := s.certs[name]
+	c, found := s.creds[name]
+	s.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown credential %q", name)
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("credential %q has no client certificate", name)
+	}
+	loaded, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.certs[name] = &loaded
+	s.mu.Unlock()
+	return &loaded, nil
+}
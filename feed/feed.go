@@ -0,0 +1,156 @@
+// Package feed streams job lifecycle events to HTTP clients that cannot
+// use GraphQL subscriptions.
+package feed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+)
+
+// heartbeat is how often an idle stream sends a comment to keep proxies
+// from closing it.
+const heartbeat = 15 * time.Second
+
+// Filter selects job events by status, host and tag. Each field matches
+// if it is empty or contains the event's value.
+type Filter struct {
+	Statuses []string
+	Hosts    []string // Host names or *.domain wildcards
+	Tags     []string // Matches events of jobs with any of the tags
+}
+
+// FilterFromQuery reads a filter from repeated status, host and tag query
+// parameters.
+func FilterFromQuery(q url.Values) Filter {
+	lower := func(values []string) []string {
+		for i, v := range values {
+			values[i] = strings.ToLower(v)
+		}
+		return values
+	}
+	return Filter{Statuses: q["status"], Hosts: lower(q["host"]), Tags: q["tag"]}
+}
+
+// Match reports whether the event passes the filter.
+func (f Filter) Match(e urldata.JobEvent) bool {
+	if len(f.Statuses) > 0 && !contains(f.Statuses, e.Status) {
+		return false
+	}
+	if len(f.Hosts) > 0 {
+		matched := false
+		for _, h := range f.Hosts {
+			if urldata.MatchesHost(h, e.Host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.Tags) > 0 {
+		matched := false
+		for _, tag := range e.Tags {
+			if contains(f.Tags, tag) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe subscribes to the events selected by the request's query
+// parameters. If it names a sequence number to resume after, in the since
+// parameter or else the Last-Event-ID header sent by reconnecting SSE
+// clients, the retained events after it are returned too. Events of jobs
+// the caller may not see are left out.
+func subscribe(r *http.Request) (*urldata.Subscription, []urldata.JobEvent, bool) {
+	since := int64(-1)
+	last := r.URL.Query().Get("since")
+	if last == "" {
+		last = r.Header.Get("Last-Event-ID")
+	}
+	if n, err := strconv.ParseInt(last, 10, 64); err == nil && n >= 0 {
+		since = n
+	}
+	filter := FilterFromQuery(r.URL.Query())
+	ctx := r.Context()
+	return urldata.SubscribeFrom(since, func(e urldata.JobEvent) bool {
+		return filter.Match(e) && urldata.CanViewTenant(ctx, e.Tenant)
+	})
+}
+
+// SSEHandler streams job events as Server-Sent Events. Each event's id is
+// its sequence number, its event name the event type, and its data the
+// JobEvent as JSON. The status, host and tag query parameters filter the
+// stream. Reconnecting clients resume after the last event they saw; if
+// some of the events since have been dropped, a "gap" event comes first.
+func SSEHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		sub, replay, complete := subscribe(r)
+		defer urldata.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if !complete {
+			fmt.Fprint(w, "event: gap\ndata: {}\n\n")
+		}
+		for _, e := range replay {
+			if !writeSSE(w, e) {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case e := <-sub.C:
+				if !writeSSE(w, e) {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func writeSSE(w http.ResponseWriter, e urldata.JobEvent) bool {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return false
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	return true
+}
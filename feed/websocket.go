@@ -0,0 +1,61 @@
+package feed
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler streams job events over a WebSocket, one JobEvent as a
+// JSON text message each. Like SSEHandler it takes status, host and tag
+// filters, and a since parameter with the last sequence number a client
+// saw, to resume after a reconnect. If some of the events since have been
+// dropped, the first message is a JobEvent of type "gap".
+func WebSocketHandler() http.Handler {
+	// Use a Server rather than websocket.Handler to skip its Origin check:
+	// the feed is read-only and authenticated by the middleware in front.
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		sub, replay, complete := subscribe(ws.Request())
+		defer urldata.Unsubscribe(sub)
+
+		// Clients only send control frames; reading detects when they go away.
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+
+		if !complete {
+			if websocket.JSON.Send(ws, urldata.JobEvent{Type: "gap", Message: "some events since the requested sequence number were dropped"}) != nil {
+				return
+			}
+		}
+		for _, e := range replay {
+			if websocket.JSON.Send(ws, e) != nil {
+				return
+			}
+		}
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				// Keep idle connections open through proxies.
+				ws.PayloadType = websocket.PingFrame
+				if _, err := ws.Write(nil); err != nil {
+					return
+				}
+			case e := <-sub.C:
+				if websocket.JSON.Send(ws, e) != nil {
+					return
+				}
+			}
+		}
+	}}
+}
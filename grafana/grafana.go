@@ -0,0 +1,326 @@
+// Package grafana serves the protocol of Grafana's JSON datasource plugins,
+// so that dashboards of job counts, latency and per-host statistics can be
+// built on the server directly, without Prometheus in between.
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+)
+
+// Prefix is the path the datasource is served below, the URL to give
+// Grafana.
+const Prefix = "/grafana"
+
+// Most points returned for a series, whatever interval Grafana asks for.
+const maxPoints = 10000
+
+// Metric is a target that can be queried.
+type Metric struct {
+	Name        string
+	Description string
+	Table       bool // Whether it is a table rather than a time series
+}
+
+// Metrics lists the targets the datasource serves. The time series take an
+// optional host payload, a host or *.domain wildcard, to chart only the
+// jobs to matching hosts.
+var Metrics = []Metric{
+	{Name: "jobs.finished", Description: "Jobs finished per interval"},
+	{Name: "jobs.succeeded", Description: "Jobs finished without an error per interval"},
+	{Name: "jobs.failed", Description: "Jobs finished with an error per interval"},
+	{Name: "latency.mean", Description: "Mean fetch latency in milliseconds per interval"},
+	{Name: "latency.p95", Description: "95th percentile fetch latency in milliseconds per interval"},
+	{Name: "latency.max", Description: "Highest fetch latency in milliseconds per interval"},
+	{Name: "queue.depth", Description: "Jobs waiting in the queue, now"},
+	{Name: "hosts", Description: "Jobs, failures and latency per host over the range, with connection statistics", Table: true},
+}
+
+// query is the body of a query request. Older plugins send the type of a
+// target, "timeserie" or "table", newer ones a payload.
+type query struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+	Targets       []struct {
+		Target  string            `json:"target"`
+		RefID   string            `json:"refId"`
+		Type    string            `json:"type"`
+		Hide    bool              `json:"hide"`
+		Payload map[string]string `json:"payload"`
+	} `json:"targets"`
+}
+
+// series is a time series response, with datapoints of value and Unix
+// time in milliseconds.
+type series struct {
+	Target     string       `json:"target"`
+	RefID      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type table struct {
+	Type    string          `json:"type"` // Always "table"
+	RefID   string          `json:"refId,omitempty"`
+	Columns []column        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type column struct {
+	Text string `json:"text"`
+	Type string `json:"type"` // string, number or time
+}
+
+// Handler returns a handler serving:
+//
+//	GET  /grafana/         the connection test
+//	POST /grafana/search   the names of the targets, for older plugins
+//	POST /grafana/metrics  the targets and their payloads, for newer ones
+//	POST /grafana/query    the data of targets over a time range
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+		if path == "" {
+			w.Write([]byte("OK\n"))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch path {
+		case "search":
+			names := []string{}
+			for _, m := range Metrics {
+				names = append(names, m.Name)
+			}
+			writeJSON(w, names)
+		case "metrics":
+			writeJSON(w, metricOptions())
+		case "query":
+			var q query
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&q); err != nil {
+				http.Error(w, fmt.Sprintf("invalid query: %v", err), http.StatusBadRequest)
+				return
+			}
+			results, err := run(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, results)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// metricOptions returns the targets as newer plugins list them.
+func metricOptions() []map[string]interface{} {
+	options := []map[string]interface{}{}
+	for _, m := range Metrics {
+		option := map[string]interface{}{"label": m.Name, "value": m.Name}
+		if !m.Table && m.Name != "queue.depth" {
+			option["payloads"] = []map[string]string{{"name": "host", "label": "Host", "type": "input"}}
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// run answers the targets of a query, in order.
+func run(q query) ([]interface{}, error) {
+	if q.Range.To.Before(q.Range.From) {
+		return nil, fmt.Errorf("range ends before it starts")
+	}
+	step := time.Duration(q.IntervalMs) * time.Millisecond
+	span := q.Range.To.Sub(q.Range.From)
+	points := int64(maxPoints)
+	if q.MaxDataPoints > 0 && q.MaxDataPoints < points {
+		points = q.MaxDataPoints
+	}
+	if min := span / time.Duration(points); step < min {
+		step = min
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	samples := urldata.JobSamples(q.Range.From, q.Range.To)
+	results := []interface{}{}
+	for _, t := range q.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		host := t.Payload["host"]
+		switch t.Target {
+		case "hosts":
+			results = append(results, hostTable(t.RefID, samples))
+		case "queue.depth":
+			now := float64(time.Now().UnixMilli())
+			depth := float64(urldata.GetStats().QueueDepth)
+			results = append(results, series{Target: t.Target, RefID: t.RefID, Datapoints: [][2]float64{{depth, now}}})
+		case "jobs.finished", "jobs.succeeded", "jobs.failed", "latency.mean", "latency.p95", "latency.max":
+			s := series{Target: t.Target, RefID: t.RefID, Datapoints: [][2]float64{}}
+			if host != "" {
+				s.Target += " " + host
+			}
+			for _, b := range buckets(q.Range.From, q.Range.To, step, samples, host) {
+				if v, ok := b.value(t.Target); ok {
+					s.Datapoints = append(s.Datapoints, [2]float64{v, float64(b.start.UnixMilli())})
+				}
+			}
+			results = append(results, s)
+		default:
+			return nil, fmt.Errorf("unknown target %q", t.Target)
+		}
+	}
+	return results, nil
+}
+
+// bucket holds the jobs that finished within one interval.
+type bucket struct {
+	start     time.Time
+	succeeded int
+	failed    int
+	latencies []time.Duration // Of the jobs that sent a request
+}
+
+// buckets splits the range into intervals of step, aligned on multiples of
+// it, and sorts the samples of jobs to host, if set, into them.
+func buckets(from, to time.Time, step time.Duration, samples []urldata.JobSample, host string) []*bucket {
+	start := from.Truncate(step)
+	var bs []*bucket
+	for t := start; !t.After(to); t = t.Add(step) {
+		bs = append(bs, &bucket{start: t})
+	}
+	for _, s := range samples {
+		if host != "" && !urldata.MatchesHost(host, s.Host) {
+			continue
+		}
+		i := int(s.Finished.Sub(start) / step)
+		if i < 0 || i >= len(bs) {
+			continue
+		}
+		if s.Failed {
+			bs[i].failed++
+		} else {
+			bs[i].succeeded++
+		}
+		if s.Latency > 0 {
+			bs[i].latencies = append(bs[i].latencies, s.Latency)
+		}
+	}
+	return bs
+}
+
+// value returns the value of a target for the bucket, reporting false for
+// a latency in an interval without any, which is left out of the series
+// rather than charted as 0.
+func (b *bucket) value(target string) (float64, bool) {
+	switch target {
+	case "jobs.finished":
+		return float64(b.succeeded + b.failed), true
+	case "jobs.succeeded":
+		return float64(b.succeeded), true
+	case "jobs.failed":
+		return float64(b.failed), true
+	}
+	if len(b.latencies) == 0 {
+		return 0, false
+	}
+	sort.Slice(b.latencies, func(i, j int) bool { return b.latencies[i] < b.latencies[j] })
+	switch target {
+	case "latency.mean":
+		var sum time.Duration
+		for _, l := range b.latencies {
+			sum += l
+		}
+		return milliseconds(sum / time.Duration(len(b.latencies))), true
+	case "latency.p95":
+		return milliseconds(b.latencies[(len(b.latencies)*95-1)/100]), true
+	default:
+		return milliseconds(b.latencies[len(b.latencies)-1]), true
+	}
+}
+
+// hostTable returns the hosts jobs finished for over the range, or that
+// were requested since the server started, with their statistics.
+func hostTable(refID string, samples []urldata.JobSample) table {
+	type row struct {
+		jobs, failed int
+		latency      time.Duration
+		timed        int
+	}
+	rows := map[string]*row{}
+	for _, s := range samples {
+		r := rows[s.Host]
+		if r == nil {
+			r = &row{}
+			rows[s.Host] = r
+		}
+		r.jobs++
+		if s.Failed {
+			r.failed++
+		}
+		if s.Latency > 0 {
+			r.latency += s.Latency
+			r.timed++
+		}
+	}
+	stats := map[string]urldata.HostStats{}
+	for _, h := range urldata.GetStats().Hosts {
+		stats[h.Host] = h
+		if rows[h.Host] == nil {
+			rows[h.Host] = &row{}
+		}
+	}
+	hosts := make([]string, 0, len(rows))
+	for host := range rows {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	t := table{
+		Type:  "table",
+		RefID: refID,
+		Columns: []column{
+			{Text: "Host", Type: "string"},
+			{Text: "Jobs", Type: "number"},
+			{Text: "Failed", Type: "number"},
+			{Text: "Mean latency (ms)", Type: "number"},
+			{Text: "Requests", Type: "number"},
+			{Text: "New connections", Type: "number"},
+			{Text: "Circuit", Type: "string"},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, host := range hosts {
+		r, h := rows[host], stats[host]
+		var latency interface{}
+		if r.timed > 0 {
+			latency = milliseconds(r.latency / time.Duration(r.timed))
+		}
+		t.Rows = append(t.Rows, []interface{}{host, r.jobs, r.failed, latency, h.Requests, h.NewConnections, h.Circuit})
+	}
+	return t
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
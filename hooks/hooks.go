@@ -0,0 +1,196 @@
+// Package hooks serves webhook endpoints that external systems, such as
+// GitHub or RSS-to-webhook services, post their events to. Each hook maps
+// the JSON payload to the URLs of jobs to add with a template, so that
+// events can trigger fetches without a GraphQL client.
+package hooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+)
+
+// Largest payload read, and most jobs added for one.
+const maxPayload = 1 << 20
+const maxJobs = 100
+
+// Hook is a webhook endpoint, served at /hooks/{Name}.
+type Hook struct {
+	Name string
+	// URLs is executed with the decoded JSON payload as its data. Each
+	// line it outputs that is not blank is the URL of a job to add.
+	URLs *template.Template
+	// Secret, if set, must have signed the payload: GitHub style, as the
+	// hex HMAC-SHA256 of the body in an X-Hub-Signature-256 header of the
+	// form "sha256=...", or for services that cannot sign, by being sent
+	// as is in an X-Hook-Secret header.
+	Secret string
+	Preset string // Preset the jobs start from, if any
+	// Tenant the jobs belong to, so that its viewers can see them. They
+	// are owned by "hook:" and the hook's name.
+	Tenant string
+}
+
+// New returns a hook whose URLs template is parsed from text. Fields
+// missing from a payload expand to nothing.
+func New(name, text, secret, preset string) (Hook, error) {
+	t, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return Hook{}, fmt.Errorf("hook %s: %v", name, err)
+	}
+	return Hook{Name: name, URLs: t, Secret: secret, Preset: preset}, nil
+}
+
+// Added is the response to a payload: the jobs it added, and why adding
+// the rest failed, if it did. Jobs already added are not rolled back, so
+// the response is still 202 Accepted and the sender must not retry.
+type Added struct {
+	Jobs  []AddedJob `json:"jobs"`
+	Error string     `json:"error,omitempty"`
+}
+
+// AddedJob is a job added for a payload.
+type AddedJob struct {
+	ID       int64  `json:"id"`
+	URL      string `json:"url"`
+	Instance string `json:"instance,omitempty"` // Base URL of the instance that owns the job, if another
+}
+
+// Handler returns a handler serving POST /hooks/{name} for each hook.
+func Handler(hooks []Hook) http.Handler {
+	byName := map[string]Hook{}
+	for _, h := range hooks {
+		byName[h.Name] = h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := byName[strings.TrimPrefix(r.URL.Path, "/hooks/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPayload+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxPayload {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if h.Secret != "" && !signed(h.Secret, r.Header, body) {
+			http.Error(w, "invalid or missing signature", http.StatusUnauthorized)
+			return
+		}
+		urls, err := h.urls(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := urldata.JobOptions{Tenant: h.Tenant, Owner: "hook:" + h.Name}
+		if h.Preset != "" {
+			if opts, err = urldata.WithPreset(h.Preset, opts); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		// Refuse the whole payload before adding any job, so that a sender
+		// retrying it does not add the others twice.
+		for _, u := range urls {
+			if err := urldata.CheckJobTarget(u, opts); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		added := Added{Jobs: []AddedJob{}}
+		for _, u := range urls {
+			job, err := urldata.SubmitJob(r.Context(), u, opts)
+			if err != nil && len(added.Jobs) > 0 {
+				added.Error = err.Error()
+				break
+			}
+			var overloaded *urldata.OverloadedError
+			if errors.As(err, &overloaded) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(overloaded.RetryAfter/time.Second)))
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if errors.Is(err, urldata.ErrTargetPolicy) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			added.Jobs = append(added.Jobs, AddedJob{ID: job.ID, URL: job.URL, Instance: job.Instance})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(added)
+	})
+}
+
+// signed reports whether the payload was signed with secret.
+func signed(secret string, header http.Header, body []byte) bool {
+	if sig := header.Get("X-Hub-Signature-256"); sig != "" {
+		got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal(got, mac.Sum(nil))
+	}
+	given := header.Get("X-Hook-Secret")
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// urls returns the URLs the hook's template maps a payload to.
+func (h Hook) urls(body []byte) ([]string, error) {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	var out bytes.Buffer
+	if err := h.URLs.Execute(&out, payload); err != nil {
+		return nil, fmt.Errorf("failed to map payload: %v", err)
+	}
+	var urls []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "<no value>" {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("payload mapped to invalid URL %q", line)
+		}
+		urls = append(urls, line)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("payload mapped to no URL")
+	}
+	if len(urls) > maxJobs {
+		return nil, fmt.Errorf("payload mapped to %d URLs, more than %d", len(urls), maxJobs)
+	}
+	return urls, nil
+}
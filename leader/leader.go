@@ -0,0 +1,134 @@
+// Package leader elects one instance out of several sharing a backend to
+// run work that must not be duplicated, such as recurring schedules.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Elector tells whether this instance is currently the leader.
+type Elector interface {
+	IsLeader() bool
+}
+
+// Single is the Elector of an instance running on its own, which always leads.
+type Single struct{}
+
+// IsLeader returns true.
+func (Single) IsLeader() bool { return true }
+
+// RedisConfig configures leader election through a Redis lock.
+type RedisConfig struct {
+	Address  string // Redis server as host:port
+	Password string
+	DB       int
+	Key      string        // Key of the lock, "urlfetcher:leader" by default
+	TTL      time.Duration // How long the lock outlives a silent leader, 15s by default
+}
+
+// Redis elects a leader by holding a Redis key that expires unless the
+// leader keeps renewing it. If the leader dies or loses its connection,
+// another instance takes over once the key has expired.
+type Redis struct {
+	client *redis.Client
+	key    string
+	ttl    time.Duration
+	id     string // Value of the key while this instance holds it
+
+	mu     sync.Mutex
+	leader bool
+	until  time.Time // When our hold on the lock ends unless renewed
+}
+
+// renew extends the lock only if this instance still holds it.
+var renew = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// NewRedis returns an elector using the Redis server in c. Call Campaign
+// to take part in the election, and Run to keep doing so.
+func NewRedis(c RedisConfig) *Redis {
+	if c.Key == "" {
+		c.Key = "urlfetcher:leader"
+	}
+	if c.TTL == 0 {
+		c.TTL = 15 * time.Second
+	}
+	host, _ := os.Hostname()
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return &Redis{
+		client: redis.NewClient(&redis.Options{Addr: c.Address, Password: c.Password, DB: c.DB}),
+		key:    c.Key,
+		ttl:    c.TTL,
+		id:     fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(nonce)),
+	}
+}
+
+// IsLeader reports whether this instance holds the lock. It turns false as
+// soon as the lock may have expired, even if Redis cannot be reached to
+// find out.
+func (r *Redis) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader && time.Now().Before(r.until)
+}
+
+// Run campaigns for leadership every third of the TTL until ctx is done.
+func (r *Redis) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Campaign(ctx)
+		}
+	}
+}
+
+// Campaign tries once to take or renew the lock.
+func (r *Redis) Campaign(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, r.ttl/3)
+	defer cancel()
+	start := time.Now()
+	held := false
+	var err error
+	if r.IsLeader() {
+		var n int64
+		n, err = renew.Run(ctx, r.client, []string{r.key}, r.id, r.ttl.Milliseconds()).Int64()
+		held = err == nil && n == 1
+	} else {
+		held, err = r.client.SetNX(ctx, r.key, r.id, r.ttl).Result()
+	}
+	if err != nil {
+		fmt.Println("leader election failed:", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if held != r.leader {
+		if held {
+			fmt.Println("became leader")
+		} else {
+			fmt.Println("lost leadership")
+		}
+	}
+	r.leader = held
+	if held {
+		// Measured from before the request, so we never believe we hold
+		// the lock longer than Redis does.
+		r.until = start.Add(r.ttl)
+	}
+}
@@ -1,33 +1,1007 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/dsoo/urlfetcher/admin"
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/dsoo/urlfetcher/cluster"
+	"github.com/dsoo/urlfetcher/compress"
+	"github.com/dsoo/urlfetcher/config"
+	"github.com/dsoo/urlfetcher/credentials"
+	"github.com/dsoo/urlfetcher/feed"
+	"github.com/dsoo/urlfetcher/grafana"
+	"github.com/dsoo/urlfetcher/hooks"
+	"github.com/dsoo/urlfetcher/leader"
+	"github.com/dsoo/urlfetcher/metrics"
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/dsoo/urlfetcher/queue"
+	"github.com/dsoo/urlfetcher/rest"
+	"github.com/dsoo/urlfetcher/secrets"
+	"github.com/dsoo/urlfetcher/sigv4"
+	"github.com/dsoo/urlfetcher/trigger"
+	"github.com/dsoo/urlfetcher/ui"
 	"github.com/dsoo/urlfetcher/urldata"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/handler"
 )
 
 func main() {
-	fmt.Println("running workers")
-	urldata.RunWorkers(2)
-	fmt.Println("adding jobs")
-	urldata.AddJob("https://google.com")
-	urldata.AddJob("https://arstechnica.com")
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	seedURLs := flag.String("seed-urls", "", "comma separated URLs to fetch on startup, in addition to seed.urls")
+	flag.Parse()
+
+	cfg := &config.Config{}
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			log.Fatalf("failed to load config, error: %v", err)
+		}
+	}
+
+	urldata.SetRedaction(urldata.RedactionRules{
+		QueryParams: cfg.Redaction.QueryParams,
+		Headers:     cfg.Redaction.Headers,
+	})
+
+	resolver, err := newSecretResolver(cfg.Secrets)
+	if err != nil {
+		log.Fatalf("failed to set up secrets, error: %v", err)
+	}
+	// Keep the references, to resolve them again on refresh.
+	credentialRefs, apiKeyRefs := cfg.Credentials, cfg.Auth.APIKeys
+	cfg.Credentials, cfg.Auth.APIKeys, err = resolveSecrets(resolver, credentialRefs, apiKeyRefs)
+	if err != nil {
+		log.Fatalf("failed to resolve secrets, error: %v", err)
+	}
+
+	authenticator, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		log.Fatalf("failed to set up authentication, error: %v", err)
+	}
+	ring, _ := authenticator.(*auth.KeyRing)
+	if authenticator != nil {
+		role := cfg.Auth.DefaultRole
+		if role == "" {
+			role = auth.RoleAdmin
+		}
+		authenticator = auth.WithDefaultRole(authenticator, role)
+	}
+
+	urldata.SetBLAKE3Checksums(cfg.Checksums.BLAKE3)
+	urldata.SetSanitizeHTML(cfg.Sanitize.HTML)
+	for _, p := range cfg.Processors {
+		if err := urldata.LoadProcessorPlugin(p.Name, p.Plugin); err != nil {
+			log.Fatalf("failed to load processor %s, error: %v", p.Name, err)
+		}
+	}
+	if cfg.Thumbnails.Dir != "" {
+		urldata.SetBlobStore(urldata.DirBlobStore(cfg.Thumbnails.Dir))
+	}
+	urldata.SetThumbnailSize(cfg.Thumbnails.Size)
+	if cfg.Snapshots.Enabled {
+		urldata.SetSnapshots(&urldata.SnapshotConfig{
+			Endpoint:   cfg.Snapshots.Endpoint,
+			Credential: cfg.Snapshots.Credential,
+			Timeout:    cfg.Snapshots.Timeout.Duration,
+		})
+	}
+
+	store := credentials.NewStore()
+	for _, c := range cfg.Credentials {
+		store.Add(newCredential(c))
+	}
+	urldata.SetCredentials(store)
+	keys, err := encryptionKeys(cfg.Encryption.Keys, store)
+	if err != nil {
+		log.Fatalf("failed to set up encryption, error: %v", err)
+	}
+	if err := urldata.SetEncryptionKeys(keys); err != nil {
+		log.Fatalf("failed to set up encryption, error: %v", err)
+	}
+	signingKeys, err := downloadKeys(cfg.Downloads.Keys, store)
+	if err != nil {
+		log.Fatalf("failed to set up signed downloads, error: %v", err)
+	}
+	urldata.SetDownloadKeys(signingKeys, cfg.Downloads.MaxTTL.Duration)
+	if interval := cfg.Secrets.RefreshInterval.Duration; interval > 0 {
+		go refreshSecrets(resolver, interval, credentialRefs, apiKeyRefs, cfg.Encryption.Keys, cfg.Downloads, store, ring)
+	}
+	urldata.SetClientCertificates(cfg.Fetch.ClientCert, cfg.Fetch.HostClientCerts)
+	canonical := func(c config.Canonical) urldata.Canonicalizer {
+		if c.TrailingSlash != "" && c.TrailingSlash != "strip" && c.TrailingSlash != "add" {
+			log.Fatalf("failed to configure cache keys, error: unknown trailingSlash %q", c.TrailingSlash)
+		}
+		return urldata.CanonicalRules(c)
+	}
+	var defaultCanonical urldata.Canonicalizer
+	if cfg.Cache.Canonical != nil {
+		defaultCanonical = canonical(*cfg.Cache.Canonical)
+	}
+	hostCanonical := map[string]urldata.Canonicalizer{}
+	for host, c := range cfg.Cache.HostCanonical {
+		hostCanonical[strings.ToLower(host)] = canonical(c)
+	}
+	urldata.SetCanonicalizers(defaultCanonical, hostCanonical)
+	var tunnels []urldata.Tunnel
+	for _, t := range cfg.Fetch.Tunnels {
+		tunnels = append(tunnels, urldata.Tunnel(t))
+	}
+	urldata.SetTunnels(tunnels)
+	var egress []urldata.Egress
+	for _, e := range cfg.Fetch.Egress {
+		if _, ok := store.Get(e.Credential); e.Credential != "" && !ok {
+			log.Fatalf("failed to configure egress %s, error: unknown credential %q", e.Name, e.Credential)
+		}
+		egress = append(egress, urldata.Egress(e))
+	}
+	if err := urldata.SetEgressRoutes(egress); err != nil {
+		log.Fatalf("failed to configure egress routes, error: %v", err)
+	}
+	targetPolicy := func(c config.TargetPolicy) urldata.TargetPolicy {
+		p := urldata.TargetPolicy{Schemes: c.Schemes, Ports: c.Ports}
+		for _, cidr := range c.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Fatalf("failed to configure fetch targets, error: %v", err)
+			}
+			p.Networks = append(p.Networks, network)
+		}
+		return p
+	}
+	tenantTargets := map[string]urldata.TargetPolicy{}
+	for tenant, p := range cfg.Fetch.Targets.Tenants {
+		tenantTargets[tenant] = targetPolicy(p)
+	}
+	urldata.SetTargetPolicy(targetPolicy(cfg.Fetch.Targets.TargetPolicy), tenantTargets)
+	var rewrites []urldata.RewriteRule
+	for _, r := range cfg.Fetch.Rewrites {
+		rule := urldata.RewriteRule{Host: r.Host, Replace: r.Replace, Query: r.Query, QueryCredentials: r.QueryCredentials}
+		if r.Match != "" {
+			match, err := regexp.Compile(r.Match)
+			if err != nil {
+				log.Fatalf("failed to configure URL rewrites, error: %v", err)
+			}
+			rule.Match = match
+		}
+		for _, name := range r.QueryCredentials {
+			if _, ok := store.Get(name); !ok {
+				log.Fatalf("failed to configure URL rewrites, error: unknown credential %q", name)
+			}
+		}
+		rewrites = append(rewrites, rule)
+	}
+	urldata.SetRewriteRules(rewrites)
+	profiles := map[string]urldata.HostProfile{}
+	for host, p := range cfg.Fetch.HostProfiles {
+		if _, ok := store.Get(p.Credential); p.Credential != "" && !ok {
+			log.Fatalf("failed to configure host profile for %s, error: unknown credential %q", host, p.Credential)
+		}
+		profiles[host] = urldata.HostProfile{
+			Headers:              p.Headers,
+			MaxRequestsPerSecond: p.MaxRequestsPerSecond,
+			MaxDuration:          p.MaxDuration.Duration,
+			MaxBytes:             p.MaxBytes,
+			ClientCert:           p.ClientCert,
+			Tunnel:               p.Tunnel,
+			Egress:               p.Egress,
+			Credential:           p.Credential,
+			Scripts:              scripts(p.Scripts),
+		}
+		if err := urldata.CheckScripts(profiles[host].Scripts); err != nil {
+			log.Fatalf("failed to configure host profile for %s, error: %v", host, err)
+		}
+	}
+	urldata.SetHostProfiles(profiles)
+	urldata.SetConnectionPool(urldata.PoolConfig{
+		MaxIdleConns:        cfg.Fetch.Pool.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.Fetch.Pool.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     cfg.Fetch.Pool.MaxConnsPerHost,
+		IdleConnTimeout:     cfg.Fetch.Pool.IdleConnTimeout.Duration,
+		FallbackDelay:       cfg.Fetch.Pool.FallbackDelay.Duration,
+	})
+	if err := urldata.SetDoH(urldata.DoHConfig{
+		URL:              cfg.Fetch.DoH.URL,
+		BootstrapAddress: cfg.Fetch.DoH.BootstrapAddress,
+	}); err != nil {
+		log.Fatalf("failed to configure DNS over HTTPS, error: %v", err)
+	}
+	breaker := cfg.Fetch.CircuitBreaker
+	if breaker.Mode != "" && breaker.Mode != "fail" && breaker.Mode != "delay" {
+		log.Fatalf("failed to configure circuit breaker, error: unknown mode %q", breaker.Mode)
+	}
+	urldata.SetCircuitBreaker(urldata.BreakerConfig{
+		Threshold: breaker.Threshold,
+		Cooldown:  breaker.Cooldown.Duration,
+		Delay:     breaker.Mode == "delay",
+	})
+	urldata.SetPoliteness(urldata.PolitenessConfig{
+		LatencyFactor: cfg.Fetch.Politeness.LatencyFactor,
+		MaxDelay:      cfg.Fetch.Politeness.MaxDelay.Duration,
+		MaxRetries:    cfg.Fetch.Politeness.MaxRetries,
+		Backoff:       cfg.Fetch.Politeness.Backoff.Duration,
+		MaxBackoff:    cfg.Fetch.Politeness.MaxBackoff.Duration,
+	})
+
+	urldata.SetFetchRate(cfg.Fetch.MaxRequestsPerSecond)
+	urldata.SetDefaultMaxBytes(cfg.Fetch.MaxBytes)
+	urldata.SetMaxHeaderBytes(cfg.Fetch.MaxHeaderBytes)
+	urldata.SetMaxLookups(cfg.Fetch.MaxConcurrentLookups)
+	urldata.SetMaxConnections(cfg.Fetch.MaxConnections)
+
+	urldata.SetPublicURL(cfg.PublicURL)
+	notifiers, err := newNotifiers(cfg.Notifiers, store)
+	if err != nil {
+		log.Fatalf("failed to set up notifiers, error: %v", err)
+	}
+	urldata.SetNotifiers(notifiers)
+	var rules []urldata.AlertRule
+	for _, r := range cfg.Alerts {
+		for _, name := range r.Notify {
+			if _, ok := notifiers[name]; !ok {
+				log.Fatalf("failed to set up alert %s, error: unknown notifier %q", r.Name, name)
+			}
+		}
+		rules = append(rules, urldata.AlertRule{
+			Name:        r.Name,
+			Host:        r.Host,
+			FailureRate: r.FailureRate,
+			MinJobs:     r.MinJobs,
+			Window:      r.Window.Duration,
+			Notifiers:   r.Notify,
+		})
+	}
+	urldata.SetAlertRules(rules)
+	var pools []urldata.WorkerPool
+	for _, p := range cfg.Pools {
+		qc := config.Queue{
+			VisibilityTimeout: cfg.Queue.VisibilityTimeout,
+			Scheduler:         cfg.Queue.Scheduler,
+			TenantWeights:     cfg.Queue.TenantWeights,
+		}
+		if p.Queue != nil {
+			qc = *p.Queue
+		}
+		q, err := newQueue(qc, store)
+		if err != nil {
+			log.Fatalf("failed to set up the queue of worker pool %s, error: %v", p.Name, err)
+		}
+		pools = append(pools, urldata.WorkerPool{
+			Name:                 p.Name,
+			Workers:              p.Workers,
+			Timeout:              p.Timeout.Duration,
+			MaxRequestsPerSecond: p.MaxRequestsPerSecond,
+			Queue:                q,
+		})
+	}
+	if err := urldata.SetWorkerPools(pools); err != nil {
+		log.Fatalf("failed to set up worker pools, error: %v", err)
+	}
+	var routing []urldata.RoutingRule
+	for _, r := range cfg.Routing {
+		routing = append(routing, urldata.RoutingRule{
+			Name:        r.Name,
+			Host:        r.Host,
+			Tag:         r.Tag,
+			Tenant:      r.Tenant,
+			ContentType: r.ContentType,
+			Priority:    r.Priority,
+			Egress:      r.Egress,
+			Pool:        r.Pool,
+			Processors:  r.Processors,
+			Retention:   r.Retention.Duration,
+		})
+	}
+	if err := urldata.SetRoutingRules(routing); err != nil {
+		log.Fatalf("failed to set up routing rules, error: %v", err)
+	}
+	for name, p := range cfg.Presets {
+		if p.Type != "" && p.Type != urldata.JobCertificate {
+			log.Fatalf("failed to set up preset %s, error: unknown job type %q", name, p.Type)
+		}
+		if _, ok := notifiers[p.Notify]; p.Notify != "" && !ok {
+			log.Fatalf("failed to set up preset %s, error: unknown notifier %q", name, p.Notify)
+		}
+		if p.Pool != "" && !urldata.HasPool(p.Pool) {
+			log.Fatalf("failed to set up preset %s, error: unknown worker pool %q", name, p.Pool)
+		}
+		if err := urldata.CheckScripts(scripts(p.Scripts)); err != nil {
+			log.Fatalf("failed to set up preset %s, error: %v", name, err)
+		}
+		urldata.SetPreset(name, urldata.JobOptions{
+			Type:           p.Type,
+			ClientCert:     p.ClientCert,
+			HostHeader:     p.HostHeader,
+			ServerName:     p.ServerName,
+			ConnectAddress: p.ConnectAddress,
+			Tunnel:         p.Tunnel,
+			Egress:         p.Egress,
+			Pool:           p.Pool,
+			MaxBytes:       p.MaxBytes,
+			MaxDuration:    p.MaxDuration.Duration,
+			Notify:         p.Notify,
+			Tags:           p.Tags,
+			Scripts:        scripts(p.Scripts),
+		})
+	}
+
+	jobQueue, err := newQueue(cfg.Queue, store)
+	if err != nil {
+		log.Fatalf("failed to set up job queue, error: %v", err)
+	}
+	urldata.SetQueue(jobQueue)
+	urldata.SetMaxRedeliveries(cfg.Queue.MaxRedeliveries)
+	urldata.SetGovernor(urldata.GovernorConfig{
+		MaxHeapBytes:  cfg.LoadShedding.MaxHeapBytes,
+		MaxQueueDepth: cfg.LoadShedding.MaxQueueDepth,
+		RetryAfter:    cfg.LoadShedding.RetryAfter.Duration,
+	})
+
+	replica := cfg.Persistence.Replica
+	switch {
+	case replica && cfg.Persistence.Path == "":
+		log.Fatal("persistence.replica requires persistence.path")
+	case replica:
+		if err := urldata.SetReplica(cfg.Persistence.Path, cfg.Persistence.RefreshInterval.Duration); err != nil {
+			log.Fatalf("failed to load jobs, error: %v", err)
+		}
+	case cfg.Persistence.Path != "":
+		if err := urldata.SetPersistence(cfg.Persistence.Path); err != nil {
+			log.Fatalf("failed to restore jobs, error: %v", err)
+		}
+	}
+	if !replica {
+		urldata.SetTrashRetention(cfg.Trash.Retention.Duration)
+	}
+	if cfg.Archive.Path != "" && !replica {
+		err := urldata.SetArchive(urldata.ArchiveConfig{
+			Path:     cfg.Archive.Path,
+			After:    cfg.Archive.After.Duration,
+			Interval: cfg.Archive.Interval.Duration,
+		})
+		if err != nil {
+			log.Fatalf("failed to open job archive, error: %v", err)
+		}
+	}
+
+	if replica {
+		fmt.Println("serving as a read-only replica")
+	} else {
+		fmt.Println("running workers")
+		urldata.RunWorkers(2)
+	}
+	seeds := cfg.Seed.URLs
+	if *seedURLs != "" {
+		seeds = append(seeds, strings.Split(*seedURLs, ",")...)
+	}
+	if len(cfg.Cluster.Instances) > 0 {
+		key, err := setCluster(cfg.Cluster, store)
+		if err != nil {
+			log.Fatalf("failed to set up cluster, error: %v", err)
+		}
+		if authenticator != nil && key != "" {
+			authenticator = cluster.Authenticator(authenticator, key)
+		}
+	}
+
+	elector, err := newElector(cfg.Leader, store)
+	if err != nil {
+		log.Fatalf("failed to set up leader election, error: %v", err)
+	}
+	if !replica {
+		seed(seeds, cfg.Seed.Interval.Duration, elector)
+	}
+
+	if cfg.RemoteWrite.URL != "" {
+		rw := metrics.RemoteWriteConfig{URL: cfg.RemoteWrite.URL, Interval: cfg.RemoteWrite.Interval.Duration}
+		if cfg.RemoteWrite.Credential != "" {
+			cred, ok := store.Get(cfg.RemoteWrite.Credential)
+			if !ok {
+				log.Fatalf("failed to set up remote write, error: unknown credential %q", cfg.RemoteWrite.Credential)
+			}
+			rw.Username, rw.Password = cred.Username, cred.Password
+		}
+		urldata.SetCheckMetrics(metrics.NewRemoteWriter(context.Background(), rw))
+	}
+
+	webhooks, err := newHooks(cfg.Hooks, store, cfg.Auth.Mode != "")
+	if err != nil {
+		log.Fatalf("failed to set up hooks, error: %v", err)
+	}
 
 	schema, err := graphql.NewSchema(urldata.SchemaConfig())
 	if err != nil {
 		log.Fatalf("failed to create new schema, error: %v", err)
 	}
 
-	h := handler.New(&handler.Config{
+	var h http.Handler = rest.ETag(handler.New(&handler.Config{
 		Schema:   &schema,
 		Pretty:   true,
 		GraphiQL: true,
-	})
+	}))
+	if authenticator != nil {
+		h = auth.Middleware(authenticator, h)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", h)
+	var events http.Handler = feed.SSEHandler()
+	if authenticator != nil {
+		events = auth.Middleware(authenticator, auth.RequireRole(auth.RoleViewer, events))
+	}
+	mux.Handle("/events", events)
+	var ws http.Handler = feed.WebSocketHandler()
+	if authenticator != nil {
+		ws = auth.Middleware(authenticator, auth.RequireRole(auth.RoleViewer, ws))
+	}
+	mux.Handle("/events/ws", ws)
+	var api http.Handler = rest.Handler()
+	if authenticator != nil {
+		api = auth.Middleware(authenticator, api)
+	}
+	mux.Handle(rest.Prefix+"/", rest.SignedDownloads(api))
+	var trig http.Handler = trigger.Handler()
+	if authenticator != nil {
+		trig = trigger.KeyParam(auth.Middleware(authenticator, trig))
+	}
+	mux.Handle(trigger.Prefix, trig)
+	mux.Handle(trigger.Prefix+"/", trig)
+	var datasource http.Handler = grafana.Handler()
+	if authenticator != nil {
+		datasource = auth.Middleware(authenticator, auth.RequireRole(auth.RoleViewer, datasource))
+	}
+	mux.Handle(grafana.Prefix+"/", datasource)
+	// Hooks are called by external systems, which authenticate with the
+	// hook's secret rather than as API clients.
+	mux.Handle("/hooks/", hooks.Handler(webhooks))
+	mux.Handle("/openapi.json", rest.OpenAPIHandler())
+	mux.Handle("/docs", rest.SwaggerUIHandler())
+	mux.Handle("/ui/", http.StripPrefix("/ui/", ui.Handler()))
+	metrics.Register(urldata.CollectMetrics)
+	// Metrics cover the hosts of every tenant, so only admins may scrape
+	// them.
+	metricsHandler := metrics.Handler()
+	if authenticator != nil {
+		metricsHandler = auth.Middleware(authenticator, auth.RequireRole(auth.RoleAdmin, metricsHandler))
+	}
+	mux.Handle("/metrics", metricsHandler)
+	if err := pushMetrics(cfg.Metrics); err != nil {
+		log.Fatalf("failed to set up metrics, error: %v", err)
+	}
+
+	root := cluster.Middleware(mux)
+	if !cfg.Compression.Disabled {
+		root = compress.Middleware(compress.Config{
+			MinSize:      cfg.Compression.MinSize,
+			ContentTypes: cfg.Compression.ContentTypes,
+		}, root)
+	}
+	server := &http.Server{Addr: cfg.Listen, Handler: root}
+	if server.Addr == "" {
+		server.Addr = ":8080"
+	}
+	if cfg.TLS.CertFile == "" {
+		if cfg.Auth.Mode == "mtls" {
+			log.Fatal("auth mode mtls requires tls.certFile")
+		}
+		serveAdmin(cfg.Admin, authenticator, cfg.TLS, nil)
+		log.Fatal(server.ListenAndServe())
+	}
+	server.TLSConfig, err = newTLSConfig(cfg.TLS, cfg.Auth.Mode == "mtls")
+	if err != nil {
+		log.Fatalf("failed to set up TLS, error: %v", err)
+	}
+	serveAdmin(cfg.Admin, authenticator, cfg.TLS, server.TLSConfig)
+	log.Fatal(server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile))
+}
+
+// serveAdmin starts the admin listener if it is configured, using the same
+// authentication and TLS setup as the API. Only the configured subjects may
+// use it; without authentication it must listen on a loopback address.
+func serveAdmin(c config.Admin, authenticator auth.Authenticator, t config.TLS, tlsConfig *tls.Config) {
+	if c.Listen == "" {
+		return
+	}
+	var h http.Handler = admin.Handler()
+	if authenticator != nil {
+		if len(c.Subjects) == 0 {
+			log.Fatal("admin.listen requires admin.subjects when auth is enabled")
+		}
+		h = auth.Middleware(authenticator, auth.RequireSubjects(c.Subjects, h))
+	} else if !isLoopback(c.Listen) {
+		log.Fatalf("admin.listen %q must be a loopback address when auth is disabled", c.Listen)
+	}
+	server := &http.Server{Addr: c.Listen, Handler: h, TLSConfig: tlsConfig}
+	go func() {
+		if tlsConfig == nil {
+			log.Fatal(server.ListenAndServe())
+		}
+		log.Fatal(server.ListenAndServeTLS(t.CertFile, t.KeyFile))
+	}()
+}
+
+// isLoopback reports whether addr, as given to net.Listen, only accepts
+// connections from the local machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// seed adds a job for each URL, and again every interval if it is set.
+// Only the leader adds jobs, so instances sharing a schedule do not all
+// fetch the same URLs.
+func seed(urls []string, interval time.Duration, elector leader.Elector) {
+	if len(urls) == 0 {
+		return
+	}
+	add := func() {
+		if !elector.IsLeader() {
+			return
+		}
+		fmt.Println("adding seed jobs")
+		for _, u := range urls {
+			if u = strings.TrimSpace(u); u != "" {
+				urldata.AddJob(u)
+			}
+		}
+	}
+	add()
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				add()
+			}
+		}()
+	}
+}
+
+// setCluster sets up routing jobs to the instances of the cluster, and
+// returns the API key forwarded requests authenticate with.
+func setCluster(c config.Cluster, store *credentials.Store) (string, error) {
+	self := strings.TrimRight(c.Self, "/")
+	found := false
+	for _, instance := range c.Instances {
+		if strings.TrimRight(instance, "/") == self {
+			found = true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("cluster.self %q is not one of cluster.instances", c.Self)
+	}
+	apiKey := ""
+	if c.Credential != "" {
+		cred, ok := store.Get(c.Credential)
+		if !ok {
+			return "", fmt.Errorf("unknown credential %q", c.Credential)
+		}
+		apiKey = cred.Password
+	}
+	urldata.SetCluster(self, c.Instances, apiKey)
+	return apiKey, nil
+}
+
+// pushMetrics starts pushing the server metrics to the sink selected by the
+// config, if it is not just the Prometheus endpoint.
+func pushMetrics(c config.Metrics) error {
+	switch c.Sink {
+	case "", "prometheus":
+		return nil
+	case "statsd", "dogstatsd":
+		addr := c.Address
+		if addr == "" {
+			addr = "127.0.0.1:8125"
+		}
+		interval := c.Interval.Duration
+		if interval == 0 {
+			interval = 10 * time.Second
+		}
+		sink, err := metrics.NewStatsD(addr, c.Prefix, c.Sink == "dogstatsd")
+		if err != nil {
+			return err
+		}
+		go metrics.Push(context.Background(), sink, interval)
+		return nil
+	}
+	return fmt.Errorf("unknown metrics sink %q", c.Sink)
+}
+
+// newCredential converts a configured credential for the credential store.
+func newCredential(c config.Credential) credentials.Credential {
+	return credentials.Credential{
+		Name:           c.Name,
+		CertFile:       c.CertFile,
+		KeyFile:        c.KeyFile,
+		Username:       c.Username,
+		PrivateKeyFile: c.PrivateKeyFile,
+		Password:       c.Password,
+		WebhookURL:     c.WebhookURL,
+		Tenants:        c.Tenants,
+	}
+}
+
+// scripts returns the scripts configured, or nil if there are none.
+func scripts(c config.Scripts) *urldata.Scripts {
+	if len(c.Fields) == 0 && c.Retry == "" && c.Notify == "" {
+		return nil
+	}
+	return &urldata.Scripts{Fields: c.Fields, Retry: c.Retry, Notify: c.Notify}
+}
+
+// apiKeys returns the identities of the API keys configured in
+// auth.apiKeys, with their secrets already resolved, keyed by API key. Each
+// key maps to its subject, tenant, owner and role; an empty role is given
+// auth.defaultRole by the authenticator.
+func apiKeys(configs []config.APIKey) auth.APIKeys {
+	keys := auth.APIKeys{}
+	for _, k := range configs {
+		keys[k.Key] = &auth.Identity{Subject: k.Subject, Tenant: k.Tenant, Owner: k.Owner, Role: k.Role}
+	}
+	return keys
+}
+
+// newSecretResolver returns a resolver for the configured secret sources.
+func newSecretResolver(c config.Secrets) (*secrets.Resolver, error) {
+	r := &secrets.Resolver{}
+	if c.Vault.Address != "" {
+		v, err := secrets.NewVault(c.Vault.Address, c.Vault.Token, c.Vault.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		r.Vault = v
+	}
+	if c.KMS.Region != "" {
+		k, err := secrets.NewKMS(c.KMS.Region, c.KMS.Endpoint, sigv4.Keys{})
+		if err != nil {
+			return nil, err
+		}
+		r.KMS = k
+	}
+	return r, nil
+}
 
-	http.Handle("/graphql", h)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// resolveSecrets returns copies of the credentials and API keys with their
+// secret references resolved.
+func resolveSecrets(r *secrets.Resolver, creds []config.Credential, keys []config.APIKey) ([]config.Credential, []config.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resolved := make([]config.Credential, len(creds))
+	for i, c := range creds {
+		for _, field := range []*string{&c.Username, &c.Password, &c.WebhookURL} {
+			value, err := r.Resolve(ctx, *field)
+			if err != nil {
+				return nil, nil, fmt.Errorf("credential %s: %v", c.Name, err)
+			}
+			*field = value
+		}
+		resolved[i] = c
+	}
+	resolvedKeys := make([]config.APIKey, len(keys))
+	for i, k := range keys {
+		value, err := r.Resolve(ctx, k.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("API key of %s: %v", k.Subject, err)
+		}
+		k.Key = value
+		resolvedKeys[i] = k
+	}
+	return resolved, resolvedKeys, nil
+}
+
+// refreshSecrets resolves the secret references again every interval and
+// puts the results in place: credentials in the store, API keys in ring if
+// authentication uses them, and the encryption and download signing keys.
+// A failed refresh keeps the previous secrets.
+func refreshSecrets(r *secrets.Resolver, interval time.Duration, creds []config.Credential, keys []config.APIKey,
+	encryption []string, downloads config.Downloads, store *credentials.Store, ring *auth.KeyRing) {
+	for range time.Tick(interval) {
+		resolvedCreds, resolvedKeys, err := resolveSecrets(r, creds, keys)
+		if err != nil {
+			fmt.Println("failed to refresh secrets:", err)
+			continue
+		}
+		for _, c := range resolvedCreds {
+			store.Add(newCredential(c))
+		}
+		if ring != nil {
+			ring.Set(apiKeys(resolvedKeys))
+		}
+		bodyKeys, err := encryptionKeys(encryption, store)
+		if err == nil {
+			err = urldata.SetEncryptionKeys(bodyKeys)
+		}
+		if err != nil {
+			fmt.Println("failed to refresh encryption keys:", err)
+		}
+		signingKeys, err := downloadKeys(downloads.Keys, store)
+		if err != nil {
+			fmt.Println("failed to refresh download signing keys:", err)
+			continue
+		}
+		urldata.SetDownloadKeys(signingKeys, downloads.MaxTTL.Duration)
+	}
+}
+
+// encryptionKeys returns the keys held by the named credentials.
+func encryptionKeys(names []string, store *credentials.Store) ([]urldata.EncryptionKey, error) {
+	var keys []urldata.EncryptionKey
+	for _, name := range names {
+		cred, ok := store.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown credential %q", name)
+		}
+		key, err := base64.StdEncoding.DecodeString(cred.Password)
+		if err != nil {
+			return nil, fmt.Errorf("credential %s does not hold a base64 encoded key: %v", name, err)
+		}
+		keys = append(keys, urldata.EncryptionKey{ID: name, Key: key})
+	}
+	return keys, nil
+}
+
+// downloadKeys returns the keys held by the named credentials.
+func downloadKeys(names []string, store *credentials.Store) ([][]byte, error) {
+	var keys [][]byte
+	for _, name := range names {
+		cred, ok := store.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown credential %q", name)
+		}
+		if cred.Password == "" {
+			return nil, fmt.Errorf("credential %s has no password to sign with", name)
+		}
+		keys = append(keys, []byte(cred.Password))
+	}
+	return keys, nil
+}
+
+// newHooks returns the webhook endpoints configured, with their secrets.
+// Hooks are not behind the API authentication, so with it enabled every
+// hook must have a secret.
+func newHooks(configs []config.Hook, store *credentials.Store, authEnabled bool) ([]hooks.Hook, error) {
+	var list []hooks.Hook
+	seen := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" || strings.Contains(c.Name, "/") {
+			return nil, fmt.Errorf("invalid hook name %q", c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate hook %s", c.Name)
+		}
+		seen[c.Name] = true
+		if _, err := urldata.WithPreset(c.Preset, urldata.JobOptions{}); c.Preset != "" && err != nil {
+			return nil, fmt.Errorf("hook %s: %v", c.Name, err)
+		}
+		secret := ""
+		if c.Credential != "" {
+			cred, ok := store.Get(c.Credential)
+			if !ok {
+				return nil, fmt.Errorf("hook %s: unknown credential %q", c.Name, c.Credential)
+			}
+			secret = cred.Password
+		}
+		if secret == "" && authEnabled {
+			return nil, fmt.Errorf("hook %s: a credential with a password is required when auth is enabled", c.Name)
+		}
+		h, err := hooks.New(c.Name, c.URL, secret, c.Preset)
+		if err != nil {
+			return nil, err
+		}
+		h.Tenant = c.Tenant
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// newElector returns the leader elector selected by the config, having
+// campaigned once so the result is known at startup.
+func newElector(c config.Leader, store *credentials.Store) (leader.Elector, error) {
+	if c.Redis == "" {
+		return leader.Single{}, nil
+	}
+	rc := leader.RedisConfig{Address: c.Redis, Key: c.Key, TTL: c.TTL.Duration}
+	if c.Credential != "" {
+		cred, ok := store.Get(c.Credential)
+		if !ok {
+			return nil, fmt.Errorf("unknown credential %q", c.Credential)
+		}
+		rc.Password = cred.Password
+	}
+	r := leader.NewRedis(rc)
+	r.Campaign(context.Background())
+	go r.Run(context.Background())
+	return r, nil
+}
+
+// newQueue returns the job queue selected by the config.
+func newQueue(c config.Queue, store *credentials.Store) (queue.Queue, error) {
+	var cred *credentials.Credential
+	if c.Credential != "" {
+		var ok bool
+		if cred, ok = store.Get(c.Credential); !ok {
+			return nil, fmt.Errorf("unknown credential %q", c.Credential)
+		}
+	}
+	switch c.Type {
+	case "", "memory":
+		q := queue.NewMemory(c.VisibilityTimeout.Duration)
+		q.SetWeights(c.TenantWeights)
+		switch c.Scheduler {
+		case "", "fair":
+		case "deadline":
+			q.SetEarliestDeadlineFirst(true)
+		default:
+			return nil, fmt.Errorf("unknown scheduler %q", c.Scheduler)
+		}
+		return q, nil
+	case "sqs":
+		sc := queue.SQSConfig{QueueURL: c.URL, Region: c.Region, VisibilityTimeout: c.VisibilityTimeout.Duration}
+		if cred != nil {
+			sc.AccessKeyID, sc.SecretAccessKey = cred.Username, cred.Password
+		}
+		return queue.NewSQS(sc)
+	case "rabbitmq":
+		rc := queue.RabbitMQConfig{URL: c.URL, Queue: c.Name}
+		if cred != nil {
+			u, err := url.Parse(c.URL)
+			if err != nil {
+				return nil, err
+			}
+			u.User = url.UserPassword(cred.Username, cred.Password)
+			rc.URL = u.String()
+		}
+		return queue.NewRabbitMQ(rc)
+	}
+	return nil, fmt.Errorf("unknown queue type %q", c.Type)
+}
+
+// newTLSConfig returns the listener TLS configuration. If requireClientCert
+// is set, connections without a verified client certificate are refused.
+func newTLSConfig(c config.TLS, requireClientCert bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile == "" {
+		if requireClientCert {
+			return nil, errors.New("client certificate authentication requires tls.clientCaFile")
+		}
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// newAuthenticator returns the authenticator selected by the config, or nil
+// if authentication is disabled.
+func newAuthenticator(c config.Auth) (auth.Authenticator, error) {
+	if err := checkRoles(c); err != nil {
+		return nil, err
+	}
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case "apikey":
+		return auth.NewKeyRing(apiKeys(c.APIKeys)), nil
+	case "oidc":
+		if c.OIDC.Audience == "" {
+			fmt.Println("warning: auth.oidc.audience is not set, so tokens issued for any audience are accepted")
+		}
+		return auth.NewOIDC(auth.OIDCConfig{
+			Issuer:          c.OIDC.Issuer,
+			Audience:        c.OIDC.Audience,
+			JWKSURL:         c.OIDC.JWKSURL,
+			RefreshInterval: c.OIDC.RefreshInterval.Duration,
+			TenantClaim:     c.OIDC.TenantClaim,
+			OwnerClaim:      c.OIDC.OwnerClaim,
+			RoleClaim:       c.OIDC.RoleClaim,
+		})
+	case "mtls":
+		certs := &auth.ClientCertificates{TenantField: c.MTLS.TenantField}
+		if len(c.MTLS.Identities) > 0 {
+			certs.Identities = make(map[string]*auth.Identity)
+			for _, i := range c.MTLS.Identities {
+				certs.Identities[i.CommonName] = &auth.Identity{Subject: i.CommonName, Tenant: i.Tenant, Owner: i.Owner, Role: i.Role}
+			}
+		}
+		return certs, nil
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", c.Mode)
+}
+
+// checkRoles checks that the roles the auth config names exist.
+func checkRoles(c config.Auth) error {
+	if c.DefaultRole != "" && !auth.ValidRole(c.DefaultRole) {
+		return fmt.Errorf("unknown defaultRole %q", c.DefaultRole)
+	}
+	for _, k := range c.APIKeys {
+		if k.Role != "" && !auth.ValidRole(k.Role) {
+			return fmt.Errorf("API key of %s has unknown role %q", k.Subject, k.Role)
+		}
+	}
+	for _, i := range c.MTLS.Identities {
+		if i.Role != "" && !auth.ValidRole(i.Role) {
+			return fmt.Errorf("identity %s has unknown role %q", i.CommonName, i.Role)
+		}
+	}
+	return nil
+}
+
+// newNotifiers returns the configured notifiers keyed by name.
+// Webhook URLs are taken from the credential store if the notifier names a
+// credential.
+func newNotifiers(configs []config.Notifier, store *credentials.Store) (map[string]notify.Notifier, error) {
+	notifiers := map[string]notify.Notifier{}
+	for _, c := range configs {
+		url := c.URL
+		var cred *credentials.Credential
+		if c.Credential != "" {
+			var ok bool
+			if cred, ok = store.Get(c.Credential); !ok {
+				return nil, fmt.Errorf("notifier %s refers to unknown credential %q", c.Name, c.Credential)
+			}
+			url = cred.WebhookURL
+		}
+		if c.Type == "email" {
+			email := notify.EmailConfig{
+				Server:          c.Email.Server,
+				From:            c.Email.From,
+				To:              c.Email.To,
+				SubjectTemplate: c.Email.SubjectTemplate,
+				BodyTemplate:    c.Email.BodyTemplate,
+			}
+			if cred != nil {
+				email.Username, email.Password = cred.Username, cred.Password
+			}
+			n, err := notify.NewEmail(email)
+			if err != nil {
+				return nil, fmt.Errorf("notifier %s: %v", c.Name, err)
+			}
+			notifiers[c.Name] = n
+			continue
+		}
+		if url == "" {
+			return nil, fmt.Errorf("notifier %s has no url", c.Name)
+		}
+		switch c.Type {
+		case "webhook":
+			notifiers[c.Name] = &notify.Webhook{URL: url}
+		case "slack":
+			notifiers[c.Name] = &notify.Slack{WebhookURL: url}
+		case "discord":
+			notifiers[c.Name] = &notify.Discord{WebhookURL: url}
+		default:
+			return nil, fmt.Errorf("notifier %s has unknown type %q", c.Name, c.Type)
+		}
+	}
+	return notifiers, nil
 }
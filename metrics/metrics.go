@@ -0,0 +1,97 @@
+// Package metrics exposes server metrics in the Prometheus text format.
+//
+// Rather than keeping its own copies of every counter, the package asks
+// registered collectors for current values whenever it is scraped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric types, as written in the TYPE line of the exposition format.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Summary   = "summary"
+	Histogram = "histogram"
+)
+
+// Sample is a single value of a metric family.
+type Sample struct {
+	Suffix string            // Appended to the family name, e.g. "_sum"
+	Labels map[string]string // Label values, may be nil
+	Value  float64
+}
+
+// Family is a named group of samples sharing a type and help text.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector returns the current value of a set of metric families.
+type Collector func() []Family
+
+var mu sync.Mutex
+var collectors []Collector
+
+// Register adds a collector consulted on every scrape.
+func Register(c Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+	collectors = append(collectors, c)
+}
+
+// Handler returns an HTTP handler serving all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+// Gather returns the current value of all registered metrics.
+func Gather() []Family {
+	mu.Lock()
+	cs := append([]Collector(nil), collectors...)
+	mu.Unlock()
+	var families []Family
+	for _, c := range cs {
+		families = append(families, c()...)
+	}
+	return families
+}
+
+// Write writes all registered metrics to w in the text exposition format.
+func Write(w io.Writer) {
+	for _, f := range Gather() {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.Name, f.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			fmt.Fprintf(w, "%s%s%s %g\n", f.Name, s.Suffix, formatLabels(s.Labels), s.Value)
+		}
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
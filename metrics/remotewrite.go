@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Most samples kept waiting for the endpoint; the oldest are dropped when
+// it is unreachable for long.
+const maxPendingSamples = 10000
+
+// RemoteWriteConfig configures sending samples to a Prometheus remote write
+// endpoint, such as Prometheus itself, Mimir, Thanos or VictoriaMetrics.
+type RemoteWriteConfig struct {
+	URL string
+	// Username and Password are sent with basic authentication if
+	// Username is set, else Password as a bearer token if it is set.
+	Username string
+	Password string
+	Interval time.Duration // How often samples are sent, 15s by default
+}
+
+// RemoteWriter sends samples to a remote write endpoint in batches. It
+// speaks version 1 of the protocol: a snappy compressed protobuf
+// WriteRequest, encoded here by hand as for the text format.
+type RemoteWriter struct {
+	config  RemoteWriteConfig
+	client  *http.Client
+	mu      sync.Mutex
+	pending []remoteSample
+}
+
+type remoteSample struct {
+	labels map[string]string // Including __name__
+	value  float64
+	time   time.Time
+}
+
+// NewRemoteWriter returns a writer sending what is added to it every
+// c.Interval until ctx is done.
+func NewRemoteWriter(ctx context.Context, c RemoteWriteConfig) *RemoteWriter {
+	if c.Interval == 0 {
+		c.Interval = 15 * time.Second
+	}
+	w := &RemoteWriter{config: c, client: &http.Client{Timeout: 30 * time.Second}}
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := w.Flush(ctx); err != nil {
+					fmt.Println("failed to remote write metrics:", err)
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// Add queues a sample of the metric name with the given labels.
+func (w *RemoteWriter) Add(name string, labels map[string]string, value float64, t time.Time) {
+	all := map[string]string{"__name__": name}
+	for k, v := range labels {
+		all[k] = v
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, remoteSample{labels: all, value: value, time: t})
+	if len(w.pending) > maxPendingSamples {
+		w.pending = w.pending[len(w.pending)-maxPendingSamples:]
+	}
+}
+
+// Flush sends the queued samples. They are queued again if the endpoint
+// fails with an error worth retrying.
+func (w *RemoteWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	retry, err := w.send(ctx, batch)
+	if err != nil && retry {
+		w.mu.Lock()
+		w.pending = append(batch, w.pending...)
+		if len(w.pending) > maxPendingSamples {
+			w.pending = w.pending[len(w.pending)-maxPendingSamples:]
+		}
+		w.mu.Unlock()
+	}
+	return err
+}
+
+// send posts a batch, reporting whether it is worth sending again if it
+// fails. Endpoints answer 4xx for samples they will never accept.
+func (w *RemoteWriter) send(ctx context.Context, batch []remoteSample) (bool, error) {
+	body := snappyBlock(encodeWriteRequest(batch))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case w.config.Username != "":
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	case w.config.Password != "":
+		req.Header.Set("Authorization", "Bearer "+w.config.Password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("remote write endpoint answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// encodeWriteRequest encodes samples as a prometheus.WriteRequest, one
+// time series per sample:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []remoteSample) []byte {
+	var req []byte
+	for _, s := range samples {
+		var series []byte
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		// Receivers require the labels of a series sorted by name.
+		sort.Strings(names)
+		for _, name := range names {
+			var label []byte
+			label = appendBytesField(label, 1, []byte(name))
+			label = appendBytesField(label, 2, []byte(s.labels[name]))
+			series = appendBytesField(series, 1, label)
+		}
+		var sample []byte
+		sample = appendUvarint(sample, 1<<3|1) // Field 1, 64-bit
+		sample = appendFixed64(sample, math.Float64bits(s.value))
+		sample = appendUvarint(sample, 2<<3|0) // Field 2, varint
+		sample = appendUvarint(sample, uint64(s.time.UnixMilli()))
+		series = appendBytesField(series, 2, sample)
+		req = appendBytesField(req, 1, series)
+	}
+	return req
+}
+
+// appendBytesField appends a length-delimited protobuf field.
+func appendBytesField(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendUvarint appends v as a protobuf varint.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendFixed64 appends v as a little endian 64-bit protobuf value.
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// snappyBlock frames data in the snappy block format as literals only. It
+// does not compress, but every snappy decoder reads it, and metric batches
+// are small.
+func snappyBlock(data []byte) []byte {
+	b := appendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		// The tag holds the length less one, in the tag itself below 60,
+		// or else in the 1 or 2 bytes after it.
+		switch l := n - 1; {
+		case l < 60:
+			b = append(b, byte(l)<<2)
+		case l < 1<<8:
+			b = append(b, 60<<2, byte(l))
+		default:
+			b = append(b, 61<<2, byte(l), byte(l>>8))
+		}
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is a monitoring system metrics are pushed to, for those that do not
+// scrape the Prometheus endpoint.
+type Sink interface {
+	Send(families []Family) error
+}
+
+// Push sends the registered metrics to sink every interval until ctx is
+// done.
+func Push(ctx context.Context, sink Sink, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sink.Send(Gather()); err != nil {
+				fmt.Println("failed to push metrics:", err)
+			}
+		}
+	}
+}
+
+// Largest UDP datagram sent, small enough not to be fragmented on most
+// networks.
+const maxDatagram = 1432
+
+// StatsD is a Sink sending metrics over UDP in the StatsD line protocol,
+// or with DogStatsD set in the Datadog dialect, which carries labels as
+// tags. Plain StatsD has no tags, so label values are appended to the
+// metric name instead.
+//
+// Counters are sent as the increase since the previous push, as StatsD
+// expects, and everything else as gauges.
+type StatsD struct {
+	Prefix    string // Prepended to metric names with a dot, if set
+	DogStatsD bool
+
+	conn     net.Conn
+	mu       sync.Mutex
+	counters map[string]float64 // Last value of each counter series
+}
+
+// NewStatsD returns a StatsD sink sending to addr, host:port.
+func NewStatsD(addr, prefix string, dogStatsD bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{Prefix: prefix, DogStatsD: dogStatsD, conn: conn, counters: map[string]float64{}}, nil
+}
+
+// Send implements Sink. Lines are packed into as few datagrams as fit.
+func (s *StatsD) Send(families []Family) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var packet []byte
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+	for _, f := range families {
+		for _, sample := range f.Samples {
+			line, ok := s.line(f, sample)
+			if !ok {
+				continue
+			}
+			if len(packet)+len(line)+1 > maxDatagram {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	return flush()
+}
+
+// line formats a sample, reporting false for the first value of a counter,
+// whose increase is not known yet.
+func (s *StatsD) line(f Family, sample Sample) (string, bool) {
+	names := make([]string, 0, len(sample.Labels))
+	for name := range sample.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	name := f.Name + sample.Suffix
+	if s.Prefix != "" {
+		name = s.Prefix + "." + name
+	}
+	var tags []string
+	for _, label := range names {
+		if s.DogStatsD {
+			tags = append(tags, statsdTag(label)+":"+statsdTag(sample.Labels[label]))
+		} else {
+			name += "." + statsdName(sample.Labels[label])
+		}
+	}
+	value, kind := sample.Value, "g"
+	if f.Type == Counter {
+		key := name + "|" + strings.Join(tags, ",")
+		last, seen := s.counters[key]
+		s.counters[key] = value
+		if !seen {
+			return "", false
+		}
+		value, kind = value-last, "c"
+		if value < 0 {
+			// The counter was reset.
+			value = sample.Value
+		}
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line, true
+}
+
+// statsdTag replaces the characters that separate the parts of a StatsD
+// line in a tag name or value.
+func statsdTag(s string) string {
+	return replaceAny(s, ":|@#, \n")
+}
+
+// statsdName is statsdTag for a part of a metric name, also replacing dots,
+// which would nest it in Graphite-style names.
+func statsdName(s string) string {
+	return replaceAny(s, ":|@#, \n.")
+}
+
+// replaceAny replaces the characters of s that are in chars by '_'.
+func replaceAny(s, chars string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(chars, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultSubjectTemplate and DefaultBodyTemplate render a Message as an
+// email when no templates are configured.
+const (
+	DefaultSubjectTemplate = `{{.Title}}`
+	DefaultBodyTemplate    = `{{.Text}}
+{{range $name, $value := .Fields}}
+{{$name}}: {{$value}}{{end}}
+{{if .Link}}
+{{.Link}}
+{{end}}`
+)
+
+// EmailConfig configures an Email notifier.
+type EmailConfig struct {
+	Server   string // SMTP server as host:port
+	From     string
+	To       []string
+	Username string // Authenticates with PLAIN if set
+	Password string
+	// Subject and body templates, executed with the Message. Empty
+	// templates use the defaults.
+	SubjectTemplate string
+	BodyTemplate    string
+	// Timeout bounds the whole SMTP exchange when ctx has no earlier
+	// deadline. Defaults to 30s.
+	Timeout time.Duration
+}
+
+const defaultEmailTimeout = 30 * time.Second
+
+// Email sends messages by SMTP, using STARTTLS when the server offers it.
+type Email struct {
+	config  EmailConfig
+	subject *template.Template
+	body    *template.Template
+}
+
+// NewEmail returns an email notifier, or an error if a template does not
+// parse.
+func NewEmail(c EmailConfig) (*Email, error) {
+	if c.Server == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("notify: email needs a server, a sender and recipients")
+	}
+	if c.SubjectTemplate == "" {
+		c.SubjectTemplate = DefaultSubjectTemplate
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultEmailTimeout
+	}
+	if c.BodyTemplate == "" {
+		c.BodyTemplate = DefaultBodyTemplate
+	}
+	subject, err := template.New("subject").Parse(c.SubjectTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("notify: bad subject template: %v", err)
+	}
+	body, err := template.New("body").Parse(c.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("notify: bad body template: %v", err)
+	}
+	return &Email{config: c, subject: subject, body: body}, nil
+}
+
+// Notify implements Notifier. The SMTP exchange is bounded by ctx's
+// deadline or the configured timeout, whichever comes first, and is
+// abandoned if ctx is cancelled.
+func (e *Email) Notify(ctx context.Context, m Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, m); err != nil {
+		return err
+	}
+	if err := e.body.Execute(&body, m); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+
+	return e.send(ctx, msg.Bytes())
+}
+
+// send does what smtp.SendMail does, but over a connection whose deadline
+// follows ctx so a stalled server cannot hold the caller forever.
+func (e *Email) send(ctx context.Context, msg []byte) error {
+	host, _, err := net.SplitHostPort(e.config.Server)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(e.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialer := net.Dialer{Timeout: time.Until(deadline)}
+	conn, err := dialer.DialContext(ctx, "tcp", e.config.Server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblocks whatever read or write is in progress.
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.config.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("notify: smtp server doesn't support AUTH")
+		}
+		auth := smtp.PlainAuth("", e.config.Username, e.config.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.config.From); err != nil {
+		return err
+	}
+	for _, to := range e.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,139 @@
+// Package notify delivers notifications about jobs and alerts to external
+// services such as generic webhooks, chat tools and email.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Message is a notification, rendered by each notifier in its own format.
+type Message struct {
+	Title  string
+	Text   string
+	Fields map[string]string // Short key/value details, may be nil
+	Link   string            // URL with more details, may be empty
+}
+
+// Notifier delivers messages to one destination.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook posts every message as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client // Defaults to a client with a 10s timeout
+}
+
+// Notify implements Notifier.
+func (w *Webhook) Notify(ctx context.Context, m Message) error {
+	return postJSON(ctx, w.Client, w.URL, struct {
+		Title  string            `json:"title"`
+		Text   string            `json:"text"`
+		Fields map[string]string `json:"fields,omitempty"`
+		Link   string            `json:"link,omitempty"`
+	}{m.Title, m.Text, m.Fields, m.Link})
+}
+
+// Slack posts messages to a Slack incoming webhook.
+type Slack struct {
+	WebhookURL string
+	Client     *http.Client // Defaults to a client with a 10s timeout
+}
+
+// Notify implements Notifier.
+func (s *Slack) Notify(ctx context.Context, m Message) error {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+	type attachment struct {
+		Fields []field `json:"fields"`
+	}
+	var payload struct {
+		Text        string       `json:"text"`
+		Attachments []attachment `json:"attachments,omitempty"`
+	}
+	payload.Text = "*" + m.Title + "*\n" + m.Text
+	if m.Link != "" {
+		payload.Text += "\n<" + m.Link + "|View result>"
+	}
+	if len(m.Fields) > 0 {
+		var a attachment
+		for _, k := range sortedKeys(m.Fields) {
+			a.Fields = append(a.Fields, field{Title: k, Value: m.Fields[k], Short: true})
+		}
+		payload.Attachments = []attachment{a}
+	}
+	return postJSON(ctx, s.Client, s.WebhookURL, payload)
+}
+
+// Discord posts messages to a Discord channel webhook.
+type Discord struct {
+	WebhookURL string
+	Client     *http.Client // Defaults to a client with a 10s timeout
+}
+
+// Notify implements Notifier.
+func (d *Discord) Notify(ctx context.Context, m Message) error {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	type embed struct {
+		Title       string  `json:"title"`
+		Description string  `json:"description,omitempty"`
+		URL         string  `json:"url,omitempty"`
+		Fields      []field `json:"fields,omitempty"`
+	}
+	e := embed{Title: m.Title, Description: m.Text, URL: m.Link}
+	for _, k := range sortedKeys(m.Fields) {
+		e.Fields = append(e.Fields, field{Name: k, Value: m.Fields[k], Inline: true})
+	}
+	return postJSON(ctx, d.Client, d.WebhookURL, struct {
+		Embeds []embed `json:"embeds"`
+	}{[]embed{e}})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notify: %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,267 @@
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a queue kept in the memory of the process. It shares the
+// workers between tenants by weighted fair queuing: each tenant's jobs are
+// queued separately, and a tenant with weight 2 gets twice as many jobs
+// dequeued as one with weight 1 while both have jobs waiting, however many
+// jobs each of them has queued. Jobs of the same tenant are dequeued by
+// priority, and those of the same priority in the order they were queued.
+//
+// With earliest deadline first scheduling enabled, jobs with a deadline
+// are dequeued before all others, the earliest deadline first, and the
+// rest share what is left fairly.
+type Memory struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	edf      bool
+	urgent   deadlineHeap // Jobs with a deadline, if edf is set
+	seq      int64        // Orders jobs with the same deadline
+	weights  map[string]float64
+	tenants  map[string]*tenantQueue // Tenants with jobs waiting
+	ready    int                     // Jobs waiting across all tenants
+	vtime    float64                 // Pass of the tenant dequeued last
+	inFlight map[*Delivery]inFlight
+	// wake is signalled when jobs become ready, waking one waiting Dequeue.
+	wake chan struct{}
+}
+
+// tenantQueue holds the jobs of one tenant. Its pass advances by the
+// inverse of the tenant's weight with every job dequeued, and the tenant
+// with the lowest pass goes next.
+type tenantQueue struct {
+	items []Item
+	pass  float64
+}
+
+// inFlight is a delivery that is neither acknowledged nor expired.
+type inFlight struct {
+	item     Item
+	deadline time.Time
+}
+
+// NewMemory returns an empty queue with the given visibility timeout, or
+// DefaultVisibilityTimeout if it is 0.
+func NewMemory(visibilityTimeout time.Duration) *Memory {
+	if visibilityTimeout == 0 {
+		visibilityTimeout = DefaultVisibilityTimeout
+	}
+	return &Memory{
+		timeout:  visibilityTimeout,
+		tenants:  map[string]*tenantQueue{},
+		inFlight: map[*Delivery]inFlight{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// SetWeights sets the share of the workers each tenant gets. Tenants not
+// listed, including jobs without a tenant, have weight 1.
+func (m *Memory) SetWeights(weights map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.weights = weights
+}
+
+// SetEarliestDeadlineFirst turns dequeuing jobs by deadline on or off.
+// It only affects jobs queued afterwards.
+func (m *Memory) SetEarliestDeadlineFirst(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.edf = on
+}
+
+// Enqueue adds a job to the queue. It never fails.
+func (m *Memory) Enqueue(ctx context.Context, item Item) error {
+	m.mu.Lock()
+	m.pushLocked(item)
+	m.mu.Unlock()
+	m.signal()
+	return nil
+}
+
+// Dequeue waits until a job is available or ctx is done.
+func (m *Memory) Dequeue(ctx context.Context) (*Delivery, error) {
+	for {
+		m.mu.Lock()
+		next := m.expireLocked()
+		if m.ready > 0 {
+			item := m.popLocked()
+			d := &Delivery{JobID: item.JobID}
+			d.ack = func() error { return m.settle(d, false) }
+			d.nack = func() error { return m.settle(d, true) }
+			m.inFlight[d] = inFlight{item: item, deadline: time.Now().Add(m.timeout)}
+			more := m.ready > 0
+			m.mu.Unlock()
+			if more {
+				m.signal()
+			}
+			return d, nil
+		}
+		m.mu.Unlock()
+
+		timer := time.NewTimer(next)
+		select {
+		case <-m.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// Len returns the number of jobs waiting to be dequeued.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	return m.ready
+}
+
+// Purge drops all jobs, including those in flight.
+func (m *Memory) Purge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tenants = map[string]*tenantQueue{}
+	m.urgent = nil
+	m.ready = 0
+	m.inFlight = map[*Delivery]inFlight{}
+}
+
+// pushLocked queues a job by its deadline, or else adds it to its
+// tenant's queue after the jobs of the same or higher priority. A tenant
+// that had no jobs waiting starts at the pass of the tenant dequeued last,
+// so it can neither claim the share it did not use while idle nor wait
+// behind tenants that are ahead.
+func (m *Memory) pushLocked(item Item) {
+	m.ready++
+	if m.edf && !item.Deadline.IsZero() {
+		m.seq++
+		heap.Push(&m.urgent, deadlineItem{item, m.seq})
+		return
+	}
+	t, ok := m.tenants[item.Tenant]
+	if !ok {
+		t = &tenantQueue{pass: m.vtime}
+		m.tenants[item.Tenant] = t
+	}
+	i := len(t.items)
+	for i > 0 && t.items[i-1].Priority < item.Priority {
+		i--
+	}
+	t.items = append(t.items, Item{})
+	copy(t.items[i+1:], t.items[i:])
+	t.items[i] = item
+}
+
+// popLocked removes the job with the earliest deadline, or else the next
+// job from the tenant with the lowest pass. There must be a job waiting.
+func (m *Memory) popLocked() Item {
+	m.ready--
+	if len(m.urgent) > 0 {
+		return heap.Pop(&m.urgent).(deadlineItem).Item
+	}
+	var names []string
+	for name := range m.tenants {
+		names = append(names, name)
+	}
+	// Break ties between tenants in a stable order.
+	sort.Strings(names)
+	var name string
+	var t *tenantQueue
+	for _, n := range names {
+		if c := m.tenants[n]; t == nil || c.pass < t.pass {
+			name, t = n, c
+		}
+	}
+	item := t.items[0]
+	t.items = t.items[1:]
+	m.vtime = t.pass
+	weight := m.weights[name]
+	if weight <= 0 {
+		weight = 1
+	}
+	t.pass += 1 / weight
+	if len(t.items) == 0 {
+		delete(m.tenants, name)
+	}
+	return item
+}
+
+// settle removes a delivery from the jobs in flight, putting its job back
+// on the queue if requeue is set.
+func (m *Memory) settle(d *Delivery, requeue bool) error {
+	m.mu.Lock()
+	f, ok := m.inFlight[d]
+	if !ok {
+		m.mu.Unlock()
+		return ErrExpired
+	}
+	delete(m.inFlight, d)
+	if requeue {
+		m.pushLocked(f.item)
+	}
+	m.mu.Unlock()
+	if requeue {
+		m.signal()
+	}
+	return nil
+}
+
+// expireLocked requeues the deliveries whose visibility timeout has passed
+// and returns how long until the next one does.
+func (m *Memory) expireLocked() time.Duration {
+	now := time.Now()
+	next := m.timeout
+	for d, f := range m.inFlight {
+		if !now.Before(f.deadline) {
+			delete(m.inFlight, d)
+			m.pushLocked(f.item)
+		} else if f.deadline.Sub(now) < next {
+			next = f.deadline.Sub(now)
+		}
+	}
+	return next
+}
+
+func (m *Memory) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deadlineItem is a job queued by deadline. seq keeps jobs with the same
+// deadline in the order they were queued.
+type deadlineItem struct {
+	Item
+	seq int64
+}
+
+// deadlineHeap is a heap.Interface of jobs ordered by deadline.
+type deadlineHeap []deadlineItem
+
+func (h deadlineHeap) Len() int { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool {
+	if !h[i].Deadline.Equal(h[j].Deadline) {
+		return h[i].Deadline.Before(h[j].Deadline)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h deadlineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x interface{}) { *h = append(*h, x.(deadlineItem)) }
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
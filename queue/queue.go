@@ -0,0 +1,72 @@
+// Package queue holds the IDs of jobs waiting for a worker. Besides the
+// in-memory queue used by default, jobs can be queued in Amazon SQS or
+// RabbitMQ for users who already run those brokers.
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// DefaultVisibilityTimeout is how long a dequeued job stays hidden from
+// other workers before it is handed out again, unless it is acknowledged.
+const DefaultVisibilityTimeout = 5 * time.Minute
+
+// Item is a job to be queued.
+type Item struct {
+	JobID int64
+	// Tenant the job belongs to. The memory queue shares workers fairly
+	// between tenants; the brokers ignore it.
+	Tenant string
+	// Deadline, if set, is when the job should have run by. The memory
+	// queue can dequeue jobs by deadline; the brokers ignore it.
+	Deadline time.Time
+	// Priority orders the jobs of a tenant in the memory queue, higher
+	// first; the brokers ignore it.
+	Priority int
+}
+
+// Queue is a queue of job IDs. A dequeued job is not removed right away:
+// the worker acknowledges it with Ack once it is dealt with, or gives it
+// back with Nack. A job that is neither acknowledged nor given back within
+// the queue's visibility timeout is handed out again.
+type Queue interface {
+	// Enqueue adds a job to the queue.
+	Enqueue(ctx context.Context, item Item) error
+	// Dequeue waits until a job is available or ctx is done.
+	Dequeue(ctx context.Context) (*Delivery, error)
+	// Len returns the approximate number of jobs waiting to be dequeued.
+	Len() int
+}
+
+// Delivery is a job handed to a worker by Dequeue.
+type Delivery struct {
+	JobID int64
+	ack   func() error
+	nack  func() error
+}
+
+// Ack removes the job from the queue for good.
+func (d *Delivery) Ack() error {
+	return d.ack()
+}
+
+// Nack puts the job back on the queue to be handed out again.
+func (d *Delivery) Nack() error {
+	return d.nack()
+}
+
+// ErrExpired is returned when acknowledging a delivery whose visibility
+// timeout has passed. The job has been, or will be, handed out again.
+var ErrExpired = errors.New("queue: delivery expired")
+
+// formatID and parseID convert job IDs to and from message bodies.
+func formatID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func parseID(body string) (int64, error) {
+	return strconv.ParseInt(body, 10, 64)
+}
@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dsoo/urlfetcher/sigv4"
+)
+
+// SQSConfig configures a queue in Amazon SQS.
+type SQSConfig struct {
+	QueueURL string // e.g. https://sqs.eu-west-1.amazonaws.com/123456789012/urlfetcher
+	Region   string // Taken from QueueURL if empty
+
+	// Access keys, taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables if empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// VisibilityTimeout overrides the queue's own setting if not 0.
+	VisibilityTimeout time.Duration
+}
+
+// sqsWaitSeconds is how long a receive call waits for a message. 20
+// seconds is the longest SQS allows.
+const sqsWaitSeconds = 20
+
+// SQS is a queue in Amazon SQS, or a service implementing its JSON
+// protocol such as ElasticMQ or LocalStack.
+type SQS struct {
+	c        SQSConfig
+	endpoint string
+	client   *http.Client
+}
+
+// NewSQS returns the SQS queue at c.QueueURL. The queue must exist.
+func NewSQS(c SQSConfig) (*SQS, error) {
+	u, err := url.Parse(c.QueueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL %q", c.QueueURL)
+	}
+	if c.Region == "" {
+		c.Region = regionOf(u.Hostname())
+	}
+	if c.AccessKeyID == "" {
+		keys := sigv4.KeysFromEnv()
+		c.AccessKeyID, c.SecretAccessKey, c.SessionToken = keys.AccessKeyID, keys.SecretAccessKey, keys.SessionToken
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no AWS access key for SQS queue %s", c.QueueURL)
+	}
+	return &SQS{
+		c:        c,
+		endpoint: u.Scheme + "://" + u.Host + "/",
+		client:   &http.Client{Timeout: (sqsWaitSeconds + 10) * time.Second},
+	}, nil
+}
+
+// regionOf returns the region of an SQS host name such as
+// sqs.eu-west-1.amazonaws.com, or us-east-1 if it names none.
+func regionOf(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 4 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	if len(parts) >= 4 && parts[1] == "queue" {
+		return parts[0]
+	}
+	return "us-east-1"
+}
+
+// Enqueue sends a message holding the job ID.
+func (q *SQS) Enqueue(ctx context.Context, item Item) error {
+	return q.call(ctx, "SendMessage", map[string]interface{}{
+		"QueueUrl":    q.c.QueueURL,
+		"MessageBody": formatID(item.JobID),
+	}, nil)
+}
+
+// Dequeue waits until a message is received or ctx is done.
+func (q *SQS) Dequeue(ctx context.Context) (*Delivery, error) {
+	in := map[string]interface{}{
+		"QueueUrl":            q.c.QueueURL,
+		"MaxNumberOfMessages": 1,
+		"WaitTimeSeconds":     sqsWaitSeconds,
+	}
+	if q.c.VisibilityTimeout > 0 {
+		in["VisibilityTimeout"] = int(q.c.VisibilityTimeout / time.Second)
+	}
+	for {
+		var out struct {
+			Messages []struct {
+				Body          string
+				ReceiptHandle string
+			}
+		}
+		if err := q.call(ctx, "ReceiveMessage", in, &out); err != nil {
+			return nil, err
+		}
+		for _, m := range out.Messages {
+			receipt := m.ReceiptHandle
+			id, err := parseID(m.Body)
+			if err != nil {
+				// Not ours, drop it rather than receiving it forever.
+				q.delete(receipt)
+				return nil, fmt.Errorf("dropped SQS message with invalid body %q", m.Body)
+			}
+			return &Delivery{
+				JobID: id,
+				ack:   func() error { return q.delete(receipt) },
+				nack: func() error {
+					return q.call(context.Background(), "ChangeMessageVisibility", map[string]interface{}{
+						"QueueUrl":          q.c.QueueURL,
+						"ReceiptHandle":     receipt,
+						"VisibilityTimeout": 0,
+					}, nil)
+				},
+			}, nil
+		}
+	}
+}
+
+// Len returns the approximate number of visible messages, or 0 if SQS
+// cannot be asked.
+func (q *SQS) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var out struct {
+		Attributes map[string]string
+	}
+	err := q.call(ctx, "GetQueueAttributes", map[string]interface{}{
+		"QueueUrl":       q.c.QueueURL,
+		"AttributeNames": []string{"ApproximateNumberOfMessages"},
+	}, &out)
+	if err != nil {
+		fmt.Println("failed to get SQS queue length:", err)
+		return 0
+	}
+	n, _ := strconv.Atoi(out.Attributes["ApproximateNumberOfMessages"])
+	return n
+}
+
+func (q *SQS) delete(receipt string) error {
+	return q.call(context.Background(), "DeleteMessage", map[string]interface{}{
+		"QueueUrl":      q.c.QueueURL,
+		"ReceiptHandle": receipt,
+	}, nil)
+}
+
+// call invokes an SQS action using the AWS JSON protocol.
+func (q *SQS) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", q.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	keys := sigv4.Keys{AccessKeyID: q.c.AccessKeyID, SecretAccessKey: q.c.SecretAccessKey, SessionToken: q.c.SessionToken}
+	sigv4.Sign(req, body, keys, q.c.Region, "sqs", time.Now())
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("SQS %s failed with status %d: %s %s", action, resp.StatusCode, e.Type, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
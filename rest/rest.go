@@ -0,0 +1,974 @@
+// Package rest serves a JSON REST API over the urlfetcher job queue, next
+// to the GraphQL endpoint. The routes are declared in a table, from which
+// the OpenAPI document is generated as well.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/dsoo/urlfetcher/diff"
+	"github.com/dsoo/urlfetcher/urldata"
+)
+
+// Param describes a path or query parameter of a route.
+type Param struct {
+	Name        string
+	In          string // path, query or header
+	Description string
+	Required    bool
+}
+
+// Route is an API operation. Request and Response are zero values of the
+// types read from and written as the JSON body, or nil if there is none.
+type Route struct {
+	Method      string
+	Path        string // Path below the API prefix, with {name} parameters
+	ID          string // OpenAPI operation ID
+	Summary     string
+	Params      []Param
+	Request     interface{}
+	Response    interface{}
+	ContentType string // Response media type if not JSON
+	Handler     func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+// versionDescription documents the version parameter of routes changing a
+// job. A stale version gets a 409 Conflict.
+const versionDescription = "Version of the job the change is based on; 409 Conflict if the job has changed since"
+
+// Prefix is the path the API is served below.
+const Prefix = "/api"
+
+// Routes is the API, in the order it is documented.
+var Routes = []Route{
+	{
+		Method: "GET", Path: "/jobs", ID: "listJobs",
+		Summary: "List all jobs on the server",
+		Params: []Param{
+			{Name: "status", In: "query", Description: "Only jobs with this status"},
+			{Name: "metadata", In: "query", Description: "Only jobs with this metadata, as key=value or just key for any value; may be repeated"},
+			{Name: "finding", In: "query", Description: "Only jobs whose response has this finding, as name=value or just name for any value; may be repeated"},
+		},
+		Response: []Job{},
+		Handler:  listJobs,
+	},
+	{
+		Method: "POST", Path: "/jobs", ID: "addJob",
+		Summary:  "Add a job to fetch a URL",
+		Request:  NewJob{},
+		Response: Job{},
+		Handler:  addJob,
+	},
+	{
+		Method: "GET", Path: "/jobs/{id}", ID: "getJob",
+		Summary:  "Get a job",
+		Params:   []Param{{Name: "id", In: "path", Required: true}},
+		Response: Job{},
+		Handler:  getJob,
+	},
+	{
+		Method: "DELETE", Path: "/jobs/{id}", ID: "deleteJob",
+		Summary:  "Move a job to the trash",
+		Params:   []Param{{Name: "id", In: "path", Required: true}},
+		Response: Job{},
+		Handler:  deleteJob,
+	},
+	{
+		Method: "POST", Path: "/jobs/{id}/restore", ID: "restoreJob",
+		Summary: "Take a deleted job out of the trash",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "version", In: "query", Required: true, Description: versionDescription},
+		},
+		Response: Job{},
+		Handler:  restoreJob,
+	},
+	{
+		Method: "PATCH", Path: "/jobs/{id}/metadata", ID: "annotateJob",
+		Summary: "Set metadata on a job; keys with an empty value are removed",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "version", In: "query", Required: true, Description: versionDescription},
+		},
+		Request:  map[string]string{},
+		Response: Job{},
+		Handler:  annotateJob,
+	},
+	{
+		Method: "GET", Path: "/jobs/{id}/body", ID: "getJobBody",
+		Summary: "Download the body of a job's response",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "Range", In: "header", Description: "Bytes of the body to download, such as bytes=1024- to resume a download"},
+			{Name: "expires", In: "query", Description: "Expiry time of a signed URL, as returned by getJobBodyLink"},
+			{Name: "signature", In: "query", Description: "Signature of a signed URL, which needs no credentials"},
+		},
+		ContentType: "application/octet-stream",
+		Handler:     getJobBody,
+	},
+	{
+		Method: "GET", Path: "/jobs/{id}/body/link", ID: "getJobBodyLink",
+		Summary: "Get a signed URL from which the body of a job's response can be downloaded without credentials until it expires",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "ttl", In: "query", Description: "Seconds the URL stays valid, 3600 by default"},
+		},
+		Response: BodyLink{},
+		Handler:  getJobBodyLink,
+	},
+	{
+		Method: "GET", Path: "/jobs/{id}/har", ID: "getJobHAR",
+		Summary:     "Download a job's requests and responses as an HTTP Archive (HAR) file",
+		Params:      []Param{{Name: "id", In: "path", Required: true}},
+		ContentType: "application/json",
+		Handler:     getJobHAR,
+	},
+	{
+		Method: "GET", Path: "/jobs/{id}/diff", ID: "getJobDiff",
+		Summary: "Compare the body of a job's response with that of another job",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "from", In: "query", Required: true, Description: "ID of the job to compare with"},
+		},
+		ContentType: "text/plain",
+		Handler:     getJobDiff,
+	},
+	{
+		Method: "GET", Path: "/batches/{id}/links", ID: "getLinkGraph",
+		Summary: "Export the links between the pages fetched by a batch, such as a crawl",
+		Params: []Param{
+			{Name: "id", In: "path", Required: true},
+			{Name: "format", In: "query", Description: "dot (the default) or graphml"},
+		},
+		ContentType: "text/vnd.graphviz",
+		Handler:     getLinkGraph,
+	},
+	{
+		Method: "GET", Path: "/responses", ID: "getResponse",
+		Summary: "Get the cached response for a URL",
+		Params: []Param{
+			{Name: "url", In: "query", Required: true},
+			{Name: "followAliases", In: "query", Description: "true to fall back to the response of the URL's canonical URL or another alias"},
+		},
+		Response: Response{},
+		Handler:  getResponse,
+	},
+	{
+		Method: "GET", Path: "/thumbnails/{name}", ID: "getThumbnail",
+		Summary:     "Download a thumbnail, as linked from a response",
+		Params:      []Param{{Name: "name", In: "path", Required: true}},
+		ContentType: "image/jpeg",
+		Handler:     getThumbnail,
+	},
+	{
+		Method: "GET", Path: "/stats", ID: "getStats",
+		Summary:  "Get queue and per-host statistics",
+		Response: Stats{},
+		Handler:  getStats,
+	},
+}
+
+// Job is the API representation of a job.
+type Job struct {
+	ID           int64              `json:"id"`
+	URL          string             `json:"url"`
+	Status       string             `json:"status"`
+	Tenant       string             `json:"tenant,omitempty"`
+	Owner        string             `json:"owner,omitempty"`
+	Tags         []string           `json:"tags,omitempty"`
+	Metadata     map[string]string  `json:"metadata,omitempty"`
+	BatchID      int64              `json:"batchId,omitempty"`
+	MonitorID    int64              `json:"monitorId,omitempty"`
+	Instance     string             `json:"instance,omitempty"` // Cluster instance the job was forwarded to
+	WorkerID     int                `json:"workerId,omitempty"`
+	QueueWaitMs  float64            `json:"queueWaitMs"`  // Time last spent in the queue waiting for a worker
+	LookupWaitMs float64            `json:"lookupWaitMs"` // Time the last fetch waited for DNS lookups to start
+	Attempts     int                `json:"attempts"`
+	Error        *urldata.JobError  `json:"error,omitempty"`
+	Response     *Response          `json:"response,omitempty"`
+	DebugInfo    *urldata.DebugInfo `json:"debugInfo,omitempty"` // Set for jobs added with debug
+	Events       []urldata.Event    `json:"events,omitempty"`
+	DeletedAt    *time.Time         `json:"deletedAt,omitempty"` // When the job was moved to the trash
+	Version      int64              `json:"version"`             // Changes to the job, to pass when changing it
+}
+
+// Response is the API representation of a fetched response. The body is
+// downloaded separately.
+type Response struct {
+	URL            string                   `json:"url"`
+	StatusCode     int                      `json:"statusCode"`
+	Size           int                      `json:"size"`
+	SHA256         string                   `json:"sha256"`
+	BLAKE3         string                   `json:"blake3,omitempty"`
+	Timestamp      time.Time                `json:"timestamp"`
+	Resolver       string                   `json:"resolver,omitempty"`       // DoH endpoint or "system" that looked up the host
+	Findings       []urldata.Finding        `json:"findings,omitempty"`       // What the processors found, such as email addresses
+	Language       *urldata.Language        `json:"language,omitempty"`       // Natural language of an HTML or text body
+	Canonical      string                   `json:"canonical,omitempty"`      // URL declared canonical or redirected to
+	StructuredData []urldata.StructuredItem `json:"structuredData,omitempty"` // schema.org JSON-LD and microdata items
+	ThumbnailURL   string                   `json:"thumbnailURL,omitempty"`   // Thumbnail of an image, if enabled
+	SnapshotURL    string                   `json:"snapshotURL,omitempty"`    // Capture of the page by a web archive
+	DroppedHeaders []string                 `json:"droppedHeaders,omitempty"` // Headers with values dropped as malformed
+}
+
+// Stats is the API representation of the server statistics.
+type Stats struct {
+	QueueDepth   int         `json:"queueDepth"`
+	Paused       bool        `json:"paused"`
+	PausedHosts  []string    `json:"pausedHosts"`
+	DrainedHosts []string    `json:"drainedHosts"`
+	ParkedJobs   int         `json:"parkedJobs"`
+	Hosts        []HostStats `json:"hosts"`
+	QueueWaits   []QueueWait `json:"queueWaits"`
+	Connections  Connections `json:"connections"`
+	Shedding     string      `json:"shedding,omitempty"` // Why new jobs are refused, if they are
+	ShedJobs     int64       `json:"shedJobs"`
+	Pools        []Pool      `json:"pools"`
+}
+
+// Connections is the API representation of the outbound connections and
+// file descriptors open. Max is 0 if there is no limit, and the file
+// descriptor counts are -1 if unknown.
+type Connections struct {
+	Open                int   `json:"open"`
+	Max                 int   `json:"max"`
+	Waits               int64 `json:"waits"`
+	OpenFileDescriptors int   `json:"openFileDescriptors"`
+	MaxFileDescriptors  int   `json:"maxFileDescriptors"`
+}
+
+// Pool is the API representation of a worker pool. MaxRequestsPerSecond
+// is 0 if there is no limit.
+type Pool struct {
+	Name                 string  `json:"name"`
+	Workers              int     `json:"workers"`
+	Busy                 int     `json:"busy"`
+	QueueDepth           int     `json:"queueDepth"`
+	MaxRequestsPerSecond float64 `json:"maxRequestsPerSecond"`
+}
+
+// QueueWait is the API representation of how long the jobs of a tenant
+// waited in the queue.
+type QueueWait struct {
+	Tenant          string  `json:"tenant"`
+	Jobs            int64   `json:"jobs"`
+	P50Ms           float64 `json:"p50Ms"`
+	P90Ms           float64 `json:"p90Ms"`
+	P99Ms           float64 `json:"p99Ms"`
+	MaxMs           float64 `json:"maxMs"`
+	OldestWaitingMs float64 `json:"oldestWaitingMs"`
+}
+
+// HostStats is the API representation of the statistics of a host.
+type HostStats struct {
+	Host              string     `json:"host"`
+	Requests          int64      `json:"requests"`
+	ReusedConnections int64      `json:"reusedConnections"`
+	NewConnections    int64      `json:"newConnections"`
+	AvgDNSMs          float64    `json:"avgDnsMs"`
+	AvgConnectMs      float64    `json:"avgConnectMs"`
+	AvgTLSHandshakeMs float64    `json:"avgTlsHandshakeMs"`
+	Circuit           string     `json:"circuit"`
+	Failures          int        `json:"failures"`
+	PolitenessDelayMs float64    `json:"politenessDelayMs"`
+	BackoffUntil      *time.Time `json:"backoffUntil,omitempty"`
+}
+
+// NewJob is the request body for adding a job.
+type NewJob struct {
+	URL            string   `json:"url"`
+	Preset         string   `json:"preset,omitempty"` // Preset the other fields override
+	Type           string   `json:"type,omitempty"`   // "certificate" to only check the host's TLS certificates
+	Tags           []string `json:"tags,omitempty"`
+	Notify         string   `json:"notify,omitempty"`
+	MaxBytes       int64    `json:"maxBytes,omitempty"`
+	MaxDuration    string   `json:"maxDuration,omitempty"` // Go duration such as "30s"
+	Deadline       string   `json:"deadline,omitempty"`    // RFC 3339 time the job should have run by
+	NotBefore      string   `json:"notBefore,omitempty"`   // RFC 3339 time before which the job must not run
+	ClientCert     string   `json:"clientCert,omitempty"`
+	HostHeader     string   `json:"hostHeader,omitempty"`
+	ServerName     string   `json:"serverName,omitempty"`
+	ConnectAddress string   `json:"connectAddress,omitempty"`
+	Tunnel         string   `json:"tunnel,omitempty"`
+	Egress         string   `json:"egress,omitempty"`
+	Pool           string   `json:"pool,omitempty"`  // Worker pool to run the job
+	Debug          bool     `json:"debug,omitempty"` // Capture the requests and a transport log in debugInfo
+	// Metadata holds the client's own key/values for the job.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Error is the body written for failed requests.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// BodyLink is a signed URL downloading the body of a job's response.
+type BodyLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+var errNotFound = errors.New("not found")
+
+// Handler returns a handler serving the API. It expects to be mounted at
+// Prefix, without stripping it.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, Prefix)
+		allowed := false
+		for _, route := range Routes {
+			params, ok := match(route.Path, path)
+			if !ok {
+				continue
+			}
+			if route.Method != r.Method {
+				allowed = true
+				continue
+			}
+			if route.Method != "GET" && urldata.ReadOnly() {
+				writeError(w, http.StatusForbidden, urldata.ErrReadOnly)
+				return
+			}
+			role := auth.RoleViewer
+			if route.Method != "GET" {
+				role = auth.RoleSubmitter
+			}
+			if !auth.FromContext(r.Context()).Allows(role) {
+				writeError(w, http.StatusForbidden, &auth.ForbiddenError{Role: role})
+				return
+			}
+			route.Handler(w, r, params)
+			return
+		}
+		if allowed {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		writeError(w, http.StatusNotFound, errNotFound)
+	})
+}
+
+// SignedDownloads serves the body downloads whose URL carries a signature,
+// as returned by getJobBodyLink, without calling next, which authenticates
+// the other requests. Unsigned requests go to next.
+func SignedDownloads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params, ok := match("/jobs/{id}/body", strings.TrimPrefix(r.URL.Path, Prefix))
+		q := r.URL.Query()
+		if !ok || r.Method != "GET" || q.Get("signature") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(params["id"], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id %q", params["id"]))
+			return
+		}
+		if err := urldata.VerifyBodyDownload(id, q.Get("expires"), q.Get("signature")); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		job := urldata.GetJob(id)
+		if job == nil {
+			writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		serveBody(w, r, job)
+	})
+}
+
+// match matches a path against a route pattern and returns the values of
+// its parameters.
+func match(pattern, path string) (map[string]string, bool) {
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range want {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params[segment[1:len(segment)-1]] = got[i]
+		} else if segment != got[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+func jobView(job *urldata.Job) Job {
+	state := urldata.GetJobState(job)
+	j := Job{
+		ID:           job.ID,
+		URL:          job.URL,
+		Status:       state.Status,
+		Tenant:       job.Tenant,
+		Owner:        job.Owner,
+		Tags:         job.Options.Tags,
+		Metadata:     job.Options.Metadata,
+		BatchID:      job.Options.Batch,
+		MonitorID:    job.Options.Monitor,
+		Instance:     job.Instance,
+		WorkerID:     state.WorkerID,
+		QueueWaitMs:  millis(state.QueueWait, 1),
+		LookupWaitMs: millis(state.LookupWait, 1),
+		Attempts:     state.Attempts,
+		Error:        state.Error,
+		DebugInfo:    state.Debug,
+		Events:       urldata.GetJobEvents(job),
+		Version:      atomic.LoadInt64(&job.Version),
+	}
+	if !job.DeletedAt.IsZero() {
+		j.DeletedAt = &job.DeletedAt
+	}
+	if state.Response != nil {
+		r := responseView(state.Response)
+		j.Response = &r
+	}
+	return j
+}
+
+func responseView(r *urldata.Response) Response {
+	return Response{
+		URL:            r.URL,
+		StatusCode:     r.StatusCode,
+		Size:           len(r.Body),
+		SHA256:         r.Checksums.SHA256,
+		BLAKE3:         r.Checksums.BLAKE3,
+		Timestamp:      r.Timestamp,
+		Resolver:       r.Resolver,
+		Findings:       r.Findings,
+		Language:       r.Language,
+		Canonical:      r.Canonical,
+		StructuredData: r.StructuredData,
+		ThumbnailURL:   urldata.ThumbnailURL(r),
+		SnapshotURL:    r.Snapshot,
+		DroppedHeaders: r.DroppedHeaders,
+	}
+}
+
+// jobParam returns the job named by the id parameter, reporting
+// errNotFound for jobs the caller may not see.
+func jobParam(ctx context.Context, params map[string]string) (*urldata.Job, error) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job id %q", params["id"])
+	}
+	job := urldata.GetJob(id)
+	if job == nil || !urldata.CanView(ctx, job) {
+		return nil, errNotFound
+	}
+	return job, nil
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	status := r.URL.Query().Get("status")
+	filter := keyValues(r.URL.Query()["metadata"])
+	findings := keyValues(r.URL.Query()["finding"])
+	jobs := []Job{}
+	for _, job := range urldata.GetJobs() {
+		if urldata.CanView(r.Context(), job) && (status == "" || urldata.GetJobState(job).Status == status) && urldata.MatchesMetadata(job, filter) && urldata.MatchesFindings(job, findings) {
+			jobs = append(jobs, jobView(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// keyValues parses query parameters of the form key=value, or just key for
+// an empty value.
+func keyValues(params []string) map[string]string {
+	m := map[string]string{}
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		m[kv[0]] = ""
+		if len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m
+}
+
+func addJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var req NewJob
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if req.URL == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+	opts := urldata.JobOptions{
+		Type:           req.Type,
+		ClientCert:     req.ClientCert,
+		HostHeader:     req.HostHeader,
+		ServerName:     req.ServerName,
+		ConnectAddress: req.ConnectAddress,
+		Tunnel:         req.Tunnel,
+		Egress:         req.Egress,
+		Pool:           req.Pool,
+		Debug:          req.Debug,
+		MaxBytes:       req.MaxBytes,
+		Notify:         req.Notify,
+		Tags:           req.Tags,
+		Metadata:       req.Metadata,
+	}
+	if req.MaxDuration != "" {
+		var err error
+		if opts.MaxDuration, err = time.ParseDuration(req.MaxDuration); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid maxDuration: %v", err))
+			return
+		}
+	}
+	if req.NotBefore != "" {
+		var err error
+		if opts.NotBefore, err = time.Parse(time.RFC3339, req.NotBefore); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid notBefore: %v", err))
+			return
+		}
+	}
+	if req.Deadline != "" {
+		var err error
+		if opts.Deadline, err = time.Parse(time.RFC3339, req.Deadline); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid deadline: %v", err))
+			return
+		}
+	}
+	if req.Preset != "" {
+		var err error
+		if opts, err = urldata.WithPreset(req.Preset, opts); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if opts.Type != urldata.JobFetch && opts.Type != urldata.JobCertificate {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown job type %q", opts.Type))
+		return
+	}
+	if opts.Notify != "" && !urldata.HasNotifier(opts.Notify) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown notifier %q", opts.Notify))
+		return
+	}
+	if opts.Pool != "" && !urldata.HasPool(opts.Pool) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown worker pool %q", opts.Pool))
+		return
+	}
+	if err := urldata.CheckJobCredentials(r.Context(), req.ClientCert, req.Tunnel); errors.Is(err, urldata.ErrCredentialDenied) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if id := auth.FromContext(r.Context()); id != nil {
+		opts.Tenant = id.Tenant
+		opts.Owner = id.Owner
+	}
+	job, err := urldata.SubmitJob(r.Context(), req.URL, opts)
+	if errors.Is(err, urldata.ErrTargetPolicy) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	var overloaded *urldata.OverloadedError
+	if errors.As(err, &overloaded) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(overloaded.RetryAfter/time.Second)))
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/jobs/%d", job.Instance, Prefix, job.ID))
+	writeJSON(w, http.StatusCreated, jobView(job))
+}
+
+func deleteJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !urldata.CanChange(r.Context(), job) {
+		writeError(w, http.StatusForbidden, &auth.ForbiddenError{Role: auth.RoleAdmin})
+		return
+	}
+	deleted := urldata.DeleteJobs([]int64{job.ID})
+	if len(deleted) == 0 {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobView(deleted[0]))
+}
+
+func restoreJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id %q", params["id"]))
+		return
+	}
+	version, err := versionParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if job := urldata.GetDeletedJob(id); job != nil {
+		if !urldata.CanView(r.Context(), job) {
+			writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		if !urldata.CanChange(r.Context(), job) {
+			writeError(w, http.StatusForbidden, &auth.ForbiddenError{Role: auth.RoleAdmin})
+			return
+		}
+	}
+	job, err := urldata.RestoreJob(id, version)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobView(job))
+}
+
+func annotateJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !urldata.CanChange(r.Context(), job) {
+		writeError(w, http.StatusForbidden, &auth.ForbiddenError{Role: auth.RoleAdmin})
+		return
+	}
+	version, err := versionParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var metadata map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if job, err = urldata.Annotate(job.ID, version, metadata); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobView(job))
+}
+
+// versionParam returns the job version a change is based on.
+func versionParam(r *http.Request) (int64, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, errors.New("version is required")
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", v)
+	}
+	return version, nil
+}
+
+func getJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobView(job))
+}
+
+func getJobBody(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	serveBody(w, r, job)
+}
+
+// serveBody writes the body of job's response.
+func serveBody(w http.ResponseWriter, r *http.Request, job *urldata.Job) {
+	resp := urldata.GetJobState(job).Response
+	if resp == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no response"))
+		return
+	}
+	// The checksum identifies the body, so clients polling with
+	// If-None-Match get a 304 while it is unchanged. ServeContent also
+	// handles If-Modified-Since and range requests.
+	w.Header().Set("ETag", `"`+resp.Checksums.SHA256+`"`)
+	http.ServeContent(w, r, "", resp.Timestamp, bytes.NewReader(resp.Body))
+}
+
+func getJobBodyLink(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var ttl int64
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		if ttl, err = strconv.ParseInt(s, 10, 64); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", s))
+			return
+		}
+	}
+	if urldata.GetJobState(job).Response == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no response"))
+		return
+	}
+	u, expires, err := urldata.SignedBodyURL(job, time.Duration(ttl)*time.Second)
+	if err == urldata.ErrDownloadsDisabled {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, BodyLink{URL: u, Expires: expires})
+}
+
+// getJobHAR writes the job as a HAR file, named so that browsers save it
+// as one.
+func getJobHAR(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	har, err := urldata.HAR(job)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if har == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job-%d.har"`, job.ID))
+	w.Write(har)
+}
+
+// getJobDiff writes the differences between the bodies of two jobs' responses
+// as a unified diff, empty if they are equal.
+func getJobDiff(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	job, err := jobParam(r.Context(), params)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	from, err := jobParam(r.Context(), map[string]string{"id": r.URL.Query().Get("from")})
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a, b := urldata.GetJobState(from).Response, urldata.GetJobState(job).Response
+	if a == nil || b == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no response"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, diff.Unified(
+		fmt.Sprintf("job %d", from.ID), fmt.Sprintf("job %d", job.ID),
+		string(a.Body), string(b.Body)))
+}
+
+func getLinkGraph(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid batch id %q", params["id"]))
+		return
+	}
+	var g *urldata.LinkGraph
+	if urldata.CanViewBatch(r.Context(), id) {
+		g = urldata.GetLinkGraph(id)
+	}
+	if g == nil {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		fmt.Fprint(w, g.DOT())
+	case "graphml":
+		w.Header().Set("Content-Type", "application/graphml+xml; charset=utf-8")
+		fmt.Fprint(w, g.GraphML())
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+	}
+}
+
+func getResponse(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+	var response *urldata.Response
+	if r.URL.Query().Get("followAliases") == "true" {
+		response = urldata.GetResponseViaAliases(url)
+	} else {
+		response = urldata.GetResponse(url)
+	}
+	if response != nil && !(urldata.CanViewURL(r.Context(), url) && urldata.CanViewURL(r.Context(), response.URL)) {
+		response = nil
+	}
+	if response == nil {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, responseView(response))
+}
+
+// getThumbnail writes a thumbnail from the blob store. Thumbnails are
+// named after the body they were made of, so they never change.
+func getThumbnail(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	data, err := urldata.GetBlob("thumbnails/" + params["name"])
+	if err == urldata.ErrBlobNotFound {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, params["name"], time.Time{}, bytes.NewReader(data))
+}
+
+func getStats(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	s := urldata.StatsFor(r.Context())
+	stats := Stats{
+		QueueDepth:   s.QueueDepth,
+		Paused:       s.Paused,
+		PausedHosts:  s.PausedHosts,
+		DrainedHosts: s.DrainedHosts,
+		ParkedJobs:   s.ParkedJobs,
+		Hosts:        []HostStats{},
+		QueueWaits:   []QueueWait{},
+		Pools:        []Pool{},
+		Shedding:     s.Shedding,
+		ShedJobs:     s.ShedJobs,
+		Connections: Connections{
+			Open:                s.Connections.Open,
+			Max:                 s.Connections.Max,
+			Waits:               s.Connections.Waits,
+			OpenFileDescriptors: s.Connections.OpenFDs,
+			MaxFileDescriptors:  s.Connections.MaxFDs,
+		},
+	}
+	for _, h := range s.Hosts {
+		hs := HostStats{
+			Host:              h.Host,
+			Requests:          h.Requests,
+			ReusedConnections: h.ReusedConnections,
+			NewConnections:    h.NewConnections,
+			AvgDNSMs:          millis(h.DNSTime, h.DNSLookups),
+			AvgConnectMs:      millis(h.ConnectTime, h.Connects),
+			AvgTLSHandshakeMs: millis(h.TLSHandshakeTime, h.TLSHandshakes),
+			Circuit:           h.Circuit,
+			Failures:          h.Failures,
+			PolitenessDelayMs: millis(h.PolitenessDelay, 1),
+		}
+		if !h.BackoffUntil.IsZero() {
+			until := h.BackoffUntil
+			hs.BackoffUntil = &until
+		}
+		stats.Hosts = append(stats.Hosts, hs)
+	}
+	for _, p := range s.Pools {
+		stats.Pools = append(stats.Pools, Pool{
+			Name:                 p.Name,
+			Workers:              p.Workers,
+			Busy:                 p.Busy,
+			QueueDepth:           p.QueueDepth,
+			MaxRequestsPerSecond: p.MaxRequestsPerSecond,
+		})
+	}
+	for _, q := range s.QueueWaits {
+		stats.QueueWaits = append(stats.QueueWaits, QueueWait{
+			Tenant:          q.Tenant,
+			Jobs:            q.Jobs,
+			P50Ms:           millis(q.P50, 1),
+			P90Ms:           millis(q.P90, 1),
+			P99Ms:           millis(q.P99, 1),
+			MaxMs:           millis(q.Max, 1),
+			OldestWaitingMs: millis(q.OldestWaiting, 1),
+		})
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func millis(total time.Duration, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count) / float64(time.Millisecond)
+}
@@ -0,0 +1,199 @@
+// Package secrets resolves references to secrets kept in HashiCorp Vault or
+// encrypted with AWS KMS, so that the configuration need not hold them in
+// plain text.
+//
+// A reference is a configuration value of one of the forms:
+//
+//	vault:<path>#<field>   field of the Vault secret at path, e.g.
+//	                       vault:secret/data/urlfetcher#apiKey
+//	awskms:<ciphertext>    base64 ciphertext decrypted with AWS KMS
+//
+// Other values are secrets in plain text, and resolve to themselves.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dsoo/urlfetcher/sigv4"
+)
+
+// Prefixes of secret references.
+const (
+	VaultPrefix  = "vault:"
+	AWSKMSPrefix = "awskms:"
+)
+
+// Resolver resolves secret references. Sources left nil cannot be referred
+// to.
+type Resolver struct {
+	Vault *Vault
+	KMS   *KMS
+}
+
+// Resolve returns the secret value refers to, or value itself if it is not
+// a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, VaultPrefix):
+		if r.Vault == nil {
+			return "", fmt.Errorf("secret %s refers to Vault, which is not configured", value)
+		}
+		path, field, ok := strings.Cut(strings.TrimPrefix(value, VaultPrefix), "#")
+		if !ok || path == "" || field == "" {
+			return "", fmt.Errorf("invalid Vault reference %q, want vault:<path>#<field>", value)
+		}
+		return r.Vault.Get(ctx, path, field)
+	case strings.HasPrefix(value, AWSKMSPrefix):
+		if r.KMS == nil {
+			return "", fmt.Errorf("a secret refers to AWS KMS, which is not configured")
+		}
+		plaintext, err := r.KMS.Decrypt(ctx, strings.TrimPrefix(value, AWSKMSPrefix))
+		return string(plaintext), err
+	}
+	return value, nil
+}
+
+// Vault reads secrets from a HashiCorp Vault server, from version 1 or 2 of
+// the key/value secrets engine.
+type Vault struct {
+	Address   string // e.g. https://vault.example.com:8200
+	Token     string
+	Namespace string // Vault Enterprise namespace, if any
+	client    *http.Client
+}
+
+// NewVault returns a Vault client. The token is taken from the VAULT_TOKEN
+// environment variable if empty.
+func NewVault(address, token, namespace string) (*Vault, error) {
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" || token == "" {
+		return nil, fmt.Errorf("Vault needs an address and a token")
+	}
+	return &Vault{
+		Address:   strings.TrimSuffix(address, "/"),
+		Token:     token,
+		Namespace: namespace,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Get returns a field of the secret at path. For version 2 of the
+// key/value engine, path includes the data/ segment after the mount.
+func (v *Vault) Get(ctx context.Context, path, field string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.Address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		if len(e.Errors) == 0 {
+			return "", fmt.Errorf("Vault answered %s for %s", resp.Status, path)
+		}
+		return "", fmt.Errorf("Vault answered %s for %s: %s", resp.Status, path, strings.Join(e.Errors, "; "))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid Vault response for %s: %v", path, err)
+	}
+	data := secret.Data
+	// Version 2 nests the fields, next to the metadata of the version.
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %s", path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// KMS decrypts secrets with AWS KMS.
+type KMS struct {
+	Region   string
+	Endpoint string // https://kms.<Region>.amazonaws.com/ by default
+	Keys     sigv4.Keys
+	client   *http.Client
+}
+
+// NewKMS returns a KMS client for region. Access keys are taken from the
+// environment if keys has none.
+func NewKMS(region, endpoint string, keys sigv4.Keys) (*KMS, error) {
+	if region == "" {
+		return nil, fmt.Errorf("AWS KMS needs a region")
+	}
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com/"
+	}
+	if keys.AccessKeyID == "" {
+		keys = sigv4.KeysFromEnv()
+	}
+	if keys.AccessKeyID == "" || keys.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no AWS access key for KMS")
+	}
+	return &KMS{Region: region, Endpoint: endpoint, Keys: keys, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Decrypt returns the plaintext of a base64 ciphertext blob, as returned
+// by aws kms encrypt. The blob names the key it was encrypted with.
+func (k *KMS) Decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	if _, err := base64.StdEncoding.DecodeString(ciphertext); err != nil {
+		return nil, fmt.Errorf("invalid KMS ciphertext: %v", err)
+	}
+	body, _ := json.Marshal(map[string]string{"CiphertextBlob": ciphertext})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	sigv4.Sign(req, body, k.Keys, k.Region, "kms", time.Now())
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return nil, fmt.Errorf("KMS Decrypt failed with status %d: %s %s", resp.StatusCode, e.Type, e.Message)
+	}
+	var out struct {
+		Plaintext []byte // Base64 in JSON
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid KMS response: %v", err)
+	}
+	return out.Plaintext, nil
+}
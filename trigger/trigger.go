@@ -0,0 +1,255 @@
+// Package trigger serves a minimal API for no-code automation tools, such
+// as Zapier or IFTTT, that cannot build GraphQL requests: a job is added
+// from a single URL parameter, and its result polled as flat JSON.
+package trigger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/dsoo/urlfetcher/urldata"
+)
+
+// Prefix is the path the trigger API is served below.
+const Prefix = "/trigger"
+
+// Most of a text body included in a result, and most results listed.
+const maxBodyText = 10000
+const maxResults = 50
+
+// Result is a job as the trigger API shows it: flat, with the start of a
+// text body, so that automation tools can map its fields directly.
+type Result struct {
+	ID          string `json:"id"` // A string, as some tools expect of IDs
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Done        bool   `json:"done"` // Whether the job has finished, successfully or not
+	ResultURL   string `json:"resultURL"`
+	StatusCode  int    `json:"statusCode,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Body        string `json:"body,omitempty"` // Start of a text body
+	Error       string `json:"error,omitempty"`
+	FetchedAt   string `json:"fetchedAt,omitempty"` // RFC 3339
+}
+
+// Handler returns a handler serving:
+//
+//	GET or POST /trigger?url=...  adds a job for the URL, optionally with a
+//	                              preset and comma separated tags
+//	GET /trigger/{id}             the result of a job
+//	GET /trigger                  the latest finished jobs, newest first,
+//	                              optionally only those with a tag
+//
+// Tools that cannot set headers may pass their API key as the key
+// parameter; see KeyParam.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !auth.FromContext(r.Context()).Allows(auth.RoleViewer) {
+			writeError(w, http.StatusForbidden, (&auth.ForbiddenError{Role: auth.RoleViewer}).Error())
+			return
+		}
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+		switch {
+		case rest != "":
+			getResult(w, r, rest)
+		case formValue(r, "url") != "":
+			if !auth.FromContext(r.Context()).Allows(auth.RoleSubmitter) {
+				writeError(w, http.StatusForbidden, (&auth.ForbiddenError{Role: auth.RoleSubmitter}).Error())
+				return
+			}
+			addJob(w, r)
+		default:
+			listResults(w, r)
+		}
+	})
+}
+
+// KeyParam moves an API key passed as the key query parameter into the
+// X-API-Key header, where auth.APIKeys looks for it, before calling next.
+// It is meant for the trigger API only: keys in URLs end up in logs.
+func KeyParam(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if key := q.Get("key"); key != "" && r.Header.Get("X-API-Key") == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("X-API-Key", key)
+			q.Del("key")
+			r.URL.RawQuery = q.Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// formValue returns a parameter from the query, a form body, or a JSON
+// object body, whichever the tool sent.
+func formValue(r *http.Request, name string) string {
+	if r.Method == http.MethodPost {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			if r.Form == nil {
+				var body map[string]interface{}
+				json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body)
+				r.Form = r.URL.Query()
+				for k, v := range body {
+					if s, ok := v.(string); ok {
+						r.Form.Set(k, s)
+					}
+				}
+			}
+			return r.Form.Get(name)
+		}
+	}
+	return r.FormValue(name)
+}
+
+func addJob(w http.ResponseWriter, r *http.Request) {
+	u := formValue(r, "url")
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		writeError(w, http.StatusBadRequest, "url must be an http or https URL")
+		return
+	}
+	opts := urldata.JobOptions{}
+	if preset := formValue(r, "preset"); preset != "" {
+		var err error
+		if opts, err = urldata.WithPreset(preset, opts); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if tags := formValue(r, "tags"); tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				opts.Tags = append(opts.Tags, tag)
+			}
+		}
+	}
+	if id := auth.FromContext(r.Context()); id != nil {
+		opts.Tenant = id.Tenant
+		opts.Owner = id.Owner
+	}
+	job, err := urldata.SubmitJob(r.Context(), u, opts)
+	if errors.Is(err, urldata.ErrTargetPolicy) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	var overloaded *urldata.OverloadedError
+	if errors.As(err, &overloaded) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(overloaded.RetryAfter/time.Second)))
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	result := Result{
+		ID:        strconv.FormatInt(job.ID, 10),
+		URL:       job.URL,
+		Status:    job.Status,
+		ResultURL: fmt.Sprintf("%s%s/%d", job.Instance, Prefix, job.ID),
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
+
+func getResult(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid job id %q", rawID))
+		return
+	}
+	job := urldata.GetJob(id)
+	if job == nil || !urldata.CanView(r.Context(), job) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, resultOf(job))
+}
+
+func listResults(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	results := []Result{}
+	jobs := urldata.GetJobs()
+	for i := len(jobs) - 1; i >= 0 && len(results) < maxResults; i-- {
+		job := jobs[i]
+		if !urldata.CanView(r.Context(), job) || !urldata.Finished(urldata.GetJobState(job).Status) || tag != "" && !hasTag(job, tag) {
+			continue
+		}
+		results = append(results, resultOf(job))
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func hasTag(job *urldata.Job, tag string) bool {
+	for _, t := range job.Options.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// resultOf returns the flat view of a job.
+func resultOf(job *urldata.Job) Result {
+	state := urldata.GetJobState(job)
+	result := Result{
+		ID:        strconv.FormatInt(job.ID, 10),
+		URL:       job.URL,
+		Status:    state.Status,
+		Done:      urldata.Finished(state.Status),
+		ResultURL: fmt.Sprintf("%s/%d", Prefix, job.ID),
+	}
+	if state.Error != nil {
+		result.Error = state.Error.Error()
+	}
+	if resp := state.Response; resp != nil {
+		result.StatusCode = resp.StatusCode
+		result.ContentType = resp.Header.Get("Content-Type")
+		result.Size = len(resp.Body)
+		result.FetchedAt = resp.Timestamp.UTC().Format(time.RFC3339)
+		if isText(result.ContentType) && utf8.Valid(resp.Body) {
+			body := string(resp.Body)
+			if len(body) > maxBodyText {
+				body = body[:maxBodyText]
+				for !utf8.ValidString(body) {
+					body = body[:len(body)-1]
+				}
+			}
+			result.Body = body
+		}
+	}
+	return result
+}
+
+// isText reports whether a content type is one automation tools can use
+// as text.
+func isText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error, which automation tools show better than
+// plain text.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,120 @@
+// Dashboard for urlfetcher, talking to the GraphQL endpoint only.
+const keyInput = document.getElementById("api-key");
+keyInput.value = localStorage.getItem("urlfetcher-api-key") || "";
+keyInput.addEventListener("change", () => localStorage.setItem("urlfetcher-api-key", keyInput.value));
+
+async function query(q, variables) {
+  const headers = {"Content-Type": "application/json"};
+  if (keyInput.value) {
+    headers["X-API-Key"] = keyInput.value;
+  }
+  const resp = await fetch("../graphql", {method: "POST", headers, body: JSON.stringify({query: q, variables})});
+  if (!resp.ok) {
+    throw new Error("graphql returned " + resp.status);
+  }
+  const result = await resp.json();
+  if (result.errors && result.errors.length) {
+    throw new Error(result.errors[0].message);
+  }
+  return result.data;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === null || text === undefined ? "" : text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function statusClass(status) {
+  if (status.startsWith("done")) {
+    return "done";
+  }
+  return status;
+}
+
+function render(data) {
+  const stats = data.stats;
+  document.getElementById("queue-depth").textContent = stats.queueDepth;
+  document.getElementById("parked-jobs").textContent = stats.parkedJobs;
+  document.getElementById("queue-paused").textContent = stats.paused ? "paused" : "running";
+
+  const jobs = document.getElementById("jobs");
+  jobs.textContent = "";
+  data.jobs.sort((a, b) => b.id - a.id).slice(0, 50).forEach(job => {
+    const row = jobs.insertRow();
+    row.addEventListener("click", () => preview(job.id));
+    cell(row, job.id);
+    cell(row, job.url, "url").title = job.url;
+    const status = document.createElement("span");
+    status.textContent = job.status;
+    status.className = "status status-" + statusClass(job.status);
+    row.insertCell().appendChild(status);
+    cell(row, job.error ? job.error.category + ": " + job.error.message : "");
+    cell(row, job.workerId || "");
+  });
+
+  const hosts = document.getElementById("hosts");
+  hosts.textContent = "";
+  (stats.hosts || []).forEach(h => {
+    const row = hosts.insertRow();
+    cell(row, h.host);
+    cell(row, h.requests);
+    cell(row, h.reusedConnections);
+    cell(row, h.circuit, "circuit-" + h.circuit);
+    cell(row, h.failures);
+    cell(row, h.avgConnectMs.toFixed(1));
+    cell(row, h.backoffUntil);
+  });
+}
+
+// preview shows the response of a job: HTML sanitized by the server in the
+// sandboxed frame, anything else as text. Never put fetched content into
+// the dashboard's own document as HTML.
+async function preview(id) {
+  const frame = document.getElementById("preview");
+  const text = document.getElementById("preview-text");
+  try {
+    const data = await query(`query($id: String!) { job(id: $id) { response { previewHTML bodyPreview(chars: 2000) } } }`, {id: String(id)});
+    const response = data.job && data.job.response;
+    document.getElementById("preview-job").textContent = id;
+    document.getElementById("preview-section").hidden = false;
+    frame.hidden = !(response && response.previewHTML);
+    text.hidden = !frame.hidden;
+    frame.srcdoc = frame.hidden ? "" : response.previewHTML;
+    text.textContent = response ? response.bodyPreview : "no response yet";
+  } catch (e) {
+    document.getElementById("error").textContent = e.message;
+  }
+}
+
+async function refresh() {
+  try {
+    render(await query(`{
+      stats { queueDepth paused parkedJobs
+        hosts { host requests reusedConnections circuit failures avgConnectMs backoffUntil } }
+      jobs { id url status workerId error { category message } }
+    }`));
+    document.getElementById("error").textContent = "";
+  } catch (e) {
+    document.getElementById("error").textContent = e.message;
+  }
+}
+
+document.getElementById("submit").addEventListener("submit", async event => {
+  event.preventDefault();
+  const result = document.getElementById("submit-result");
+  try {
+    const data = await query("mutation($url: String!) { addJob(url: $url) { id } }",
+      {url: document.getElementById("url").value});
+    result.textContent = "queued job " + data.addJob.id;
+    refresh();
+  } catch (e) {
+    result.textContent = e.message;
+  }
+});
+
+refresh();
+setInterval(refresh, 2000);
@@ -0,0 +1,33 @@
+// Package ui serves the built-in web dashboard. Its files are embedded in
+// the binary, so the dashboard needs nothing but the GraphQL endpoint.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// policy is the Content-Security-Policy of the dashboard. Previews of
+// fetched pages inherit it, on top of their sandbox and their own policy,
+// so it allows no scripts but the dashboard's, and nothing from elsewhere.
+const policy = "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; object-src 'none'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// Handler returns a handler serving the dashboard. It must be mounted with
+// http.StripPrefix if served below the root, and expects the GraphQL
+// endpoint at /graphql.
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", policy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	})
+}
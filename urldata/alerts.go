@@ -0,0 +1,158 @@
+package urldata
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/graphql-go/graphql"
+)
+
+// AlertRule fires when too many jobs to a host fail within a time window,
+// e.g. more than 20% of the jobs to *.example.com in 5 minutes.
+type AlertRule struct {
+	Name        string
+	Host        string        // Host or *.domain wildcard; empty for every host
+	FailureRate float64       // Fires when the failed fraction exceeds this
+	MinJobs     int           // Jobs needed in the window before the rule is evaluated
+	Window      time.Duration // How far back jobs are counted
+	Notifiers   []string      // Names of the notifiers to tell
+}
+
+// Alert is a rule currently firing for a host.
+type Alert struct {
+	Rule        string
+	Host        string
+	FailureRate float64
+	Since       time.Time
+}
+
+type outcome struct {
+	at     time.Time
+	host   string
+	failed bool
+}
+
+var alertsMu sync.Mutex
+var alertRules []AlertRule
+var outcomes []outcome
+var firing = map[string]*Alert{} // Keyed by rule and host
+var maxWindow time.Duration
+
+// SetAlertRules replaces the alert rules.
+func SetAlertRules(rules []AlertRule) {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	alertRules = rules
+	firing = map[string]*Alert{}
+	maxWindow = 0
+	for _, r := range rules {
+		if r.Window > maxWindow {
+			maxWindow = r.Window
+		}
+	}
+}
+
+// GetAlerts returns the alerts currently firing.
+func GetAlerts() []Alert {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	alerts := []Alert{}
+	for _, a := range firing {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Host < alerts[j].Host
+	})
+	return alerts
+}
+
+// recordOutcome counts a finished job towards the alert rules of its host,
+// and fires or resolves alerts whose state changes.
+func recordOutcome(job *Job) {
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	if len(alertRules) == 0 {
+		return
+	}
+	now := clock.Now()
+	host := hostOf(job.URL)
+	outcomes = append(outcomes, outcome{at: now, host: host, failed: job.Status == "error"})
+	keep := 0
+	for keep < len(outcomes) && now.Sub(outcomes[keep].at) > maxWindow {
+		keep++
+	}
+	outcomes = outcomes[keep:]
+
+	for _, r := range alertRules {
+		if r.Host != "" && !MatchesHost(r.Host, host) {
+			continue
+		}
+		total, failed := 0, 0
+		for _, o := range outcomes {
+			if o.host == host && now.Sub(o.at) <= r.Window {
+				total++
+				if o.failed {
+					failed++
+				}
+			}
+		}
+		if total == 0 || total < r.MinJobs {
+			continue
+		}
+		rate := float64(failed) / float64(total)
+		key := r.Name + " " + host
+		a, active := firing[key]
+		switch {
+		case rate > r.FailureRate && !active:
+			a = &Alert{Rule: r.Name, Host: host, FailureRate: rate, Since: now}
+			firing[key] = a
+			notifyAll(r.Notifiers, notify.Message{
+				Title: fmt.Sprintf("Alert %s firing for %s", r.Name, host),
+				Text: fmt.Sprintf("%d of the last %d jobs to %s failed within %v.",
+					failed, total, host, r.Window),
+				Fields: map[string]string{"host": host, "failureRate": strconv.FormatFloat(rate, 'f', 2, 64)},
+			})
+		case rate > r.FailureRate:
+			a.FailureRate = rate
+		case rate <= r.FailureRate && active:
+			delete(firing, key)
+			notifyAll(r.Notifiers, notify.Message{
+				Title: fmt.Sprintf("Alert %s resolved for %s", r.Name, host),
+				Text: fmt.Sprintf("Failures to %s are back under %.0f%% after %v.",
+					host, 100*r.FailureRate, now.Sub(a.Since).Round(time.Second)),
+				Fields: map[string]string{"host": host, "failureRate": strconv.FormatFloat(rate, 'f', 2, 64)},
+			})
+		}
+	}
+}
+
+func alertType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Alert",
+		Fields: graphql.Fields{
+			"rule": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Name of the rule that fired",
+			},
+			"host": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Host the rule fired for",
+			},
+			"failureRate": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Fraction of the host's jobs that failed within the rule's window",
+			},
+			"since": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the alert started firing",
+			},
+		},
+	})
+}
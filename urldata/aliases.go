@@ -0,0 +1,267 @@
+package urldata
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"golang.org/x/net/html"
+)
+
+// Most aliases followed from a URL to its canonical URL, in case pages
+// declare each other canonical.
+const maxAliasHops = 5
+
+// The aliases of the successful responses in the cache: the URLs that
+// declared another canonical or were redirected to it, keyed by cache key,
+// and the aliases of each canonical URL.
+var aliasesMu sync.Mutex
+var canonicalOf = map[string]string{}
+var aliasesOf = map[string]map[string]bool{}
+
+// canonicalURL returns the URL a response for rawURL declares canonical,
+// with a Link header or a <link rel="canonical"> in the head of an HTML
+// body, or else base if the request was redirected there. It returns "" if
+// either is rawURL itself.
+func canonicalURL(rawURL, base string, header http.Header, body []byte) string {
+	canonical := base
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	if ref := headerCanonical(header); ref != "" {
+		if u, err := baseURL.Parse(ref); err == nil {
+			canonical = u.String()
+		}
+	} else if ref := htmlCanonical(header, body); ref != "" {
+		if u, err := baseURL.Parse(ref); err == nil {
+			canonical = u.String()
+		}
+	}
+	if cacheKey(canonical) == cacheKey(rawURL) {
+		return ""
+	}
+	return canonical
+}
+
+// headerCanonical returns the target of a Link header with rel=canonical.
+func headerCanonical(header http.Header) string {
+	for _, v := range header.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "rel") && hasRel(strings.Trim(value, `"`), "canonical") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// htmlCanonical returns the href of the first <link rel="canonical"> of an
+// HTML body, looking no further than its head.
+func htmlCanonical(header http.Header, body []byte) string {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return ""
+	}
+	tokens := html.NewTokenizer(strings.NewReader(string(body)))
+	for {
+		tt := tokens.Next()
+		if tt == html.ErrorToken {
+			return ""
+		}
+		name, hasAttr := tokens.TagName()
+		if tt == html.EndTagToken && string(name) == "head" || tt == html.StartTagToken && string(name) == "body" {
+			return ""
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken || string(name) != "link" {
+			continue
+		}
+		rel, href := "", ""
+		for hasAttr {
+			var key, value []byte
+			key, value, hasAttr = tokens.TagAttr()
+			switch string(key) {
+			case "rel":
+				rel = string(value)
+			case "href":
+				href = strings.TrimSpace(string(value))
+			}
+		}
+		if hasRel(rel, "canonical") && href != "" {
+			return href
+		}
+	}
+}
+
+// hasRel reports whether a space separated list of link relations has rel.
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(rels) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexAliases records the response's URL as an alias of its canonical URL,
+// replacing what was recorded for the URL before. Only successful
+// responses are trusted to declare a canonical URL.
+func indexAliases(r *Response) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	key := cacheKey(r.URL)
+	if old, ok := canonicalOf[key]; ok {
+		delete(canonicalOf, key)
+		oldKey := cacheKey(old)
+		delete(aliasesOf[oldKey], r.URL)
+		if len(aliasesOf[oldKey]) == 0 {
+			delete(aliasesOf, oldKey)
+		}
+	}
+	if r.Canonical == "" || r.StatusCode < 200 || r.StatusCode > 299 {
+		return
+	}
+	canonicalOf[key] = r.Canonical
+	canonicalKey := cacheKey(r.Canonical)
+	if aliasesOf[canonicalKey] == nil {
+		aliasesOf[canonicalKey] = map[string]bool{}
+	}
+	aliasesOf[canonicalKey][r.URL] = true
+}
+
+// resetAliases empties the alias index.
+func resetAliases() {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	canonicalOf = map[string]string{}
+	aliasesOf = map[string]map[string]bool{}
+}
+
+// CanonicalURL returns the canonical URL of rawURL, following the aliases
+// recorded from fetched responses, or rawURL itself if it is no alias.
+func CanonicalURL(rawURL string) string {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	return canonicalLocked(rawURL)
+}
+
+// canonicalLocked is CanonicalURL with aliasesMu held.
+func canonicalLocked(rawURL string) string {
+	canonical := rawURL
+	for i := 0; i < maxAliasHops; i++ {
+		next, ok := canonicalOf[cacheKey(canonical)]
+		if !ok || next == rawURL {
+			break
+		}
+		canonical = next
+	}
+	return canonical
+}
+
+// Aliases returns the canonical URL of rawURL and all the URLs known to be
+// aliases of it, directly or through other aliases, sorted.
+func Aliases(rawURL string) (canonical string, aliases []string) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	canonical = canonicalLocked(rawURL)
+	aliases = []string{}
+	seen := map[string]bool{cacheKey(canonical): true}
+	pending := []string{canonical}
+	for len(pending) > 0 {
+		u := pending[0]
+		pending = pending[1:]
+		for alias := range aliasesOf[cacheKey(u)] {
+			if !seen[cacheKey(alias)] {
+				seen[cacheKey(alias)] = true
+				aliases = append(aliases, alias)
+				pending = append(pending, alias)
+			}
+		}
+	}
+	sort.Strings(aliases)
+	return canonical, aliases
+}
+
+// GetResponseViaAliases returns the cached response for rawURL, or if there
+// is none, the one cached for its canonical URL or another of its aliases.
+func GetResponseViaAliases(rawURL string) *Response {
+	return responseViaAliases(rawURL, func(string) bool { return true })
+}
+
+// responseViaAliases is GetResponseViaAliases, only following aliases for
+// which visible holds.
+func responseViaAliases(rawURL string, visible func(url string) bool) *Response {
+	if r := GetResponse(rawURL); r != nil {
+		return r
+	}
+	canonical, aliases := Aliases(rawURL)
+	for _, u := range append([]string{canonical}, aliases...) {
+		if !visible(u) {
+			continue
+		}
+		if r := GetResponse(u); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// aliasesField returns the query listing the canonical URL of a URL and
+// its aliases.
+func aliasesField() *graphql.Field {
+	aliasSetType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "AliasSet",
+		Description: "A canonical URL and the URLs that declared it canonical or were redirected to it",
+		Fields: graphql.Fields{
+			"canonical": &graphql.Field{
+				Type: graphql.String,
+			},
+			"aliases": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+			},
+		},
+	})
+	return &graphql.Field{
+		Type:        aliasSetType,
+		Description: "Retrieve the canonical URL of a URL and all its known aliases",
+		Args: graphql.FieldConfigArgument{
+			"url": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			url := p.Args["url"].(string)
+			visible := urlFilter(p.Context)
+			if !visible(url) {
+				return nil, nil
+			}
+			canonical, aliases := Aliases(url)
+			if !visible(canonical) {
+				canonical = url
+			}
+			seen := []string{}
+			for _, alias := range aliases {
+				if visible(alias) {
+					seen = append(seen, alias)
+				}
+			}
+			return map[string]interface{}{"canonical": canonical, "aliases": seen}, nil
+		},
+	}
+}
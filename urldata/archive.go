@@ -0,0 +1,136 @@
+package urldata
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ArchiveConfig configures moving finished jobs out of memory.
+type ArchiveConfig struct {
+	Path     string        // Append-only file of archived jobs, one JSON object per line
+	After    time.Duration // How long after finishing jobs are archived
+	Interval time.Duration // How often to look for jobs to archive
+}
+
+// Defaults for the archive settings.
+const defaultArchiveAfter = 24 * time.Hour
+const defaultArchiveInterval = time.Minute
+
+// Guards writing to and reading from the archive file.
+var archiveMu sync.Mutex
+var archive *os.File
+
+// SetArchive opens the archive file and starts archiving jobs that
+// finished longer than c.After ago.
+func SetArchive(c ArchiveConfig) error {
+	if c.After == 0 {
+		c.After = defaultArchiveAfter
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultArchiveInterval
+	}
+	f, err := os.OpenFile(c.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	archiveMu.Lock()
+	archive = f
+	archiveMu.Unlock()
+	go func() {
+		for {
+			<-clock.After(c.Interval)
+			if err := ArchiveJobs(c.After); err != nil {
+				fmt.Println("failed to archive jobs:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// ArchiveJobs moves the jobs that finished more than age ago from memory
+// to the archive file.
+func ArchiveJobs(age time.Duration) error {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if archive == nil {
+		return nil
+	}
+	cutoff := clock.Now().Add(-age)
+	var old []*Job
+	for _, job := range GetJobs() {
+		events := jobEvents(job)
+		if Finished(jobStatus(job)) && len(events) > 0 && events[len(events)-1].Time.Before(cutoff) {
+			old = append(old, job)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+
+	w := bufio.NewWriter(archive)
+	enc := json.NewEncoder(w)
+	for _, job := range old {
+		eventsMu.Lock()
+		err := enc.Encode(job)
+		eventsMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := archive.Sync(); err != nil {
+		return err
+	}
+	jobsMu.Lock()
+	for _, job := range old {
+		delete(jobs, job.ID)
+	}
+	jobsMu.Unlock()
+	for _, job := range old {
+		persistArchived(job.ID)
+	}
+	fmt.Println("archived", len(old), "jobs")
+	return nil
+}
+
+// ArchiveFilter selects archived jobs. Zero fields match every job.
+type ArchiveFilter struct {
+	ID     int64
+	URL    string
+	Status string
+	Limit  int // Return at most the latest Limit matches
+}
+
+// GetArchivedJobs reads the archive and returns the jobs that match the
+// filter, oldest first.
+func GetArchivedJobs(f ArchiveFilter) ([]*Job, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if archive == nil {
+		return nil, nil
+	}
+	if _, err := archive.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	found := []*Job{}
+	dec := json.NewDecoder(bufio.NewReader(archive))
+	for dec.More() {
+		job := &Job{}
+		if err := dec.Decode(job); err != nil {
+			return nil, err
+		}
+		if (f.ID == 0 || job.ID == f.ID) && (f.URL == "" || job.URL == f.URL) && (f.Status == "" || job.Status == f.Status) {
+			found = append(found, job)
+			if f.Limit > 0 && len(found) > f.Limit {
+				found = found[1:]
+			}
+		}
+	}
+	return found, nil
+}
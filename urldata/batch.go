@@ -0,0 +1,167 @@
+package urldata
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/graphql-go/graphql"
+)
+
+// Batch is a group of jobs submitted together.
+type Batch struct {
+	ID       int64
+	JobIDs   []int64
+	Notify   string // Notifier told when the whole batch has finished
+	Tenant   string // Tenant of the jobs, which alone may see the batch
+	Created  time.Time
+	Finished time.Time // Zero until every job has finished
+	Pending  int       // Jobs that have not finished yet
+	Failed   int       // Jobs that finished with an error
+
+	crawl *crawl // Set if the batch follows the links of its pages
+}
+
+var batchesMu sync.Mutex
+var batches = map[int64]*Batch{}
+var curBatchID = int64(0)
+
+// AddBatch adds a job for each URL, all sharing opts. If opts.Notify is set
+// the notifier is told once the whole batch has finished, instead of once
+// per job. It returns an *OverloadedError if new jobs are refused.
+func AddBatch(urls []string, opts JobOptions) (*Batch, error) {
+	if err := admitJob(); err != nil {
+		return nil, err
+	}
+	b := &Batch{
+		ID:      atomic.AddInt64(&curBatchID, 1),
+		Notify:  opts.Notify,
+		Tenant:  opts.Tenant,
+		Created: clock.Now(),
+		Pending: len(urls),
+	}
+	batchesMu.Lock()
+	batches[b.ID] = b
+	batchesMu.Unlock()
+
+	opts.Batch = b.ID
+	opts.Notify = ""
+	for _, url := range urls {
+		job := AddJobWithOptions(url, opts)
+		batchesMu.Lock()
+		b.JobIDs = append(b.JobIDs, job.ID)
+		batchesMu.Unlock()
+	}
+	return GetBatch(b.ID), nil
+}
+
+// GetBatch returns a snapshot of the batch with the given ID, or nil if
+// there is none.
+func GetBatch(id int64) *Batch {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	b, ok := batches[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *b
+	snapshot.JobIDs = append([]int64(nil), b.JobIDs...)
+	return &snapshot
+}
+
+// batchJobFinished counts a finished job towards its batch, and notifies
+// the batch's notifier when it was the last one.
+func batchJobFinished(job *Job) {
+	if job.Options.Batch == 0 {
+		return
+	}
+	batchesMu.Lock()
+	b, ok := batches[job.Options.Batch]
+	if !ok || b.Pending == 0 {
+		batchesMu.Unlock()
+		return
+	}
+	b.Pending--
+	if job.Status == "error" {
+		b.Failed++
+	}
+	if b.Pending > 0 {
+		batchesMu.Unlock()
+		return
+	}
+	b.Finished = clock.Now()
+	done := *b
+	batchesMu.Unlock()
+
+	if done.Notify == "" {
+		return
+	}
+	outcome := "succeeded"
+	if done.Failed > 0 {
+		outcome = fmt.Sprintf("finished with %d failed", done.Failed)
+	}
+	notifyAll([]string{done.Notify}, notify.Message{
+		Title: fmt.Sprintf("Batch %d %s", done.ID, outcome),
+		Text:  fmt.Sprintf("%d of %d jobs succeeded.", len(done.JobIDs)-done.Failed, len(done.JobIDs)),
+		Fields: map[string]string{
+			"jobs":     strconv.Itoa(len(done.JobIDs)),
+			"failed":   strconv.Itoa(done.Failed),
+			"duration": done.Finished.Sub(done.Created).Round(time.Millisecond).String(),
+		},
+		Link: resultLink(fmt.Sprintf(`{ batch(id: "%d") { pending failed jobs { id url status error { category message } } } }`, done.ID)),
+	})
+}
+
+func batchType(jobType *graphql.Object) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Batch",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Unique ID for the batch",
+			},
+			"jobs": &graphql.Field{
+				Type:        graphql.NewList(jobType),
+				Description: "Jobs in the batch, in submission order",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var jobs []*Job
+					for _, id := range p.Source.(*Batch).JobIDs {
+						if job := GetJob(id); job != nil {
+							jobs = append(jobs, job)
+						}
+					}
+					return jobs, nil
+				},
+			},
+			"notify": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Notifier told when the batch has finished",
+			},
+			"pending": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs that have not finished yet",
+			},
+			"failed": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs that finished with an error",
+			},
+			"created": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the batch was submitted",
+			},
+			"finished": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the last job of the batch finished",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if b := p.Source.(*Batch); !b.Finished.IsZero() {
+						return b.Finished, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+}
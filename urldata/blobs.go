@@ -0,0 +1,119 @@
+package urldata
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for a key with no blob.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps binary data derived from responses, such as thumbnails,
+// by key. Keys are slash separated paths of letters, digits, dots, dashes
+// and underscores.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// memoryBlobs is the default BlobStore, which keeps blobs until the
+// server exits.
+type memoryBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memoryBlobs) Put(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = data
+	return nil
+}
+
+func (m *memoryBlobs) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return data, nil
+}
+
+// DirBlobStore is a BlobStore keeping each blob in a file below a
+// directory.
+type DirBlobStore string
+
+// Put implements BlobStore. The file is written under another name first,
+// so that it is never read half written.
+func (d DirBlobStore) Put(key string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get implements BlobStore.
+func (d DirBlobStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+var blobsMu sync.Mutex
+var blobs BlobStore = &memoryBlobs{blobs: map[string][]byte{}}
+
+// SetBlobStore sets where blobs are kept, in memory if nil.
+func SetBlobStore(s BlobStore) {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	if s == nil {
+		s = &memoryBlobs{blobs: map[string][]byte{}}
+	}
+	blobs = s
+}
+
+// blobStore returns the current BlobStore, encrypting blobs if encryption
+// is on.
+func blobStore() BlobStore {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	return encryptingBlobs{next: blobs}
+}
+
+// validBlobKey reports whether key is safe to use as a path below a
+// directory.
+func validBlobKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GetBlob returns the blob kept under key, or ErrBlobNotFound.
+func GetBlob(key string) ([]byte, error) {
+	if !validBlobKey(key) {
+		return nil, ErrBlobNotFound
+	}
+	return blobStore().Get(key)
+}
@@ -0,0 +1,146 @@
+package urldata
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Length of bodyPreview if the query does not give one.
+const defaultPreviewChars = 200
+
+// truncateBody returns body as a string, cut to at most max bytes without
+// splitting a UTF-8 sequence. A negative max leaves it whole. Only the part
+// returned is copied.
+func truncateBody(body []byte, max int) string {
+	if max < 0 || len(body) <= max {
+		return string(body)
+	}
+	for max > 0 && !utf8.RuneStart(body[max]) {
+		max--
+	}
+	return string(body[:max])
+}
+
+// bodyPreview returns the first chars characters of body, with runs of
+// white space collapsed into single spaces so it fits on a line.
+func bodyPreview(body []byte, chars int) string {
+	var b strings.Builder
+	space := false
+	// Ranging over the conversion does not copy the body.
+	for _, r := range string(body) {
+		if chars <= 0 {
+			break
+		}
+		if unicode.IsSpace(r) {
+			space = b.Len() > 0
+			continue
+		}
+		if space {
+			if chars == 1 {
+				break // Rather than end on a space
+			}
+			b.WriteByte(' ')
+			space = false
+			chars--
+		}
+		b.WriteRune(r)
+		chars--
+	}
+	return b.String()
+}
+
+// responseJSON is how a Response is stored in the journal and archives. The
+// body is written as a string, as it was before Response held bytes, so
+// that existing files can still be read.
+type responseJSON struct {
+	URL        string
+	StatusCode int
+	Body       string
+	// BodyKey is the ID of the key EncryptedBody was encrypted with, in
+	// place of Body, when encryption is on.
+	BodyKey        string `json:",omitempty"`
+	EncryptedBody  []byte `json:",omitempty"`
+	Header         http.Header
+	Timestamp      time.Time
+	Checksums      Checksums
+	Links          []string
+	Resolver       string           `json:",omitempty"`
+	Exchanges      []Exchange       `json:",omitempty"`
+	Findings       []Finding        `json:",omitempty"`
+	Language       *Language        `json:",omitempty"`
+	Canonical      string           `json:",omitempty"`
+	StructuredData []StructuredItem `json:",omitempty"`
+	Thumbnail      string           `json:",omitempty"`
+	Snapshot       string           `json:",omitempty"`
+	DroppedHeaders []string         `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *Response) MarshalJSON() ([]byte, error) {
+	keyID, sealed, err := encrypt(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	j := responseJSON{
+		URL:            r.URL,
+		StatusCode:     r.StatusCode,
+		Header:         r.Header,
+		Timestamp:      r.Timestamp,
+		Checksums:      r.Checksums,
+		Links:          r.Links,
+		Resolver:       r.Resolver,
+		Exchanges:      r.Exchanges,
+		Findings:       r.Findings,
+		Language:       r.Language,
+		Canonical:      r.Canonical,
+		StructuredData: r.StructuredData,
+		Thumbnail:      r.Thumbnail,
+		Snapshot:       r.Snapshot,
+		DroppedHeaders: r.DroppedHeaders,
+	}
+	if keyID != "" {
+		j.BodyKey, j.EncryptedBody = keyID, sealed
+	} else {
+		j.Body = string(r.Body)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Response) UnmarshalJSON(data []byte) error {
+	var j responseJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = Response{
+		URL:            j.URL,
+		StatusCode:     j.StatusCode,
+		Body:           []byte(j.Body),
+		Header:         j.Header,
+		Timestamp:      j.Timestamp,
+		Checksums:      j.Checksums,
+		Links:          j.Links,
+		Resolver:       j.Resolver,
+		Exchanges:      j.Exchanges,
+		Findings:       j.Findings,
+		Language:       j.Language,
+		Canonical:      j.Canonical,
+		StructuredData: j.StructuredData,
+		Thumbnail:      j.Thumbnail,
+		Snapshot:       j.Snapshot,
+		DroppedHeaders: j.DroppedHeaders,
+	}
+	if j.BodyKey != "" {
+		body, err := decrypt(j.BodyKey, j.EncryptedBody)
+		if err != nil {
+			return err
+		}
+		r.Body = body
+	}
+	r.checkStored()
+	return nil
+}
@@ -0,0 +1,43 @@
+package urldata_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+	"github.com/dsoo/urlfetcher/urltest"
+)
+
+// BenchmarkFetchLargeBody fetches a 1 MiB body and queries its length,
+// which should not copy the body once it is stored.
+func BenchmarkFetchLargeBody(b *testing.B) {
+	s := urltest.NewTestService(b)
+	body := strings.Repeat("x", 1<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A new URL every time, so the job is not answered from the cache.
+		url := "http://bench.test/?page=" + strconv.Itoa(i)
+		s.Fetcher.Handle(url, body)
+		id := s.AddJob(url)
+		s.WaitForJob(id, 5*time.Second)
+		s.Query(`query($id: String!) { job(id: $id) { response { bodyLength } } }`,
+			map[string]interface{}{"id": strconv.FormatInt(id, 10)})
+	}
+}
+
+// BenchmarkResponseJSON writes a response with a 1 MiB body as it is
+// stored in the journal and archives.
+func BenchmarkResponseJSON(b *testing.B) {
+	r := &urldata.Response{URL: "http://bench.test/", StatusCode: 200, Body: []byte(strings.Repeat("x", 1<<20))}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
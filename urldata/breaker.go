@@ -0,0 +1,153 @@
+package urldata
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerConfig configures the per-host circuit breaker.
+type BreakerConfig struct {
+	// Threshold is the number of consecutive failed fetches that opens a
+	// host's circuit. Zero disables the breaker.
+	Threshold int
+	// Cooldown is how long a circuit stays open before a single trial
+	// request is let through.
+	Cooldown time.Duration
+	// Delay holds jobs for an open circuit until the cooldown ends instead
+	// of failing them immediately.
+	Delay bool
+}
+
+// Circuit states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+type circuit struct {
+	state    string
+	failures int // Consecutive failures
+	openedAt time.Time
+	trial    int64 // Job let through as the trial while half-open
+}
+
+var breaker BreakerConfig
+var circuitsMu sync.Mutex
+var circuits = map[string]*circuit{}
+
+// SetCircuitBreaker configures the per-host circuit breaker.
+func SetCircuitBreaker(c BreakerConfig) {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	breaker = c
+	circuits = map[string]*circuit{}
+}
+
+func circuitLocked(host string) *circuit {
+	c, ok := circuits[host]
+	if !ok {
+		c = &circuit{state: circuitClosed}
+		circuits[host] = c
+	}
+	return c
+}
+
+// circuitAllow reports whether job jobID may send a request to host now. If
+// not, it also returns when the circuit will next let a request through.
+func circuitAllow(host string, jobID int64) (bool, time.Time) {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	if breaker.Threshold == 0 {
+		return true, time.Time{}
+	}
+	c := circuitLocked(host)
+	switch c.state {
+	case circuitOpen:
+		retryAt := c.openedAt.Add(breaker.Cooldown)
+		if clock.Now().Before(retryAt) {
+			return false, retryAt
+		}
+		// Let this request through as the trial; hold the rest back until
+		// it reports back.
+		c.state = circuitHalfOpen
+		c.trial = jobID
+		return true, time.Time{}
+	case circuitHalfOpen:
+		return false, clock.Now().Add(breaker.Cooldown)
+	}
+	return true, time.Time{}
+}
+
+// circuitRecord records the outcome of a request to host.
+func circuitRecord(host string, success bool) {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	if breaker.Threshold == 0 {
+		return
+	}
+	c := circuitLocked(host)
+	c.trial = 0
+	if success {
+		c.state = circuitClosed
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= breaker.Threshold {
+		c.state = circuitOpen
+		c.openedAt = clock.Now()
+	}
+}
+
+// circuitRelease is called once job jobID is done with host. If the job was
+// the trial of the host's half-open circuit and ended without an outcome,
+// such as when refused by policy or rate limits before sending its request,
+// the circuit opens again with its cooldown over, so that the next request
+// becomes the trial.
+func circuitRelease(host string, jobID int64) {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	c, ok := circuits[host]
+	if ok && c.state == circuitHalfOpen && c.trial == jobID {
+		c.state = circuitOpen
+		c.trial = 0
+	}
+}
+
+// circuitStates returns the state and consecutive failures of each host's
+// circuit.
+func circuitStates() map[string]circuit {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	states := make(map[string]circuit, len(circuits))
+	for host, c := range circuits {
+		states[host] = *c
+	}
+	return states
+}
+
+// admitCircuit is called by a worker before processing a job. Jobs that can
+// be answered from the cache always pass. Otherwise, if the host's circuit
+// is open the job is failed, or with BreakerConfig.Delay parked until the
+// cooldown ends, and admitCircuit returns false.
+func admitCircuit(job *Job) bool {
+	if cachedResponse(job) != nil {
+		return true
+	}
+	ok, retryAt := circuitAllow(hostOf(job.URL), job.ID)
+	if ok {
+		return true
+	}
+	if !breaker.Delay {
+		updateJob(job, func(job *Job) {
+			job.Error = policyError("circuit for %s is open", hostOf(job.URL))
+			job.Status = "error"
+		})
+		recordEvent(job, "completed", "failed fast, circuit for %s is open", hostOf(job.URL))
+		jobFinished(job)
+		return false
+	}
+	parkUntil(job, retryAt, "circuit for %s is open, delayed until %s", hostOf(job.URL), retryAt.Format(time.RFC3339))
+	return false
+}
@@ -0,0 +1,61 @@
+package urldata
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Budgets a job can exceed, as reported in Job.BudgetExceeded.
+const (
+	budgetBytes    = "maxBytes"
+	budgetDuration = "maxDuration"
+)
+
+var errTooLarge = errors.New("response body exceeds the job's byte budget")
+
+// Byte budget of jobs that do not set one, 0 for none.
+var defaultMaxBytes int64
+
+// SetDefaultMaxBytes sets the byte budget of the jobs that do not set
+// their own. 0 means no limit.
+func SetDefaultMaxBytes(n int64) {
+	atomic.StoreInt64(&defaultMaxBytes, n)
+}
+
+// withBudget bounds ctx by the job's duration budget, if it has one.
+func withBudget(ctx context.Context, job *Job) (context.Context, context.CancelFunc) {
+	if job.Options.MaxDuration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, job.Options.MaxDuration)
+}
+
+// readBody reads a response body, stopping with errTooLarge as soon as it
+// exceeds the job's byte budget, or the default one.
+func readBody(job *Job, r io.Reader) ([]byte, error) {
+	limit := job.Options.MaxBytes
+	if limit <= 0 {
+		limit = atomic.LoadInt64(&defaultMaxBytes)
+	}
+	if limit <= 0 {
+		return readAll(r)
+	}
+	body, err := readAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		return nil, errTooLarge
+	}
+	return body, err
+}
+
+// exceedBudget records that the job overran the named budget and returns
+// the error to fail it with.
+func exceedBudget(job *Job, budget string) *JobError {
+	updateJob(job, func(job *Job) { job.BudgetExceeded = budget })
+	category := ErrPolicy
+	if budget == budgetDuration {
+		category = ErrTimeout
+	}
+	return &JobError{Category: category, Message: "exceeded the job's " + budget + " budget"}
+}
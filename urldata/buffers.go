@@ -0,0 +1,34 @@
+package urldata
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers larger than this are dropped rather than pooled, so that one huge
+// response does not stay allocated for good.
+const maxPooledBuffer = 4 << 20
+
+// bufferPool holds the buffers response bodies are read into. Reading into
+// a warm buffer avoids growing a new one from scratch for every fetch, as
+// io.ReadAll does.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// readAll reads r to the end into a pooled buffer, and returns a copy of
+// exactly the size read, since bodies outlive the buffer.
+func readAll(r io.Reader) ([]byte, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			bufferPool.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
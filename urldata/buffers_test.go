@@ -0,0 +1,48 @@
+package urldata
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReadAll(t *testing.T) {
+	var previous, previousBody []byte
+	for _, size := range []int{0, 10, 1 << 20, maxPooledBuffer + 1, 10} {
+		body := bytes.Repeat([]byte{byte('a' + size%26)}, size)
+		got, err := readAll(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("readAll of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("readAll of %d bytes returned %d bytes", size, len(got))
+		}
+		// Bodies outlive the pooled buffer they were read into.
+		if !bytes.Equal(previous, previousBody) {
+			t.Errorf("reading %d bytes changed the body read before", size)
+		}
+		previous, previousBody = got, body
+	}
+}
+
+// The body is read from an io.Reader that is not a bytes.Reader, as
+// response bodies are not, so neither read can size the buffer up front.
+type plainReader struct{ r io.Reader }
+
+func (p plainReader) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func benchmarkRead(b *testing.B, read func(io.Reader) ([]byte, error)) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		if _, err := read(plainReader{bytes.NewReader(body)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadAll reads a 1 MiB body into a pooled buffer, and
+// BenchmarkIOReadAll with io.ReadAll, as bodies were read before.
+func BenchmarkReadAll(b *testing.B)   { benchmarkRead(b, readAll) }
+func BenchmarkIOReadAll(b *testing.B) { benchmarkRead(b, io.ReadAll) }
@@ -0,0 +1,132 @@
+package urldata
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Canonicalizer normalises URLs into response cache keys, so that URLs
+// which differ only superficially share a cache entry. Canonicalize may
+// modify u in place.
+type Canonicalizer interface {
+	Canonicalize(u *url.URL)
+}
+
+// CanonicalizerFunc adapts a function to the Canonicalizer interface.
+type CanonicalizerFunc func(u *url.URL)
+
+// Canonicalize implements Canonicalizer.
+func (f CanonicalizerFunc) Canonicalize(u *url.URL) {
+	f(u)
+}
+
+// CanonicalRules is the built-in Canonicalizer. It always lower cases the
+// scheme and host, drops default ports and the fragment, and optionally
+// strips query parameters and normalises trailing slashes.
+type CanonicalRules struct {
+	// StripParams are query parameters to drop, such as tracking
+	// parameters. A trailing "*" matches any suffix, as in "utm_*".
+	StripParams   []string
+	TrailingSlash string // "strip" or "add" to normalise paths, "" to leave them alone
+	SortQuery     bool   // Order query parameters by name
+}
+
+// Canonicalize implements Canonicalizer.
+func (r CanonicalRules) Canonicalize(u *url.URL) {
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "http" && strings.HasSuffix(u.Host, ":80") || u.Scheme == "https" && strings.HasSuffix(u.Host, ":443") {
+		u.Host = u.Hostname()
+	}
+	u.Fragment = ""
+	switch r.TrailingSlash {
+	case "strip":
+		if len(u.Path) > 1 {
+			u.Path = strings.TrimRight(u.Path, "/")
+			u.RawPath = ""
+		}
+	case "add":
+		if !strings.HasSuffix(u.Path, "/") && !strings.Contains(u.Path[strings.LastIndex(u.Path, "/")+1:], ".") {
+			u.Path += "/"
+			u.RawPath = ""
+		}
+	}
+	if u.RawQuery == "" || len(r.StripParams) == 0 && !r.SortQuery {
+		return
+	}
+	// Rebuild the query by hand, since url.Values would also sort it.
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if pair != "" && !r.strips(name) {
+			kept = append(kept, pair)
+		}
+	}
+	if r.SortQuery {
+		sort.Strings(kept)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
+
+// strips reports whether the query parameter name is one of StripParams.
+func (r CanonicalRules) strips(name string) bool {
+	for _, p := range r.StripParams {
+		if p == name || strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+var canonicalMu sync.Mutex
+var defaultCanonicalizer Canonicalizer
+var hostCanonicalizers map[string]Canonicalizer
+
+// SetCanonicalizers configures how URLs are turned into cache keys.
+// defaultC applies to every host, and hosts maps host names (or "*.domain"
+// wildcards) to canonicalizers for specific hosts. Either may be nil; URLs
+// without a canonicalizer are their own cache keys.
+func SetCanonicalizers(defaultC Canonicalizer, hosts map[string]Canonicalizer) {
+	canonicalMu.Lock()
+	defer canonicalMu.Unlock()
+	defaultCanonicalizer = defaultC
+	hostCanonicalizers = hosts
+}
+
+// canonicalizerFor returns the canonicalizer for host, preferring an exact
+// match over a wildcard and a wildcard over the default.
+func canonicalizerFor(host string) Canonicalizer {
+	canonicalMu.Lock()
+	defer canonicalMu.Unlock()
+	if c, ok := hostCanonicalizers[host]; ok {
+		return c
+	}
+	for pattern, c := range hostCanonicalizers {
+		if MatchesHost(pattern, host) {
+			return c
+		}
+	}
+	return defaultCanonicalizer
+}
+
+// cacheKey returns the key of the responses cache for rawURL.
+func cacheKey(rawURL string) string {
+	c := canonicalizerFor(hostOf(rawURL))
+	if c == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	c.Canonicalize(u)
+	return u.String()
+}
@@ -0,0 +1,255 @@
+package urldata
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/graphql-go/graphql"
+)
+
+// defaultWarnDays is how many days before expiry certificate monitors warn
+// unless told otherwise.
+const defaultWarnDays = 14
+
+// Job types, set in JobOptions.Type.
+const (
+	JobFetch       = ""            // GET the URL
+	JobCertificate = "certificate" // Only complete a TLS handshake with the URL's host
+)
+
+// CertificateCheck is what a certificate job found out about the TLS
+// certificates of its host.
+type CertificateCheck struct {
+	TLSVersion  string
+	Chain       []Certificate // The certificates the server sent, its own first
+	Verified    bool          // Whether the chain is trusted for the host
+	VerifyError string        // Why it is not
+}
+
+// Certificate describes an X.509 certificate.
+type Certificate struct {
+	Subject      string
+	Issuer       string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	DNSNames     []string
+	SHA256       string // Hex encoded fingerprint of the DER encoding
+}
+
+// Expires returns the earliest expiry of the certificates in the chain.
+func (c *CertificateCheck) Expires() time.Time {
+	var earliest time.Time
+	for _, cert := range c.Chain {
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest
+}
+
+// checkCertificate connects to the job's host the way a fetch would, but
+// stops after the TLS handshake. The certificates are recorded even if
+// they are not trusted; the job only fails if no handshake was possible.
+func checkCertificate(ctx context.Context, job *Job) {
+	u, err := url.Parse(job.URL)
+	if err != nil || u.Scheme != "https" {
+		failJob(nil, job, policyError("certificate jobs need an https URL"))
+		return
+	}
+	client, err := clientFor(job)
+	if err != nil {
+		failJob(nil, job, policyError("bad transport settings: %v", err))
+		return
+	}
+	transport := client.Transport.(*http.Transport)
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	serverName := host
+	if job.Options.ServerName != "" {
+		serverName = job.Options.ServerName
+	}
+	recordEvent(job, "request", "TLS handshake with %s", net.JoinHostPort(host, port))
+	conn, err := transport.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		failJob(ctx, job, classifyError(err))
+		return
+	}
+	defer conn.Close()
+	config := transport.TLSClientConfig.Clone()
+	config.ServerName = serverName
+	// The chain is verified below, so an untrusted or expired certificate
+	// can still be described.
+	config.InsecureSkipVerify = true
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		failJob(ctx, job, classifyError(err))
+		return
+	}
+	state := tlsConn.ConnectionState()
+	check := &CertificateCheck{TLSVersion: tlsVersions[state.Version], Verified: true}
+	for _, cert := range state.PeerCertificates {
+		check.Chain = append(check.Chain, describeCertificate(cert))
+	}
+	if len(state.PeerCertificates) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: intermediates,
+			CurrentTime:   clock.Now(),
+		})
+		if err != nil {
+			check.Verified, check.VerifyError = false, err.Error()
+		}
+	}
+	updateJob(job, func(job *Job) {
+		job.Certificate = check
+		job.Status = "done"
+	})
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func describeCertificate(cert *x509.Certificate) Certificate {
+	sum := sha256.Sum256(cert.Raw)
+	return Certificate{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		DNSNames:     cert.DNSNames,
+		SHA256:       hex.EncodeToString(sum[:]),
+	}
+}
+
+// warnCertificateExpiry tells the monitor's notifier when the certificates
+// checked by its job expire within m.WarnDays, once per server certificate.
+// It returns the fingerprint of the certificate warned about last.
+func warnCertificateExpiry(job *Job, m Monitor) string {
+	check := job.Certificate
+	if job.Status != "done" || check == nil || len(check.Chain) == 0 {
+		return m.warned
+	}
+	expires := check.Expires()
+	left := expires.Sub(clock.Now())
+	leaf := check.Chain[0]
+	if left > time.Duration(m.WarnDays)*24*time.Hour || leaf.SHA256 == m.warned {
+		return m.warned
+	}
+	if m.Notify != "" {
+		notifyAll([]string{m.Notify}, notify.Message{
+			Title: fmt.Sprintf("Certificate of %s expires in %d days", hostOf(job.URL), int(left.Hours()/24)),
+			Text:  fmt.Sprintf("A certificate in the chain of %s expires at %s.", leaf.Subject, expires.Format(time.RFC3339)),
+			Fields: map[string]string{
+				"expires":  expires.Format(time.RFC3339),
+				"issuer":   leaf.Issuer,
+				"verified": strconv.FormatBool(check.Verified),
+			},
+			Link: resultLink(fmt.Sprintf(`{ job(id: "%d") { certificate { expires verified chain { subject notAfter } } } }`, job.ID)),
+		})
+	}
+	return leaf.SHA256
+}
+
+func certificateCheckType() *graphql.Object {
+	certificateType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Certificate",
+		Fields: graphql.Fields{
+			"subject": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Distinguished name of the subject",
+			},
+			"issuer": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Distinguished name of the issuer",
+			},
+			"serialNumber": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Serial number in decimal",
+			},
+			"notBefore": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "Start of the validity period",
+			},
+			"notAfter": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "End of the validity period",
+			},
+			"dnsNames": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Host names the certificate is valid for",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Certificate).DNSNames, nil
+				},
+			},
+			"sha256": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Hex encoded SHA-256 fingerprint",
+			},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "CertificateCheck",
+		Fields: graphql.Fields{
+			"tlsVersion": &graphql.Field{
+				Type:        graphql.String,
+				Description: "TLS version negotiated",
+			},
+			"chain": &graphql.Field{
+				Type:        graphql.NewList(certificateType),
+				Description: "The certificates sent by the server, its own first",
+			},
+			"verified": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the chain is trusted for the host",
+			},
+			"verifyError": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Why the chain is not trusted",
+			},
+			"expires": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "Earliest expiry of the certificates in the chain",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := p.Source.(*CertificateCheck).Expires(); !t.IsZero() {
+						return t, nil
+					}
+					return nil, nil
+				},
+			},
+			"daysLeft": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Whole days until the earliest expiry, negative once expired",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					t := p.Source.(*CertificateCheck).Expires()
+					if t.IsZero() {
+						return nil, nil
+					}
+					return int(t.Sub(clock.Now()).Hours() / 24), nil
+				},
+			},
+		},
+	})
+}
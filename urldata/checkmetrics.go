@@ -0,0 +1,53 @@
+package urldata
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/metrics"
+)
+
+var checkMetricsMu sync.Mutex
+var checkMetrics *metrics.RemoteWriter
+
+// SetCheckMetrics sends the outcome of every monitor check to w, or stops
+// if w is nil, so that per-URL latency and status land in an existing
+// Prometheus-compatible stack.
+func SetCheckMetrics(w *metrics.RemoteWriter) {
+	checkMetricsMu.Lock()
+	defer checkMetricsMu.Unlock()
+	checkMetrics = w
+}
+
+// writeCheckMetrics queues the samples of a finished monitor job:
+//
+//	urlfetcher_check_up                1 if the job succeeded, else 0
+//	urlfetcher_check_duration_seconds  from sending the request to the response
+//	urlfetcher_check_status_code       of the response, if there is one
+func writeCheckMetrics(m *Monitor, job *Job) {
+	checkMetricsMu.Lock()
+	w := checkMetrics
+	checkMetricsMu.Unlock()
+	if w == nil {
+		return
+	}
+	state := GetJobState(job)
+	now := clock.Now()
+	labels := map[string]string{
+		"url":     job.URL,
+		"monitor": strconv.FormatInt(m.ID, 10),
+		"kind":    m.Kind,
+	}
+	up := 0.0
+	if state.Status == "done" {
+		up = 1
+	}
+	w.Add("urlfetcher_check_up", labels, up, now)
+	latency := requestLatency(job)
+	if state.Response != nil {
+		latency = fetchLatency(job, state.Response)
+		w.Add("urlfetcher_check_status_code", labels, float64(state.Response.StatusCode), now)
+	}
+	w.Add("urlfetcher_check_duration_seconds", labels, float64(latency)/float64(time.Second), now)
+}
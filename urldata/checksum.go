@@ -0,0 +1,72 @@
+package urldata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+// Whether BLAKE3 checksums are computed in addition to SHA-256.
+var blake3Enabled = false
+
+// SetBLAKE3Checksums enables or disables computing BLAKE3 checksums of
+// response bodies. SHA-256 checksums are always computed.
+func SetBLAKE3Checksums(enabled bool) {
+	blake3Enabled = enabled
+}
+
+// Checksums holds hex encoded digests of a response body.
+type Checksums struct {
+	SHA256 string
+	BLAKE3 string // Empty unless BLAKE3 checksums are enabled
+}
+
+func computeChecksums(body []byte) Checksums {
+	sum := sha256.Sum256(body)
+	c := Checksums{SHA256: hex.EncodeToString(sum[:])}
+	if blake3Enabled {
+		b := blake3.Sum256(body)
+		c.BLAKE3 = hex.EncodeToString(b[:])
+	}
+	return c
+}
+
+// Verify recomputes the checksums of the body and reports whether they
+// match the ones recorded when the response was stored.
+func (r *Response) Verify() bool {
+	body := r.Body
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != r.Checksums.SHA256 {
+		return false
+	}
+	if r.Checksums.BLAKE3 != "" {
+		b := blake3.Sum256(body)
+		if hex.EncodeToString(b[:]) != r.Checksums.BLAKE3 {
+			return false
+		}
+	}
+	return true
+}
+
+// Corrupt reports whether the body did not match its checksums when the
+// response was read back from storage. Such responses are not served from
+// the cache.
+func (r *Response) Corrupt() bool {
+	return r.corrupt
+}
+
+// checkStored is called once for a response read back from storage. It
+// flags the response as corrupt if its body does not match its checksums,
+// and computes them for responses stored before there were any.
+func (r *Response) checkStored() {
+	if r.Checksums.SHA256 == "" {
+		r.Checksums = computeChecksums(r.Body)
+		return
+	}
+	if !r.Verify() {
+		r.corrupt = true
+		fmt.Println("checksum mismatch for stored response", RedactURL(r.URL))
+	}
+}
@@ -0,0 +1,41 @@
+package urldata
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStoredChecksums(t *testing.T) {
+	body := []byte("stored body")
+	r := &Response{URL: "http://example.test/", StatusCode: 200, Body: body, Checksums: computeChecksums(body)}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var read Response
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.Corrupt() {
+		t.Error("intact response flagged as corrupt")
+	}
+
+	var tampered Response
+	if err := json.Unmarshal([]byte(strings.Replace(string(data), "stored body", "altered body", 1)), &tampered); err != nil {
+		t.Fatal(err)
+	}
+	if !tampered.Corrupt() {
+		t.Error("altered body not flagged as corrupt")
+	}
+
+	// Responses stored before checksums existed get them on reading.
+	var old Response
+	if err := json.Unmarshal([]byte(`{"URL": "http://example.test/", "Body": "stored body"}`), &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Corrupt() || old.Checksums.SHA256 != r.Checksums.SHA256 {
+		t.Errorf("old response: corrupt %t, sha256 %q; want %q", old.Corrupt(), old.Checksums.SHA256, r.Checksums.SHA256)
+	}
+}
@@ -0,0 +1,49 @@
+package urldata
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass. Everything in the package
+// that depends on the time of day, such as cache freshness, goes through
+// the package clock so tests can substitute a simulated one.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock is the package clock. It delegates to the clock set by SetClock,
+// which tests may swap while workers are reading it.
+var clock Clock = packageClock{}
+
+var clockMu sync.RWMutex
+var currentClock Clock = realClock{}
+
+type packageClock struct{}
+
+func (packageClock) current() Clock {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return currentClock
+}
+
+func (c packageClock) Now() time.Time                         { return c.current().Now() }
+func (c packageClock) After(d time.Duration) <-chan time.Time { return c.current().After(d) }
+
+// SetClock replaces the package clock. Passing nil restores the system clock.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	currentClock = c
+}
@@ -0,0 +1,127 @@
+package urldata
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/graphql-go/graphql"
+)
+
+// cloneJobField returns the mutation that resubmits an existing job.
+func cloneJobField(jobType *graphql.Object) *graphql.Field {
+	overrideFields := graphql.InputObjectConfigFieldMap{
+		"url": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "URL to fetch instead of the original one",
+		},
+	}
+	for name, arg := range jobOptionArgs() {
+		overrideFields[name] = &graphql.InputObjectFieldConfig{Type: arg.Type, Description: arg.Description}
+	}
+	overridesType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "JobOverrides",
+		Description: "Settings of a cloned job that differ from the original",
+		Fields:      overrideFields,
+	})
+
+	return &graphql.Field{
+		Type:        jobType,
+		Description: "Add a new job with the URL and options of an existing one, optionally changing some of them.",
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Description: "id of the job to clone",
+				Type:        graphql.NewNonNull(graphql.String),
+			},
+			"overrides": &graphql.ArgumentConfig{
+				Type: overridesType,
+			},
+		},
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			id, err := strconv.Atoi(params.Args["id"].(string))
+			if err != nil {
+				return nil, err
+			}
+			original := GetJob(int64(id))
+			if original == nil || !CanView(params.Context, original) {
+				return nil, fmt.Errorf("job %d not found", id)
+			}
+			url, opts := original.URL, original.Options
+			opts.Batch = 0
+			opts.Monitor = 0
+			overrides, _ := params.Args["overrides"].(map[string]interface{})
+			if u, ok := overrides["url"].(string); ok {
+				url = u
+			}
+			if err := parseJobOptions(params.Context, overrides, &opts); err != nil {
+				return nil, err
+			}
+			if id := auth.FromContext(params.Context); id != nil {
+				opts.Tenant = id.Tenant
+				opts.Owner = id.Owner
+			}
+			return SubmitJob(params.Context, url, opts)
+		},
+	}
+}
+
+// ReplayJob adds a job re-issuing the request of the job with the given ID,
+// to reproduce intermittent failures. The new job keeps the original's URL
+// and options, with the client certificate, tunnel and egress route the
+// original was fetched with pinned, even if it got them from host rules.
+// It always fetches, bypassing the cache. Tenant and owner are taken from
+// opts.
+func ReplayJob(id int64, opts JobOptions) (*Job, error) {
+	original := GetJob(id)
+	if original == nil {
+		return nil, fmt.Errorf("job %d not found", id)
+	}
+	if err := admitJob(); err != nil {
+		return nil, err
+	}
+	replay := original.Options
+	replay.Tenant = opts.Tenant
+	replay.Owner = opts.Owner
+	replay.Batch = 0
+	replay.Monitor = 0
+	replay.Replay = id
+	replay.ClientCert = clientCertFor(original)
+	replay.Tunnel = tunnelFor(original)
+	replay.Egress = egressFor(original)
+	replay.NoCache = true
+	// The scheduling of the original has passed by now.
+	replay.NotBefore = time.Time{}
+	replay.Deadline = time.Time{}
+	job := AddJobWithOptions(original.URL, replay)
+	return &job, nil
+}
+
+// replayJobField returns the mutation that replays an existing job.
+func replayJobField(jobType *graphql.Object) *graphql.Field {
+	return &graphql.Field{
+		Type:        jobType,
+		Description: "Re-issue the request of an existing job as a new job linked to it, to reproduce intermittent failures.",
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Description: "id of the job to replay",
+				Type:        graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			id, err := strconv.Atoi(params.Args["id"].(string))
+			if err != nil {
+				return nil, err
+			}
+			if original := GetJob(int64(id)); original == nil || !CanView(params.Context, original) {
+				return nil, fmt.Errorf("job %d not found", id)
+			}
+			opts := JobOptions{}
+			if id := auth.FromContext(params.Context); id != nil {
+				opts.Tenant = id.Tenant
+				opts.Owner = id.Owner
+			}
+			return ReplayJob(int64(id), opts)
+		},
+	}
+}
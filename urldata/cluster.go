@@ -0,0 +1,85 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dsoo/urlfetcher/client"
+	"github.com/dsoo/urlfetcher/cluster"
+)
+
+// Cluster routing, set up by SetCluster.
+var clusterSelf string
+var clusterRing *cluster.Ring
+var clusterPeers = map[string]*client.Client{}
+
+// SetCluster makes jobs for hosts owned by other instances be forwarded
+// to them. self and instances are base URLs of the instances, and apiKey
+// authenticates forwarded requests if set.
+func SetCluster(self string, instances []string, apiKey string) {
+	clusterSelf = strings.TrimRight(self, "/")
+	clusterRing = cluster.NewRing(instances)
+	clusterPeers = map[string]*client.Client{}
+	for _, instance := range instances {
+		instance = strings.TrimRight(instance, "/")
+		c := client.NewClient(instance, apiKey)
+		c.Header = http.Header{cluster.ForwardedHeader: {clusterSelf}}
+		clusterPeers[instance] = c
+	}
+}
+
+// SubmitJob adds a job for url, unless another instance of the cluster
+// owns its host; then the job is forwarded there, and the returned job
+// describes the remote one.
+func SubmitJob(ctx context.Context, url string, opts JobOptions) (*Job, error) {
+	if err := CheckJobTarget(url, opts); err != nil {
+		return nil, err
+	}
+	owner := ""
+	if clusterRing != nil && !cluster.Forwarded(ctx) {
+		owner = clusterRing.Owner(hostOf(url))
+	}
+	if owner == "" || owner == clusterSelf {
+		if err := admitJob(); err != nil {
+			return nil, err
+		}
+		job := AddJobWithOptions(url, opts)
+		return &job, nil
+	}
+
+	// The owner trusts the identity headers from the cluster's API key.
+	ctx = client.WithHeader(ctx, cluster.IdentityHeader(opts.Tenant, opts.Owner))
+	remote, err := clusterPeers[owner].AddJob(ctx, url, &client.JobOptions{
+		Type:           opts.Type,
+		Tags:           opts.Tags,
+		Notify:         opts.Notify,
+		MaxBytes:       opts.MaxBytes,
+		MaxDuration:    opts.MaxDuration,
+		Deadline:       opts.Deadline,
+		NotBefore:      opts.NotBefore,
+		ClientCert:     opts.ClientCert,
+		HostHeader:     opts.HostHeader,
+		ServerName:     opts.ServerName,
+		ConnectAddress: opts.ConnectAddress,
+		Tunnel:         opts.Tunnel,
+		Egress:         opts.Egress,
+		Pool:           opts.Pool,
+		Preset:         opts.Preset,
+		Debug:          opts.Debug,
+		Metadata:       opts.Metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to forward job to %s: %v", owner, err)
+	}
+	return &Job{
+		ID:       remote.ID,
+		URL:      remote.URL,
+		Status:   remote.Status,
+		Tenant:   remote.Tenant,
+		Owner:    remote.Owner,
+		Options:  opts,
+		Instance: owner,
+	}, nil
+}
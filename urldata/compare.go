@@ -0,0 +1,221 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/graphql-go/graphql"
+)
+
+// RouteResult is how one egress route answered a compared URL.
+type RouteResult struct {
+	Egress     string // Route fetched through, "" for the default route
+	JobID      int64
+	Status     string // Status of the job, unfinished if the wait timed out
+	StatusCode int
+	SHA256     string // Digest of the body
+	Size       int
+	Latency    time.Duration // From sending the request to receiving the whole response
+	Error      string
+}
+
+// Comparison holds the results of fetching a URL through several egress
+// routes, to find out how its content varies by vantage point.
+type Comparison struct {
+	URL    string
+	Routes []RouteResult
+}
+
+// Identical reports whether every route got the same status code and body.
+// Routes that failed or have not finished differ from all others.
+func (c *Comparison) Identical() bool {
+	for _, r := range c.Routes {
+		if r.Status != "done" || r.StatusCode != c.Routes[0].StatusCode || r.SHA256 != c.Routes[0].SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareFetch fetches url through each of the egress routes, "" standing
+// for the default one, and waits up to timeout, or until ctx is done, for
+// the results. Each route gets a job of its own that bypasses the cache,
+// so the routes are fetched concurrently by as many workers as are free.
+func CompareFetch(ctx context.Context, url string, egresses []string, opts JobOptions, timeout time.Duration) (*Comparison, error) {
+	for _, name := range egresses {
+		if name == "" {
+			continue
+		}
+		egressMu.Lock()
+		_, ok := egressRoutes[name]
+		egressMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown egress %q", name)
+		}
+	}
+	if err := admitJob(); err != nil {
+		return nil, err
+	}
+	opts.NoCache = true
+	var ids []int64
+	for _, name := range egresses {
+		opts.Egress = name
+		job := AddJobWithOptions(url, opts)
+		ids = append(ids, job.ID)
+	}
+	c := &Comparison{URL: url}
+	for i, job := range WaitForJobs(ctx, ids, timeout) {
+		r := RouteResult{Egress: egresses[i], JobID: ids[i]}
+		if job != nil {
+			state := GetJobState(job)
+			r.Status = state.Status
+			if resp := state.Response; resp != nil {
+				r.StatusCode = resp.StatusCode
+				r.SHA256 = resp.Checksums.SHA256
+				r.Size = len(resp.Body)
+				r.Latency = fetchLatency(job, resp)
+			}
+			if state.Error != nil {
+				r.Error = state.Error.Message
+			}
+		}
+		c.Routes = append(c.Routes, r)
+	}
+	return c, nil
+}
+
+// fetchLatency returns the time from the job's last request to receiving
+// all of resp, or 0 if the job sent no request.
+func fetchLatency(job *Job, resp *Response) time.Duration {
+	events := jobEvents(job)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == "request" && !events[i].Time.After(resp.Timestamp) {
+			return resp.Timestamp.Sub(events[i].Time)
+		}
+	}
+	return 0
+}
+
+// compareFetchField returns the mutation that compares a URL across egress
+// routes.
+func compareFetchField() *graphql.Field {
+	routeType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "RouteResult",
+		Description: "How one egress route answered a compared URL",
+		Fields: graphql.Fields{
+			"egress": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Egress route fetched through, null for the default route",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if name := p.Source.(RouteResult).Egress; name != "" {
+						return name, nil
+					}
+					return nil, nil
+				},
+			},
+			"jobId": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Job that fetched through the route",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(RouteResult).JobID, nil
+				},
+			},
+			"status": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Status of the job, unfinished if the wait timed out",
+			},
+			"statusCode": &graphql.Field{
+				Type: graphql.Int,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if code := p.Source.(RouteResult).StatusCode; code != 0 {
+						return code, nil
+					}
+					return nil, nil
+				},
+			},
+			"sha256": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Hex encoded SHA-256 digest of the body",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if sum := p.Source.(RouteResult).SHA256; sum != "" {
+						return sum, nil
+					}
+					return nil, nil
+				},
+			},
+			"size": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Length of the body in bytes",
+			},
+			"latencyMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Milliseconds from sending the request to receiving the whole response",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if d := p.Source.(RouteResult).Latency; d > 0 {
+						return float64(d) / float64(time.Millisecond), nil
+					}
+					return nil, nil
+				},
+			},
+			"error": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if msg := p.Source.(RouteResult).Error; msg != "" {
+						return msg, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+	comparisonType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Comparison",
+		Description: "Results of fetching a URL through several egress routes",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type: graphql.String,
+			},
+			"routes": &graphql.Field{
+				Type: graphql.NewList(routeType),
+			},
+			"identical": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether every route got the same status code and body",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Comparison).Identical(), nil
+				},
+			},
+		},
+	})
+	return &graphql.Field{
+		Type:        comparisonType,
+		Description: "Fetch a URL through several egress routes concurrently and compare the results, to debug content that varies by geography.",
+		Args: graphql.FieldConfigArgument{
+			"url": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"egresses": &graphql.ArgumentConfig{
+				Description: "Names of the egress routes to fetch through; an empty name stands for the default route",
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			},
+			"timeoutSeconds": &graphql.ArgumentConfig{
+				Description: "How long to wait for the routes at most, 30 seconds by default and 300 at most",
+				Type:        graphql.Int,
+			},
+		},
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			egresses := stringList(params.Args["egresses"])
+			if len(egresses) == 0 {
+				return nil, fmt.Errorf("egresses must not be empty")
+			}
+			opts := JobOptions{}
+			if id := auth.FromContext(params.Context); id != nil {
+				opts.Tenant = id.Tenant
+				opts.Owner = id.Owner
+			}
+			return CompareFetch(params.Context, params.Args["url"].(string), egresses, opts, waitDuration(params.Args["timeoutSeconds"], defaultJobWait))
+		},
+	}
+}
@@ -0,0 +1,276 @@
+package urldata
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsoo/urlfetcher/metrics"
+	"github.com/graphql-go/graphql"
+)
+
+// Guards connSlots and maxConns.
+var connsMu sync.Mutex
+var connSlots chan struct{} // nil for no limit
+var maxConns int
+
+var openConns int64 // Outbound connections open, updated atomically
+var connWaits int64 // Dials that waited for a connection to close
+
+// connWaitInterval is how often a dial waiting for a connection to close
+// closes the idle pooled connections again, since connections returned to
+// the pool while it waits would otherwise hold it up until they time out.
+const connWaitInterval = 100 * time.Millisecond
+
+// SetMaxConnections limits the outbound connections open at once to n, so
+// that the server slows down rather than running out of file descriptors.
+// If n is 0 there is no limit, which is the default. If n is -1, the limit
+// is three quarters of the process's open file limit, leaving the rest to
+// the journal, the API and everything else, or none if that limit is not
+// known. A dial beyond the limit closes the idle pooled connections, and
+// waits for a connection to close.
+func SetMaxConnections(n int) {
+	slots, max := connLimit(n)
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	connSlots, maxConns = slots, max
+}
+
+// connLimit returns the slots and limit of connections for
+// SetMaxConnections(n).
+func connLimit(n int) (chan struct{}, int) {
+	if n == -1 {
+		n = maxFDs() * 3 / 4
+	}
+	if n <= 0 {
+		return nil, 0
+	}
+	return make(chan struct{}, n), n
+}
+
+// countedDial returns dial, counting the connections it opens against the
+// limit.
+func countedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		release, err := acquireConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return &countedConn{Conn: conn, release: release}, nil
+	}
+}
+
+// acquireConn counts a connection about to be opened, waiting while the
+// limit is reached, and returns the function to call once it is closed.
+func acquireConn(ctx context.Context) (func(), error) {
+	connsMu.Lock()
+	slots := connSlots
+	connsMu.Unlock()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			atomic.AddInt64(&connWaits, 1)
+			if err := waitForConn(ctx, slots); err != nil {
+				return nil, err
+			}
+		}
+	}
+	atomic.AddInt64(&openConns, 1)
+	return func() {
+		atomic.AddInt64(&openConns, -1)
+		if slots != nil {
+			<-slots
+		}
+	}, nil
+}
+
+// waitForConn takes a slot once a connection has closed, closing the idle
+// pooled connections every connWaitInterval until then.
+func waitForConn(ctx context.Context, slots chan struct{}) error {
+	timer := time.NewTimer(connWaitInterval)
+	defer timer.Stop()
+	for {
+		closeIdleConnections()
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			timer.Reset(connWaitInterval)
+		}
+	}
+}
+
+// closeIdleConnections closes the idle connections of every HTTP client,
+// to make room for new ones.
+func closeIdleConnections() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, client := range clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// countedConn is a connection counted against the limit until it is
+// closed.
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// ConnectionStats describes the outbound connections and file descriptors
+// of the process.
+type ConnectionStats struct {
+	Open    int   // Outbound connections open
+	Max     int   // Limit on Open, 0 for none
+	Waits   int64 // Dials that had to wait for a connection to close
+	OpenFDs int   // Files the process has open, -1 if not known
+	MaxFDs  int   // Limit on OpenFDs, -1 if not known or unlimited
+}
+
+func connectionStats() ConnectionStats {
+	connsMu.Lock()
+	max := maxConns
+	connsMu.Unlock()
+	return ConnectionStats{
+		Open:    int(atomic.LoadInt64(&openConns)),
+		Max:     max,
+		Waits:   atomic.LoadInt64(&connWaits),
+		OpenFDs: openFDs(),
+		MaxFDs:  maxFDs(),
+	}
+}
+
+// openFDs returns the number of files the process has open, or -1 if it
+// cannot tell, as outside Linux.
+func openFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// Not counting the directory being read.
+	return len(names) - 1
+}
+
+// maxFDs returns the soft limit on the files the process may open, or -1
+// if it is unlimited or cannot be told, as outside Linux.
+func maxFDs() int {
+	data, err := os.ReadFile("/proc/self/limits")
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Max open files") {
+			fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+			if len(fields) > 0 {
+				if n, err := strconv.Atoi(fields[0]); err == nil {
+					return n
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// connectionMetrics returns the connection and file descriptor statistics
+// as Prometheus metrics, the latter under the names of the standard process
+// collector.
+func connectionMetrics(s ConnectionStats) []metrics.Family {
+	families := []metrics.Family{
+		{
+			Name: "urlfetcher_open_connections", Help: "Outbound connections open.", Type: metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(s.Open)}},
+		},
+		{
+			Name: "urlfetcher_max_connections", Help: "Limit on the outbound connections open, 0 for none.", Type: metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(s.Max)}},
+		},
+		{
+			Name: "urlfetcher_connection_waits_total", Help: "Dials that waited for a connection to close.", Type: metrics.Counter,
+			Samples: []metrics.Sample{{Value: float64(s.Waits)}},
+		},
+	}
+	if s.OpenFDs >= 0 {
+		families = append(families, metrics.Family{
+			Name: "process_open_fds", Help: "Number of open file descriptors.", Type: metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(s.OpenFDs)}},
+		})
+	}
+	if s.MaxFDs >= 0 {
+		families = append(families, metrics.Family{
+			Name: "process_max_fds", Help: "Maximum number of open file descriptors.", Type: metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(s.MaxFDs)}},
+		})
+	}
+	return families
+}
+
+func connectionStatsType() *graphql.Object {
+	orNull := func(n int) interface{} {
+		if n <= 0 {
+			return nil
+		}
+		return n
+	}
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "ConnectionStats",
+		Fields: graphql.Fields{
+			"open": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Outbound connections open",
+			},
+			"max": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Limit on the outbound connections open, null if there is none",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return orNull(p.Source.(ConnectionStats).Max), nil
+				},
+			},
+			"waits": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Dials that waited for a connection to close since the server started",
+			},
+			"openFileDescriptors": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Files the process has open, null if it cannot tell",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if n := p.Source.(ConnectionStats).OpenFDs; n >= 0 {
+						return n, nil
+					}
+					return nil, nil
+				},
+			},
+			"maxFileDescriptors": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Limit on the files the process may open, null if unlimited or unknown",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return orNull(p.Source.(ConnectionStats).MaxFDs), nil
+				},
+			},
+		},
+	})
+}
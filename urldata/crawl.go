@@ -0,0 +1,132 @@
+package urldata
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Limits of a crawl unless it is given its own.
+const (
+	defaultCrawlPages = 100
+	defaultCrawlDepth = 3
+	defaultCrawlLinks = 1000
+)
+
+// CrawlOptions limits a crawl.
+type CrawlOptions struct {
+	MaxPages int // Pages to fetch at most, defaultCrawlPages if 0
+	MaxDepth int // Links to follow at most from the start
+	// CheckLinks also fetches each link the crawl does not follow, such
+	// as those to other hosts, to find broken links, up to MaxLinks of
+	// them (defaultCrawlLinks if 0).
+	CheckLinks bool
+	MaxLinks   int
+}
+
+// crawl is the state of a batch that follows the links of its pages.
+type crawl struct {
+	CrawlOptions
+	host    string          // Only links to this host are followed
+	seen    map[string]bool // URLs of the pages added to the batch
+	checked map[string]bool // URLs of the links added only to be checked
+}
+
+// Crawl fetches url and then the pages it links to on the same host,
+// breadth first, until c.MaxPages pages were added or no links are left
+// within c.MaxDepth links of url. The pages form a batch, whose notifier is
+// told once the crawl has finished.
+func Crawl(rawURL string, c CrawlOptions, opts JobOptions) (*Batch, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("crawls need an http or https URL")
+	}
+	if c.MaxPages <= 0 {
+		c.MaxPages = defaultCrawlPages
+	}
+	if c.MaxDepth < 0 {
+		c.MaxDepth = defaultCrawlDepth
+	}
+	if c.MaxLinks <= 0 {
+		c.MaxLinks = defaultCrawlLinks
+	}
+	u.Fragment = ""
+	b, err := AddBatch(nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	batchesMu.Lock()
+	batches[b.ID].crawl = &crawl{
+		CrawlOptions: c,
+		host:         strings.ToLower(u.Host),
+		seen:         map[string]bool{},
+		checked:      map[string]bool{},
+	}
+	batchesMu.Unlock()
+	addToCrawl(b.ID, []string{u.String()}, 0, opts)
+	return GetBatch(b.ID), nil
+}
+
+// crawlJobFinished adds the unseen links of a crawled page to its batch.
+// It runs before batchJobFinished, so the batch cannot finish while there
+// are pages left to add.
+func crawlJobFinished(job *Job) {
+	if job.Options.Batch == 0 || job.Options.LinkCheck || job.Response == nil || job.Status == "error" {
+		return
+	}
+	if err := admitJob(); err != nil {
+		// Shedding load, the crawl stops growing rather than queueing
+		// more pages.
+		fmt.Println("not following the links of job", job.ID, "error:", err)
+		return
+	}
+	depth := job.Options.CrawlDepth + 1
+	addToCrawl(job.Options.Batch, job.Response.Links, depth, job.Options)
+}
+
+// addToCrawl adds a job at the given depth for each URL that the crawl of
+// the batch should follow and has not seen yet, and a link check job for
+// the others if the crawl checks links.
+func addToCrawl(batchID int64, urls []string, depth int, opts JobOptions) {
+	batchesMu.Lock()
+	b, ok := batches[batchID]
+	if !ok || b.crawl == nil {
+		batchesMu.Unlock()
+		return
+	}
+	c := b.crawl
+	var follow, check []string
+	for _, link := range urls {
+		if c.seen[link] || c.checked[link] {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err == nil && strings.ToLower(u.Host) == c.host && depth <= c.MaxDepth && len(c.seen) < c.MaxPages {
+			c.seen[link] = true
+			follow = append(follow, link)
+		} else if c.CheckLinks && len(c.checked) < c.MaxLinks {
+			c.checked[link] = true
+			check = append(check, link)
+		}
+	}
+	b.Pending += len(follow) + len(check)
+	batchesMu.Unlock()
+
+	opts.Batch = batchID
+	opts.CrawlDepth = depth
+	opts.Notify = ""
+	for _, link := range follow {
+		job := AddJobWithOptions(link, opts)
+		batchesMu.Lock()
+		b.JobIDs = append(b.JobIDs, job.ID)
+		batchesMu.Unlock()
+	}
+	opts.LinkCheck = true
+	for _, link := range check {
+		job := AddJobWithOptions(link, opts)
+		batchesMu.Lock()
+		b.JobIDs = append(b.JobIDs, job.ID)
+		batchesMu.Unlock()
+	}
+}
@@ -0,0 +1,91 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+)
+
+// ResponseResolver computes a custom field of a response for the caller
+// in ctx.
+type ResponseResolver func(ctx context.Context, r *Response) (interface{}, error)
+
+// JobResolver computes a custom field of a job for the caller in ctx. Use
+// GetJobState to read the fields that change while the job runs.
+type JobResolver func(ctx context.Context, job *Job) (interface{}, error)
+
+// customField is a field registered by embedding code.
+type customField struct {
+	typ     graphql.Output
+	resolve graphql.FieldResolveFn
+}
+
+var fieldNamePattern = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// Guards responseFields and jobFields.
+var customFieldsMu sync.Mutex
+var responseFields = map[string]customField{}
+var jobFields = map[string]customField{}
+
+// RegisterResponseField adds a field of type typ, computed by resolve, to
+// the Response type of schemas built by SchemaConfig from then on, so that
+// deployments can add fields such as a custom score without changing the
+// package. Like sql.Register, it panics if the name is not a valid GraphQL
+// name or is registered twice; SchemaConfig panics if it is the name of a
+// built-in field.
+func RegisterResponseField(name string, typ graphql.Output, resolve ResponseResolver) {
+	registerField(responseFields, name, typ, func(p graphql.ResolveParams) (interface{}, error) {
+		return resolve(p.Context, p.Source.(*Response))
+	})
+}
+
+// RegisterJobField is RegisterResponseField for the Job type.
+func RegisterJobField(name string, typ graphql.Output, resolve JobResolver) {
+	registerField(jobFields, name, typ, func(p graphql.ResolveParams) (interface{}, error) {
+		return resolve(p.Context, jobOf(p.Source))
+	})
+}
+
+func registerField(fields map[string]customField, name string, typ graphql.Output, resolve graphql.FieldResolveFn) {
+	if !fieldNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("urldata: invalid field name %q", name))
+	}
+	if typ == nil {
+		panic(fmt.Sprintf("urldata: field %s has no type", name))
+	}
+	customFieldsMu.Lock()
+	defer customFieldsMu.Unlock()
+	if _, dup := fields[name]; dup {
+		panic(fmt.Sprintf("urldata: field %s registered twice", name))
+	}
+	fields[name] = customField{typ: typ, resolve: resolve}
+}
+
+// addCustomFields adds the registered fields to the Response and Job
+// types.
+func addCustomFields(responseType, jobType *graphql.Object) {
+	customFieldsMu.Lock()
+	defer customFieldsMu.Unlock()
+	addFields(responseType, responseFields)
+	addFields(jobType, jobFields)
+}
+
+func addFields(object *graphql.Object, fields map[string]customField) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	builtin := object.Fields()
+	for _, name := range names {
+		if _, ok := builtin[name]; ok {
+			panic(fmt.Sprintf("urldata: registered field %s.%s is a built-in field", object.Name(), name))
+		}
+		f := fields[name]
+		object.AddFieldConfig(name, &graphql.Field{Type: f.typ, Resolve: f.resolve})
+	}
+}
@@ -0,0 +1,230 @@
+package urldata
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Most of the body of a redirect response kept for debugging.
+const maxDebugBody = 16 << 10
+
+// DebugInfo is what is captured of a job run with the debug option, to
+// find out why a fetch misbehaves. It is only kept for such jobs, as it
+// takes up space.
+type DebugInfo struct {
+	// Requests are the requests as written, after URL rewrites and the
+	// headers of host profiles, one per redirect. Authorization headers,
+	// and the headers and query parameters of the redaction rules, are
+	// redacted.
+	Requests []string `json:"requests"`
+	// Redirects are the redirect responses as received, with the start of
+	// their bodies.
+	Redirects []string `json:"redirects"`
+	// Log lists what the transport did: lookups, connections, handshakes
+	// and so on, timed from the start of the fetch.
+	Log []string `json:"log"`
+}
+
+// debugRecorder builds the DebugInfo of a fetch.
+type debugRecorder struct {
+	mu    sync.Mutex
+	start time.Time
+	info  DebugInfo
+	req   *strings.Builder // Request being written
+}
+
+// withDebugRecorder returns a context that captures the DebugInfo of the
+// requests made with it.
+func withDebugRecorder(ctx context.Context) (context.Context, *debugRecorder) {
+	rec := &debugRecorder{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			rec.logf("getting connection to %s", hostPort)
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			rec.logf("looking up %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				rec.logf("lookup failed: %v", info.Err)
+				return
+			}
+			var addrs []string
+			for _, a := range info.Addrs {
+				addrs = append(addrs, a.String())
+			}
+			rec.logf("looked up %s", strings.Join(addrs, ", "))
+		},
+		ConnectStart: func(network, addr string) {
+			rec.logf("connecting to %s over %s", addr, network)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				rec.logf("failed to connect to %s: %v", addr, err)
+				return
+			}
+			rec.logf("connected to %s", addr)
+		},
+		TLSHandshakeStart: func() {
+			rec.logf("starting TLS handshake")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				rec.logf("TLS handshake failed: %v", err)
+				return
+			}
+			rec.logf("TLS handshake done: %s, %s, ALPN %q, server name %q",
+				tlsVersions[state.Version], tls.CipherSuiteName(state.CipherSuite),
+				state.NegotiatedProtocol, state.ServerName)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				rec.logf("reusing connection %s -> %s, idle for %v", info.Conn.LocalAddr(), info.Conn.RemoteAddr(), info.IdleTime)
+				return
+			}
+			rec.logf("got new connection %s -> %s", info.Conn.LocalAddr(), info.Conn.RemoteAddr())
+		},
+		WroteHeaderField: func(key string, value []string) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if rec.req == nil {
+				rec.req = &strings.Builder{}
+			}
+			for _, v := range value {
+				fmt.Fprintf(rec.req, "%s: %s\n", key, redactHeaderValue(key, v))
+			}
+		},
+		WroteHeaders: func() {
+			rec.logf("wrote request headers")
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				rec.logf("failed to write request: %v", info.Err)
+				return
+			}
+			rec.logf("wrote request")
+		},
+		GotFirstResponseByte: func() {
+			rec.logf("got first response byte")
+		},
+	}), rec
+}
+
+// logf adds a line to the log, timed from the start of the fetch.
+func (rec *debugRecorder) logf(format string, args ...interface{}) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	elapsed := time.Since(rec.start).Round(time.Microsecond)
+	rec.info.Log = append(rec.info.Log, fmt.Sprintf("+%v %s", elapsed, fmt.Sprintf(format, args...)))
+}
+
+// wrap returns a fetcher that captures the requests sent by f, and the
+// responses they get that redirect. Only HTTP clients can be wrapped;
+// other fetchers are returned as they are.
+func (rec *debugRecorder) wrap(f Fetcher) Fetcher {
+	c, ok := f.(*http.Client)
+	if !ok {
+		return f
+	}
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *c
+	wrapped.Transport = &debugTransport{next: next, rec: rec}
+	return &wrapped
+}
+
+// debugTransport records the requests of a debugged fetch and keeps the
+// redirect responses, which the HTTP client discards.
+type debugTransport struct {
+	next http.RoundTripper
+	rec  *debugRecorder
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	t.rec.mu.Lock()
+	written := ""
+	if t.rec.req != nil {
+		written = t.rec.req.String()
+		t.rec.req = nil
+	}
+	t.rec.info.Requests = append(t.rec.info.Requests, fmt.Sprintf("%s %s\n%s", req.Method, RedactURL(req.URL.String()), written))
+	t.rec.mu.Unlock()
+	if err != nil {
+		t.rec.logf("request failed: %v", redactError(err))
+		return nil, err
+	}
+	t.rec.logf("got %s %s", resp.Proto, resp.Status)
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || resp.Header.Get("Location") == "" {
+		return resp, nil
+	}
+	// Read the start of the body, then hand it on as if it had not been.
+	start, _ := io.ReadAll(io.LimitReader(resp.Body, maxDebugBody))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(start), resp.Body), resp.Body}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", resp.Proto, resp.Status)
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range resp.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\n", name, redactHeaderValue(name, v))
+		}
+	}
+	b.WriteString("\n")
+	b.Write(start)
+	t.rec.mu.Lock()
+	t.rec.info.Redirects = append(t.rec.info.Redirects, b.String())
+	t.rec.mu.Unlock()
+	return resp, nil
+}
+
+// captured returns what was captured so far.
+func (rec *debugRecorder) captured() *DebugInfo {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &DebugInfo{
+		Requests:  append([]string(nil), rec.info.Requests...),
+		Redirects: append([]string(nil), rec.info.Redirects...),
+		Log:       append([]string(nil), rec.info.Log...),
+	}
+}
+
+func debugInfoType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        "DebugInfo",
+		Description: "What was captured of a job run with debug set",
+		Fields: graphql.Fields{
+			"requests": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "The requests as written, after URL rewrites and host profile headers, one per redirect, with secrets redacted",
+			},
+			"redirects": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "The redirect responses as received, with the start of their bodies",
+			},
+			"log": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "What the transport did, timed from the start of the fetch",
+			},
+		},
+	})
+}
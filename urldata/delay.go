@@ -0,0 +1,97 @@
+package urldata
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Jobs that must not run before a given time wait in the delay queue, a
+// heap ordered by that time, and are queued for the workers once it has
+// come. A single goroutine serves the delay queue however many jobs it
+// holds.
+var delayMu sync.Mutex
+var delayed delayHeap
+var delayWake = make(chan struct{}, 1)
+var delayOnce sync.Once
+
+// delayedJob is a job in the delay queue.
+type delayedJob struct {
+	at time.Time
+	id int64
+}
+
+// delayHeap is a heap.Interface of delayed jobs, the earliest first.
+type delayHeap []delayedJob
+
+func (h delayHeap) Len() int            { return len(h) }
+func (h delayHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(delayedJob)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
+
+// delayJob puts the job in the delay queue if its notBefore time is still
+// to come, and reports whether it did.
+func delayJob(job *Job) bool {
+	at := job.Options.NotBefore
+	if !clock.Now().Before(at) {
+		return false
+	}
+	setStatus(job, "scheduled")
+	recordEvent(job, "scheduled", "scheduled to run at %s", at.Format(time.RFC3339))
+	delayMu.Lock()
+	heap.Push(&delayed, delayedJob{at: at, id: job.ID})
+	delayMu.Unlock()
+	delayOnce.Do(func() { go runDelayQueue() })
+	select {
+	case delayWake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// runDelayQueue queues the delayed jobs as their time comes.
+func runDelayQueue() {
+	for {
+		var due []int64
+		var wait <-chan time.Time
+		delayMu.Lock()
+		now := clock.Now()
+		for len(delayed) > 0 && !now.Before(delayed[0].at) {
+			due = append(due, heap.Pop(&delayed).(delayedJob).id)
+		}
+		if len(delayed) > 0 {
+			wait = clock.After(delayed[0].at.Sub(now))
+		}
+		delayMu.Unlock()
+
+		for _, id := range due {
+			job := GetJob(id)
+			if job == nil || jobStatus(job) != "scheduled" {
+				continue
+			}
+			setStatus(job, "waiting")
+			recordEvent(job, "queued", "queued at its scheduled time")
+			if !parkIfHeld(job) {
+				enqueue(id)
+			}
+		}
+
+		select {
+		case <-wait:
+		case <-delayWake:
+		}
+	}
+}
+
+// delayedJobs returns the number of jobs in the delay queue.
+func delayedJobs() int {
+	delayMu.Lock()
+	defer delayMu.Unlock()
+	return len(delayed)
+}
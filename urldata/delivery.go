@@ -0,0 +1,135 @@
+package urldata
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/dsoo/urlfetcher/queue"
+)
+
+// defaultMaxRedeliveries is how many times a job whose worker was lost is
+// handed out again before it fails.
+const defaultMaxRedeliveries = 3
+
+var maxRedeliveries = defaultMaxRedeliveries
+
+// SetMaxRedeliveries sets how many times a job whose worker was lost
+// mid-fetch, by a crash or a restart, is started again before it fails.
+// 0 restores the default of 3.
+func SetMaxRedeliveries(n int) {
+	if n == 0 {
+		n = defaultMaxRedeliveries
+	}
+	maxRedeliveries = n
+}
+
+// Jobs being worked on by a worker of this process.
+var runningMu sync.Mutex
+var running = map[int64]bool{}
+
+// claim decides whether a worker should run a delivered job. It marks the
+// job as running and returns it, or acknowledges the delivery and returns
+// nil if there is nothing to do. Queues deliver jobs at least once, so the
+// same job may arrive again while it is running or after it finished.
+func claim(d *queue.Delivery) *Job {
+	wait, measured := markDequeued(d.JobID)
+	job := GetJob(d.JobID)
+	if job == nil {
+		// Discarded after it was queued.
+		settle(d, false)
+		return nil
+	}
+	runningMu.Lock()
+	status := jobStatus(job)
+	// Jobs that are finished, or parked until something requeues them,
+	// and duplicates of a delivery being worked on are skipped.
+	run := !running[job.ID] && (status == "waiting" || status == "fetching")
+	if run {
+		running[job.ID] = true
+	}
+	runningMu.Unlock()
+	if !run {
+		settle(d, false)
+		return nil
+	}
+	if measured {
+		updateJob(job, func(job *Job) { job.QueueWait = wait })
+	}
+	// A job still fetching but not running here lost its worker before it
+	// was acknowledged, so the queue handed it out again.
+	if status == "fetching" && !redeliver(job, "handed out again after its worker was lost") {
+		release(job)
+		settle(d, false)
+		return nil
+	}
+	return job
+}
+
+// release marks a claimed job as no longer running.
+func release(job *Job) {
+	runningMu.Lock()
+	delete(running, job.ID)
+	runningMu.Unlock()
+}
+
+// redeliver records that the job was interrupted and lets it be started
+// again, unless it already was too often. Then it fails the job instead,
+// so that a job that keeps crashing its worker does not do so forever,
+// and returns false.
+func redeliver(job *Job, format string, args ...interface{}) bool {
+	updateJob(job, func(job *Job) { job.Redeliveries++ })
+	recordEvent(job, "interrupted", format, args...)
+	if job.Redeliveries > maxRedeliveries {
+		updateJob(job, func(job *Job) {
+			job.Error = policyError("interrupted %d times, giving up", job.Redeliveries)
+			job.Status = "error"
+		})
+		recordEvent(job, "completed", "finished with status %q", "error")
+		jobFinished(job)
+		return false
+	}
+	setStatus(job, "waiting")
+	return true
+}
+
+// runJob runs a claimed job and acknowledges its delivery once the job
+// has finished or been parked. If the worker panics, the job is given back
+// to the queue instead, to be started again.
+func runJob(workerID int, job *Job, d *queue.Delivery) {
+	busy := false
+	defer func() {
+		r := recover()
+		release(job)
+		if busy {
+			workerIdle(workerID, jobStatus(job))
+		}
+		if r != nil {
+			fmt.Printf("worker %d panicked on job %d: %v\n%s", workerID, job.ID, r, debug.Stack())
+			settle(d, true)
+			return
+		}
+		settle(d, false)
+	}()
+	if !admit(job) || !admitPolite(job) || !admitCircuit(job) {
+		return
+	}
+	defer circuitRelease(hostOf(job.URL), job.ID)
+	workerBusy(workerID, job.ID)
+	busy = true
+	doJob(workerID, job.ID)
+}
+
+// settle acknowledges a delivery, or gives it back to the queue if requeue
+// is set.
+func settle(d *queue.Delivery, requeue bool) {
+	var err error
+	if requeue {
+		err = d.Nack()
+	} else {
+		err = d.Ack()
+	}
+	if err != nil && err != queue.ErrExpired {
+		fmt.Println("failed to settle delivery of job", d.JobID, "error:", err)
+	}
+}
@@ -0,0 +1,143 @@
+package urldata
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/graphql-go/graphql"
+)
+
+// Directives applied to field definitions, to keep access and throttling
+// policy in the schema rather than in resolvers. graphql-go builds schemas
+// in code and cannot attach directives to fields, so they are applied by
+// wrapping fields with requiresRole and rateLimit where the fields are
+// declared. The directives are defined in the schema, and the ones applied
+// to a field appended to its description, so that introspection shows the
+// policy.
+var (
+	requiresRoleDirective = graphql.NewDirective(graphql.DirectiveConfig{
+		Name:        "requiresRole",
+		Description: "Only callers with the role, or a higher one, may use the field.",
+		Locations:   []string{graphql.DirectiveLocationFieldDefinition},
+		Args: graphql.FieldConfigArgument{
+			"role": &graphql.ArgumentConfig{
+				Description: "viewer, submitter or admin",
+				Type:        graphql.NewNonNull(graphql.String),
+			},
+		},
+	})
+	rateLimitDirective = graphql.NewDirective(graphql.DirectiveConfig{
+		Name:        "rateLimit",
+		Description: "Each caller may use the field at most limit times per duration seconds.",
+		Locations:   []string{graphql.DirectiveLocationFieldDefinition},
+		Args: graphql.FieldConfigArgument{
+			"limit": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.Int),
+			},
+			"duration": &graphql.ArgumentConfig{
+				Description: "Seconds",
+				Type:        graphql.NewNonNull(graphql.Int),
+			},
+		},
+	})
+)
+
+// schemaDirectives returns the directives of the schema: the standard ones
+// and ours.
+func schemaDirectives() []*graphql.Directive {
+	return append(append([]*graphql.Directive{}, graphql.SpecifiedDirectives...), requiresRoleDirective, rateLimitDirective)
+}
+
+// RateLimitError is returned when a caller has used a field with
+// @rateLimit too often.
+type RateLimitError struct {
+	Field      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry in %s", e.Field, e.RetryAfter.Round(time.Second))
+}
+
+// requiresRole applies @requiresRole(role) to field.
+func requiresRole(role string, field *graphql.Field) *graphql.Field {
+	describeDirective(field, fmt.Sprintf("@requiresRole(role: %q)", role))
+	field.Resolve = roleResolver(role, field.Resolve)
+	return field
+}
+
+// roleResolver returns resolve, failing for callers whose role does not
+// allow role.
+func roleResolver(role string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if !auth.FromContext(p.Context).Allows(role) {
+			return nil, &auth.ForbiddenError{Role: role}
+		}
+		return resolve(p)
+	}
+}
+
+// rateLimit applies @rateLimit(limit, duration) to field. Callers are told
+// apart by their subject; without authentication they share the limit.
+func rateLimit(limit int, duration time.Duration, field *graphql.Field) *graphql.Field {
+	describeDirective(field, fmt.Sprintf("@rateLimit(limit: %d, duration: %d)", limit, int(duration/time.Second)))
+	resolve := field.Resolve
+	field.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+		name := p.Info.ParentType.Name() + "." + p.Info.FieldName
+		subject := ""
+		if id := auth.FromContext(p.Context); id != nil {
+			subject = id.Subject
+		}
+		if wait := takeRateLimit(name+" "+subject, limit, duration); wait > 0 {
+			return nil, &RateLimitError{Field: p.Info.FieldName, RetryAfter: wait}
+		}
+		return resolve(p)
+	}
+	return field
+}
+
+func describeDirective(field *graphql.Field, directive string) {
+	if field.Description != "" {
+		field.Description += "\n\n"
+	}
+	field.Description += directive
+}
+
+// rateWindow counts the uses of a field by a caller since start.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var rateWindowsMu sync.Mutex
+var rateWindows = map[string]*rateWindow{}
+
+// takeRateLimit counts a use against key, returning how long to wait
+// before trying again if limit uses in the current window of duration have
+// been counted already, or 0.
+func takeRateLimit(key string, limit int, duration time.Duration) time.Duration {
+	now := clock.Now()
+	rateWindowsMu.Lock()
+	defer rateWindowsMu.Unlock()
+	w := rateWindows[key]
+	if w == nil || !now.Before(w.start.Add(duration)) {
+		if len(rateWindows) >= 10000 {
+			// Forget callers whose windows have passed, assuming no
+			// limit has a longer duration than an hour.
+			for k, w := range rateWindows {
+				if now.Sub(w.start) > time.Hour {
+					delete(rateWindows, k)
+				}
+			}
+		}
+		w = &rateWindow{start: now}
+		rateWindows[key] = w
+	}
+	if w.count >= limit {
+		return w.start.Add(duration).Sub(now)
+	}
+	w.count++
+	return 0
+}
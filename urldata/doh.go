@@ -0,0 +1,178 @@
+package urldata
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DoHConfig configures DNS-over-HTTPS resolution of the hosts jobs fetch
+// from, for networks whose DNS is filtered or untrusted.
+type DoHConfig struct {
+	URL string // RFC 8484 endpoint, e.g. https://cloudflare-dns.com/dns-query
+	// BootstrapAddress is the IP address, optionally with a port, to
+	// connect to for URL instead of looking its host up with the system
+	// resolver.
+	BootstrapAddress string
+}
+
+// Resolver used for the hosts jobs fetch from, nil for the system one.
+var dohMu sync.Mutex
+var dohResolver *net.Resolver
+var dohURL string
+
+// SetDoH makes jobs look up host names through the DNS-over-HTTPS endpoint
+// c.URL. An empty URL restores the system resolver.
+func SetDoH(c DoHConfig) error {
+	var resolver *net.Resolver
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("DoH URL %q is not https", c.URL)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if c.BootstrapAddress != "" {
+			dialer := &net.Dialer{Timeout: 10 * time.Second}
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, connectAddr(c.BootstrapAddress, addr))
+			}
+		}
+		client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, url: c.URL}, nil
+			},
+		}
+	}
+	dohMu.Lock()
+	dohResolver, dohURL = resolver, c.URL
+	dohMu.Unlock()
+	clientsMu.Lock()
+	clients = map[clientKey]*http.Client{}
+	clientsMu.Unlock()
+	return nil
+}
+
+// resolverFor names the resolver that looks up the host the job connects
+// to: the DoH endpoint or "system". It is empty if the name is resolved
+// elsewhere, by the far end of a tunnel or by a proxy, or if the job
+// connects to an IP address.
+func resolverFor(job *Job, req *http.Request) string {
+	if tunnelFor(job) != "" || egressFor(job) != "" {
+		return ""
+	}
+	if proxy, err := http.ProxyFromEnvironment(req); err != nil || proxy != nil {
+		return ""
+	}
+	host := req.URL.Hostname()
+	if job.Options.ConnectAddress != "" {
+		host = connectAddr(job.Options.ConnectAddress, "x:0")
+		host, _, _ = net.SplitHostPort(host)
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	dohMu.Lock()
+	defer dohMu.Unlock()
+	if dohURL != "" {
+		return dohURL
+	}
+	return "system"
+}
+
+// dnsResolver returns the resolver to dial with, nil for the system one.
+func dnsResolver() *net.Resolver {
+	dohMu.Lock()
+	defer dohMu.Unlock()
+	return dohResolver
+}
+
+// dohConn passes the DNS queries of a net.Resolver to a DoH endpoint.
+// Since it is not a net.PacketConn, the resolver frames messages as it
+// would over TCP, with a two byte length prefix.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	query    bytes.Buffer
+	answer   bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	data := c.query.Bytes()
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return len(b), nil // More to come
+	}
+	msg := data[2 : 2+int(binary.BigEndian.Uint16(data))]
+	answer, err := c.exchange(msg)
+	c.query.Reset()
+	if err != nil {
+		return 0, err
+	}
+	if len(answer) > 0xffff {
+		return 0, errors.New("DoH answer too large")
+	}
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+	c.answer.Write(size[:])
+	c.answer.Write(answer)
+	return len(b), nil
+}
+
+// exchange sends a DNS message to the endpoint and returns its answer.
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH endpoint answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff+1))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
@@ -0,0 +1,124 @@
+package urldata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// How long signed download URLs stay valid unless asked otherwise, and at
+// most unless configured otherwise.
+const (
+	defaultDownloadTTL = time.Hour
+	defaultMaxDownload = 7 * 24 * time.Hour
+)
+
+// ErrDownloadsDisabled is returned when a signed download URL is asked for
+// while no signing key is configured.
+var ErrDownloadsDisabled = errors.New("signed download URLs are not enabled")
+
+// ErrBadSignature is returned for download URLs that have expired, or were
+// not signed with any of the configured keys.
+var ErrBadSignature = errors.New("invalid or expired signature")
+
+var downloadsMu sync.RWMutex
+var downloadKeys [][]byte
+var maxDownloadTTL = defaultMaxDownload
+
+// SetDownloadKeys enables signed URLs downloading the bodies of responses
+// without credentials, valid for at most maxTTL (7 days if 0), or disables
+// them if keys is empty. The first key signs new URLs; the others only
+// verify URLs signed with them, so that keys can be rotated.
+func SetDownloadKeys(keys [][]byte, maxTTL time.Duration) {
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxDownload
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	downloadKeys = keys
+	maxDownloadTTL = maxTTL
+}
+
+// SignedBodyURL returns a URL from which the body of job's response can be
+// downloaded without credentials for ttl, or an hour if ttl is 0, and when
+// it expires. The URL is relative to the server unless its public URL is
+// known.
+func SignedBodyURL(job *Job, ttl time.Duration) (string, time.Time, error) {
+	downloadsMu.RLock()
+	keys, maxTTL := downloadKeys, maxDownloadTTL
+	downloadsMu.RUnlock()
+	if len(keys) == 0 {
+		return "", time.Time{}, ErrDownloadsDisabled
+	}
+	if ttl == 0 {
+		ttl = defaultDownloadTTL
+	}
+	if ttl < 0 || ttl > maxTTL {
+		return "", time.Time{}, fmt.Errorf("the URL may be valid for at most %s", maxTTL)
+	}
+	expires := clock.Now().Add(ttl).Truncate(time.Second)
+	path := fmt.Sprintf("/api/jobs/%d/body?expires=%d&signature=%s", job.ID, expires.Unix(), bodySignature(keys[0], job.ID, expires.Unix()))
+	if link := apiLink(path); link != "" {
+		return link, expires, nil
+	}
+	return path, expires, nil
+}
+
+// VerifyBodyDownload checks the expires and signature parameters of a
+// download URL for the body of the job with the given ID.
+func VerifyBodyDownload(id int64, expires, signature string) error {
+	at, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !clock.Now().Before(time.Unix(at, 0)) {
+		return ErrBadSignature
+	}
+	downloadsMu.RLock()
+	keys := downloadKeys
+	downloadsMu.RUnlock()
+	for _, key := range keys {
+		if hmac.Equal([]byte(signature), []byte(bodySignature(key, id, at))) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// bodySignature returns the HMAC-SHA256 of the job ID and expiry time.
+func bodySignature(key []byte, id int64, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "jobs/%d/body\n%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyDownloadURLField returns the field of the job type giving a signed
+// URL for its body.
+func bodyDownloadURLField() *graphql.Field {
+	return &graphql.Field{
+		Type:        graphql.String,
+		Description: "URL from which the body of the job's response can be downloaded without credentials until it expires, null if the job has no response",
+		Args: graphql.FieldConfigArgument{
+			"ttlSeconds": &graphql.ArgumentConfig{
+				Description: "How long the URL stays valid, an hour by default",
+				Type:        graphql.Int,
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			job := jobOf(p.Source)
+			if GetJobState(job).Response == nil {
+				return nil, nil
+			}
+			ttl, _ := p.Args["ttlSeconds"].(int)
+			u, _, err := SignedBodyURL(job, time.Duration(ttl)*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			return u, nil
+		},
+	}
+}
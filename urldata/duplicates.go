@@ -0,0 +1,219 @@
+package urldata
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Words per shingle hashed into the simhash of a text.
+const shingleWords = 3
+
+// Largest maxDistance accepted by duplicatesOf; beyond it unrelated pages
+// start to match.
+const maxSimhashDistance = 16
+
+// Duplicate is a URL serving the same or nearly the same content as
+// another.
+type Duplicate struct {
+	URL       string
+	Identical bool // Whether the bodies are byte for byte the same
+	// Distance is the number of bits the simhashes of the texts differ
+	// by, 0 for identical bodies.
+	Distance int
+}
+
+// contentKey is what the duplicate index knows of a URL's response.
+type contentKey struct {
+	sha256  string
+	simhash uint64
+	text    bool // Whether simhash is set, for HTML and text bodies
+}
+
+// The duplicate index of the successful responses in the cache, by URL
+// and by SHA-256 digest.
+var duplicatesMu sync.Mutex
+var contentKeys = map[string]contentKey{}
+var urlsByDigest = map[string]map[string]bool{}
+
+// indexContent records the content of the response for finding duplicates,
+// replacing what was recorded for its URL before.
+func indexContent(r *Response) {
+	duplicatesMu.Lock()
+	defer duplicatesMu.Unlock()
+	unindexContent(r.URL)
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return
+	}
+	k := contentKey{sha256: r.Checksums.SHA256}
+	if text, ok := responseText(r); ok {
+		k.simhash, k.text = simhash(text), true
+	}
+	contentKeys[r.URL] = k
+	if urlsByDigest[k.sha256] == nil {
+		urlsByDigest[k.sha256] = map[string]bool{}
+	}
+	urlsByDigest[k.sha256][r.URL] = true
+}
+
+// unindexContent removes url from the duplicate index. duplicatesMu must
+// be held.
+func unindexContent(url string) {
+	k, ok := contentKeys[url]
+	if !ok {
+		return
+	}
+	delete(contentKeys, url)
+	delete(urlsByDigest[k.sha256], url)
+	if len(urlsByDigest[k.sha256]) == 0 {
+		delete(urlsByDigest, k.sha256)
+	}
+}
+
+// resetDuplicates empties the duplicate index.
+func resetDuplicates() {
+	duplicatesMu.Lock()
+	defer duplicatesMu.Unlock()
+	contentKeys = map[string]contentKey{}
+	urlsByDigest = map[string]map[string]bool{}
+}
+
+// DuplicatesOf returns the other URLs in the cache whose content is the
+// same as that of url, or, for HTML and text, whose simhash differs by at
+// most maxDistance bits. Identical ones come first, then the nearest. It
+// returns nil if url has no successful response in the cache.
+func DuplicatesOf(url string, maxDistance int) []Duplicate {
+	r := GetResponse(url)
+	if r == nil {
+		return nil
+	}
+	duplicatesMu.Lock()
+	defer duplicatesMu.Unlock()
+	k, ok := contentKeys[r.URL]
+	if !ok {
+		return nil
+	}
+	found := []Duplicate{}
+	for other := range urlsByDigest[k.sha256] {
+		if other != r.URL {
+			found = append(found, Duplicate{URL: other, Identical: true})
+		}
+	}
+	if maxDistance > 0 && k.text {
+		for other, o := range contentKeys {
+			if other == r.URL || !o.text || o.sha256 == k.sha256 {
+				continue
+			}
+			if d := bits.OnesCount64(k.simhash ^ o.simhash); d <= maxDistance {
+				found = append(found, Duplicate{URL: other, Distance: d})
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Distance != found[j].Distance {
+			return found[i].Distance < found[j].Distance
+		}
+		return found[i].URL < found[j].URL
+	})
+	return found
+}
+
+// simhash returns the 64-bit simhash of the word shingles of text: texts
+// that share most of their shingles get hashes differing in few bits.
+func simhash(text string) uint64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	var weights [64]int
+	add := func(shingle []string) {
+		h := fnv.New64a()
+		for _, w := range shingle {
+			h.Write([]byte(w))
+			h.Write([]byte{' '})
+		}
+		sum := h.Sum64()
+		for i := range weights {
+			if sum&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+	if len(words) < shingleWords {
+		add(words)
+	}
+	for i := 0; i+shingleWords <= len(words); i++ {
+		add(words[i : i+shingleWords])
+	}
+	var hash uint64
+	for i, w := range weights {
+		if w > 0 {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// duplicatesOfField returns the query listing the URLs that serve the same
+// content as a URL.
+func duplicatesOfField() *graphql.Field {
+	duplicateType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Duplicate",
+		Description: "A URL serving the same or nearly the same content as another",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type: graphql.String,
+			},
+			"identical": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the bodies are byte for byte the same",
+			},
+			"distance": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Bits the simhashes of the texts differ by, 0 for identical bodies",
+			},
+		},
+	})
+	return &graphql.Field{
+		Type:        graphql.NewList(duplicateType),
+		Description: "List the other URLs whose cached response has the same content as that of a URL, or nearly the same with maxDistance",
+		Args: graphql.FieldConfigArgument{
+			"url": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"maxDistance": &graphql.ArgumentConfig{
+				Description: "Also list HTML and text pages whose simhash differs by at most this many bits, up to 16; 0, the default, only lists identical bodies",
+				Type:        graphql.Int,
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			maxDistance, _ := p.Args["maxDistance"].(int)
+			if maxDistance < 0 || maxDistance > maxSimhashDistance {
+				return nil, fmt.Errorf("maxDistance must be between 0 and %d", maxSimhashDistance)
+			}
+			url := p.Args["url"].(string)
+			visible := urlFilter(p.Context)
+			if !visible(url) {
+				return nil, nil
+			}
+			d := DuplicatesOf(url, maxDistance)
+			if d == nil {
+				return nil, nil
+			}
+			seen := []Duplicate{}
+			for _, dup := range d {
+				if visible(dup.URL) {
+					seen = append(seen, dup)
+				}
+			}
+			return seen, nil
+		},
+	}
+}
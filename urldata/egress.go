@@ -0,0 +1,92 @@
+package urldata
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Egress describes a named route out of the network, a proxy in another
+// region for instance, that requests can be sent through so that content
+// which varies by geography is fetched from the right vantage point.
+type Egress struct {
+	Name       string
+	Proxy      string   // URL of the HTTP, HTTPS or SOCKS5 proxy
+	Credential string   // Credential holding the proxy's username and password, if it needs them
+	Hosts      []string // Hosts (or "*.domain" wildcards) always fetched through this route
+}
+
+// Guards egressRoutes and hostEgress.
+var egressMu sync.Mutex
+var egressRoutes = map[string]Egress{}
+var hostEgress = map[string]string{}
+
+// SetEgressRoutes configures the egress routes available to jobs. A job
+// uses a route if it names one in its options, or if its host matches one
+// of the route's Hosts.
+func SetEgressRoutes(configured []Egress) error {
+	routes := map[string]Egress{}
+	hosts := map[string]string{}
+	for _, e := range configured {
+		u, err := url.Parse(e.Proxy)
+		if err != nil {
+			return fmt.Errorf("egress %s: %v", e.Name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+			return fmt.Errorf("egress %s: proxy must be an http, https or socks5 URL", e.Name)
+		}
+		routes[e.Name] = e
+		for _, host := range e.Hosts {
+			hosts[strings.ToLower(host)] = e.Name
+		}
+	}
+	egressMu.Lock()
+	egressRoutes = routes
+	hostEgress = hosts
+	egressMu.Unlock()
+	clientsMu.Lock()
+	clients = map[clientKey]*http.Client{}
+	clientsMu.Unlock()
+	return nil
+}
+
+// egressFor returns the name of the egress route the job is fetched
+// through, or "" for the default route.
+func egressFor(job *Job) string {
+	if job.Options.Egress != "" {
+		return job.Options.Egress
+	}
+	if u, err := url.Parse(job.URL); err == nil {
+		egressMu.Lock()
+		defer egressMu.Unlock()
+		if name, ok := lookupHost(hostEgress, u.Hostname()); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// egressProxy returns the proxy URL of the named route, with the
+// credentials of the route filled in.
+func egressProxy(name string) (*url.URL, error) {
+	egressMu.Lock()
+	e, ok := egressRoutes[name]
+	egressMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown egress %q", name)
+	}
+	u, err := url.Parse(e.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if e.Credential != "" {
+		c, ok := creds.Get(e.Credential)
+		if !ok {
+			return nil, fmt.Errorf("egress %s: unknown credential %q", name, e.Credential)
+		}
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+	return u, nil
+}
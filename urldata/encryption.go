@@ -0,0 +1,144 @@
+package urldata
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// EncryptionKey is an AES key that stored bodies are encrypted with. Its
+// ID is recorded with every entry it encrypts, so that keys can be
+// rotated while entries encrypted with older ones remain readable.
+type EncryptionKey struct {
+	ID  string
+	Key []byte // 16, 24 or 32 bytes, for AES-128, AES-192 or AES-256
+}
+
+// Prefix of encrypted blobs, followed by the length of the key ID, the key
+// ID, the nonce and the sealed data. Blobs without it were stored before
+// encryption was enabled.
+var sealedBlobMagic = []byte("UFENC1")
+
+// ErrDecrypt is returned when reading an encrypted entry fails, because
+// its key is not configured, or is not the key it was encrypted with.
+var ErrDecrypt = errors.New("failed to decrypt")
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Guards the encryption keys; currentKey is nil when encryption is off.
+var encryptionMu sync.RWMutex
+var currentKey *encryptionKey
+var encryptionKeys = map[string]*encryptionKey{}
+
+// SetEncryptionKeys enables AES-GCM encryption of the response bodies in
+// the journal, the archive and the blob store, or disables it if keys is
+// empty. The first key encrypts what is written from now on; the others
+// only decrypt what older keys encrypted. To rotate keys, put a new key
+// first and keep the old ones until nothing written with them is kept.
+// Entries written before encryption was enabled are still read.
+func SetEncryptionKeys(keys []EncryptionKey) error {
+	byID := map[string]*encryptionKey{}
+	var current *encryptionKey
+	for _, k := range keys {
+		if k.ID == "" || len(k.ID) > 255 {
+			return fmt.Errorf("encryption key IDs must be 1 to 255 bytes long")
+		}
+		if byID[k.ID] != nil {
+			return fmt.Errorf("duplicate encryption key %q", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return fmt.Errorf("encryption key %q: %v", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("encryption key %q: %v", k.ID, err)
+		}
+		byID[k.ID] = &encryptionKey{id: k.ID, aead: aead}
+		if current == nil {
+			current = byID[k.ID]
+		}
+	}
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	currentKey = current
+	encryptionKeys = byID
+	return nil
+}
+
+// encrypt seals data with the current key, returning its ID and the nonce
+// followed by the sealed data, or an empty ID and data itself if
+// encryption is off. The key ID is authenticated along with the data.
+func encrypt(data []byte) (string, []byte, error) {
+	encryptionMu.RLock()
+	k := currentKey
+	encryptionMu.RUnlock()
+	if k == nil {
+		return "", data, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.id, k.aead.Seal(nonce, nonce, data, []byte(k.id)), nil
+}
+
+// decrypt opens what encrypt sealed with the key keyID.
+func decrypt(keyID string, sealed []byte) ([]byte, error) {
+	encryptionMu.RLock()
+	k := encryptionKeys[keyID]
+	encryptionMu.RUnlock()
+	if k == nil {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrDecrypt, keyID)
+	}
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: data too short", ErrDecrypt)
+	}
+	nonce, sealed := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	data, err := k.aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w with key %q: %v", ErrDecrypt, keyID, err)
+	}
+	return data, nil
+}
+
+// encryptingBlobs is a BlobStore encrypting the blobs of another while
+// encryption is on.
+type encryptingBlobs struct {
+	next BlobStore
+}
+
+func (e encryptingBlobs) Put(key string, data []byte) error {
+	id, sealed, err := encrypt(data)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return e.next.Put(key, data)
+	}
+	blob := make([]byte, 0, len(sealedBlobMagic)+1+len(id)+len(sealed))
+	blob = append(blob, sealedBlobMagic...)
+	blob = append(blob, byte(len(id)))
+	blob = append(blob, id...)
+	return e.next.Put(key, append(blob, sealed...))
+}
+
+func (e encryptingBlobs) Get(key string) ([]byte, error) {
+	blob, err := e.next.Get(key)
+	if err != nil || !bytes.HasPrefix(blob, sealedBlobMagic) {
+		return blob, err
+	}
+	rest := blob[len(sealedBlobMagic):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return nil, fmt.Errorf("blob %s is corrupt", key)
+	}
+	id := string(rest[1 : 1+rest[0]])
+	return decrypt(id, rest[1+rest[0]:])
+}
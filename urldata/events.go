@@ -0,0 +1,73 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Event is an entry in a job's timeline.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"` // scheduled, queued, dequeued, parked, request, redirect, headers, script, retry, interrupted, completed, status or response
+	Message string    `json:"message"`
+}
+
+// Guards the Events of all jobs, which workers append to while resolvers read.
+var eventsMu sync.Mutex
+
+// recordEvent appends an event to the job's timeline, journals the change
+// and publishes the event.
+func recordEvent(job *Job, eventType string, format string, args ...interface{}) {
+	e := Event{Time: clock.Now(), Type: eventType, Message: fmt.Sprintf(format, args...)}
+	journalEvent(job, e)
+	publish(job, e)
+}
+
+// GetJobEvents returns a copy of the job's timeline.
+func GetJobEvents(job *Job) []Event {
+	return jobEvents(job)
+}
+
+// jobEvents returns a copy of the job's timeline.
+func jobEvents(job *Job) []Event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return append([]Event(nil), job.Events...)
+}
+
+type jobContextKey struct{}
+
+// withJob returns a context carrying the job a request is made for, so
+// transport hooks can record events against it.
+func withJob(ctx context.Context, job *Job) context.Context {
+	return context.WithValue(ctx, jobContextKey{}, job)
+}
+
+func jobFromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobContextKey{}).(*Job)
+	return job
+}
+
+func eventType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event",
+		Fields: graphql.Fields{
+			"time": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the event happened",
+			},
+			"type": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Kind of event: scheduled, queued, dequeued, parked, request, redirect, headers, script, retry, interrupted, completed, status or response",
+			},
+			"message": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Details of the event",
+			},
+		},
+	})
+}
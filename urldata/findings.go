@@ -0,0 +1,244 @@
+package urldata
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/graphql-go/graphql"
+	"golang.org/x/net/html"
+)
+
+// Finding is a fact a processor found in a response, such as an email
+// address or the number of words. A response may have several findings of
+// the same name.
+type Finding struct {
+	Processor string `json:"processor"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+}
+
+// Processor finds facts in a fetched response. It must not change the
+// response.
+type Processor func(r *Response) []Finding
+
+var processorsMu sync.Mutex
+var processors = map[string]Processor{"html": htmlFindings}
+
+// RegisterProcessor adds or replaces a processor. The findings of every
+// processor are attached to the responses fetched from then on.
+func RegisterProcessor(name string, p Processor) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	processors[name] = p
+}
+
+// runProcessors returns the findings of the named processors, or all of
+// them if names is nil, in r, ordered by processor.
+func runProcessors(r *Response, names []string) []Finding {
+	processorsMu.Lock()
+	if names == nil {
+		names = make([]string, 0, len(processors))
+		for name := range processors {
+			names = append(names, name)
+		}
+	} else {
+		names = append([]string(nil), names...)
+	}
+	run := make(map[string]Processor, len(processors))
+	for name, p := range processors {
+		run[name] = p
+	}
+	processorsMu.Unlock()
+	sort.Strings(names)
+	var findings []Finding
+	for _, name := range names {
+		if run[name] == nil {
+			continue
+		}
+		for _, f := range run[name](r) {
+			f.Processor = name
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// MatchesFindings reports whether the response of the job has a finding
+// for each name in filter, with the given value unless it is empty.
+func MatchesFindings(job *Job, filter map[string]string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	resp := GetJobState(job).Response
+	if resp == nil {
+		return false
+	}
+	for name, value := range filter {
+		found := false
+		for _, f := range resp.Findings {
+			if f.Name == name && (value == "" || f.Value == value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// selectFindings returns the findings with the given name, or all of them
+// if name is empty.
+func selectFindings(findings []Finding, name string) []Finding {
+	if name == "" {
+		return findings
+	}
+	selected := []Finding{}
+	for _, f := range findings {
+		if f.Name == name {
+			selected = append(selected, f)
+		}
+	}
+	return selected
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+
+// htmlFindings is the processor of HTML pages. It finds the email
+// addresses in the text and mailto links, and counts the links, images and
+// words of the text.
+func htmlFindings(r *Response) []Finding {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(r.Body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	var emails []string
+	seen := map[string]bool{}
+	addEmail := func(email string) {
+		email = strings.ToLower(email)
+		if !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	images, words := 0, 0
+	skip := 0 // Depth inside script and style elements
+	tokens := html.NewTokenizer(strings.NewReader(string(r.Body)))
+	for tt := tokens.Next(); tt != html.ErrorToken; tt = tokens.Next() {
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokens.TagName()
+			switch string(name) {
+			case "img":
+				images++
+			case "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "a", "area":
+				for hasAttr {
+					var key, value []byte
+					key, value, hasAttr = tokens.TagAttr()
+					if string(key) != "href" {
+						continue
+					}
+					if u, err := url.Parse(strings.TrimSpace(string(value))); err == nil && strings.EqualFold(u.Scheme, "mailto") && u.Opaque != "" {
+						for _, email := range strings.Split(u.Opaque, ",") {
+							addEmail(email)
+						}
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := tokens.TagName()
+			if (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := string(tokens.Text())
+			for _, field := range strings.Fields(text) {
+				if strings.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+					words++
+				}
+			}
+			for _, email := range emailPattern.FindAllString(text, -1) {
+				addEmail(email)
+			}
+		}
+	}
+	findings := []Finding{
+		{Name: "linkCount", Value: strconv.Itoa(len(r.Links))},
+		{Name: "imageCount", Value: strconv.Itoa(images)},
+		{Name: "wordCount", Value: strconv.Itoa(words)},
+	}
+	for _, email := range emails {
+		findings = append(findings, Finding{Name: "email", Value: email})
+	}
+	return findings
+}
+
+// parseFindingFilter converts a list of findingInput values to a map from
+// finding name to value.
+func parseFindingFilter(arg interface{}) (map[string]string, error) {
+	values, _ := arg.([]interface{})
+	filter := map[string]string{}
+	for _, v := range values {
+		entry, _ := v.(map[string]interface{})
+		name, _ := entry["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("finding names must not be empty")
+		}
+		filter[name], _ = entry["value"].(string)
+	}
+	return filter, nil
+}
+
+var findingInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "FindingInput",
+	Description: "A finding that responses must have",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"name": &graphql.InputObjectFieldConfig{
+			Type: graphql.NewNonNull(graphql.String),
+		},
+		"value": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "Value the finding must have; empty or missing matches any value",
+		},
+	},
+})
+
+func findingType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Finding",
+		Description: "A fact a processor found in a response",
+		Fields: graphql.Fields{
+			"processor": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Processor that made the finding, such as html",
+			},
+			"name": &graphql.Field{
+				Type:        graphql.String,
+				Description: "What was found, such as email, linkCount, imageCount or wordCount",
+			},
+			"value": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+}
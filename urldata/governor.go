@@ -0,0 +1,120 @@
+package urldata
+
+import (
+	"fmt"
+	runtimemetrics "runtime/metrics"
+	"sync"
+	"time"
+)
+
+// How long refused callers are told to wait unless configured otherwise,
+// and how often the governor samples the heap and the queue.
+const (
+	defaultShedRetryAfter = 30 * time.Second
+	governorInterval      = time.Second
+)
+
+// GovernorConfig configures load shedding: refusing new jobs while the
+// server is short of memory or has more queued than it can work off, rather
+// than running out of memory. Zero thresholds are not checked.
+type GovernorConfig struct {
+	MaxHeapBytes  uint64        // Heap in use above which jobs are refused
+	MaxQueueDepth int           // Jobs waiting in the queue above which jobs are refused
+	RetryAfter    time.Duration // How long refused callers are told to wait, 30s if 0
+}
+
+// OverloadedError is returned for jobs refused while the server sheds
+// load. In GraphQL responses its code extension is RETRY_LATER.
+type OverloadedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("server overloaded (%s), retry in %s", e.Reason, e.RetryAfter)
+}
+
+// Extensions implements gqlerrors.ExtendedError.
+func (e *OverloadedError) Extensions() map[string]interface{} {
+	return map[string]interface{}{
+		"code":              "RETRY_LATER",
+		"retryAfterSeconds": int(e.RetryAfter / time.Second),
+	}
+}
+
+// Guards the governor's configuration and last sample.
+var governorMu sync.Mutex
+var governor GovernorConfig
+var sampledAt time.Time
+var shedReason string // Why jobs are refused as of the last sample, "" if they are not
+var shedJobs int64
+
+// SetGovernor configures load shedding.
+func SetGovernor(c GovernorConfig) {
+	if c.RetryAfter <= 0 {
+		c.RetryAfter = defaultShedRetryAfter
+	}
+	governorMu.Lock()
+	defer governorMu.Unlock()
+	governor = c
+	sampledAt, shedReason = time.Time{}, ""
+}
+
+// admitJob returns an *OverloadedError if new jobs are refused.
+func admitJob() error {
+	governorMu.Lock()
+	defer governorMu.Unlock()
+	if reason := sampleLoad(); reason != "" {
+		shedJobs++
+		return &OverloadedError{Reason: reason, RetryAfter: governor.RetryAfter}
+	}
+	return nil
+}
+
+// sampleLoad returns why jobs are refused, or "". The heap and queue are
+// sampled at most once a second, as asking a broker for the queue length
+// may take a while. governorMu must be held.
+func sampleLoad() string {
+	if governor.MaxHeapBytes == 0 && governor.MaxQueueDepth == 0 {
+		return ""
+	}
+	if now := clock.Now(); now.Sub(sampledAt) >= governorInterval {
+		sampledAt = now
+		shedReason = overloaded(governor)
+	}
+	return shedReason
+}
+
+// overloaded returns why c's thresholds are exceeded, or "".
+func overloaded(c GovernorConfig) string {
+	if c.MaxHeapBytes > 0 {
+		if heap := heapInUse(); heap > c.MaxHeapBytes {
+			return fmt.Sprintf("heap of %d MiB over %d MiB", heap>>20, c.MaxHeapBytes>>20)
+		}
+	}
+	if c.MaxQueueDepth > 0 {
+		if depth := queueDepth(); depth > c.MaxQueueDepth {
+			return fmt.Sprintf("%d jobs queued, over %d", depth, c.MaxQueueDepth)
+		}
+	}
+	return ""
+}
+
+// heapInUse returns the bytes of live and not yet swept heap objects,
+// without stopping the world as runtime.ReadMemStats would.
+func heapInUse() uint64 {
+	sample := []runtimemetrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// sheddingStats returns why jobs are refused, "" if they are not, and how
+// many have been.
+func sheddingStats() (string, int64) {
+	governorMu.Lock()
+	defer governorMu.Unlock()
+	return sampleLoad(), shedJobs
+}
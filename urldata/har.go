@@ -0,0 +1,346 @@
+package urldata
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Exchange is one request sent for a job and the response it got; a job
+// that was redirected has one per hop. Exchanges are kept with the final
+// response so that the job can be exported as a HAR file.
+type Exchange struct {
+	Started        time.Time
+	Method         string
+	URL            string
+	RequestHeader  http.Header // As written on the wire, credentials redacted
+	Proto          string
+	StatusCode     int
+	ResponseHeader http.Header
+	Timings        Timings
+}
+
+// Timings splits the time an exchange took into the phases of HAR. The
+// phases that did not happen, such as DNS for a reused connection, are 0.
+type Timings struct {
+	Blocked time.Duration // Waiting for a connection, other than the phases below
+	DNS     time.Duration
+	Connect time.Duration // Including SSL
+	SSL     time.Duration
+	Send    time.Duration
+	Wait    time.Duration // Until the first byte of the response
+	Receive time.Duration // Reading the rest of the response
+}
+
+// exchangeRecorder collects the exchanges of one fetch from the hooks of an
+// httptrace.ClientTrace, which the transport may call from other goroutines.
+type exchangeRecorder struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	nextURL   string // URL of the request about to be sent
+
+	getConn, dnsStart, connectStart, tlsStart, wrote, firstByte time.Time
+}
+
+type exchangeRecorderKey struct{}
+
+// withExchangeRecorder returns a context that records the exchanges of the
+// requests made with it, the first of which is for rawURL.
+func withExchangeRecorder(ctx context.Context, rawURL string) (context.Context, *exchangeRecorder) {
+	rec := &exchangeRecorder{nextURL: rawURL}
+	ctx = context.WithValue(ctx, exchangeRecorderKey{}, rec)
+	lock := func(f func()) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		f()
+	}
+	// current is the exchange being recorded, to be called with mu held.
+	current := func() *Exchange {
+		if len(rec.exchanges) == 0 {
+			return &Exchange{}
+		}
+		return &rec.exchanges[len(rec.exchanges)-1]
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			lock(func() {
+				rec.getConn = time.Now()
+				rec.exchanges = append(rec.exchanges, Exchange{
+					Started:       clock.Now(),
+					Method:        http.MethodGet,
+					URL:           RedactURL(rec.nextURL),
+					RequestHeader: http.Header{},
+				})
+			})
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { lock(func() { rec.dnsStart = time.Now() }) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			lock(func() { current().Timings.DNS = time.Since(rec.dnsStart) })
+		},
+		ConnectStart: func(string, string) { lock(func() { rec.connectStart = time.Now() }) },
+		ConnectDone: func(string, string, error) {
+			lock(func() { current().Timings.Connect += time.Since(rec.connectStart) })
+		},
+		TLSHandshakeStart: func() { lock(func() { rec.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			lock(func() {
+				e := current()
+				e.Timings.SSL = time.Since(rec.tlsStart)
+				e.Timings.Connect += e.Timings.SSL
+			})
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			lock(func() {
+				t := &current().Timings
+				t.Blocked = time.Since(rec.getConn) - t.DNS - t.Connect
+				if t.Blocked < 0 {
+					t.Blocked = 0
+				}
+			})
+		},
+		WroteHeaderField: func(key string, value []string) {
+			lock(func() {
+				for _, v := range value {
+					current().RequestHeader.Add(key, redactHeaderValue(key, v))
+				}
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			lock(func() {
+				rec.wrote = time.Now()
+				e := current()
+				e.Timings.Send = time.Since(rec.getConn) - e.Timings.Blocked - e.Timings.DNS - e.Timings.Connect
+			})
+		},
+		GotFirstResponseByte: func() {
+			lock(func() {
+				rec.firstByte = time.Now()
+				current().Timings.Wait = rec.firstByte.Sub(rec.wrote)
+			})
+		},
+	}), rec
+}
+
+// finish completes the exchange in progress with the response it got, now
+// that it has been read.
+func (rec *exchangeRecorder) finish(resp *http.Response) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.exchanges) == 0 {
+		return
+	}
+	e := &rec.exchanges[len(rec.exchanges)-1]
+	e.Proto = resp.Proto
+	e.StatusCode = resp.StatusCode
+	e.ResponseHeader = resp.Header
+	if !rec.firstByte.IsZero() {
+		e.Timings.Receive = time.Since(rec.firstByte)
+	}
+}
+
+// redirected completes the exchange whose response redirected to next.
+func (rec *exchangeRecorder) redirected(resp *http.Response, next string) {
+	if resp != nil {
+		rec.finish(resp)
+	}
+	rec.mu.Lock()
+	rec.nextURL = next
+	rec.mu.Unlock()
+}
+
+// recorded returns the exchanges recorded so far.
+func (rec *exchangeRecorder) recorded() []Exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Exchange(nil), rec.exchanges...)
+}
+
+// recorderFromContext returns the recorder of the fetch a request is made
+// for, or nil.
+func recorderFromContext(ctx context.Context) *exchangeRecorder {
+	rec, _ := ctx.Value(exchangeRecorderKey{}).(*exchangeRecorder)
+	return rec
+}
+
+// The HAR 1.2 format, as far as it is produced here. See
+// http://www.softwareishard.com/blog/har-12-spec/.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string  `json:"method"`
+	URL         string  `json:"url"`
+	HTTPVersion string  `json:"httpVersion"`
+	Cookies     []harNV `json:"cookies"`
+	Headers     []harNV `json:"headers"`
+	QueryString []harNV `json:"queryString"`
+	HeadersSize int     `json:"headersSize"`
+	BodySize    int     `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HAR exports the job's response as an HTTP Archive, with an entry for
+// each exchange, for browser devtools and other HAR-aware tools. The body
+// of the final response is included, base64 encoded unless it is UTF-8.
+// It returns nil if the job has no response.
+func HAR(job *Job) ([]byte, error) {
+	resp := GetJobState(job).Response
+	if resp == nil {
+		return nil, nil
+	}
+	var har harLog
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "urlfetcher", Version: "1"}
+	har.Log.Entries = []harEntry{}
+	exchanges := resp.Exchanges
+	if len(exchanges) == 0 {
+		// Fetched before exchanges were recorded, or by a fetcher that does
+		// not trace; all that is known is the final response.
+		exchanges = []Exchange{{
+			Started:        resp.Timestamp,
+			Method:         http.MethodGet,
+			URL:            resp.URL,
+			StatusCode:     resp.StatusCode,
+			ResponseHeader: resp.Header,
+		}}
+	}
+	for i, e := range exchanges {
+		entry := harEntry{
+			StartedDateTime: e.Started.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+			Request: harRequest{
+				Method:      e.Method,
+				URL:         RedactURL(e.URL),
+				HTTPVersion: e.Proto,
+				Cookies:     []harNV{},
+				Headers:     harHeaders(e.RequestHeader),
+				QueryString: []harNV{},
+				HeadersSize: -1,
+			},
+			Response: harResponse{
+				Status:      e.StatusCode,
+				StatusText:  http.StatusText(e.StatusCode),
+				HTTPVersion: e.Proto,
+				Cookies:     []harNV{},
+				Headers:     harHeaders(e.ResponseHeader),
+				Content:     harContent{MimeType: e.ResponseHeader.Get("Content-Type")},
+				RedirectURL: RedactURL(e.ResponseHeader.Get("Location")),
+				HeadersSize: -1,
+				BodySize:    -1,
+			},
+			Timings: harTimings{
+				Blocked: harMillis(e.Timings.Blocked),
+				DNS:     harMillis(e.Timings.DNS),
+				Connect: harMillis(e.Timings.Connect),
+				SSL:     harMillis(e.Timings.SSL),
+				Send:    float64(e.Timings.Send) / float64(time.Millisecond),
+				Wait:    float64(e.Timings.Wait) / float64(time.Millisecond),
+				Receive: float64(e.Timings.Receive) / float64(time.Millisecond),
+			},
+		}
+		if u, err := url.Parse(entry.Request.URL); err == nil {
+			for name, values := range u.Query() {
+				for _, v := range values {
+					entry.Request.QueryString = append(entry.Request.QueryString, harNV{Name: name, Value: v})
+				}
+			}
+		}
+		t := e.Timings
+		entry.Time = float64(t.Blocked+t.Connect+t.DNS+t.Send+t.Wait+t.Receive) / float64(time.Millisecond)
+		if i == len(exchanges)-1 {
+			entry.Response.Content.Size = len(resp.Body)
+			entry.Response.BodySize = len(resp.Body)
+			if utf8.Valid(resp.Body) {
+				entry.Response.Content.Text = string(resp.Body)
+			} else {
+				entry.Response.Content.Text = base64.StdEncoding.EncodeToString(resp.Body)
+				entry.Response.Content.Encoding = "base64"
+			}
+		} else {
+			entry.Comment = "redirect, body not kept"
+		}
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+	return json.MarshalIndent(har, "", "  ")
+}
+
+// harMillis converts the duration of an optional phase to milliseconds,
+// -1 if it did not happen.
+func harMillis(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harHeaders lists the headers as HAR name/value pairs.
+func harHeaders(h http.Header) []harNV {
+	list := []harNV{}
+	for name, values := range h {
+		for _, v := range values {
+			list = append(list, harNV{Name: name, Value: redactHeaderValue(name, v)})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,112 @@
+package urldata
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/graphql-go/graphql"
+)
+
+// HeaderField is a response header with all its values.
+type HeaderField struct {
+	Name   string
+	Values []string
+}
+
+// selectHeaders returns the headers of h named in names, or all of them
+// if names is empty, sorted by name. Names are case insensitive.
+func selectHeaders(h http.Header, names []string) []HeaderField {
+	var fields []HeaderField
+	if len(names) == 0 {
+		for name, values := range h {
+			fields = append(fields, HeaderField{Name: name, Values: values})
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			if values, ok := h[name]; ok && !seen[name] {
+				seen[name] = true
+				fields = append(fields, HeaderField{Name: name, Values: values})
+			}
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+func headerFieldType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Header",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Canonical header name",
+			},
+			"values": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Values of the header, in the order they were received",
+			},
+		},
+	})
+}
+
+// Largest response headers read unless configured otherwise, and the
+// longest header value kept.
+const (
+	defaultMaxHeaderBytes = 256 << 10
+	maxHeaderValueBytes   = 16 << 10
+)
+
+// Guarded by clientsMu, as clients are built with it.
+var maxHeaderBytes int64 = defaultMaxHeaderBytes
+
+// SetMaxHeaderBytes limits the size of the response headers read to n
+// bytes, or 256 KiB if n is 0. Fetches of responses with larger headers
+// fail with a POLICY error.
+func SetMaxHeaderBytes(n int64) {
+	if n <= 0 {
+		n = defaultMaxHeaderBytes
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	maxHeaderBytes = n
+	clients = map[clientKey]*http.Client{}
+}
+
+// sanitizeHeader removes the malformed values from header, those with
+// control characters or invalid UTF-8, or longer than 16 KiB, and returns
+// the names of the headers it removed values of.
+func sanitizeHeader(header http.Header) []string {
+	var dropped []string
+	for name, values := range header {
+		kept := values[:0]
+		for _, v := range values {
+			if validHeaderValue(v) {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == len(values) {
+			continue
+		}
+		dropped = append(dropped, name)
+		if len(kept) == 0 {
+			delete(header, name)
+		} else {
+			header[name] = kept
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+func validHeaderValue(v string) bool {
+	if len(v) > maxHeaderValueBytes || !utf8.ValidString(v) {
+		return false
+	}
+	return strings.IndexFunc(v, func(r rune) bool {
+		return r < ' ' && r != '\t' || r == 0x7f
+	}) < 0
+}
@@ -0,0 +1,47 @@
+package urldata
+
+import (
+	"sort"
+	"time"
+)
+
+// JobSample is a finished job, as dashboards chart them.
+type JobSample struct {
+	ID       int64
+	Host     string
+	Finished time.Time
+	Failed   bool
+	// Latency is the time from the job's last request to receiving its
+	// whole response, 0 if it sent none.
+	Latency time.Duration
+}
+
+// JobSamples returns the jobs known to this instance that finished between
+// from and to, in the order they finished.
+func JobSamples(from, to time.Time) []JobSample {
+	samples := []JobSample{}
+	for _, job := range GetJobs() {
+		state := GetJobState(job)
+		if !Finished(state.Status) {
+			continue
+		}
+		events := jobEvents(job)
+		finished := time.Time{}
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Type == "completed" {
+				finished = events[i].Time
+				break
+			}
+		}
+		if finished.IsZero() || finished.Before(from) || finished.After(to) {
+			continue
+		}
+		s := JobSample{ID: job.ID, Host: hostOf(job.URL), Finished: finished, Failed: state.Status == "error"}
+		if state.Response != nil {
+			s.Latency = fetchLatency(job, state.Response)
+		}
+		samples = append(samples, s)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Finished.Before(samples[j].Finished) })
+	return samples
+}
@@ -0,0 +1,420 @@
+package urldata_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/dsoo/urlfetcher/urldata"
+	"github.com/dsoo/urlfetcher/urltest"
+	"github.com/graphql-go/graphql"
+)
+
+const jobFields = `{ id status attempts error { category retryable } }`
+
+// queryJob returns the status, attempts and error of a job.
+func queryJob(s *urltest.Service, id int64) map[string]interface{} {
+	data := s.Query(`query($id: String!) { job(id: $id) `+jobFields+` }`,
+		map[string]interface{}{"id": strconv.FormatInt(id, 10)})
+	job, _ := data["job"].(map[string]interface{})
+	return job
+}
+
+// waitForStatus polls until the job has the given status.
+func waitForStatus(t *testing.T, id int64, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job := urldata.GetJob(id); job != nil && urldata.GetJobState(job).Status == status {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %d did not become %s", id, status)
+}
+
+// jobError returns the category and retryability of a job's error.
+func jobError(t *testing.T, job map[string]interface{}) (string, bool) {
+	t.Helper()
+	e, ok := job["error"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("job %v has no error", job["id"])
+	}
+	return e["category"].(string), e["retryable"].(bool)
+}
+
+func requested(f *urltest.FakeFetcher, url string) bool {
+	for _, r := range f.Requests() {
+		if r == url {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRetryClassification(t *testing.T) {
+	s := urltest.NewTestService(t)
+	urldata.SetPoliteness(urldata.PolitenessConfig{MaxRetries: -1})
+	t.Cleanup(func() { urldata.SetPoliteness(urldata.PolitenessConfig{}) })
+
+	tests := []struct {
+		name      string
+		response  urltest.FakeResponse
+		category  string
+		retryable bool
+	}{
+		{"unavailable", urltest.FakeResponse{Status: http.StatusServiceUnavailable}, urldata.ErrHTTP5xx, true},
+		{"server-error", urltest.FakeResponse{Status: http.StatusInternalServerError}, urldata.ErrHTTP5xx, true},
+		{"too-many", urltest.FakeResponse{Status: http.StatusTooManyRequests}, urldata.ErrHTTP4xx, true},
+		{"request-timeout", urltest.FakeResponse{Status: http.StatusRequestTimeout}, urldata.ErrHTTP4xx, true},
+		{"not-found", urltest.FakeResponse{Status: http.StatusNotFound}, urldata.ErrHTTP4xx, false},
+		{"eof", urltest.FakeResponse{Err: io.ErrUnexpectedEOF}, urldata.ErrConnect, true},
+		{"refused", urltest.FakeResponse{Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			urldata.ErrConnect, true},
+		{"no-such-host", urltest.FakeResponse{Err: &net.DNSError{Err: "no such host", Name: "no-such-host.test", IsNotFound: true}},
+			urldata.ErrDNS, false},
+		{"dns-timeout", urltest.FakeResponse{Err: &net.DNSError{Err: "i/o timeout", Name: "dns-timeout.test", IsTimeout: true}},
+			urldata.ErrDNS, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A host per case, so that backing off one does not hold up
+			// the others.
+			url := "http://" + tt.name + ".test/"
+			s.Fetcher.HandleResponse(url, tt.response)
+			id := s.AddJob(url)
+			if status := s.WaitForJob(id, 5*time.Second); status != "error" {
+				t.Fatalf("status = %q, want error", status)
+			}
+			job := queryJob(s, id)
+			category, retryable := jobError(t, job)
+			if category != tt.category || retryable != tt.retryable {
+				t.Errorf("error = %s, retryable %t; want %s, retryable %t", category, retryable, tt.category, tt.retryable)
+			}
+			if attempts := job["attempts"].(float64); attempts != 0 {
+				t.Errorf("attempts = %v with retries disabled", attempts)
+			}
+		})
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	s := urltest.NewTestService(t)
+	urldata.SetPoliteness(urldata.PolitenessConfig{MaxRetries: 2, Backoff: time.Second})
+	t.Cleanup(func() { urldata.SetPoliteness(urldata.PolitenessConfig{}) })
+
+	url := "http://flaky.test/"
+	s.Fetcher.HandleResponse(url, urltest.FakeResponse{Status: http.StatusServiceUnavailable})
+	id := s.AddJob(url)
+	waitForStatus(t, id, "parked")
+
+	s.Fetcher.Handle(url, "recovered")
+	s.Clock.Advance(time.Minute)
+	if status := s.WaitForJob(id, 5*time.Second); status == "error" {
+		t.Fatalf("job failed after its retry: %v", queryJob(s, id)["error"])
+	}
+	if attempts := queryJob(s, id)["attempts"].(float64); attempts != 1 {
+		t.Errorf("attempts = %v, want 1", attempts)
+	}
+	if n := len(s.Fetcher.Requests()); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	s := urltest.NewTestService(t)
+	urldata.SetPoliteness(urldata.PolitenessConfig{MaxRetries: 1, Backoff: time.Second})
+	t.Cleanup(func() { urldata.SetPoliteness(urldata.PolitenessConfig{}) })
+
+	url := "http://down.test/"
+	s.Fetcher.HandleResponse(url, urltest.FakeResponse{Status: http.StatusBadGateway})
+	id := s.AddJob(url)
+	waitForStatus(t, id, "parked")
+	s.Clock.Advance(time.Minute)
+	if status := s.WaitForJob(id, 5*time.Second); status != "error" {
+		t.Fatalf("status = %q, want error", status)
+	}
+	if attempts := queryJob(s, id)["attempts"].(float64); attempts != 1 {
+		t.Errorf("attempts = %v, want 1", attempts)
+	}
+}
+
+func circuitState(s *urltest.Service, host string) string {
+	data := s.Query(`{ stats { hosts { host circuit } } }`, nil)
+	for _, h := range data["stats"].(map[string]interface{})["hosts"].([]interface{}) {
+		h := h.(map[string]interface{})
+		if h["host"] == host {
+			return h["circuit"].(string)
+		}
+	}
+	return ""
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := urltest.NewTestService(t)
+	urldata.SetPoliteness(urldata.PolitenessConfig{MaxRetries: -1})
+	urldata.SetCircuitBreaker(urldata.BreakerConfig{Threshold: 2, Cooldown: time.Minute})
+	t.Cleanup(func() {
+		urldata.SetPoliteness(urldata.PolitenessConfig{})
+		urldata.SetCircuitBreaker(urldata.BreakerConfig{})
+	})
+
+	for _, path := range []string{"a", "b"} {
+		url := "http://broken.test/" + path
+		s.Fetcher.HandleResponse(url, urltest.FakeResponse{Status: http.StatusInternalServerError})
+		s.WaitForJob(s.AddJob(url), 5*time.Second)
+	}
+	if state := circuitState(s, "broken.test"); state != "open" {
+		t.Fatalf("circuit is %q after two failures, want open", state)
+	}
+
+	// While open, jobs fail without a request.
+	s.Fetcher.Handle("http://broken.test/c", "ok")
+	id := s.AddJob("http://broken.test/c")
+	s.WaitForJob(id, 5*time.Second)
+	if category, _ := jobError(t, queryJob(s, id)); category != urldata.ErrPolicy {
+		t.Errorf("error = %s, want %s", category, urldata.ErrPolicy)
+	}
+	if requested(s.Fetcher, "http://broken.test/c") {
+		t.Error("request sent through an open circuit")
+	}
+
+	// After the cooldown the next job is the trial, and its success
+	// closes the circuit.
+	s.Clock.Advance(time.Minute)
+	s.Fetcher.Handle("http://broken.test/d", "ok")
+	id = s.AddJob("http://broken.test/d")
+	if status := s.WaitForJob(id, 5*time.Second); status == "error" {
+		t.Fatalf("trial job failed: %v", queryJob(s, id)["error"])
+	}
+	if state := circuitState(s, "broken.test"); state != "closed" {
+		t.Errorf("circuit is %q after a successful trial, want closed", state)
+	}
+}
+
+// caller runs GraphQL queries as an authenticated identity, which the
+// urltest endpoint has no way to pass.
+type caller struct {
+	t        *testing.T
+	schema   graphql.Schema
+	identity *auth.Identity
+}
+
+func newCaller(t *testing.T, schema graphql.Schema, tenant, owner, role string) *caller {
+	return &caller{t: t, schema: schema, identity: &auth.Identity{Subject: owner, Tenant: tenant, Owner: owner, Role: role}}
+}
+
+func (c *caller) query(query string, variables map[string]interface{}) *graphql.Result {
+	c.t.Helper()
+	return graphql.Do(graphql.Params{
+		Schema:         c.schema,
+		RequestString:  query,
+		VariableValues: variables,
+		Context:        auth.NewContext(context.Background(), c.identity),
+	})
+}
+
+// mustQuery runs a query and returns its data, failing the test on errors.
+func (c *caller) mustQuery(query string, variables map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+	result := c.query(query, variables)
+	if result.HasErrors() {
+		c.t.Fatalf("query returned errors: %v", result.Errors)
+	}
+	return result.Data.(map[string]interface{})
+}
+
+func (c *caller) addJob(url string) int64 {
+	c.t.Helper()
+	data := c.mustQuery(`mutation($url: String!) { addJob(url: $url) { id } }`, map[string]interface{}{"url": url})
+	id, _ := strconv.ParseInt(fmt.Sprint(data["addJob"].(map[string]interface{})["id"]), 10, 64)
+	return id
+}
+
+func newSchema(t *testing.T) graphql.Schema {
+	schema, err := graphql.NewSchema(urldata.SchemaConfig())
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	return schema
+}
+
+func TestTenantScoping(t *testing.T) {
+	s := urltest.NewTestService(t)
+	schema := newSchema(t)
+	alice := newCaller(t, schema, "a", "alice", auth.RoleSubmitter)
+	bob := newCaller(t, schema, "b", "bob", auth.RoleSubmitter)
+	admin := newCaller(t, schema, "", "root", auth.RoleAdmin)
+
+	url := "http://private.test/report"
+	s.Fetcher.Handle(url, "tenant a's report")
+	id := alice.addJob(url)
+	s.WaitForJob(id, 5*time.Second)
+	vars := map[string]interface{}{"id": strconv.FormatInt(id, 10), "url": url}
+
+	const jobQuery = `query($id: String!) { job(id: $id) { id } }`
+	const responseQuery = `query($url: String!) { response(url: $url) { body } }`
+	if alice.mustQuery(jobQuery, vars)["job"] == nil {
+		t.Error("job hidden from its own tenant")
+	}
+	if admin.mustQuery(jobQuery, vars)["job"] == nil {
+		t.Error("job hidden from an admin")
+	}
+	if job := bob.mustQuery(jobQuery, vars)["job"]; job != nil {
+		t.Errorf("job of tenant a visible to tenant b: %v", job)
+	}
+	if jobs := bob.mustQuery(`{ jobs { id } }`, nil)["jobs"].([]interface{}); len(jobs) != 0 {
+		t.Errorf("tenant b lists jobs of tenant a: %v", jobs)
+	}
+	if alice.mustQuery(responseQuery, vars)["response"] == nil {
+		t.Error("response hidden from its own tenant")
+	}
+	if r := bob.mustQuery(responseQuery, vars)["response"]; r != nil {
+		t.Errorf("response fetched for tenant a visible to tenant b: %v", r)
+	}
+
+	const statsQuery = `{ stats { hosts { host } } }`
+	if hosts := alice.mustQuery(statsQuery, nil)["stats"].(map[string]interface{})["hosts"].([]interface{}); len(hosts) != 1 {
+		t.Errorf("tenant a sees hosts %v, want private.test", hosts)
+	}
+	if hosts := bob.mustQuery(statsQuery, nil)["stats"].(map[string]interface{})["hosts"].([]interface{}); len(hosts) != 0 {
+		t.Errorf("tenant b sees hosts of tenant a: %v", hosts)
+	}
+
+	bob.mustQuery(`mutation($id: String!) { deleteJobs(ids: [$id]) { id } }`, vars)
+	if urldata.GetJob(id) == nil {
+		t.Error("tenant b deleted a job of tenant a")
+	}
+}
+
+// refused reports whether adding a job for url fails because of the
+// target policy.
+func (c *caller) refused(url string) bool {
+	c.t.Helper()
+	result := c.query(`mutation($url: String!) { addJob(url: $url) { id } }`, map[string]interface{}{"url": url})
+	return len(result.Errors) > 0 && strings.Contains(result.Errors[0].Message, urldata.ErrTargetPolicy.Error())
+}
+
+func TestTargetPolicy(t *testing.T) {
+	s := urltest.NewTestService(t)
+	schema := newSchema(t)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	urldata.SetTargetPolicy(urldata.TargetPolicy{}, map[string]urldata.TargetPolicy{
+		"ops": {Networks: []*net.IPNet{loopback}},
+	})
+	t.Cleanup(func() { urldata.SetTargetPolicy(urldata.TargetPolicy{}, nil) })
+
+	anyone := newCaller(t, schema, "", "", auth.RoleSubmitter)
+	for _, url := range []string{"http://127.0.0.1/", "http://10.1.2.3/", "http://169.254.169.254/latest/meta-data/",
+		"http://public.test:22/", "gopher://public.test/"} {
+		s.Fetcher.Handle(url, "secret")
+		if !anyone.refused(url) {
+			t.Errorf("%s: not refused", url)
+		}
+		if requested(s.Fetcher, url) {
+			t.Errorf("%s: refused target was fetched", url)
+		}
+	}
+
+	s.Fetcher.Handle("https://public.test/", "hello")
+	if anyone.refused("https://public.test/") {
+		t.Error("public target refused")
+	}
+
+	// A trusted tenant may fetch from its own networks...
+	ops := newCaller(t, schema, "ops", "ops", auth.RoleSubmitter)
+	id := ops.addJob("http://127.0.0.1/")
+	if status := s.WaitForJob(id, 5*time.Second); status == "error" {
+		t.Fatalf("trusted tenant refused: %v", queryJob(s, id)["error"])
+	}
+	if !ops.refused("http://10.1.2.3/") {
+		t.Error("trusted tenant allowed outside its networks")
+	}
+
+	// ...but what it fetched is not served to others from the cache.
+	if !anyone.refused("http://127.0.0.1/") {
+		t.Error("refused target served from the cache")
+	}
+}
+
+// leaksTenant reports whether a resolver result includes a job of tenant.
+func leaksTenant(result interface{}, tenant string) bool {
+	switch v := result.(type) {
+	case *urldata.Job:
+		return v != nil && v.Tenant == tenant
+	case urldata.Job:
+		return v.Tenant == tenant
+	case []*urldata.Job:
+		for _, job := range v {
+			if job != nil && job.Tenant == tenant {
+				return true
+			}
+		}
+	case []urldata.Job:
+		for _, job := range v {
+			if job.Tenant == tenant {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TestJobFieldsHideOtherTenants resolves every field of the schema that
+// returns jobs as a caller of another tenant, so that a new field cannot
+// leave the jobs of other tenants visible.
+func TestJobFieldsHideOtherTenants(t *testing.T) {
+	s := urltest.NewTestService(t)
+	schema := newSchema(t)
+	alice := newCaller(t, schema, "a", "alice", auth.RoleSubmitter)
+	url := "http://private.test/"
+	s.Fetcher.Handle(url, "private")
+	id := alice.addJob(url)
+	s.WaitForJob(id, 5*time.Second)
+
+	// Sources of the fields of each object type with fields returning
+	// jobs, all pointing at the job of tenant a.
+	sources := map[string]interface{}{
+		"Query":    nil,
+		"Mutation": nil,
+		"Batch":    &urldata.Batch{ID: 1, JobIDs: []int64{id}, Tenant: "a"},
+		"Monitor":  &urldata.Monitor{ID: 1, URL: url, LastJobID: id},
+	}
+	idString := strconv.FormatInt(id, 10)
+	args := map[string]interface{}{"id": idString, "ids": []interface{}{idString}, "url": url, "version": 0}
+	ctx := auth.NewContext(context.Background(), &auth.Identity{Subject: "bob", Tenant: "b", Owner: "bob", Role: auth.RoleSubmitter})
+
+	for typeName, typ := range schema.TypeMap() {
+		object, ok := typ.(*graphql.Object)
+		if !ok || strings.HasPrefix(typeName, "__") {
+			continue
+		}
+		for fieldName, field := range object.Fields() {
+			if graphql.GetNamed(field.Type).String() != "Job" {
+				continue
+			}
+			name := typeName + "." + fieldName
+			source, ok := sources[typeName]
+			if !ok {
+				t.Errorf("%s returns jobs, but the test has no source for %s", name, typeName)
+				continue
+			}
+			if field.Resolve == nil {
+				t.Errorf("%s returns jobs without a resolver to hide them", name)
+				continue
+			}
+			result, err := field.Resolve(graphql.ResolveParams{Context: ctx, Source: source, Args: args})
+			if err == nil && leaksTenant(result, "a") {
+				t.Errorf("%s shows a job of tenant a to tenant b", name)
+			}
+		}
+	}
+}
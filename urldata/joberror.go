@@ -0,0 +1,162 @@
+package urldata
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Error categories of a failed job.
+const (
+	ErrDNS      = "DNS"       // The host could not be resolved
+	ErrConnect  = "CONNECT"   // The connection failed or broke
+	ErrTLS      = "TLS"       // The TLS handshake or certificate check failed
+	ErrTimeout  = "TIMEOUT"   // The request timed out
+	ErrHTTP4xx  = "HTTP_4XX"  // The host answered with a client error
+	ErrHTTP5xx  = "HTTP_5XX"  // The host answered with a server error
+	ErrBodyRead = "BODY_READ" // The response body could not be read
+	ErrPolicy   = "POLICY"    // The job was refused by the server's own rules
+)
+
+// JobError describes why a job failed.
+type JobError struct {
+	Category  string `json:"category"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"` // Whether trying again later may succeed
+}
+
+func (e *JobError) Error() string {
+	return e.Category + ": " + e.Message
+}
+
+func policyError(format string, args ...interface{}) *JobError {
+	return &JobError{Category: ErrPolicy, Message: fmt.Sprintf(format, args...)}
+}
+
+// classifyError categorises an error returned while sending a request.
+func classifyError(err error) *JobError {
+	// Error messages quote the URL requested.
+	err = redactError(err)
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, errTooManyRedirects), errors.Is(err, ErrTargetPolicy),
+		strings.Contains(err.Error(), "server response headers exceeded"):
+		return policyError("%v", err)
+	case errors.As(err, &dnsErr):
+		return &JobError{Category: ErrDNS, Message: err.Error(), Retryable: dnsErr.IsTemporary || dnsErr.IsTimeout}
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr), strings.Contains(err.Error(), "tls: "):
+		return &JobError{Category: ErrTLS, Message: err.Error()}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &JobError{Category: ErrTimeout, Message: err.Error(), Retryable: true}
+	case errors.As(err, &opErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return &JobError{Category: ErrConnect, Message: err.Error(), Retryable: true}
+	}
+	// Nothing says the failure is transient, so don't retry it.
+	return &JobError{Category: ErrConnect, Message: err.Error()}
+}
+
+// httpError returns the error for a response with an error status, or nil.
+// Server errors, 408 and 429 are retryable.
+func httpError(resp *http.Response) *JobError {
+	return statusError(resp.StatusCode, resp.Status)
+}
+
+// cachedError returns the error for a cached response with an error status,
+// which was only cached because asking again would not help, or nil.
+func cachedError(r *Response) *JobError {
+	return statusError(r.StatusCode, fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)))
+}
+
+// statusError returns the error for a status code, described by status, or
+// nil if it is not an error.
+func statusError(code int, status string) *JobError {
+	switch {
+	case code >= 500:
+		return &JobError{Category: ErrHTTP5xx, Message: status, Retryable: true}
+	case code >= 400:
+		retryable := code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+		return &JobError{Category: ErrHTTP4xx, Message: status, Retryable: retryable}
+	}
+	return nil
+}
+
+// failJob fails the job with e. Retryable failures, or those the job's
+// retry script picks, are retried with an exponential backoff, no earlier
+// than the host allows, until the job runs out of retries; the job is
+// parked in the meantime.
+func failJob(ctx context.Context, job *Job, e *JobError) {
+	if ctx != nil && ctx.Err() == context.DeadlineExceeded && job.Options.MaxDuration > 0 {
+		e = exceedBudget(job, budgetDuration)
+	}
+	attempts := job.Attempts
+	politeness := currentPoliteness()
+	if attempts >= politeness.MaxRetries || !scriptRetry(job, e) {
+		updateJob(job, func(job *Job) {
+			job.Error = e
+			job.Status = "error"
+		})
+		return
+	}
+	wait := politeness.Backoff << uint(attempts)
+	if wait <= 0 || wait > politeness.MaxBackoff {
+		wait = politeness.MaxBackoff
+	}
+	at := clock.Now().Add(wait)
+	if _, until := paceStats(hostOf(job.URL)); until.After(at) {
+		at = until
+	}
+	updateJob(job, func(job *Job) {
+		job.Error = e
+		job.Attempts++
+	})
+	recordEvent(job, "retry", "%v, retry %d at %s", e, attempts+1, at.Format(time.RFC3339))
+	parkUntil(job, at, "waiting to retry until %s", at.Format(time.RFC3339))
+}
+
+func jobErrorType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "JobError",
+		Fields: graphql.Fields{
+			"category": &graphql.Field{
+				Type: graphql.NewEnum(graphql.EnumConfig{
+					Name: "ErrorCategory",
+					Values: graphql.EnumValueConfigMap{
+						ErrDNS:      &graphql.EnumValueConfig{Value: ErrDNS, Description: "The host could not be resolved"},
+						ErrConnect:  &graphql.EnumValueConfig{Value: ErrConnect, Description: "The connection failed or broke"},
+						ErrTLS:      &graphql.EnumValueConfig{Value: ErrTLS, Description: "The TLS handshake or certificate check failed"},
+						ErrTimeout:  &graphql.EnumValueConfig{Value: ErrTimeout, Description: "The request timed out"},
+						ErrHTTP4xx:  &graphql.EnumValueConfig{Value: ErrHTTP4xx, Description: "The host answered with a client error"},
+						ErrHTTP5xx:  &graphql.EnumValueConfig{Value: ErrHTTP5xx, Description: "The host answered with a server error"},
+						ErrBodyRead: &graphql.EnumValueConfig{Value: ErrBodyRead, Description: "The response body could not be read"},
+						ErrPolicy:   &graphql.EnumValueConfig{Value: ErrPolicy, Description: "The job was refused by the server's own rules"},
+					},
+				}),
+				Description: "Kind of failure",
+			},
+			"message": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Details of the failure",
+			},
+			"retryable": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether trying again later may succeed",
+			},
+		},
+	})
+}
@@ -0,0 +1,126 @@
+package urldata
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Guards the fields of all jobs that change while they run: Status,
+// Response, Error, Certificate, WorkerID, QueueWait, LookupWait, Attempts,
+// Redeliveries, BudgetExceeded and Debug. Workers change them while
+// resolvers, the REST API and the journal read them, so they are only changed through updateJob, and
+// read from other goroutines through GetJobState.
+var stateMu sync.RWMutex
+
+// JobState is a consistent copy of the fields of a job that change while
+// it runs.
+type JobState struct {
+	Status         string
+	Response       *Response
+	Error          *JobError
+	Certificate    *CertificateCheck
+	WorkerID       int
+	QueueWait      time.Duration
+	LookupWait     time.Duration
+	Attempts       int
+	Redeliveries   int
+	BudgetExceeded string
+	Debug          *DebugInfo
+}
+
+// GetJobState returns a copy of the fields of the job that change while it
+// runs.
+func GetJobState(job *Job) JobState {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return JobState{
+		Status:         job.Status,
+		Response:       job.Response,
+		Error:          job.Error,
+		Certificate:    job.Certificate,
+		WorkerID:       job.WorkerID,
+		QueueWait:      job.QueueWait,
+		LookupWait:     job.LookupWait,
+		Attempts:       job.Attempts,
+		Redeliveries:   job.Redeliveries,
+		BudgetExceeded: job.BudgetExceeded,
+		Debug:          job.Debug,
+	}
+}
+
+// snapshotJob returns a copy of the job that can be read while the job
+// runs on.
+func snapshotJob(job *Job) Job {
+	state := GetJobState(job)
+	return Job{
+		ID:             job.ID,
+		URL:            job.URL,
+		Status:         state.Status,
+		Response:       state.Response,
+		Tenant:         job.Tenant,
+		Owner:          job.Owner,
+		Options:        job.Options,
+		Events:         jobEvents(job),
+		WorkerID:       state.WorkerID,
+		QueueWait:      state.QueueWait,
+		LookupWait:     state.LookupWait,
+		Attempts:       state.Attempts,
+		Error:          state.Error,
+		BudgetExceeded: state.BudgetExceeded,
+		Redeliveries:   state.Redeliveries,
+		Instance:       job.Instance,
+		Certificate:    state.Certificate,
+		Debug:          state.Debug,
+		DeletedAt:      job.DeletedAt,
+		Version:        atomic.LoadInt64(&job.Version),
+	}
+}
+
+// jobStatus returns the status of the job.
+func jobStatus(job *Job) string {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return job.Status
+}
+
+// UpdateJobStatus sets the status of a job, and records the change on its
+// timeline and in the event stream. It returns nil if there is no such job.
+func UpdateJobStatus(id int64, status string) *Job {
+	job := GetJob(id)
+	if job == nil {
+		return nil
+	}
+	setStatus(job, status)
+	recordEvent(job, "status", "status set to %q", status)
+	return job
+}
+
+// SetJobResponse sets the response of a job, and records the change on its
+// timeline and in the event stream. It returns nil if there is no such job.
+func SetJobResponse(id int64, r *Response) *Job {
+	job := GetJob(id)
+	if job == nil {
+		return nil
+	}
+	updateJob(job, func(job *Job) { job.Response = r })
+	if r == nil {
+		recordEvent(job, "response", "response cleared")
+	} else {
+		recordEvent(job, "response", "response set, status %d", r.StatusCode)
+	}
+	return job
+}
+
+// updateJob changes the state of the job in change, without readers seeing
+// it half done.
+func updateJob(job *Job, change func(job *Job)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	change(job)
+}
+
+// setStatus sets the status of the job.
+func setStatus(job *Job, status string) {
+	updateJob(job, func(job *Job) { job.Status = status })
+}
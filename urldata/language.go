@@ -0,0 +1,198 @@
+package urldata
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/graphql-go/graphql"
+	"golang.org/x/net/html"
+)
+
+// Language is the natural language a response is written in.
+type Language struct {
+	Code       string  `json:"code"`       // ISO 639-1 code, such as "en"
+	Confidence float64 `json:"confidence"` // From 0 to 1
+}
+
+// Most text looked at to detect the language of a body.
+const maxLanguageText = 64 << 10
+
+// Fewest common words a text of a Latin or Cyrillic script must have for
+// its language to be told.
+const minLanguageWords = 3
+
+// Common words of the languages told apart by their words rather than their
+// script.
+var commonWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "that", "for", "it", "with", "was", "on", "are", "this", "be", "you", "not", "have", "from", "by"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "un", "du", "dans", "pour", "que", "qui", "pas", "sur", "au", "avec", "sont", "nous", "vous"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "auf", "für", "von", "dem", "auch", "es", "wir", "sie"},
+	"es": {"el", "la", "los", "las", "y", "que", "de", "en", "es", "por", "un", "una", "para", "con", "no", "del", "se", "lo", "como", "más"},
+	"it": {"il", "la", "di", "che", "e", "non", "per", "un", "una", "sono", "del", "della", "gli", "le", "con", "è", "anche", "questo", "si", "nel"},
+	"pt": {"o", "a", "os", "as", "de", "que", "não", "em", "um", "uma", "para", "com", "do", "da", "é", "são", "por", "mais", "se", "também"},
+	"nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "op", "te", "zijn", "voor", "met", "die", "ook", "er", "maar", "wij", "naar", "bij"},
+	"sv": {"och", "att", "det", "som", "en", "är", "på", "för", "med", "inte", "av", "till", "den", "har", "jag", "vi", "ett", "om", "var", "också"},
+	"pl": {"i", "w", "nie", "na", "się", "z", "jest", "do", "to", "że", "jak", "ale", "od", "po", "tak", "dla", "są", "przez", "jego", "już"},
+	"ru": {"и", "в", "не", "на", "что", "с", "по", "это", "как", "он", "но", "из", "для", "к", "все", "так", "его", "был", "она", "от"},
+	"uk": {"і", "в", "не", "на", "що", "з", "це", "як", "та", "до", "але", "від", "для", "по", "він", "його", "вона", "був", "ми", "також"},
+}
+
+// commonWordLanguages maps each common word to the languages it is common
+// in.
+var commonWordLanguages = func() map[string][]string {
+	m := map[string][]string{}
+	for lang, words := range commonWords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// Scripts that are mostly used by a single language.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	code   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Arabic, "ar"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// detectLanguage guesses the language of an HTML or plain text response.
+// It returns nil for other media types and for texts too short to tell.
+func detectLanguage(r *Response) *Language {
+	text, ok := responseText(r)
+	if !ok {
+		return nil
+	}
+	if len(text) > maxLanguageText {
+		text = truncateBody([]byte(text), maxLanguageText)
+	}
+	// Count the letters of each script first: the languages with a script
+	// of their own are told by it.
+	letters, latin, cyrillic := 0, 0, 0
+	scripts := map[string]int{}
+	for _, c := range text {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Latin, c):
+			latin++
+		case unicode.Is(unicode.Cyrillic, c):
+			cyrillic++
+		default:
+			for _, s := range scriptLanguages {
+				if unicode.Is(s.script, c) {
+					scripts[s.code]++
+					break
+				}
+			}
+		}
+	}
+	if letters == 0 {
+		return nil
+	}
+	// Japanese mixes kana with Han characters.
+	if scripts["ja"] > 0 {
+		scripts["ja"] += scripts["zh"]
+		delete(scripts, "zh")
+	}
+	best, bestCount := "", 0
+	for code, n := range scripts {
+		if n > bestCount || n == bestCount && code < best {
+			best, bestCount = code, n
+		}
+	}
+	if bestCount > latin && bestCount > cyrillic {
+		return &Language{Code: best, Confidence: float64(bestCount) / float64(letters)}
+	}
+
+	scores := map[string]int{}
+	total := 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(c rune) bool { return !unicode.IsLetter(c) }) {
+		langs := commonWordLanguages[word]
+		for _, lang := range langs {
+			scores[lang]++
+		}
+		if len(langs) > 0 {
+			total++
+		}
+	}
+	best, bestCount = "", 0
+	for lang, n := range scores {
+		if n > bestCount || n == bestCount && lang < best {
+			best, bestCount = lang, n
+		}
+	}
+	if bestCount < minLanguageWords {
+		return nil
+	}
+	return &Language{Code: best, Confidence: float64(bestCount) / float64(total)}
+}
+
+// responseText returns the text of an HTML or plain text response, without
+// the markup, scripts and styles of HTML. It reports false for other media
+// types.
+func responseText(r *Response) (string, bool) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(r.Body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/plain":
+		return string(r.Body), true
+	case "text/html", "application/xhtml+xml":
+	default:
+		return "", false
+	}
+	var b strings.Builder
+	skip := 0 // Depth inside script and style elements
+	tokens := html.NewTokenizer(strings.NewReader(string(r.Body)))
+	for tt := tokens.Next(); tt != html.ErrorToken && b.Len() < maxLanguageText; tt = tokens.Next() {
+		switch tt {
+		case html.StartTagToken:
+			if name, _ := tokens.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokens.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(tokens.Text())
+				b.WriteByte(' ')
+			}
+		}
+	}
+	return b.String(), true
+}
+
+func languageType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Language",
+		Description: "The natural language a response is written in",
+		Fields: graphql.Fields{
+			"code": &graphql.Field{
+				Type:        graphql.String,
+				Description: "ISO 639-1 code, such as en",
+			},
+			"confidence": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "How sure the detection is, from 0 to 1",
+			},
+		},
+	})
+}
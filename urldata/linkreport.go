@@ -0,0 +1,163 @@
+package urldata
+
+import (
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+)
+
+// LinkReport lists the broken links found by a batch, usually a crawl that
+// checks links.
+type LinkReport struct {
+	Pending int // Jobs of the batch that have not finished yet
+	Checked int // Distinct links whose target was fetched
+	Broken  int // Distinct links whose target failed
+	Pages   []PageLinks
+	// Orphaned404s are URLs of the batch that were not found and that no
+	// page of the batch links to.
+	Orphaned404s []string
+}
+
+// PageLinks lists the broken links of a page.
+type PageLinks struct {
+	URL    string
+	Broken []BrokenLink
+}
+
+// BrokenLink is a link whose target could not be fetched.
+type BrokenLink struct {
+	URL        string
+	StatusCode int       // 0 if there was no response
+	Error      *JobError // Why fetching the target failed
+}
+
+// GetLinkReport returns the broken links between the pages of a batch, or
+// nil if there is no such batch. Links whose target the batch did not fetch
+// are not reported.
+func GetLinkReport(batchID int64) *LinkReport {
+	b := GetBatch(batchID)
+	if b == nil {
+		return nil
+	}
+	r := &LinkReport{Pending: b.Pending}
+	var fetched []*Job
+	byURL := map[string]*Job{}
+	for _, id := range b.JobIDs {
+		job := GetJob(id)
+		if job == nil || byURL[job.URL] != nil {
+			continue
+		}
+		byURL[job.URL] = job
+		fetched = append(fetched, job)
+	}
+
+	linked := map[string]bool{}
+	counted := map[string]bool{}
+	for _, job := range fetched {
+		page := PageLinks{URL: job.URL}
+		for _, link := range pageLinks(job) {
+			linked[link] = true
+			target := byURL[link]
+			if target == nil {
+				continue
+			}
+			state := GetJobState(target)
+			if !Finished(state.Status) {
+				continue
+			}
+			// Jobs restored from before error responses failed them may
+			// be done with one.
+			broken := state.Status == "error" || state.Response != nil && state.Response.StatusCode >= 400
+			if !counted[link] {
+				counted[link] = true
+				r.Checked++
+				if broken {
+					r.Broken++
+				}
+			}
+			if broken {
+				bl := BrokenLink{URL: link, Error: state.Error}
+				if state.Response != nil {
+					bl.StatusCode = state.Response.StatusCode
+				}
+				page.Broken = append(page.Broken, bl)
+			}
+		}
+		if len(page.Broken) > 0 {
+			r.Pages = append(r.Pages, page)
+		}
+	}
+	for _, job := range fetched {
+		if resp := GetJobState(job).Response; resp != nil && resp.StatusCode == http.StatusNotFound && !linked[job.URL] {
+			r.Orphaned404s = append(r.Orphaned404s, job.URL)
+		}
+	}
+	return r
+}
+
+func linkReportType(errorType *graphql.Object) *graphql.Object {
+	brokenLinkType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BrokenLink",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL linked to",
+			},
+			"statusCode": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "HTTP status code of the target, if it responded",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if code := p.Source.(BrokenLink).StatusCode; code != 0 {
+						return code, nil
+					}
+					return nil, nil
+				},
+			},
+			"error": &graphql.Field{
+				Type:        errorType,
+				Description: "Why fetching the target failed",
+			},
+		},
+	})
+	pageLinksType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageLinks",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL of the page",
+			},
+			"broken": &graphql.Field{
+				Type:        graphql.NewList(brokenLinkType),
+				Description: "Links on the page whose target failed",
+			},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "LinkReport",
+		Fields: graphql.Fields{
+			"pending": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Jobs of the batch that have not finished, so the report may be incomplete",
+			},
+			"checked": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of distinct links whose target was fetched",
+			},
+			"broken": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of distinct links whose target failed",
+			},
+			"pages": &graphql.Field{
+				Type:        graphql.NewList(pageLinksType),
+				Description: "Pages with broken links, in the order they were fetched",
+			},
+			"orphaned404s": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "URLs of the batch that were not found and that no page of the batch links to",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*LinkReport).Orphaned404s, nil
+				},
+			},
+		},
+	})
+}
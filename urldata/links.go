@@ -0,0 +1,268 @@
+package urldata
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"golang.org/x/net/html"
+)
+
+// extractLinks returns the absolute http(s) URLs that the anchors of an
+// HTML body link to, without fragments or duplicates, in document order.
+// Bodies that are not HTML have no links.
+func extractLinks(base string, header http.Header, body []byte) []string {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+	var links []string
+	seen := map[string]bool{}
+	tokens := html.NewTokenizer(strings.NewReader(string(body)))
+	for {
+		tt := tokens.Next()
+		if tt == html.ErrorToken {
+			return links
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := tokens.TagName()
+		tag := string(name)
+		if tag != "a" && tag != "area" && tag != "base" || !hasAttr {
+			continue
+		}
+		for {
+			key, value, more := tokens.TagAttr()
+			if string(key) == "href" {
+				ref, err := baseURL.Parse(strings.TrimSpace(string(value)))
+				if err != nil {
+					break
+				}
+				if tag == "base" {
+					baseURL = ref
+					break
+				}
+				ref.Fragment = ""
+				link := ref.String()
+				if (ref.Scheme == "http" || ref.Scheme == "https") && !seen[link] {
+					seen[link] = true
+					links = append(links, link)
+				}
+				break
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// LinkGraph is the pages of a batch and the links between them.
+type LinkGraph struct {
+	Pages []Page
+	Edges []Edge
+}
+
+// Page is a node of a link graph: a URL fetched by the batch, or one that
+// a fetched page links to.
+type Page struct {
+	URL        string
+	JobID      int64 // 0 if the batch did not fetch the URL
+	Status     string
+	StatusCode int // 0 if there was no response
+	Depth      int // Links followed from the start of a crawl
+}
+
+// Edge is a link from one page to another.
+type Edge struct {
+	From string
+	To   string
+}
+
+// GetLinkGraph returns the link graph of the pages fetched by a batch, or
+// nil if there is no such batch.
+func GetLinkGraph(batchID int64) *LinkGraph {
+	b := GetBatch(batchID)
+	if b == nil {
+		return nil
+	}
+	g := &LinkGraph{}
+	pages := map[string]bool{}
+	for _, id := range b.JobIDs {
+		job := GetJob(id)
+		if job == nil || pages[job.URL] {
+			continue
+		}
+		pages[job.URL] = true
+		state := GetJobState(job)
+		page := Page{URL: job.URL, JobID: job.ID, Status: state.Status, Depth: job.Options.CrawlDepth}
+		if state.Response != nil {
+			page.StatusCode = state.Response.StatusCode
+		}
+		// The links of pages fetched only to check them are not part of
+		// the site.
+		for _, link := range pageLinks(job) {
+			g.Edges = append(g.Edges, Edge{From: job.URL, To: link})
+		}
+		g.Pages = append(g.Pages, page)
+	}
+	// Pages linked to but not fetched complete the graph.
+	var unfetched []string
+	for _, e := range g.Edges {
+		if !pages[e.To] {
+			pages[e.To] = true
+			unfetched = append(unfetched, e.To)
+		}
+	}
+	sort.Strings(unfetched)
+	for _, u := range unfetched {
+		g.Pages = append(g.Pages, Page{URL: u})
+	}
+	return g
+}
+
+// pageLinks returns the links of a page the batch crawled or was given.
+func pageLinks(job *Job) []string {
+	r := GetJobState(job).Response
+	if r == nil || job.Options.LinkCheck {
+		return nil
+	}
+	return r.Links
+}
+
+// DOT returns the graph in the Graphviz DOT language.
+func (g *LinkGraph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph links {\n")
+	for _, p := range g.Pages {
+		label := p.URL
+		if p.StatusCode != 0 {
+			label = fmt.Sprintf("%s\n%d", p.URL, p.StatusCode)
+		}
+		style := ""
+		if p.JobID == 0 {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q%s];\n", p.URL, label, style)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %q -> %q;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// GraphML returns the graph as a GraphML document, with each page's status
+// code and whether it was fetched as node data.
+func (g *LinkGraph) GraphML() string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	b.WriteString(`  <key id="url" for="node" attr.name="url" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="statusCode" for="node" attr.name="statusCode" attr.type="int"/>` + "\n")
+	b.WriteString(`  <key id="fetched" for="node" attr.name="fetched" attr.type="boolean"/>` + "\n")
+	b.WriteString(`  <graph id="links" edgedefault="directed">` + "\n")
+	ids := map[string]string{}
+	for i, p := range g.Pages {
+		ids[p.URL] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(&b, `    <node id="%s"><data key="url">%s</data><data key="statusCode">%d</data><data key="fetched">%t</data></node>`+"\n",
+			ids[p.URL], escapeXML(p.URL), p.StatusCode, p.JobID != 0)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, `    <edge source="%s" target="%s"/>`+"\n", ids[e.From], ids[e.To])
+	}
+	b.WriteString("  </graph>\n</graphml>\n")
+	return b.String()
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func linkGraphType() *graphql.Object {
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Page",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL of the page",
+			},
+			"jobId": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the job that fetched the page, null if the batch did not fetch it",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := p.Source.(Page).JobID; id != 0 {
+						return id, nil
+					}
+					return nil, nil
+				},
+			},
+			"status": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Status of the job that fetched the page",
+			},
+			"statusCode": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "HTTP status code of the page, if it was fetched",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if code := p.Source.(Page).StatusCode; code != 0 {
+						return code, nil
+					}
+					return nil, nil
+				},
+			},
+			"depth": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of links followed from the start of the crawl to the page, if it was fetched",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if page := p.Source.(Page); page.JobID != 0 {
+						return page.Depth, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Edge",
+		Fields: graphql.Fields{
+			"from": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL of the linking page",
+			},
+			"to": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL linked to",
+			},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "LinkGraph",
+		Fields: graphql.Fields{
+			"pages": &graphql.Field{
+				Type:        graphql.NewList(pageType),
+				Description: "Pages fetched by the batch in submission order, then the pages they link to",
+			},
+			"edges": &graphql.Field{
+				Type:        graphql.NewList(edgeType),
+				Description: "Links from the fetched pages",
+			},
+		},
+	})
+}
@@ -0,0 +1,43 @@
+package urldata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How many DNS lookups may be in progress at once unless configured
+// otherwise.
+const defaultMaxLookups = 100
+
+// Guards lookupSlots.
+var lookupsMu sync.Mutex
+var lookupSlots = make(chan struct{}, defaultMaxLookups)
+
+// SetMaxLookups limits the lookups of the hosts jobs fetch from that are in
+// progress at once to n, or 100 if n is 0, so that adding thousands of jobs
+// for distinct hosts cannot exhaust the file descriptors of the resolver.
+// Fetches wait for a free slot, and the wait counts as the job's lookupWait.
+func SetMaxLookups(n int) {
+	if n <= 0 {
+		n = defaultMaxLookups
+	}
+	lookupsMu.Lock()
+	defer lookupsMu.Unlock()
+	lookupSlots = make(chan struct{}, n)
+}
+
+// acquireLookup waits for a lookup slot, and returns how long it waited
+// and the function to release the slot with.
+func acquireLookup(ctx context.Context) (time.Duration, func(), error) {
+	lookupsMu.Lock()
+	slots := lookupSlots
+	lookupsMu.Unlock()
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+		return time.Since(start), func() { <-slots }, nil
+	case <-ctx.Done():
+		return time.Since(start), nil, ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package urldata
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/graphql-go/graphql"
+)
+
+// MetadataEntry is a client-defined key/value pair attached to a job.
+type MetadataEntry struct {
+	Key   string
+	Value string
+}
+
+// Annotate sets metadata on a job, typically once the client has processed
+// its response. Keys with an empty value are removed. The job must still be
+// at the given version. It returns nil if there is no such job.
+func Annotate(id int64, version int64, set map[string]string) (*Job, error) {
+	jobsMu.Lock()
+	job, ok := jobs[id]
+	if !ok {
+		jobsMu.Unlock()
+		return nil, nil
+	}
+	if err := claimVersion(job, version); err != nil {
+		jobsMu.Unlock()
+		return nil, err
+	}
+	// Resolvers read the map without locking, so it is replaced rather than
+	// changed.
+	metadata := map[string]string{}
+	for k, v := range job.Options.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range set {
+		if v == "" {
+			delete(metadata, k)
+		} else {
+			metadata[k] = v
+		}
+	}
+	job.Options.Metadata = metadata
+	jobsMu.Unlock()
+	persist(job)
+	return job, nil
+}
+
+// MatchesMetadata reports whether the job has all the key/value pairs of
+// filter. An empty value in filter matches any value of the key.
+func MatchesMetadata(job *Job, filter map[string]string) bool {
+	for k, v := range filter {
+		got, ok := job.Options.Metadata[k]
+		if !ok || v != "" && got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataEntries returns the metadata ordered by key.
+func metadataEntries(metadata map[string]string) []MetadataEntry {
+	entries := []MetadataEntry{}
+	for k, v := range metadata {
+		entries = append(entries, MetadataEntry{Key: k, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// parseMetadata converts a list of metadataInput values to a map. Entries
+// without a value get an empty one.
+func parseMetadata(arg interface{}) (map[string]string, error) {
+	values, _ := arg.([]interface{})
+	metadata := map[string]string{}
+	for _, v := range values {
+		entry, _ := v.(map[string]interface{})
+		key, _ := entry["key"].(string)
+		if key == "" {
+			return nil, fmt.Errorf("metadata keys must not be empty")
+		}
+		metadata[key], _ = entry["value"].(string)
+	}
+	return metadata, nil
+}
+
+// withoutEmpty returns metadata without its empty values.
+func withoutEmpty(metadata map[string]string) map[string]string {
+	for k, v := range metadata {
+		if v == "" {
+			delete(metadata, k)
+		}
+	}
+	return metadata
+}
+
+// metadataInput is shared by every argument taking metadata, since a schema
+// may only define the type once.
+var metadataInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "MetadataInput",
+	Description: "A key/value pair of job metadata",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"key": &graphql.InputObjectFieldConfig{
+			Type: graphql.NewNonNull(graphql.String),
+		},
+		"value": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "Value of the key; empty or missing removes the key when annotating, and matches any value when filtering",
+		},
+	},
+})
+
+func metadataEntryType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "MetadataEntry",
+		Fields: graphql.Fields{
+			"key": &graphql.Field{
+				Type: graphql.String,
+			},
+			"value": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+}
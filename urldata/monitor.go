@@ -0,0 +1,282 @@
+package urldata
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/graphql-go/graphql"
+)
+
+// minMonitorInterval is the shortest interval a URL can be monitored at.
+const minMonitorInterval = 10 * time.Second
+
+// Monitor fetches a URL at an interval. A content monitor tells its
+// notifier whenever the content changes, an uptime monitor whenever the
+// URL goes down or comes back up, and a certificate monitor when the
+// certificates of its host are about to expire.
+type Monitor struct {
+	ID       int64
+	Kind     string // content, uptime or certificate
+	URL      string
+	Interval time.Duration
+	Notify   string // Notifier told about changes
+	Tenant   string
+	Owner    string
+	Created  time.Time
+	Stopped  bool
+
+	Checks      int       // Jobs that have finished
+	Changes     int       // Checks that found different content
+	LastJobID   int64     // The latest job, finished or not
+	LastChanged time.Time // When a change was last found
+	// SHA256 is the checksum of the content last fetched successfully,
+	// fetched by the job BaselineJobID.
+	SHA256        string
+	BaselineJobID int64
+	// WarnDays is how many days before the certificates expire a
+	// certificate monitor warns.
+	WarnDays int
+
+	next   time.Time // When the latest job was scheduled to run
+	warned string    // Fingerprint of the certificate last warned about
+}
+
+var monitorsMu sync.Mutex
+var monitors = map[int64]*Monitor{}
+var curMonitorID = int64(0)
+
+// MonitorURL starts fetching url every interval. When the content differs
+// from the previous successful fetch, notifier is told, with a link to the
+// differences. Monitor jobs are never answered from the cache.
+func MonitorURL(url string, interval time.Duration, notifier string, opts JobOptions) (*Monitor, error) {
+	return startMonitor(&Monitor{Kind: "content", URL: url, Interval: interval, Notify: notifier}, opts)
+}
+
+// MonitorUptime starts fetching url every interval, recording whether it
+// was up and how long it took to respond. Notifier is told when an
+// incident starts and when it ends.
+func MonitorUptime(url string, interval time.Duration, notifier string, opts JobOptions) (*Monitor, error) {
+	return startMonitor(&Monitor{Kind: "uptime", URL: url, Interval: interval, Notify: notifier}, opts)
+}
+
+// MonitorCertificate starts checking the TLS certificates of url's host
+// every interval. Notifier is told once per server certificate when one in
+// the chain expires within warnDays.
+func MonitorCertificate(url string, interval time.Duration, warnDays int, notifier string, opts JobOptions) (*Monitor, error) {
+	if warnDays < 0 {
+		return nil, errors.New("warnDays must not be negative")
+	}
+	opts.Type = JobCertificate
+	return startMonitor(&Monitor{Kind: "certificate", URL: url, Interval: interval, Notify: notifier, WarnDays: warnDays}, opts)
+}
+
+// startMonitor registers m and adds its first job, to run right away.
+func startMonitor(m *Monitor, opts JobOptions) (*Monitor, error) {
+	if m.Interval < minMonitorInterval {
+		return nil, fmt.Errorf("interval must be at least %v", minMonitorInterval)
+	}
+	if m.Notify != "" && !HasNotifier(m.Notify) {
+		return nil, fmt.Errorf("unknown notifier %q", m.Notify)
+	}
+	if err := admitJob(); err != nil {
+		return nil, err
+	}
+	m.ID = atomic.AddInt64(&curMonitorID, 1)
+	m.Tenant, m.Owner = opts.Tenant, opts.Owner
+	m.Created = clock.Now()
+	m.next = m.Created
+	monitorsMu.Lock()
+	monitors[m.ID] = m
+	monitorsMu.Unlock()
+	runMonitor(m, opts)
+	return GetMonitor(m.ID), nil
+}
+
+// runMonitor adds the monitor's next job, to run at m.next.
+func runMonitor(m *Monitor, opts JobOptions) {
+	opts.Monitor = m.ID
+	opts.NoCache = true
+	opts.NotBefore = m.next
+	opts.Notify = ""
+	job := AddJobWithOptions(m.URL, opts)
+	monitorsMu.Lock()
+	m.LastJobID = job.ID
+	monitorsMu.Unlock()
+}
+
+// StopMonitor stops a monitor. A check that is already scheduled still
+// runs, but is the last.
+func StopMonitor(id int64) error {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	m, ok := monitors[id]
+	if !ok {
+		return errors.New("no such monitor")
+	}
+	m.Stopped = true
+	return nil
+}
+
+// GetMonitor returns a snapshot of the monitor with the given ID, or nil
+// if there is none.
+func GetMonitor(id int64) *Monitor {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	m, ok := monitors[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *m
+	return &snapshot
+}
+
+// GetMonitors returns snapshots of all monitors.
+func GetMonitors() []*Monitor {
+	monitorsMu.Lock()
+	list := make([]*Monitor, 0, len(monitors))
+	for _, m := range monitors {
+		snapshot := *m
+		list = append(list, &snapshot)
+	}
+	monitorsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// monitorJobFinished compares the content fetched by a monitor's job with
+// the previous one, or records whether the URL was up, and schedules the
+// next check.
+func monitorJobFinished(job *Job) {
+	if job.Options.Monitor == 0 {
+		return
+	}
+	monitorsMu.Lock()
+	m, ok := monitors[job.Options.Monitor]
+	if !ok || m.Stopped {
+		monitorsMu.Unlock()
+		return
+	}
+	m.Checks++
+	var changed *Monitor
+	var previous int64
+	if m.Kind == "content" && job.Status == "done" && job.Response != nil {
+		sum := job.Response.Checksums.SHA256
+		if m.SHA256 != "" && sum != m.SHA256 {
+			m.Changes++
+			m.LastChanged = clock.Now()
+			snapshot := *m
+			changed, previous = &snapshot, m.BaselineJobID
+		}
+		m.SHA256, m.BaselineJobID = sum, job.ID
+	}
+	if m.Kind == "certificate" {
+		m.warned = warnCertificateExpiry(job, *m)
+	}
+	m.next = m.next.Add(m.Interval)
+	if now := clock.Now(); m.next.Before(now) {
+		m.next = now
+	}
+	kind, notifier := m.Kind, m.Notify
+	checked := *m
+	monitorsMu.Unlock()
+
+	writeCheckMetrics(&checked, job)
+
+	if kind == "uptime" {
+		recordUptimeCheck(job, notifier)
+	}
+	if changed != nil && changed.Notify != "" {
+		notifyAll([]string{changed.Notify}, notify.Message{
+			Title: fmt.Sprintf("Content of %s changed", changed.URL),
+			Text:  fmt.Sprintf("Monitor %d found a change after %d checks.", changed.ID, changed.Checks),
+			Fields: map[string]string{
+				"previous job": strconv.FormatInt(previous, 10),
+				"job":          strconv.FormatInt(job.ID, 10),
+				"changes":      strconv.Itoa(changed.Changes),
+			},
+			Link: apiLink(fmt.Sprintf("/api/jobs/%d/diff?from=%d", job.ID, previous)),
+		})
+	}
+	runMonitor(m, job.Options)
+}
+
+func monitorType(jobType *graphql.Object) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Monitor",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Unique ID for the monitor",
+			},
+			"kind": &graphql.Field{
+				Type:        graphql.String,
+				Description: "What the monitor watches for: content changes or uptime",
+			},
+			"url": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The URL being monitored",
+			},
+			"interval": &graphql.Field{
+				Type:        graphql.String,
+				Description: "How often the URL is fetched",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Monitor).Interval.String(), nil
+				},
+			},
+			"notify": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Notifier told when the content changes",
+			},
+			"created": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the monitor was started",
+			},
+			"stopped": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the monitor was stopped",
+			},
+			"checks": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of times the URL was fetched",
+			},
+			"changes": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of times the content was found changed",
+			},
+			"lastChanged": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When a change was last found",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := p.Source.(*Monitor).LastChanged; !t.IsZero() {
+						return t, nil
+					}
+					return nil, nil
+				},
+			},
+			"sha256": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Checksum of the content last fetched",
+			},
+			"warnDays": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "How many days before its certificates expire a certificate monitor warns",
+			},
+			"lastJob": &graphql.Field{
+				Type:        jobType,
+				Description: "The latest check, which may not have run yet",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if job := GetJob(p.Source.(*Monitor).LastJobID); job != nil {
+						return job, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+}
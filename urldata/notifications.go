@@ -0,0 +1,117 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+)
+
+var notifiersMu sync.Mutex
+var notifiers = map[string]notify.Notifier{}
+var publicURL string
+
+// SetNotifiers sets the notifiers that alert rules, jobs and batches refer
+// to by name.
+func SetNotifiers(n map[string]notify.Notifier) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	notifiers = n
+}
+
+// HasNotifier reports whether a notifier with the given name is configured.
+func HasNotifier(name string) bool {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	_, ok := notifiers[name]
+	return ok
+}
+
+// SetPublicURL sets the externally reachable base URL of the server, used
+// to link to results from notifications.
+func SetPublicURL(u string) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	publicURL = strings.TrimSuffix(u, "/")
+}
+
+// notifyAll sends m to the named notifiers in the background.
+func notifyAll(names []string, m notify.Message) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	for _, name := range names {
+		n, ok := notifiers[name]
+		if !ok {
+			fmt.Println("unknown notifier", name)
+			continue
+		}
+		go func(name string, n notify.Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := n.Notify(ctx, m); err != nil {
+				fmt.Println("notifier", name, "failed:", err)
+			}
+		}(name, n)
+	}
+}
+
+// resultLink returns a link that opens query in GraphiQL, or "" if the
+// server's public URL is unknown.
+func resultLink(query string) string {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if publicURL == "" {
+		return ""
+	}
+	return publicURL + "/graphql?query=" + url.QueryEscape(query)
+}
+
+// apiLink returns a link to path on the server, or "" if the server's
+// public URL is unknown.
+func apiLink(path string) string {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if publicURL == "" {
+		return ""
+	}
+	return publicURL + path
+}
+
+// notifyJob tells the job's notifier, if it has one, how the job ended.
+// The job's notify script may pick another.
+func notifyJob(job *Job) {
+	notifier := scriptNotifier(job)
+	if notifier == "" {
+		return
+	}
+	outcome := "succeeded"
+	if job.Status == "error" {
+		outcome = "failed"
+	}
+	fields := map[string]string{
+		"status":   job.Status,
+		"duration": jobDuration(job).Round(time.Millisecond).String(),
+	}
+	if job.Error != nil {
+		fields["error"] = job.Error.Error()
+	}
+	notifyAll([]string{notifier}, notify.Message{
+		Title:  fmt.Sprintf("Job %d %s", job.ID, outcome),
+		Text:   job.URL,
+		Fields: fields,
+		Link:   resultLink(fmt.Sprintf(`{ job(id: "%d") { url status error { category message } response { statusCode body } } }`, job.ID)),
+	})
+}
+
+// jobDuration returns how long the job took from being queued until now.
+func jobDuration(job *Job) time.Duration {
+	events := jobEvents(job)
+	if len(events) == 0 {
+		return 0
+	}
+	return clock.Now().Sub(events[0].Time)
+}
@@ -0,0 +1,151 @@
+package urldata
+
+import (
+	"sort"
+	"sync"
+)
+
+// Queue pause state. While the queue is paused globally, workers hold on to
+// the job they dequeued and wait. Jobs for a paused or drained host are
+// parked instead, and put back on the queue once the host is released.
+var pauseMu sync.Mutex
+var pauseCond = sync.NewCond(&pauseMu)
+var queuePaused bool
+var pausedHosts = map[string]bool{}
+var drainedHosts = map[string]bool{} // Host names or "*.domain" wildcards
+var parkedJobs = map[string][]int64{}
+
+// PauseQueue stops workers from starting new jobs. Jobs already being
+// fetched run to completion, and queued jobs are kept.
+func PauseQueue() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	queuePaused = true
+}
+
+// ResumeQueue lets workers start jobs again after PauseQueue.
+func ResumeQueue() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	queuePaused = false
+	pauseCond.Broadcast()
+}
+
+// PauseHost stops workers from starting jobs for host. Such jobs are parked
+// until the host is resumed.
+func PauseHost(host string) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	pausedHosts[host] = true
+}
+
+// ResumeHost lets workers start jobs for host again and requeues the jobs
+// parked while it was paused.
+func ResumeHost(host string) {
+	pauseMu.Lock()
+	delete(pausedHosts, host)
+	pauseMu.Unlock()
+	releaseParked()
+}
+
+// DrainHost blocks a host, or every host matching a "*.domain" wildcard.
+// Jobs for it are parked as soon as they are submitted or dequeued, and
+// resume automatically when the host is undrained.
+func DrainHost(pattern string) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	drainedHosts[pattern] = true
+}
+
+// UndrainHost unblocks a host drained with DrainHost and requeues its
+// parked jobs.
+func UndrainHost(pattern string) {
+	pauseMu.Lock()
+	delete(drainedHosts, pattern)
+	pauseMu.Unlock()
+	releaseParked()
+}
+
+// heldLocked returns why jobs for host are held back, or "" if they are
+// not. pauseMu must be held.
+func heldLocked(host string) string {
+	if pausedHosts[host] {
+		return "paused"
+	}
+	for pattern := range drainedHosts {
+		if MatchesHost(pattern, host) {
+			return "drained"
+		}
+	}
+	return ""
+}
+
+// parkIfHeld parks the job if its host is paused or drained, and reports
+// whether it did.
+func parkIfHeld(job *Job) bool {
+	host := hostOf(job.URL)
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	reason := heldLocked(host)
+	if reason == "" {
+		return false
+	}
+	parkedJobs[host] = append(parkedJobs[host], job.ID)
+	setStatus(job, "parked")
+	recordEvent(job, "parked", "parked while %s is %s", host, reason)
+	return true
+}
+
+// releaseParked requeues the parked jobs of hosts that are no longer held.
+func releaseParked() {
+	var released []int64
+	pauseMu.Lock()
+	for host, ids := range parkedJobs {
+		if heldLocked(host) == "" {
+			released = append(released, ids...)
+			delete(parkedJobs, host)
+		}
+	}
+	pauseMu.Unlock()
+
+	for _, id := range released {
+		if job := GetJob(id); job != nil {
+			setStatus(job, "waiting")
+		}
+	}
+	go func() {
+		for _, id := range released {
+			enqueue(id)
+		}
+	}()
+}
+
+// admit is called by a worker after dequeuing a job. It blocks while the
+// queue is paused, and returns false if the job was parked because its host
+// is paused or drained.
+func admit(job *Job) bool {
+	pauseMu.Lock()
+	for queuePaused {
+		pauseCond.Wait()
+	}
+	pauseMu.Unlock()
+	return !parkIfHeld(job)
+}
+
+// pauseStats returns the pause state for the stats query.
+func pauseStats() (paused bool, hosts []string, drained []string, parked int) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	for host := range pausedHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for host := range drainedHosts {
+		drained = append(drained, host)
+	}
+	sort.Strings(drained)
+	for _, ids := range parkedJobs {
+		parked += len(ids)
+	}
+	return queuePaused, hosts, drained, parked
+}
@@ -0,0 +1,270 @@
+package urldata
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// journalEntry is a line of the persistence journal. Each change to a job
+// appends a snapshot of it, or only the event recorded if the job's state
+// did not change; the latest snapshot of a job wins, and events after it
+// are added to its timeline.
+type journalEntry struct {
+	Job      *Job            `json:"job,omitempty"`
+	Event    *journaledEvent `json:"event,omitempty"`
+	Archived int64           `json:"archived,omitempty"` // ID of a job moved to the archive
+	Purged   int64           `json:"purged,omitempty"`   // ID of a deleted job purged from the trash
+}
+
+// journaledEvent is an event added to the timeline of job JobID.
+type journaledEvent struct {
+	JobID int64 `json:"jobId"`
+	Event
+}
+
+// jobMark is the part of a job's state that clients see change: changes to
+// it bump the job's version, and are journaled as a snapshot of the job
+// rather than as an event.
+type jobMark struct {
+	status   string
+	response *Response
+	err      *JobError
+	attempts int
+}
+
+// Guards the journal, and the marks of the jobs as they were journaled.
+var journalMu sync.Mutex
+var journal *os.File
+var journaledMarks = map[int64]jobMark{}
+
+// SetPersistence keeps a journal of jobs in the file at path, so they
+// survive restarts. Jobs found in an existing journal are restored: those
+// that had finished as they were, and the others are queued again. Jobs
+// that were being fetched when the server stopped are marked interrupted
+// first; if their response has been cached meanwhile, they are answered
+// from the cache rather than fetched twice.
+func SetPersistence(path string) error {
+	restored, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+
+	// Rewrite the journal with only the latest snapshot of each job.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, job := range restored {
+		if err := enc.Encode(journalEntry{Job: job}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	journalMu.Lock()
+	journal = f
+	journalMu.Unlock()
+
+	recoverJobs(restored)
+	return nil
+}
+
+// readJournal returns the latest snapshot of every job in the journal at
+// path, ordered by ID. A missing journal holds no jobs.
+func readJournal(path string) ([]*Job, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := map[int64]*Job{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var e journalEntry
+		if err := dec.Decode(&e); err != nil {
+			if errors.Is(err, ErrDecrypt) {
+				// Dropping the jobs would lose them for good.
+				return nil, err
+			}
+			// A crash can leave the last line incomplete.
+			fmt.Println("ignoring the rest of the journal:", err)
+			break
+		}
+		if e.Job != nil {
+			latest[e.Job.ID] = e.Job
+		}
+		if job := latest[eventJobID(e)]; job != nil {
+			job.Events = append(job.Events, e.Event.Event)
+		}
+		if e.Archived != 0 {
+			delete(latest, e.Archived)
+		}
+		if e.Purged != 0 {
+			delete(latest, e.Purged)
+		}
+	}
+	restored := make([]*Job, 0, len(latest))
+	for _, job := range latest {
+		restored = append(restored, job)
+	}
+	sort.Slice(restored, func(i, j int) bool { return restored[i].ID < restored[j].ID })
+	return restored, nil
+}
+
+// recoverJobs puts restored jobs back in memory and queues the unfinished
+// ones again.
+func recoverJobs(restored []*Job) {
+	var queue []int64
+	jobsMu.Lock()
+	for _, job := range restored {
+		if job.ID > atomic.LoadInt64(&curJobID) {
+			atomic.StoreInt64(&curJobID, job.ID)
+		}
+		if !job.DeletedAt.IsZero() {
+			trashMu.Lock()
+			trash[job.ID] = job
+			trashMu.Unlock()
+			continue
+		}
+		jobs[job.ID] = job
+		// Restore the cache from successful fetches.
+		if r := job.Response; job.Status == "done" && r != nil && !bypassesCache(job) {
+			cacheNewerResponse(cacheKey(job.URL), r)
+		}
+		if !Finished(job.Status) {
+			queue = append(queue, job.ID)
+		}
+	}
+	jobsMu.Unlock()
+
+	var requeued []int64
+	for _, id := range queue {
+		job := GetJob(id)
+		status := jobStatus(job)
+		if status == "scheduled" && delayJob(job) {
+			continue
+		}
+		if status == "fetching" && !redeliver(job, "interrupted by a restart while fetching") {
+			continue
+		}
+		setStatus(job, "waiting")
+		recordEvent(job, "queued", "queued again after a restart")
+		requeued = append(requeued, id)
+	}
+	if len(requeued) > 0 {
+		fmt.Println("requeueing", len(requeued), "jobs after restart")
+	}
+	go func() {
+		for _, id := range requeued {
+			enqueue(id)
+		}
+	}()
+}
+
+// persist appends a snapshot of the job to the journal, if there is one.
+func persist(job *Job) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journal == nil {
+		return
+	}
+	eventsMu.Lock()
+	stateMu.RLock()
+	line, err := json.Marshal(journalEntry{Job: job})
+	stateMu.RUnlock()
+	eventsMu.Unlock()
+	if err == nil {
+		_, err = journal.Write(append(line, '\n'))
+	}
+	if err != nil {
+		fmt.Println("failed to write journal:", err)
+	}
+}
+
+// journalEvent appends e to the job's timeline, and to the journal if there
+// is one: if the job's status, response, error or attempts changed since
+// its last event, its version is bumped and a snapshot of the job
+// journaled, and otherwise only the event, so that a long timeline does not
+// copy the job's response into the journal with every event, nor make the
+// version clients based a change on stale.
+func journalEvent(job *Job, e Event) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	eventsMu.Lock()
+	job.Events = append(job.Events, e)
+	stateMu.RLock()
+	mark := jobMark{status: job.Status, response: job.Response, err: job.Error, attempts: job.Attempts}
+	last, ok := journaledMarks[job.ID]
+	journaledMarks[job.ID] = mark
+	changed := !ok || mark != last
+	if changed {
+		atomic.AddInt64(&job.Version, 1)
+	}
+	var line []byte
+	var err error
+	if journal != nil {
+		if changed {
+			line, err = json.Marshal(journalEntry{Job: job})
+		} else {
+			line, err = json.Marshal(journalEntry{Event: &journaledEvent{JobID: job.ID, Event: e}})
+		}
+	}
+	stateMu.RUnlock()
+	eventsMu.Unlock()
+	if journal == nil {
+		return
+	}
+	if err == nil {
+		_, err = journal.Write(append(line, '\n'))
+	}
+	if err != nil {
+		fmt.Println("failed to write journal:", err)
+	}
+}
+
+// eventJobID returns the ID of the job whose event the entry holds, or 0.
+func eventJobID(e journalEntry) int64 {
+	if e.Event == nil {
+		return 0
+	}
+	return e.Event.JobID
+}
+
+// persistArchived records in the journal that a job was moved to the archive.
+func persistArchived(id int64) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	delete(journaledMarks, id)
+	if journal == nil {
+		return
+	}
+	line, _ := json.Marshal(journalEntry{Archived: id})
+	if _, err := journal.Write(append(line, '\n')); err != nil {
+		fmt.Println("failed to write journal:", err)
+	}
+}
@@ -0,0 +1,143 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// addressPins holds the addresses the hosts of a fetch were resolved to,
+// so that every connection the fetch makes to a host goes to the same
+// address the target policy was checked against. Otherwise a host could
+// answer the check with a public address, then change its DNS records
+// (rebind) to have the connection made to an internal one.
+type addressPins struct {
+	mu      sync.Mutex
+	ips     map[string][]net.IP // By host
+	proxies map[string]bool     // Addresses of the proxies requests went through
+}
+
+type pinsContextKey struct{}
+
+// withAddressPins returns a context pinning the addresses of the hosts
+// connected to with it.
+func withAddressPins(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pinsContextKey{}, &addressPins{ips: map[string][]net.IP{}, proxies: map[string]bool{}})
+}
+
+func pinsFromContext(ctx context.Context) *addressPins {
+	pins, _ := ctx.Value(pinsContextKey{}).(*addressPins)
+	return pins
+}
+
+// lookup returns the addresses of host, resolving it with resolver only
+// the first time. pins may be nil, to resolve every time.
+func (pins *addressPins) lookup(ctx context.Context, resolver *net.Resolver, host string) ([]net.IP, error) {
+	if pins != nil {
+		pins.mu.Lock()
+		defer pins.mu.Unlock()
+		if ips, ok := pins.ips[host]; ok {
+			return ips, nil
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	wait, release, err := acquireLookup(ctx)
+	if job := jobFromContext(ctx); job != nil {
+		updateJob(job, func(job *Job) { job.LookupWait += wait })
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The lookup is reported to the fetch's httptrace hooks through ctx,
+	// as the dial's would be.
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	if pins != nil {
+		pins.ips[host] = ips
+	}
+	return ips, nil
+}
+
+// recordProxies returns proxy, noting the proxies requests are sent
+// through in their fetch's pins: proxies resolve the hosts themselves, and
+// the address dialed is theirs.
+func recordProxies(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if pins := pinsFromContext(req.Context()); u != nil && pins != nil {
+			addr := u.Host
+			if u.Port() == "" {
+				addr = net.JoinHostPort(u.Hostname(), fmt.Sprint(schemePorts[u.Scheme]))
+			}
+			pins.mu.Lock()
+			pins.proxies[addr] = true
+			pins.mu.Unlock()
+		}
+		return u, err
+	}
+}
+
+// pinnedDial returns dial resolving host names with resolver, or the
+// system resolver if nil, once per fetch, and connecting only to the
+// addresses the target policy of the fetch's job allows.
+func pinnedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), resolver *net.Resolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		pins := pinsFromContext(ctx)
+		if pins != nil {
+			pins.mu.Lock()
+			proxy := pins.proxies[addr]
+			pins.mu.Unlock()
+			if proxy {
+				return dial(ctx, network, addr)
+			}
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := pins.lookup(ctx, resolver, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		tenant := ""
+		if job := jobFromContext(ctx); job != nil {
+			tenant = job.Tenant
+		}
+		policy := targetPolicyFor(tenant)
+		var dialErr error
+		for _, ip := range ips {
+			if !policy.allowsAddress(ip) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if dialErr == nil {
+				dialErr = err
+			}
+		}
+		if dialErr == nil {
+			return nil, fmt.Errorf("address %s of %s %w", ips[0], host, ErrTargetPolicy)
+		}
+		return nil, dialErr
+	}
+}
@@ -0,0 +1,74 @@
+package urldata
+
+import (
+	"fmt"
+	"plugin"
+	"sort"
+)
+
+// PluginProcessor is the type of the Process symbol a processor plugin
+// exports. It gets the URL, status code, headers and body of a response,
+// which it must not change, and returns findings as a map from names to
+// values. Only standard types cross the plugin boundary, so plugins need
+// not import this package:
+//
+//	package main
+//
+//	func Process(url string, statusCode int, header map[string][]string, body []byte) map[string][]string {
+//		return map[string][]string{"bytes": {strconv.Itoa(len(body))}}
+//	}
+//
+// built with go build -buildmode=plugin, by the same Go version and with
+// the same versions of any packages it shares with the server.
+type PluginProcessor = func(url string, statusCode int, header map[string][]string, body []byte) map[string][]string
+
+// LoadProcessorPlugin opens the Go plugin at path and registers its
+// Process function as the processor name. Plugins are only supported on
+// Linux, FreeBSD and macOS, by servers built with cgo, and cannot be
+// unloaded.
+func LoadProcessorPlugin(name, path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Process")
+	if err != nil {
+		return err
+	}
+	process, ok := sym.(PluginProcessor)
+	if !ok {
+		if ptr, isPtr := sym.(*PluginProcessor); isPtr && *ptr != nil {
+			process, ok = *ptr, true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("plugin %s: Process is a %T, not a %T", path, sym, process)
+	}
+	RegisterProcessor(name, func(r *Response) (findings []Finding) {
+		// A plugin that panics finds nothing rather than failing the job.
+		defer func() {
+			if recover() != nil {
+				findings = nil
+			}
+		}()
+		return pluginFindings(process(r.URL, r.StatusCode, r.Header, r.Body))
+	})
+	return nil
+}
+
+// pluginFindings returns the findings in the result of a plugin, ordered
+// by name.
+func pluginFindings(result map[string][]string) []Finding {
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var findings []Finding
+	for _, name := range names {
+		for _, v := range result[name] {
+			findings = append(findings, Finding{Name: name, Value: v})
+		}
+	}
+	return findings
+}
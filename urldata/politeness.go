@@ -0,0 +1,215 @@
+package urldata
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolitenessConfig controls how hard a single host is hit.
+type PolitenessConfig struct {
+	// LatencyFactor spaces out requests to a host by this multiple of its
+	// average response latency, so slow hosts are asked less often. Zero
+	// disables the adaptive delay.
+	LatencyFactor float64
+	// MaxDelay caps the adaptive delay between requests to a host.
+	MaxDelay time.Duration
+	// MaxRetries is how often a job that failed with a retryable error,
+	// such as a 429 or 503 response, is retried. -1 disables retries.
+	MaxRetries int
+	// Backoff is the initial wait before retrying, and before asking a host
+	// again after a 429 or 503 without a usable Retry-After header. It
+	// doubles for each further failure.
+	Backoff time.Duration
+	// MaxBackoff caps both Backoff and Retry-After.
+	MaxBackoff time.Duration
+}
+
+var defaultPoliteness = PolitenessConfig{
+	MaxDelay:   10 * time.Second,
+	MaxRetries: 3,
+	Backoff:    time.Second,
+	MaxBackoff: 10 * time.Minute,
+}
+
+type hostPace struct {
+	latency      time.Duration // Moving average of response latency
+	backoff      time.Duration // Last backoff applied, doubled on repeats
+	nextRequest  time.Time     // No request may start before this
+	backoffUntil time.Time     // Set while the host asked us to back off
+}
+
+var politeness = defaultPoliteness
+var pacesMu sync.Mutex
+var paces = map[string]*hostPace{}
+
+// SetPoliteness configures per-host request pacing. Zero fields other than
+// LatencyFactor keep their defaults; a MaxRetries of -1 means none.
+func SetPoliteness(c PolitenessConfig) {
+	if c.MaxDelay == 0 {
+		c.MaxDelay = defaultPoliteness.MaxDelay
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultPoliteness.MaxRetries
+	} else if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defaultPoliteness.Backoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultPoliteness.MaxBackoff
+	}
+	pacesMu.Lock()
+	defer pacesMu.Unlock()
+	politeness = c
+}
+
+// currentPoliteness returns the politeness settings for use outside
+// pacesMu.
+func currentPoliteness() PolitenessConfig {
+	pacesMu.Lock()
+	defer pacesMu.Unlock()
+	return politeness
+}
+
+func paceLocked(host string) *hostPace {
+	p, ok := paces[host]
+	if !ok {
+		p = &hostPace{}
+		paces[host] = p
+	}
+	return p
+}
+
+// admitPolite is called by a worker before processing a job. If the job's
+// host may not be asked yet it parks the job until it may and returns
+// false; otherwise it reserves the host's next request slot.
+func admitPolite(job *Job) bool {
+	if cachedResponse(job) != nil {
+		return true
+	}
+	host := hostOf(job.URL)
+	interval := profileInterval(host)
+	pacesMu.Lock()
+	p := paceLocked(host)
+	now := clock.Now()
+	if now.Before(p.nextRequest) {
+		at := p.nextRequest
+		backingOff := now.Before(p.backoffUntil)
+		pacesMu.Unlock()
+		if backingOff {
+			parkUntil(job, at, "%s asked us to back off until %s", host, at.Format(time.RFC3339))
+		} else {
+			parkUntil(job, at, "pacing requests to %s until %s", host, at.Format(time.RFC3339))
+		}
+		return false
+	}
+	delay := time.Duration(politeness.LatencyFactor * float64(p.latency))
+	if delay > politeness.MaxDelay {
+		delay = politeness.MaxDelay
+	}
+	if delay < interval {
+		delay = interval
+	}
+	p.nextRequest = now.Add(delay)
+	pacesMu.Unlock()
+	return true
+}
+
+// recordResponse folds the latency of a response that was not throttled
+// into the host's moving average and resets its backoff.
+func recordResponse(host string, d time.Duration) {
+	pacesMu.Lock()
+	defer pacesMu.Unlock()
+	p := paceLocked(host)
+	p.backoff = 0
+	if p.latency == 0 {
+		p.latency = d
+		return
+	}
+	p.latency = (4*p.latency + d) / 5
+}
+
+// throttled reports whether resp asks the client to slow down.
+func throttled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// backOff holds back all requests to host after a throttled response,
+// until the time given by Retry-After or else an exponential backoff. It
+// returns when requests may resume.
+func backOff(host string, resp *http.Response) time.Time {
+	pacesMu.Lock()
+	defer pacesMu.Unlock()
+	p := paceLocked(host)
+	now := clock.Now()
+	wait, ok := retryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		wait = politeness.Backoff
+		if p.backoff > 0 {
+			// Still throttled since the last backoff.
+			wait = 2 * p.backoff
+		}
+	}
+	if wait > politeness.MaxBackoff {
+		wait = politeness.MaxBackoff
+	}
+	p.backoff = wait
+	p.backoffUntil = now.Add(wait)
+	if p.backoffUntil.After(p.nextRequest) {
+		p.nextRequest = p.backoffUntil
+	}
+	return p.backoffUntil
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// paceStats returns the adaptive delay and backoff deadline for host.
+func paceStats(host string) (time.Duration, time.Time) {
+	pacesMu.Lock()
+	defer pacesMu.Unlock()
+	p, ok := paces[host]
+	if !ok {
+		return 0, time.Time{}
+	}
+	delay := time.Duration(politeness.LatencyFactor * float64(p.latency))
+	if delay > politeness.MaxDelay {
+		delay = politeness.MaxDelay
+	}
+	var until time.Time
+	if clock.Now().Before(p.backoffUntil) {
+		until = p.backoffUntil
+	}
+	return delay, until
+}
+
+// parkUntil parks the job and puts it back on the queue at the given time.
+func parkUntil(job *Job, at time.Time, format string, args ...interface{}) {
+	setStatus(job, "parked")
+	recordEvent(job, "parked", format, args...)
+	go func() {
+		<-clock.After(at.Sub(clock.Now()))
+		setStatus(job, "waiting")
+		enqueue(job.ID)
+	}()
+}
@@ -0,0 +1,211 @@
+package urldata
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/metrics"
+	"github.com/dsoo/urlfetcher/queue"
+	"github.com/graphql-go/graphql"
+)
+
+// WorkerPool is a named set of workers with a queue of their own, so that
+// jobs of one kind, slow page renders say, neither wait behind nor hold up
+// the others. Jobs choose a pool with JobOptions.Pool; those without one
+// run on the default workers.
+type WorkerPool struct {
+	Name    string
+	Workers int
+	// Timeout is the default for JobOptions.MaxDuration of the pool's
+	// jobs.
+	Timeout time.Duration
+	// MaxRequestsPerSecond limits the requests of the pool's jobs, on top
+	// of the global limit. 0 means no limit.
+	MaxRequestsPerSecond float64
+	// Queue holds the pool's jobs, an in-memory queue if nil. Like the
+	// main queue, it must not be shared with other pools or instances.
+	Queue queue.Queue
+}
+
+// workerPool is a pool that has been set up.
+type workerPool struct {
+	WorkerPool
+	limiter rateLimiter
+}
+
+var poolsMu sync.Mutex
+var pools = map[string]*workerPool{}
+
+// SetWorkerPools sets up the named worker pools. Like SetQueue, it must be
+// called before any job is added and before the workers are started;
+// RunWorkers starts the pools' workers along with the default ones.
+func SetWorkerPools(configured []WorkerPool) error {
+	m := map[string]*workerPool{}
+	for _, p := range configured {
+		if p.Name == "" {
+			return fmt.Errorf("worker pool without a name")
+		}
+		if _, ok := m[p.Name]; ok {
+			return fmt.Errorf("worker pool %s: declared twice", p.Name)
+		}
+		if p.Workers <= 0 {
+			return fmt.Errorf("worker pool %s: needs at least one worker", p.Name)
+		}
+		if p.Queue == nil {
+			p.Queue = queue.NewMemory(0)
+		}
+		wp := &workerPool{WorkerPool: p}
+		wp.limiter.set(p.MaxRequestsPerSecond)
+		m[p.Name] = wp
+	}
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	pools = m
+	return nil
+}
+
+// HasPool reports whether a worker pool is named name.
+func HasPool(name string) bool {
+	return poolNamed(name) != nil
+}
+
+func poolNamed(name string) *workerPool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	return pools[name]
+}
+
+// poolOf returns the pool of job, or nil for the default workers. Jobs
+// whose pool is no longer configured run on the default workers.
+func poolOf(job *Job) *workerPool {
+	if job == nil || job.Options.Pool == "" {
+		return nil
+	}
+	return poolNamed(job.Options.Pool)
+}
+
+// sortedPools returns the pools ordered by name.
+func sortedPools() []*workerPool {
+	poolsMu.Lock()
+	list := make([]*workerPool, 0, len(pools))
+	for _, p := range pools {
+		list = append(list, p)
+	}
+	poolsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// queueFor returns the queue the job waits in.
+func queueFor(job *Job) queue.Queue {
+	if p := poolOf(job); p != nil {
+		return p.Queue
+	}
+	return jobQueue
+}
+
+// withPool fills in the options left unset from the job's pool.
+func withPool(opts JobOptions) JobOptions {
+	if p := poolNamed(opts.Pool); p != nil && opts.MaxDuration == 0 {
+		opts.MaxDuration = p.Timeout
+	}
+	return opts
+}
+
+// queueDepth returns the number of jobs waiting in the main queue and
+// those of the pools.
+func queueDepth() int {
+	depth := jobQueue.Len()
+	for _, p := range sortedPools() {
+		depth += p.Queue.Len()
+	}
+	return depth
+}
+
+// runPools starts the workers of the pools.
+func runPools() {
+	for _, p := range sortedPools() {
+		for i := 0; i < p.Workers; i++ {
+			go fetchWorker(newWorker(p.Name), p.Queue)
+		}
+	}
+}
+
+// PoolStats describes a worker pool and its queue.
+type PoolStats struct {
+	Name                 string
+	Workers              int
+	Busy                 int // Workers processing a job
+	QueueDepth           int
+	MaxRequestsPerSecond float64 // 0 for no limit
+}
+
+func poolStats() []PoolStats {
+	busy := map[string]int{}
+	for _, w := range GetWorkers() {
+		if w.State == "busy" {
+			busy[w.Pool]++
+		}
+	}
+	stats := []PoolStats{}
+	for _, p := range sortedPools() {
+		stats = append(stats, PoolStats{
+			Name:                 p.Name,
+			Workers:              p.Workers,
+			Busy:                 busy[p.Name],
+			QueueDepth:           p.Queue.Len(),
+			MaxRequestsPerSecond: p.MaxRequestsPerSecond,
+		})
+	}
+	return stats
+}
+
+func poolMetrics(stats []PoolStats) []metrics.Family {
+	depth := metrics.Family{
+		Name: "urlfetcher_pool_queue_depth", Help: "Number of jobs waiting in the queue of a worker pool.", Type: metrics.Gauge,
+	}
+	busy := metrics.Family{
+		Name: "urlfetcher_pool_busy_workers", Help: "Workers of a pool processing a job.", Type: metrics.Gauge,
+	}
+	for _, s := range stats {
+		labels := map[string]string{"pool": s.Name}
+		depth.Samples = append(depth.Samples, metrics.Sample{Labels: labels, Value: float64(s.QueueDepth)})
+		busy.Samples = append(busy.Samples, metrics.Sample{Labels: labels, Value: float64(s.Busy)})
+	}
+	return []metrics.Family{depth, busy}
+}
+
+func poolStatsType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "PoolStats",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type: graphql.String,
+			},
+			"workers": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Workers in the pool",
+			},
+			"busy": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Workers processing a job",
+			},
+			"queueDepth": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs waiting in the pool's queue",
+			},
+			"maxRequestsPerSecond": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Limit on requests per second of the pool's jobs, null if there is none",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if r := p.Source.(PoolStats).MaxRequestsPerSecond; r > 0 {
+						return r, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,209 @@
+package urldata
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+)
+
+// Preset is a named set of job options, which jobs can start from instead
+// of repeating them.
+type Preset struct {
+	Name    string
+	Options JobOptions
+}
+
+var presetsMu sync.Mutex
+var presets = map[string]JobOptions{}
+
+// SetPreset adds or replaces a preset.
+func SetPreset(name string, opts JobOptions) {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets[name] = opts
+}
+
+// DeletePreset removes a preset and reports whether it existed. Jobs that
+// started from it keep their options.
+func DeletePreset(name string) bool {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	_, ok := presets[name]
+	delete(presets, name)
+	return ok
+}
+
+// GetPresets returns all presets ordered by name.
+func GetPresets() []Preset {
+	presetsMu.Lock()
+	list := []Preset{}
+	for name, opts := range presets {
+		list = append(list, Preset{Name: name, Options: opts})
+	}
+	presetsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// WithPreset returns opts with the options it leaves unset taken from the
+// named preset.
+func WithPreset(name string, opts JobOptions) (JobOptions, error) {
+	presetsMu.Lock()
+	preset, ok := presets[name]
+	presetsMu.Unlock()
+	if !ok {
+		return opts, fmt.Errorf("unknown preset %q", name)
+	}
+	merged := opts
+	overlayOptions(&merged, preset)
+	overlayOptions(&merged, opts)
+	merged.Preset = name
+	return merged, nil
+}
+
+// overlayOptions sets the options that can be given in a preset and are
+// set in src on dst.
+func overlayOptions(dst *JobOptions, src JobOptions) {
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&dst.Type, src.Type)
+	set(&dst.ClientCert, src.ClientCert)
+	set(&dst.HostHeader, src.HostHeader)
+	set(&dst.ServerName, src.ServerName)
+	set(&dst.ConnectAddress, src.ConnectAddress)
+	set(&dst.Tunnel, src.Tunnel)
+	set(&dst.Egress, src.Egress)
+	set(&dst.Pool, src.Pool)
+	set(&dst.Notify, src.Notify)
+	if src.MaxBytes != 0 {
+		dst.MaxBytes = src.MaxBytes
+	}
+	if src.MaxDuration != 0 {
+		dst.MaxDuration = src.MaxDuration
+	}
+	if len(src.Tags) > 0 {
+		dst.Tags = src.Tags
+	}
+	if src.Scripts != nil {
+		dst.Scripts = src.Scripts
+	}
+}
+
+// presetArgs returns the arguments of the setPreset mutation: the job
+// options that are not specific to one job.
+func presetArgs() graphql.FieldConfigArgument {
+	args := withJobOptionArgs(graphql.FieldConfigArgument{
+		"name": &graphql.ArgumentConfig{
+			Type: graphql.NewNonNull(graphql.String),
+		},
+	})
+	delete(args, "preset")
+	delete(args, "notBefore")
+	delete(args, "deadline")
+	delete(args, "metadata")
+	delete(args, "debug")
+	return args
+}
+
+func presetType() *graphql.Object {
+	option := func(get func(o JobOptions) interface{}) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(Preset).Options), nil
+		}
+	}
+	optional := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Preset",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Name jobs refer to the preset by",
+			},
+			"type": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Job type, fetch or certificate",
+				Resolve: option(func(o JobOptions) interface{} {
+					if o.Type == JobFetch {
+						return "fetch"
+					}
+					return o.Type
+				}),
+			},
+			"clientCert": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Credential holding a TLS client certificate to present",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.ClientCert) }),
+			},
+			"hostHeader": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Host header to send instead of the URL's host",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.HostHeader) }),
+			},
+			"serverName": &graphql.Field{
+				Type:        graphql.String,
+				Description: "TLS server name to send and verify instead of the URL's host",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.ServerName) }),
+			},
+			"connectAddress": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Address to connect to instead of the URL's host",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.ConnectAddress) }),
+			},
+			"tunnel": &graphql.Field{
+				Type:        graphql.String,
+				Description: "SSH tunnel to fetch through",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.Tunnel) }),
+			},
+			"egress": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Egress route to fetch through",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.Egress) }),
+			},
+			"pool": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Worker pool to run the jobs",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.Pool) }),
+			},
+			"maxBytes": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Largest response body accepted",
+				Resolve: option(func(o JobOptions) interface{} {
+					if o.MaxBytes > 0 {
+						return o.MaxBytes
+					}
+					return nil
+				}),
+			},
+			"maxDuration": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Longest time the request may take",
+				Resolve: option(func(o JobOptions) interface{} {
+					if o.MaxDuration > 0 {
+						return o.MaxDuration.String()
+					}
+					return nil
+				}),
+			},
+			"notify": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Notifier told when a job has finished",
+				Resolve:     option(func(o JobOptions) interface{} { return optional(o.Notify) }),
+			},
+			"tags": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Labels given to the jobs",
+				Resolve:     option(func(o JobOptions) interface{} { return o.Tags }),
+			},
+		},
+	})
+}
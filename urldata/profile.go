@@ -0,0 +1,117 @@
+package urldata
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostProfile holds the defaults for every job fetching from a host, so
+// that submitters need not repeat them. Options given with a job take
+// precedence over its host's profile.
+type HostProfile struct {
+	Headers map[string]string // Request headers to send
+	// MaxRequestsPerSecond spaces out the requests to the host, on top of
+	// the adaptive politeness delay. 0 means no limit.
+	MaxRequestsPerSecond float64
+	MaxDuration          time.Duration // Default for JobOptions.MaxDuration
+	MaxBytes             int64         // Default for JobOptions.MaxBytes
+	ClientCert           string        // Default for JobOptions.ClientCert
+	Tunnel               string        // Default for JobOptions.Tunnel
+	Egress               string        // Default for JobOptions.Egress
+	// Credential names the credential sent in the Authorization header:
+	// its username and password as basic auth, or its password as a bearer
+	// token if it has no username.
+	Credential string
+	Scripts    *Scripts // Default for JobOptions.Scripts
+}
+
+var profilesMu sync.Mutex
+var hostProfiles = map[string]HostProfile{}
+
+// SetHostProfiles replaces the host profiles, keyed by host names or
+// "*.domain" wildcards.
+func SetHostProfiles(profiles map[string]HostProfile) {
+	m := map[string]HostProfile{}
+	for host, p := range profiles {
+		m[strings.ToLower(host)] = p
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	hostProfiles = m
+}
+
+// profileFor returns the profile of host, preferring an exact match over a
+// wildcard. Hosts without a profile get the zero profile.
+func profileFor(host string) HostProfile {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if p, ok := hostProfiles[host]; ok {
+		return p
+	}
+	for pattern, p := range hostProfiles {
+		if MatchesHost(pattern, host) {
+			return p
+		}
+	}
+	return HostProfile{}
+}
+
+// withHostProfile fills in the options left unset from the profile of the
+// URL's host.
+func withHostProfile(rawURL string, opts JobOptions) JobOptions {
+	p := profileFor(hostOf(rawURL))
+	if opts.MaxDuration == 0 {
+		opts.MaxDuration = p.MaxDuration
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = p.MaxBytes
+	}
+	if opts.ClientCert == "" {
+		opts.ClientCert = p.ClientCert
+	}
+	if opts.Tunnel == "" {
+		opts.Tunnel = p.Tunnel
+	}
+	if opts.Egress == "" {
+		opts.Egress = p.Egress
+	}
+	if opts.Scripts == nil {
+		opts.Scripts = p.Scripts
+	}
+	return opts
+}
+
+// applyProfileHeaders adds the headers and credential of the host profile
+// to a request.
+func applyProfileHeaders(req *http.Request, host string) error {
+	p := profileFor(host)
+	for name, value := range p.Headers {
+		req.Header.Set(name, value)
+	}
+	if p.Credential == "" {
+		return nil
+	}
+	c, ok := creds.Get(p.Credential)
+	if !ok {
+		return fmt.Errorf("unknown credential %q", p.Credential)
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.Password)
+	}
+	return nil
+}
+
+// profileInterval is the least time between requests to host allowed by
+// its profile.
+func profileInterval(host string) time.Duration {
+	rate := profileFor(host).MaxRequestsPerSecond
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
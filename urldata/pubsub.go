@@ -0,0 +1,115 @@
+package urldata
+
+import (
+	"sync"
+	"time"
+)
+
+// JobEvent is an event on a job's timeline, as published to subscribers.
+type JobEvent struct {
+	Seq     int64     `json:"seq"` // Increases by one with every published event
+	JobID   int64     `json:"jobId"`
+	URL     string    `json:"url"`
+	Host    string    `json:"host"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Status  string    `json:"status"` // Status of the job when the event happened
+	Tags    []string  `json:"tags,omitempty"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Subscription receives published job events. Events are dropped rather
+// than block the publisher if the subscriber falls behind.
+type Subscription struct {
+	C <-chan JobEvent
+
+	c      chan JobEvent
+	filter func(JobEvent) bool
+}
+
+// replaySize is how many recent events are kept for subscribers resuming
+// after a reconnect.
+const replaySize = 4096
+
+var subscribersMu sync.Mutex
+var subscribers = map[*Subscription]bool{}
+var eventSeq = int64(0)
+var recent = make([]JobEvent, 0, replaySize) // Ring buffer of the latest events
+var recentStart = 0                          // Index of the oldest event in recent
+
+// Subscribe returns a subscription to the events for which filter returns
+// true, or to all events if filter is nil. It must be cancelled with
+// Unsubscribe.
+func Subscribe(filter func(JobEvent) bool) *Subscription {
+	s, _, _ := SubscribeFrom(-1, filter)
+	return s
+}
+
+// SubscribeFrom is like Subscribe, but also returns the retained events
+// after sequence number since that pass the filter, so a subscriber can
+// resume without missing events published in between. A negative since
+// skips the replay. complete is false if events after since have already
+// been dropped from the replay buffer.
+func SubscribeFrom(since int64, filter func(JobEvent) bool) (s *Subscription, replay []JobEvent, complete bool) {
+	c := make(chan JobEvent, 256)
+	s = &Subscription{C: c, c: c, filter: filter}
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers[s] = true
+	if since < 0 {
+		return s, nil, true
+	}
+	complete = since >= eventSeq-int64(len(recent))
+	for i := range recent {
+		e := recent[(recentStart+i)%len(recent)]
+		if e.Seq > since && (filter == nil || filter(e)) {
+			replay = append(replay, e)
+		}
+	}
+	return s, replay, complete
+}
+
+// Unsubscribe stops delivery to s and closes its channel.
+func Unsubscribe(s *Subscription) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	if subscribers[s] {
+		delete(subscribers, s)
+		close(s.c)
+	}
+}
+
+// publish sends an event about the job to all interested subscribers.
+func publish(job *Job, e Event) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	eventSeq++
+	je := JobEvent{
+		Seq:     eventSeq,
+		JobID:   job.ID,
+		URL:     job.URL,
+		Host:    hostOf(job.URL),
+		Tenant:  job.Tenant,
+		Status:  jobStatus(job),
+		Tags:    job.Options.Tags,
+		Type:    e.Type,
+		Message: e.Message,
+		Time:    e.Time,
+	}
+	if len(recent) < replaySize {
+		recent = append(recent, je)
+	} else {
+		recent[recentStart] = je
+		recentStart = (recentStart + 1) % replaySize
+	}
+	for s := range subscribers {
+		if s.filter != nil && !s.filter(je) {
+			continue
+		}
+		select {
+		case s.c <- je:
+		default:
+		}
+	}
+}
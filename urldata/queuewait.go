@@ -0,0 +1,211 @@
+package urldata
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/metrics"
+	"github.com/graphql-go/graphql"
+)
+
+// Upper bounds in seconds of the buckets of the queue wait histogram.
+var waitBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Number of recent waits per tenant that percentiles are computed from.
+const recentWaits = 1000
+
+// QueueWaitStats summarises how long the jobs of a tenant waited in the
+// queue for a worker.
+type QueueWaitStats struct {
+	Tenant string
+	Jobs   int64 // Jobs that have left the queue
+	// Percentiles of the waits of the most recent jobs.
+	P50, P90, P99, Max time.Duration
+	// OldestWaiting is how long the longest waiting job still in the queue
+	// has been there, 0 if there is none. It keeps growing while a tenant
+	// is starved.
+	OldestWaiting time.Duration
+}
+
+// queuedJob is a job put on the queue by this instance.
+type queuedJob struct {
+	tenant string
+	at     time.Time
+}
+
+// waitStats accumulates the queue waits of a tenant.
+type waitStats struct {
+	count   int64
+	sum     time.Duration
+	buckets []int64 // Waits per bucket of waitBuckets, not cumulative
+	recent  []time.Duration
+	next    int // Index in recent to overwrite once it is full
+}
+
+// Guards enqueuedAt and tenantWaits. Waits are only measured for jobs that
+// are queued and run by the same instance.
+var queueWaitMu sync.Mutex
+var enqueuedAt = map[int64]queuedJob{}
+var tenantWaits = map[string]*waitStats{}
+
+// markEnqueued records when a job was put on the queue.
+func markEnqueued(id int64, tenant string) {
+	queueWaitMu.Lock()
+	defer queueWaitMu.Unlock()
+	enqueuedAt[id] = queuedJob{tenant: tenant, at: clock.Now()}
+}
+
+// markDequeued records that a job left the queue, and returns how long it
+// waited, if it was queued by this instance.
+func markDequeued(id int64) (time.Duration, bool) {
+	queueWaitMu.Lock()
+	defer queueWaitMu.Unlock()
+	q, ok := enqueuedAt[id]
+	if !ok {
+		return 0, false
+	}
+	delete(enqueuedAt, id)
+	wait := clock.Now().Sub(q.at)
+	s := tenantWaits[q.tenant]
+	if s == nil {
+		s = &waitStats{buckets: make([]int64, len(waitBuckets))}
+		tenantWaits[q.tenant] = s
+	}
+	s.count++
+	s.sum += wait
+	for i, le := range waitBuckets {
+		if wait.Seconds() <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	if len(s.recent) < recentWaits {
+		s.recent = append(s.recent, wait)
+	} else {
+		s.recent[s.next] = wait
+		s.next = (s.next + 1) % recentWaits
+	}
+	return wait, true
+}
+
+// queueWaitStats returns the queue wait statistics of every tenant, ordered
+// by tenant.
+func queueWaitStats() []QueueWaitStats {
+	queueWaitMu.Lock()
+	defer queueWaitMu.Unlock()
+	now := clock.Now()
+	byTenant := map[string]*QueueWaitStats{}
+	get := func(tenant string) *QueueWaitStats {
+		w, ok := byTenant[tenant]
+		if !ok {
+			w = &QueueWaitStats{Tenant: tenant}
+			byTenant[tenant] = w
+		}
+		return w
+	}
+	for tenant, s := range tenantWaits {
+		w := get(tenant)
+		w.Jobs = s.count
+		sorted := append([]time.Duration(nil), s.recent...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		at := func(p float64) time.Duration {
+			return sorted[int(p*float64(len(sorted)-1))]
+		}
+		w.P50, w.P90, w.P99, w.Max = at(0.5), at(0.9), at(0.99), sorted[len(sorted)-1]
+	}
+	for _, q := range enqueuedAt {
+		if w := get(q.tenant); now.Sub(q.at) > w.OldestWaiting {
+			w.OldestWaiting = now.Sub(q.at)
+		}
+	}
+	list := []QueueWaitStats{}
+	for _, w := range byTenant {
+		list = append(list, *w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list
+}
+
+// queueWaitMetrics returns the queue waits as a histogram per tenant.
+func queueWaitMetrics() metrics.Family {
+	f := metrics.Family{
+		Name: "urlfetcher_queue_wait_seconds", Help: "Time jobs waited in the queue for a worker, by tenant.", Type: metrics.Histogram,
+	}
+	queueWaitMu.Lock()
+	defer queueWaitMu.Unlock()
+	tenants := make([]string, 0, len(tenantWaits))
+	for tenant := range tenantWaits {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		s := tenantWaits[tenant]
+		var cumulative int64
+		for i, le := range waitBuckets {
+			cumulative += s.buckets[i]
+			f.Samples = append(f.Samples, metrics.Sample{
+				Suffix: "_bucket", Labels: map[string]string{"tenant": tenant, "le": strconv.FormatFloat(le, 'g', -1, 64)}, Value: float64(cumulative)})
+		}
+		f.Samples = append(f.Samples,
+			metrics.Sample{Suffix: "_bucket", Labels: map[string]string{"tenant": tenant, "le": "+Inf"}, Value: float64(s.count)},
+			metrics.Sample{Suffix: "_sum", Labels: map[string]string{"tenant": tenant}, Value: s.sum.Seconds()},
+			metrics.Sample{Suffix: "_count", Labels: map[string]string{"tenant": tenant}, Value: float64(s.count)})
+	}
+	return f
+}
+
+// resetQueueWaits forgets all queue waits.
+func resetQueueWaits() {
+	queueWaitMu.Lock()
+	defer queueWaitMu.Unlock()
+	enqueuedAt = map[int64]queuedJob{}
+	tenantWaits = map[string]*waitStats{}
+}
+
+func queueWaitStatsType() *graphql.Object {
+	ms := func(get func(w QueueWaitStats) time.Duration) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			return millis(get(p.Source.(QueueWaitStats)), 1), nil
+		}
+	}
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "QueueWaitStats",
+		Fields: graphql.Fields{
+			"tenant": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Tenant of the jobs, empty for jobs without one",
+			},
+			"jobs": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs that have left the queue",
+			},
+			"p50Ms": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Median wait of recent jobs in milliseconds",
+				Resolve:     ms(func(w QueueWaitStats) time.Duration { return w.P50 }),
+			},
+			"p90Ms": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "90th percentile wait of recent jobs in milliseconds",
+				Resolve:     ms(func(w QueueWaitStats) time.Duration { return w.P90 }),
+			},
+			"p99Ms": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "99th percentile wait of recent jobs in milliseconds",
+				Resolve:     ms(func(w QueueWaitStats) time.Duration { return w.P99 }),
+			},
+			"maxMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Longest wait of recent jobs in milliseconds",
+				Resolve:     ms(func(w QueueWaitStats) time.Duration { return w.Max }),
+			},
+			"oldestWaitingMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "How long the longest waiting job still in the queue has been there, in milliseconds",
+				Resolve:     ms(func(w QueueWaitStats) time.Duration { return w.OldestWaiting }),
+			},
+		},
+	})
+}
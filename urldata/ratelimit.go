@@ -0,0 +1,81 @@
+package urldata
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out requests evenly to at most rate per second,
+// rather than letting them through in bursts.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64   // Requests per second, 0 for no limit
+	next time.Time // Earliest time the next request may be sent
+}
+
+// Global limit on outbound requests, shared by all workers.
+var fetchLimiter rateLimiter
+
+func (l *rateLimiter) set(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if perSecond < 0 {
+		perSecond = 0
+	}
+	l.rate = perSecond
+	l.next = time.Time{}
+}
+
+// wait blocks until the limit lets another request be sent, or ctx is
+// done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := clock.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(time.Duration(float64(time.Second) / l.rate))
+	l.mu.Unlock()
+	if !at.After(now) {
+		return nil
+	}
+	select {
+	case <-clock.After(at.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetFetchRate limits the requests sent by all workers together to
+// perSecond, e.g. to stay within an egress or compliance limit. Redirects
+// count as requests. 0 removes the limit. It can be changed at any time.
+func SetFetchRate(perSecond float64) {
+	fetchLimiter.set(perSecond)
+}
+
+// FetchRate returns the limit on requests per second, 0 if there is none.
+func FetchRate() float64 {
+	fetchLimiter.mu.Lock()
+	defer fetchLimiter.mu.Unlock()
+	return fetchLimiter.rate
+}
+
+// waitForFetchRate blocks until the global rate limit, and that of the
+// worker pool of the job in ctx, let another request be sent, or ctx is
+// done.
+func waitForFetchRate(ctx context.Context) error {
+	if err := fetchLimiter.wait(ctx); err != nil {
+		return err
+	}
+	if p := poolOf(jobFromContext(ctx)); p != nil {
+		return p.limiter.wait(ctx)
+	}
+	return nil
+}
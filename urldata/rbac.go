@@ -0,0 +1,219 @@
+package urldata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/graphql-go/graphql"
+)
+
+// CanViewTenant reports whether the caller in ctx may see the jobs of
+// tenant: admins, and callers without an identity, see those of every
+// tenant, viewers and submitters those of their own.
+func CanViewTenant(ctx context.Context, tenant string) bool {
+	id := auth.FromContext(ctx)
+	return id.Allows(auth.RoleAdmin) || id.Allows(auth.RoleViewer) && id.Tenant == tenant
+}
+
+// CanView reports whether the caller in ctx may see job.
+func CanView(ctx context.Context, job *Job) bool {
+	return CanViewTenant(ctx, job.Tenant)
+}
+
+// CanChange reports whether the caller in ctx may change or delete job:
+// admins may change any job, submitters the jobs they own.
+func CanChange(ctx context.Context, job *Job) bool {
+	return canChangeOwned(ctx, job.Tenant, job.Owner)
+}
+
+// canChangeOwned reports whether the caller in ctx may change what owner of
+// tenant created, such as a job or a monitor.
+func canChangeOwned(ctx context.Context, tenant, owner string) bool {
+	id := auth.FromContext(ctx)
+	if id.Allows(auth.RoleAdmin) {
+		return true
+	}
+	return id.Allows(auth.RoleSubmitter) && tenant == id.Tenant && owner == id.Owner
+}
+
+// CanViewURL reports whether the caller in ctx may see what was fetched
+// for url, such as its cached response: callers that see every tenant may,
+// others if one of the jobs they may see is for url.
+func CanViewURL(ctx context.Context, url string) bool {
+	return urlFilter(ctx)(url)
+}
+
+// CanViewBatch reports whether the caller in ctx may see the batch with the
+// given ID, and what was found by its jobs.
+func CanViewBatch(ctx context.Context, id int64) bool {
+	b := GetBatch(id)
+	return b != nil && CanViewTenant(ctx, b.Tenant)
+}
+
+// viewableURLs returns the URLs of the jobs the caller in ctx may see, and
+// false if it may see those of every tenant.
+func viewableURLs(ctx context.Context) ([]string, bool) {
+	if auth.FromContext(ctx).Allows(auth.RoleAdmin) {
+		return nil, false
+	}
+	var urls []string
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range jobs {
+		if CanView(ctx, job) {
+			urls = append(urls, job.URL)
+		}
+	}
+	return urls, true
+}
+
+// urlFilter returns a function reporting whether the caller in ctx may see
+// what was fetched for a URL, as CanViewURL does, for filtering many URLs.
+func urlFilter(ctx context.Context) func(url string) bool {
+	urls, limited := viewableURLs(ctx)
+	if !limited {
+		return func(string) bool { return true }
+	}
+	keys := map[string]bool{}
+	for _, u := range urls {
+		keys[cacheKey(u)] = true
+	}
+	return func(url string) bool { return keys[cacheKey(url)] }
+}
+
+// hostFilter returns a function reporting whether the caller in ctx may see
+// what is known about a host: callers that see every tenant may, others if
+// one of the jobs they may see is for the host.
+func hostFilter(ctx context.Context) func(host string) bool {
+	urls, limited := viewableURLs(ctx)
+	if !limited {
+		return func(string) bool { return true }
+	}
+	hosts := map[string]bool{}
+	for _, u := range urls {
+		hosts[hostOf(u)] = true
+	}
+	return func(host string) bool { return hosts[host] }
+}
+
+// ErrCredentialDenied is wrapped by the errors for client certificates and
+// tunnels the caller may not name.
+var ErrCredentialDenied = errors.New("not granted to the caller's tenant")
+
+// CheckJobCredentials returns an error unless the caller in ctx may name
+// the client certificate and tunnel for a job: admins, and callers without
+// an identity, may name any, others those granted to their tenant.
+func CheckJobCredentials(ctx context.Context, clientCert, tunnel string) error {
+	id := auth.FromContext(ctx)
+	if clientCert != "" {
+		c, ok := creds.Get(clientCert)
+		if !ok {
+			return fmt.Errorf("unknown client certificate %q", clientCert)
+		}
+		if !id.Allows(auth.RoleAdmin) && !granted(c.Tenants, id.Tenant) {
+			return fmt.Errorf("client certificate %q: %w", clientCert, ErrCredentialDenied)
+		}
+	}
+	if tunnel != "" {
+		t, ok := tunnels[tunnel]
+		if !ok {
+			return fmt.Errorf("unknown tunnel %q", tunnel)
+		}
+		if !id.Allows(auth.RoleAdmin) && !granted(t.Tenants, id.Tenant) {
+			return fmt.Errorf("tunnel %q: %w", tunnel, ErrCredentialDenied)
+		}
+	}
+	return nil
+}
+
+// granted reports whether tenant is among tenants.
+func granted(tenants []string, tenant string) bool {
+	for _, t := range tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// errCannotChange returns the error for a caller that may see job but not
+// change it, or nil if it may.
+func errCannotChange(ctx context.Context, job *Job) error {
+	return errCannotChangeOwned(ctx, job.Tenant, job.Owner)
+}
+
+// errCannotChangeOwned returns the error for a caller that may see what
+// owner of tenant created but not change it, or nil if it may.
+func errCannotChangeOwned(ctx context.Context, tenant, owner string) error {
+	if canChangeOwned(ctx, tenant, owner) {
+		return nil
+	}
+	if auth.FromContext(ctx).Allows(auth.RoleSubmitter) {
+		return &auth.ForbiddenError{Role: auth.RoleAdmin}
+	}
+	return &auth.ForbiddenError{Role: auth.RoleSubmitter}
+}
+
+// guardRoles makes the fields of the query type require the viewer role,
+// and those of the mutation type the submitter role, unless they require a
+// higher one with @requiresRole. It hides the jobs of other tenants from
+// the fields of query, mutation and the given object types that return
+// jobs.
+func guardRoles(query, mutation *graphql.Object, jobType *graphql.Object, objects ...*graphql.Object) {
+	for _, field := range query.Fields() {
+		field.Resolve = roleResolver(auth.RoleViewer, field.Resolve)
+	}
+	for _, field := range mutation.Fields() {
+		field.Resolve = roleResolver(auth.RoleSubmitter, field.Resolve)
+	}
+	for _, object := range append([]*graphql.Object{query, mutation}, objects...) {
+		for _, field := range object.Fields() {
+			list, isList := field.Type.(*graphql.List)
+			if field.Resolve != nil && (field.Type == jobType || isList && list.OfType == jobType) {
+				hideJobs(field)
+			}
+		}
+	}
+}
+
+// hideJobs makes a field returning jobs leave out those the caller may not
+// see, returning null for a single one. A result it does not know how to
+// filter is an error rather than shown unfiltered.
+func hideJobs(field *graphql.FieldDefinition) {
+	resolve := field.Resolve
+	field.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+		result, err := resolve(p)
+		switch v := result.(type) {
+		case nil:
+		case *Job:
+			if v != nil && !CanView(p.Context, v) {
+				return nil, err
+			}
+		case Job:
+			if !CanView(p.Context, &v) {
+				return nil, err
+			}
+		case []*Job:
+			visible := make([]*Job, 0, len(v))
+			for _, job := range v {
+				if job == nil || CanView(p.Context, job) {
+					visible = append(visible, job)
+				}
+			}
+			return visible, err
+		case []Job:
+			visible := make([]Job, 0, len(v))
+			for i := range v {
+				if CanView(p.Context, &v[i]) {
+					visible = append(visible, v[i])
+				}
+			}
+			return visible, err
+		default:
+			return nil, fmt.Errorf("%s: cannot hide the jobs of other tenants in a %T", field.Name, result)
+		}
+		return result, err
+	}
+}
@@ -0,0 +1,116 @@
+package urldata
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// What redacted values are replaced by.
+const redacted = "[redacted]"
+
+// RedactionRules name the query parameters and headers whose values are
+// hidden wherever URLs and requests are logged or recorded: the server's
+// log, job timelines, debug information, HAR exchanges and error messages.
+// Names are matched without regard to case.
+type RedactionRules struct {
+	QueryParams []string
+	Headers     []string
+}
+
+// Request headers that are always redacted, since they carry secrets from
+// the credentials.
+var redactedHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+var redactionMu sync.RWMutex
+var redactedParams = map[string]bool{}
+var extraRedactedHeaders = map[string]bool{}
+
+// SetRedaction replaces the redaction rules.
+func SetRedaction(rules RedactionRules) {
+	params := map[string]bool{}
+	for _, name := range rules.QueryParams {
+		params[strings.ToLower(name)] = true
+	}
+	headers := map[string]bool{}
+	for _, name := range rules.Headers {
+		headers[strings.ToLower(name)] = true
+	}
+	redactionMu.Lock()
+	defer redactionMu.Unlock()
+	redactedParams = params
+	extraRedactedHeaders = headers
+}
+
+// redactHeader reports whether the value of a header is hidden.
+func redactHeader(name string) bool {
+	name = strings.ToLower(name)
+	if redactedHeaders[name] {
+		return true
+	}
+	redactionMu.RLock()
+	defer redactionMu.RUnlock()
+	return extraRedactedHeaders[name]
+}
+
+// redactHeaderValue returns the value of a header as it may be recorded:
+// hidden if the header is redacted, and with redacted parameters hidden if
+// it is a URL.
+func redactHeaderValue(name, value string) string {
+	switch {
+	case redactHeader(name):
+		return redacted
+	case strings.EqualFold(name, "Location"), strings.EqualFold(name, "Content-Location"), strings.EqualFold(name, "Referer"):
+		return RedactURL(value)
+	}
+	return value
+}
+
+// RedactURL returns rawURL with the values of redacted query parameters,
+// and any password, replaced. The rest of the URL is kept as written, so
+// that it can still be recognised. Strings that do not parse as URLs are
+// returned as they are. Passwords become xxxxx, as with url.URL.Redacted.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	_, changed := u.User.Password()
+	redactionMu.RLock()
+	params := redactedParams
+	redactionMu.RUnlock()
+	if len(params) > 0 && u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			name, _, hasValue := strings.Cut(pair, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if hasValue && params[strings.ToLower(name)] {
+				pairs[i] = pair[:strings.IndexByte(pair, '=')+1] + redacted
+				changed = true
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+	if !changed {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// redactError returns err with its URL redacted if it is a *url.Error,
+// whose message quotes it, as the HTTP client returns.
+func redactError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	if safe := RedactURL(urlErr.URL); safe != urlErr.URL {
+		return &url.Error{Op: urlErr.Op, URL: safe, Err: urlErr.Err}
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package urldata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// ErrReadOnly is returned for changes requested from a read-only replica.
+var ErrReadOnly = errors.New("this instance is a read-only replica")
+
+// defaultReplicaInterval is how often a replica reads new journal entries
+// unless configured otherwise.
+const defaultReplicaInterval = 5 * time.Second
+
+// Set to 1 once the instance is a replica.
+var readOnly int32
+
+// ReadOnly reports whether the instance is a read-only replica.
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// SetReplica makes the instance a read-only replica of the jobs that
+// another instance journals to the file at path, e.g. on a shared volume.
+// The jobs are loaded, and then the journal is followed every interval.
+// Replicas must not run workers, and refuse mutations.
+func SetReplica(path string, interval time.Duration) error {
+	if interval == 0 {
+		interval = defaultReplicaInterval
+	}
+	atomic.StoreInt32(&readOnly, 1)
+	r := &replica{path: path}
+	if err := r.follow(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			<-clock.After(interval)
+			if err := r.follow(); err != nil {
+				fmt.Println("failed to follow journal:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// replica follows a journal written by another instance.
+type replica struct {
+	path   string
+	f      *os.File
+	offset int64 // End of the last complete entry read
+}
+
+// follow applies the entries added to the journal since it was last read.
+// The writer compacts the journal into a new file when it starts, in which
+// case the jobs are loaded again from scratch.
+func (r *replica) follow() error {
+	info, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		if current, err := r.f.Stat(); err != nil || !os.SameFile(current, info) || info.Size() < r.offset {
+			r.f.Close()
+			r.f = nil
+		}
+	}
+	if r.f == nil {
+		if r.f, err = os.Open(r.path); err != nil {
+			return err
+		}
+		r.offset = 0
+		jobsMu.Lock()
+		jobs = make(map[int64]*Job)
+		jobsMu.Unlock()
+		trashMu.Lock()
+		trash = map[int64]*Job{}
+		trashMu.Unlock()
+	}
+	if _, err := r.f.Seek(r.offset, 0); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r.f)
+	if err != nil {
+		return err
+	}
+	// The writer may be in the middle of a line.
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			fmt.Println("skipping unreadable journal entry:", err)
+			continue
+		}
+		applyJournalEntry(e)
+	}
+	r.offset += int64(end)
+	return nil
+}
+
+// applyJournalEntry brings the jobs in memory up to date with an entry of
+// the journal of another instance.
+func applyJournalEntry(e journalEntry) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	if job := e.Job; job != nil {
+		if job.DeletedAt.IsZero() {
+			jobs[job.ID] = job
+			delete(trash, job.ID)
+		} else {
+			trash[job.ID] = job
+			delete(jobs, job.ID)
+		}
+		if job.ID > atomic.LoadInt64(&curJobID) {
+			atomic.StoreInt64(&curJobID, job.ID)
+		}
+		if r := job.Response; job.Status == "done" && r != nil && !bypassesCache(job) {
+			cacheNewerResponse(cacheKey(job.URL), r)
+		}
+	}
+	if id := eventJobID(e); id != 0 {
+		job := jobs[id]
+		if job == nil {
+			job = trash[id]
+		}
+		if job != nil {
+			eventsMu.Lock()
+			job.Events = append(job.Events, e.Event.Event)
+			eventsMu.Unlock()
+		}
+	}
+	for _, id := range []int64{e.Archived, e.Purged} {
+		if id != 0 {
+			delete(jobs, id)
+			delete(trash, id)
+		}
+	}
+}
+
+// guardMutations makes every field of the mutation type fail with
+// ErrReadOnly on a replica.
+func guardMutations(mutation *graphql.Object) {
+	for _, field := range mutation.Fields() {
+		resolve := field.Resolve
+		field.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+			if ReadOnly() {
+				return nil, ErrReadOnly
+			}
+			return resolve(p)
+		}
+	}
+}
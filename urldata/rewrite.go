@@ -0,0 +1,70 @@
+package urldata
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+)
+
+// RewriteRule changes the URL of the jobs for a host at fetch time, so
+// secrets such as API keys and routing tweaks live in the server
+// configuration rather than in every submitted URL. Jobs keep the URL they
+// were submitted with; only the request is sent to the rewritten one.
+type RewriteRule struct {
+	Host    string         // Host or *.domain wildcard the rule applies to
+	Match   *regexp.Regexp // Replaced in the whole URL, if set
+	Replace string         // Replacement, with $1 style references to groups of Match
+	// Query sets query parameters to fixed values.
+	Query map[string]string
+	// QueryCredentials sets query parameters to the password of the named
+	// credentials.
+	QueryCredentials map[string]string
+}
+
+var rewriteMu sync.Mutex
+var rewriteRules []RewriteRule
+
+// SetRewriteRules replaces the URL rewrite rules. Every rule whose host
+// matches is applied, in order.
+func SetRewriteRules(rules []RewriteRule) {
+	rewriteMu.Lock()
+	defer rewriteMu.Unlock()
+	rewriteRules = rules
+}
+
+// rewriteURL returns the URL to send the request for rawURL to.
+func rewriteURL(rawURL string) (string, error) {
+	rewriteMu.Lock()
+	rules := rewriteRules
+	rewriteMu.Unlock()
+	for _, r := range rules {
+		if !MatchesHost(r.Host, hostOf(rawURL)) {
+			continue
+		}
+		if r.Match != nil {
+			rawURL = r.Match.ReplaceAllString(rawURL, r.Replace)
+		}
+		if len(r.Query) == 0 && len(r.QueryCredentials) == 0 {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		for name, value := range r.Query {
+			q.Set(name, value)
+		}
+		for name, credential := range r.QueryCredentials {
+			c, ok := creds.Get(credential)
+			if !ok {
+				return "", fmt.Errorf("unknown credential %q", credential)
+			}
+			q.Set(name, c.Password)
+		}
+		u.RawQuery = q.Encode()
+		rawURL = u.String()
+	}
+	return rawURL, nil
+}
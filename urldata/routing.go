@@ -0,0 +1,195 @@
+package urldata
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often finished jobs past their retention are deleted.
+const retentionInterval = time.Minute
+
+// RoutingRule sets the options of the jobs it matches, so that policy
+// need not be given with every job. Empty conditions match every job, and
+// a job must meet all of a rule's conditions.
+type RoutingRule struct {
+	Name   string
+	Host   string // Host or *.domain wildcard
+	Tag    string // Tag the job has
+	Tenant string
+	// ContentType is the media type of the job's response, or "type/*".
+	// Only known once the job has fetched its response, so rules with one
+	// may only set Processors and Retention.
+	ContentType string
+
+	// What the rule sets; zero values leave the setting to later rules.
+	Priority   int           // Default for JobOptions.Priority
+	Egress     string        // Default for JobOptions.Egress
+	Pool       string        // Default for JobOptions.Pool
+	Processors []string      // Processors run on the response instead of all of them
+	Retention  time.Duration // How long the job is kept after finishing before it is deleted
+}
+
+var routingMu sync.Mutex
+var routingRules []RoutingRule
+var expiring sync.Once
+
+// SetRoutingRules replaces the routing rules. Of the rules that match a
+// job, the first that gives a setting decides it; options given with the
+// job, or its preset, take precedence over the rules, and the rules over
+// its host's profile. If a rule sets a retention, jobs past theirs are
+// deleted from then on.
+func SetRoutingRules(rules []RoutingRule) error {
+	retains := false
+	for _, r := range rules {
+		retains = retains || r.Retention > 0
+		if r.ContentType != "" && (r.Priority != 0 || r.Egress != "" || r.Pool != "") {
+			return fmt.Errorf("routing rule %s: rules matching on content type may only set processors and retention", r.Name)
+		}
+		if r.Pool != "" && !HasPool(r.Pool) {
+			return fmt.Errorf("routing rule %s: unknown worker pool %q", r.Name, r.Pool)
+		}
+		if r.Egress != "" {
+			egressMu.Lock()
+			_, ok := egressRoutes[r.Egress]
+			egressMu.Unlock()
+			if !ok {
+				return fmt.Errorf("routing rule %s: unknown egress %q", r.Name, r.Egress)
+			}
+		}
+		for _, name := range r.Processors {
+			processorsMu.Lock()
+			_, ok := processors[name]
+			processorsMu.Unlock()
+			if !ok {
+				return fmt.Errorf("routing rule %s: unknown processor %q", r.Name, name)
+			}
+		}
+		if r.Retention < 0 {
+			return fmt.Errorf("routing rule %s: negative retention", r.Name)
+		}
+	}
+	routingMu.Lock()
+	routingRules = rules
+	routingMu.Unlock()
+	if retains {
+		expiring.Do(func() {
+			go func() {
+				for {
+					<-clock.After(retentionInterval)
+					ExpireJobs()
+				}
+			}()
+		})
+	}
+	return nil
+}
+
+// getRoutingRules returns the routing rules; the slice is never changed.
+func getRoutingRules() []RoutingRule {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+	return routingRules
+}
+
+// matches reports whether the rule matches a job for a URL of host with
+// opts. response is nil until the job has fetched one.
+func (r RoutingRule) matches(host string, opts JobOptions, response *Response) bool {
+	if r.Host != "" && !MatchesHost(strings.ToLower(r.Host), host) {
+		return false
+	}
+	if r.Tenant != "" && r.Tenant != opts.Tenant {
+		return false
+	}
+	if r.Tag != "" && !hasTag(opts.Tags, r.Tag) {
+		return false
+	}
+	if r.ContentType == "" {
+		return true
+	}
+	if response == nil {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	pattern := strings.ToLower(r.ContentType)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	}
+	return mediaType == pattern
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// withRoutingRules fills in the options left unset from the rules that
+// match a job for rawURL.
+func withRoutingRules(rawURL string, opts JobOptions) JobOptions {
+	host := hostOf(rawURL)
+	for _, r := range getRoutingRules() {
+		if r.ContentType != "" || !r.matches(host, opts, nil) {
+			continue
+		}
+		if opts.Priority == 0 {
+			opts.Priority = r.Priority
+		}
+		if opts.Egress == "" {
+			opts.Egress = r.Egress
+		}
+		if opts.Pool == "" {
+			opts.Pool = r.Pool
+		}
+	}
+	return opts
+}
+
+// routedProcessors returns the processors the rules run on the job's
+// response, or nil to run all of them.
+func routedProcessors(job *Job, response *Response) []string {
+	for _, r := range getRoutingRules() {
+		if len(r.Processors) > 0 && r.matches(hostOf(job.URL), job.Options, response) {
+			return r.Processors
+		}
+	}
+	return nil
+}
+
+// jobRetention returns how long the rules keep the job once it has
+// finished, or 0 to keep it.
+func jobRetention(job *Job) time.Duration {
+	response := GetJobState(job).Response
+	for _, r := range getRoutingRules() {
+		if r.Retention > 0 && r.matches(hostOf(job.URL), job.Options, response) {
+			return r.Retention
+		}
+	}
+	return 0
+}
+
+// ExpireJobs moves the jobs that finished longer ago than their retention
+// to the trash.
+func ExpireJobs() {
+	now := clock.Now()
+	var expired []int64
+	for _, job := range GetJobs() {
+		if !Finished(jobStatus(job)) {
+			continue
+		}
+		retention := jobRetention(job)
+		events := jobEvents(job)
+		if retention > 0 && len(events) > 0 && now.Sub(events[len(events)-1].Time) >= retention {
+			expired = append(expired, job.ID)
+		}
+	}
+	if len(expired) > 0 {
+		DeleteJobs(expired)
+		fmt.Println("deleted", len(expired), "jobs past their retention")
+	}
+}
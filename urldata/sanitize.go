@@ -0,0 +1,223 @@
+package urldata
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// Content-Security-Policy put into HTML previews, in case the page that
+// shows them sandboxes them less than it should. It blocks scripts, frames
+// and plugins, and anything that could send data away but images, styles
+// and fonts.
+const previewPolicy = "default-src 'none'; img-src * data:; style-src * 'unsafe-inline'; font-src * data:; form-action 'none'; base-uri 'none'"
+
+// Elements removed with their content: those that run code, load other
+// documents or plugins, or change how the document is loaded.
+var unsafeElements = map[string]bool{
+	"script":   true,
+	"noscript": true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"base":     true,
+	"link":     true,
+	"template": true,
+	"portal":   true,
+	// SVG elements that can set attributes, such as href, to scripts.
+	"animate":          true,
+	"animatemotion":    true,
+	"animatetransform": true,
+	"set":              true,
+	"handler":          true,
+	"listener":         true,
+}
+
+// Attributes whose values are URLs.
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"cite":       true,
+	"data":       true,
+	"codebase":   true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+	"ping":       true,
+}
+
+var sanitizeMu sync.Mutex
+var sanitizeStored bool
+
+// SetSanitizeHTML sets whether the bodies of HTML responses are stored
+// sanitized, as SanitizeHTML returns them. Links, findings, structured data
+// and the language are still taken from the body as fetched.
+func SetSanitizeHTML(on bool) {
+	sanitizeMu.Lock()
+	defer sanitizeMu.Unlock()
+	sanitizeStored = on
+}
+
+// sanitizeResponse replaces the body of an HTML response with its
+// sanitized version if stored bodies are sanitized.
+func sanitizeResponse(r *Response) {
+	sanitizeMu.Lock()
+	on := sanitizeStored
+	sanitizeMu.Unlock()
+	if !on || !isHTML(r.Header, r.Body) {
+		return
+	}
+	r.Body = SanitizeHTML(r.Body)
+	r.Checksums = computeChecksums(r.Body)
+}
+
+// isHTML reports whether a body is an HTML document, by its Content-Type
+// or else its content.
+func isHTML(header http.Header, body []byte) bool {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// SanitizeHTML returns an HTML document without anything that runs
+// scripts or loads other documents: script, frame, plugin, base and link
+// elements, meta elements other than charsets, event handler and srcdoc
+// attributes, and javascript:, vbscript: and (but for images) data: URLs.
+// What remains is rendered as a whole document.
+func SanitizeHTML(body []byte) []byte {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	sanitizeNode(doc)
+	return render(doc)
+}
+
+// previewHTML returns the sanitized body of an HTML response with
+// previewPolicy declared in its head, or nil if the response is not HTML.
+func previewHTML(r *Response) []byte {
+	if !isHTML(r.Header, r.Body) {
+		return nil
+	}
+	doc, err := html.Parse(bytes.NewReader(r.Body))
+	if err != nil {
+		return nil
+	}
+	sanitizeNode(doc)
+	if head := findElement(doc, "head"); head != nil {
+		meta := &html.Node{Type: html.ElementNode, Data: "meta", Attr: []html.Attribute{
+			{Key: "http-equiv", Val: "Content-Security-Policy"},
+			{Key: "content", Val: previewPolicy},
+		}}
+		head.InsertBefore(meta, head.FirstChild)
+	}
+	return render(doc)
+}
+
+func render(doc *html.Node) []byte {
+	var b bytes.Buffer
+	if err := html.Render(&b, doc); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+func sanitizeNode(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && (unsafeElements[strings.ToLower(c.Data)] || unsafeMeta(c)) {
+			n.RemoveChild(c)
+		} else {
+			if c.Type == html.ElementNode {
+				c.Attr = safeAttributes(c)
+			}
+			sanitizeNode(c)
+		}
+		c = next
+	}
+}
+
+// unsafeMeta reports whether n is a meta element doing more than declaring
+// the charset, such as a refresh or a Content-Security-Policy.
+func unsafeMeta(n *html.Node) bool {
+	if n.Data != "meta" || n.Namespace != "" {
+		return false
+	}
+	for _, a := range n.Attr {
+		if a.Key == "http-equiv" {
+			return true
+		}
+	}
+	return false
+}
+
+func safeAttributes(n *html.Node) []html.Attribute {
+	var safe []html.Attribute
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"), key == "srcdoc", key == "srcset" && n.Data != "img" && n.Data != "source":
+			continue
+		case urlAttributes[key]:
+			if !safeURL(a.Val, n.Data == "img" && key == "src") {
+				continue
+			}
+		case key == "style":
+			v := strings.ToLower(a.Val)
+			if strings.Contains(v, "expression(") || strings.Contains(v, "javascript:") {
+				continue
+			}
+		}
+		safe = append(safe, a)
+	}
+	return safe
+}
+
+// safeURL reports whether a URL attribute cannot run a script: it has no
+// scheme but http, https, mailto or tel, or data for images if image is
+// set. Browsers ignore whitespace and control characters in schemes, and
+// so does the check.
+func safeURL(raw string, image bool) bool {
+	scheme, _, ok := strings.Cut(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, raw), ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return true // Relative
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto", "tel":
+		return true
+	case "data":
+		return image
+	}
+	return false
+}
+
+// findElement returns the first element named name below n, or nil.
+func findElement(n *html.Node, name string) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == name {
+			return c
+		}
+		if found := findElement(c, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package urldata
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scripts are expressions evaluated for each job of a preset or host
+// profile: to derive findings from its response, decide whether a failed
+// fetch is retried, and route its notification. They are written in Go's
+// expression syntax, with the variables and functions of scriptVars and
+// scriptFuncs, and have no access to anything else.
+type Scripts struct {
+	// Fields maps finding names to expressions whose values are added to
+	// the findings of a fetched response, with processor "script".
+	Fields map[string]string
+	// Retry decides whether a failed fetch is retried, instead of whether
+	// its error is retryable. The politeness settings still limit retries.
+	Retry string
+	// Notify names the notifier told when the job has finished, instead of
+	// JobOptions.Notify, or gives "" for none.
+	Notify string
+}
+
+// CheckScripts reports the first script of s that does not compile.
+func CheckScripts(s *Scripts) error {
+	if s == nil {
+		return nil
+	}
+	sources := []string{s.Retry, s.Notify}
+	for _, src := range s.Fields {
+		sources = append(sources, src)
+	}
+	for _, src := range sources {
+		if src == "" {
+			continue
+		}
+		if _, err := compileScript(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptEnv is what scripts about a job can see.
+type scriptEnv struct {
+	job      *Job
+	state    JobState
+	response *Response
+}
+
+func newScriptEnv(job *Job, response *Response) *scriptEnv {
+	state := GetJobState(job)
+	if response == nil {
+		response = state.Response
+	}
+	return &scriptEnv{job: job, state: state, response: response}
+}
+
+// Variables of scripts.
+var scriptVars = map[string]func(env *scriptEnv) interface{}{
+	"url":  func(env *scriptEnv) interface{} { return env.job.URL },
+	"host": func(env *scriptEnv) interface{} { return hostOf(env.job.URL) },
+	// Status of the job, "fetching" until it has finished.
+	"status": func(env *scriptEnv) interface{} { return env.state.Status },
+	"statusCode": func(env *scriptEnv) interface{} {
+		if env.response == nil {
+			return 0.0
+		}
+		return float64(env.response.StatusCode)
+	},
+	"size": func(env *scriptEnv) interface{} {
+		if env.response == nil {
+			return 0.0
+		}
+		return float64(len(env.response.Body))
+	},
+	"attempts": func(env *scriptEnv) interface{} { return float64(env.state.Attempts) },
+	// Error category of the failure, "" if the job has not failed.
+	"error": func(env *scriptEnv) interface{} {
+		if env.state.Error == nil {
+			return ""
+		}
+		return env.state.Error.Category
+	},
+	"retryable": func(env *scriptEnv) interface{} { return env.state.Error != nil && env.state.Error.Retryable },
+}
+
+// scriptFunc is a function of scripts, taking arguments of the given kinds:
+// "string", "number", "bool", or "" for any.
+type scriptFunc struct {
+	args []string
+	call func(env *scriptEnv, args []interface{}) (interface{}, error)
+}
+
+// Functions of scripts.
+var scriptFuncs = map[string]scriptFunc{
+	"contains":  stringFunc(2, func(s []string) interface{} { return strings.Contains(s[0], s[1]) }),
+	"hasPrefix": stringFunc(2, func(s []string) interface{} { return strings.HasPrefix(s[0], s[1]) }),
+	"hasSuffix": stringFunc(2, func(s []string) interface{} { return strings.HasSuffix(s[0], s[1]) }),
+	"lower":     stringFunc(1, func(s []string) interface{} { return strings.ToLower(s[0]) }),
+	"len":       stringFunc(1, func(s []string) interface{} { return float64(len(s[0])) }),
+	"matches": {args: []string{"string", "string"}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		return regexp.MatchString(args[1].(string), args[0].(string))
+	}},
+	// header returns the first value of a response header, or "".
+	"header": {args: []string{"string"}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		if env.response == nil {
+			return "", nil
+		}
+		return env.response.Header.Get(args[0].(string)), nil
+	}},
+	// finding returns the first value of a finding of another processor, or "".
+	"finding": {args: []string{"string"}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		if env.response != nil {
+			for _, f := range env.response.Findings {
+				if f.Name == args[0].(string) && f.Processor != "script" {
+					return f.Value, nil
+				}
+			}
+		}
+		return "", nil
+	}},
+	"hasTag": {args: []string{"string"}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		return hasTag(env.job.Options.Tags, args[0].(string)), nil
+	}},
+	"metadata": {args: []string{"string"}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		return env.job.Options.Metadata[args[0].(string)], nil
+	}},
+	"body": {call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		if env.response == nil {
+			return "", nil
+		}
+		return string(env.response.Body), nil
+	}},
+	// cond returns its second argument if the first is true, else its third.
+	"cond": {args: []string{"bool", "", ""}, call: func(env *scriptEnv, args []interface{}) (interface{}, error) {
+		if args[0].(bool) {
+			return args[1], nil
+		}
+		return args[2], nil
+	}},
+}
+
+// stringFunc returns a function of n strings.
+func stringFunc(n int, f func(s []string) interface{}) scriptFunc {
+	args := make([]string, n)
+	for i := range args {
+		args[i] = "string"
+	}
+	return scriptFunc{args: args, call: func(env *scriptEnv, values []interface{}) (interface{}, error) {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = v.(string)
+		}
+		return f(s), nil
+	}}
+}
+
+var scriptsMu sync.Mutex
+var compiledScripts = map[string]ast.Expr{}
+
+// compileScript parses a script and checks that it only uses what scripts
+// may. Scripts come from the configuration, so compiled ones are kept.
+func compileScript(src string) (ast.Expr, error) {
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+	if e, ok := compiledScripts[src]; ok {
+		return e, nil
+	}
+	e, err := parser.ParseExpr(src)
+	if err == nil {
+		err = checkScript(e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid script %q: %v", src, err)
+	}
+	compiledScripts[src] = e
+	return e, nil
+}
+
+func checkScript(e ast.Expr) error {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT && e.Kind != token.STRING {
+			return fmt.Errorf("unsupported literal %s", e.Value)
+		}
+		return nil
+	case *ast.Ident:
+		if e.Name != "true" && e.Name != "false" && scriptVars[e.Name] == nil {
+			return fmt.Errorf("unknown variable %s", e.Name)
+		}
+		return nil
+	case *ast.ParenExpr:
+		return checkScript(e.X)
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT && e.Op != token.SUB {
+			return fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		return checkScript(e.X)
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND, token.LOR, token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+			token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		default:
+			return fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		if err := checkScript(e.X); err != nil {
+			return err
+		}
+		return checkScript(e.Y)
+	case *ast.CallExpr:
+		name, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			return fmt.Errorf("unsupported call")
+		}
+		f, ok := scriptFuncs[name.Name]
+		if !ok {
+			return fmt.Errorf("unknown function %s", name.Name)
+		}
+		if len(e.Args) != len(f.args) || e.Ellipsis.IsValid() {
+			return fmt.Errorf("%s takes %d arguments", name.Name, len(f.args))
+		}
+		for _, arg := range e.Args {
+			if err := checkScript(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported expression")
+}
+
+// runScript evaluates a script about a job.
+func runScript(src string, env *scriptEnv) (interface{}, error) {
+	e, err := compileScript(src)
+	if err != nil {
+		return nil, err
+	}
+	return evalScript(e, env)
+}
+
+// evalScript evaluates a compiled script. Values are bools, strings, or
+// float64 for all numbers.
+func evalScript(e ast.Expr, env *scriptEnv) (interface{}, error) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.STRING {
+			return strconv.Unquote(e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return scriptVars[e.Name](env), nil
+	case *ast.ParenExpr:
+		return evalScript(e.X, env)
+	case *ast.UnaryExpr:
+		x, err := evalScript(e.X, env)
+		if err != nil {
+			return nil, err
+		}
+		switch v := x.(type) {
+		case bool:
+			if e.Op == token.NOT {
+				return !v, nil
+			}
+		case float64:
+			if e.Op == token.SUB {
+				return -v, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid operation %s on %s", e.Op, kindOf(x))
+	case *ast.BinaryExpr:
+		return evalBinary(e, env)
+	case *ast.CallExpr:
+		name := e.Fun.(*ast.Ident).Name
+		f := scriptFuncs[name]
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			v, err := evalScript(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			if f.args[i] != "" && kindOf(v) != f.args[i] {
+				return nil, fmt.Errorf("argument %d of %s is a %s, not a %s", i+1, name, kindOf(v), f.args[i])
+			}
+			args[i] = v
+		}
+		return f.call(env, args)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+func evalBinary(e *ast.BinaryExpr, env *scriptEnv) (interface{}, error) {
+	x, err := evalScript(e.X, env)
+	if err != nil {
+		return nil, err
+	}
+	if e.Op == token.LAND || e.Op == token.LOR {
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid operation %s on %s", e.Op, kindOf(x))
+		}
+		if b == (e.Op == token.LOR) {
+			return b, nil
+		}
+		y, err := evalScript(e.Y, env)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := y.(bool); !ok {
+			return nil, fmt.Errorf("invalid operation %s on %s", e.Op, kindOf(y))
+		}
+		return y, nil
+	}
+	y, err := evalScript(e.Y, env)
+	if err != nil {
+		return nil, err
+	}
+	if kindOf(x) != kindOf(y) {
+		return nil, fmt.Errorf("mismatched operands %s and %s of %s", kindOf(x), kindOf(y), e.Op)
+	}
+	switch e.Op {
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	}
+	switch a := x.(type) {
+	case float64:
+		b := y.(float64)
+		switch e.Op {
+		case token.LSS:
+			return a < b, nil
+		case token.LEQ:
+			return a <= b, nil
+		case token.GTR:
+			return a > b, nil
+		case token.GEQ:
+			return a >= b, nil
+		case token.ADD:
+			return a + b, nil
+		case token.SUB:
+			return a - b, nil
+		case token.MUL:
+			return a * b, nil
+		case token.QUO:
+			return a / b, nil
+		case token.REM:
+			return math.Mod(a, b), nil
+		}
+	case string:
+		b := y.(string)
+		switch e.Op {
+		case token.LSS:
+			return a < b, nil
+		case token.LEQ:
+			return a <= b, nil
+		case token.GTR:
+			return a > b, nil
+		case token.GEQ:
+			return a >= b, nil
+		case token.ADD:
+			return a + b, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operation %s on %s", e.Op, kindOf(x))
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// formatScriptValue returns a value of a script as text.
+func formatScriptValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// scriptFindings returns the findings the field scripts of the job derive
+// from its response, ordered by name. Scripts that fail are left out and
+// recorded as script events.
+func scriptFindings(job *Job, r *Response) []Finding {
+	s := job.Options.Scripts
+	if s == nil || len(s.Fields) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := newScriptEnv(job, r)
+	var findings []Finding
+	for _, name := range names {
+		v, err := runScript(s.Fields[name], env)
+		if err != nil {
+			recordEvent(job, "script", "field %s: %v", name, err)
+			continue
+		}
+		findings = append(findings, Finding{Processor: "script", Name: name, Value: formatScriptValue(v)})
+	}
+	return findings
+}
+
+// scriptRetry returns whether the retry script of the job retries the
+// failure e, or e.Retryable if the job has no such script or it fails.
+func scriptRetry(job *Job, e *JobError) bool {
+	s := job.Options.Scripts
+	if s == nil || s.Retry == "" {
+		return e.Retryable
+	}
+	env := newScriptEnv(job, nil)
+	env.state.Error = e
+	v, err := runScript(s.Retry, env)
+	if err == nil {
+		if retry, ok := v.(bool); ok {
+			return retry
+		}
+		err = fmt.Errorf("result is a %s, not a bool", kindOf(v))
+	}
+	recordEvent(job, "script", "retry: %v", err)
+	return e.Retryable
+}
+
+// scriptNotifier returns the notifier the notify script of the job picks,
+// or JobOptions.Notify if the job has no such script or it fails.
+func scriptNotifier(job *Job) string {
+	s := job.Options.Scripts
+	if s == nil || s.Notify == "" {
+		return job.Options.Notify
+	}
+	v, err := runScript(s.Notify, newScriptEnv(job, nil))
+	if err == nil {
+		if name, ok := v.(string); ok {
+			return name
+		}
+		err = fmt.Errorf("result is a %s, not a string", kindOf(v))
+	}
+	recordEvent(job, "script", "notify: %v", err)
+	return job.Options.Notify
+}
@@ -0,0 +1,128 @@
+package urldata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SnapshotConfig configures submitting fetched URLs to a web archive.
+type SnapshotConfig struct {
+	// Endpoint is what the URL to archive is appended to, the Internet
+	// Archive's Save Page Now by default.
+	Endpoint string
+	// Credential names a credential whose username and password are the
+	// access and secret keys of the archive, if it needs them.
+	Credential string
+	Timeout    time.Duration // For each submission, defaultSnapshotTimeout by default
+}
+
+// Defaults for the snapshot settings. Save Page Now can take a while to
+// capture a page.
+const defaultSnapshotEndpoint = "https://web.archive.org/save/"
+const defaultSnapshotTimeout = 2 * time.Minute
+
+var snapshotMu sync.Mutex
+var snapshotConfig *SnapshotConfig
+
+// SetSnapshots enables submitting the URLs of successful fetch jobs to a web
+// archive once they are done, or disables it if c is nil. The URL of each
+// snapshot is recorded on the job's response.
+func SetSnapshots(c *SnapshotConfig) {
+	if c != nil {
+		copied := *c
+		if copied.Endpoint == "" {
+			copied.Endpoint = defaultSnapshotEndpoint
+		}
+		if copied.Timeout == 0 {
+			copied.Timeout = defaultSnapshotTimeout
+		}
+		c = &copied
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	snapshotConfig = c
+}
+
+// snapshotJobFinished submits the URL of a job that fetched a page
+// successfully to the archive, in the background.
+func snapshotJobFinished(job *Job) {
+	snapshotMu.Lock()
+	c := snapshotConfig
+	snapshotMu.Unlock()
+	if c == nil || job.Options.Type != JobFetch {
+		return
+	}
+	state := GetJobState(job)
+	// Responses answered from the cache may have been archived already.
+	if state.Status != "done" || state.Response == nil || state.Response.Snapshot != "" {
+		return
+	}
+	go func() {
+		archived, err := submitSnapshot(c, job.URL)
+		if err != nil {
+			recordEvent(job, "snapshot", "failed to archive: %v", redactError(err))
+			return
+		}
+		recordSnapshot(job, state.Response, archived)
+		recordEvent(job, "snapshot", "archived as %s", archived)
+	}()
+}
+
+// submitSnapshot asks the archive to capture rawURL and returns the URL of
+// the capture. Archives answer with it in a Content-Location or Location
+// header, or by redirecting to it.
+func submitSnapshot(c *SnapshotConfig, rawURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Endpoint+rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Credential != "" {
+		cred, ok := creds.Get(c.Credential)
+		if !ok {
+			return "", fmt.Errorf("unknown credential %q", c.Credential)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("LOW %s:%s", cred.Username, cred.Password))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("archive answered %s", resp.Status)
+	}
+	for _, name := range []string{"Content-Location", "Location"} {
+		if loc := resp.Header.Get(name); loc != "" {
+			u, err := resp.Request.URL.Parse(loc)
+			if err != nil {
+				return "", fmt.Errorf("invalid %s %q: %v", name, loc, err)
+			}
+			return u.String(), nil
+		}
+	}
+	if resp.Request.URL.String() != req.URL.String() {
+		return resp.Request.URL.String(), nil
+	}
+	return "", fmt.Errorf("archive did not say where the snapshot is")
+}
+
+// recordSnapshot records the snapshot URL on a copy of the job's response,
+// as responses are shared and read without locks, and puts the copy in
+// place of the original on the job and in the cache.
+func recordSnapshot(job *Job, resp *Response, snapshot string) {
+	copied := *resp
+	copied.Snapshot = snapshot
+	updateJob(job, func(job *Job) {
+		if job.Response == resp {
+			job.Response = &copied
+		}
+	})
+	replaceResponse(cacheKey(job.URL), resp, &copied)
+}
@@ -0,0 +1,414 @@
+package urldata
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/metrics"
+	"github.com/graphql-go/graphql"
+)
+
+// HostStats holds connection statistics for a single target host.
+type HostStats struct {
+	Host              string
+	Requests          int64
+	ReusedConnections int64
+	NewConnections    int64
+	DNSLookups        int64
+	DNSTime           time.Duration
+	Connects          int64
+	ConnectTime       time.Duration
+	TLSHandshakes     int64
+	TLSHandshakeTime  time.Duration
+	Circuit           string        // Circuit breaker state: closed, open or half-open
+	Failures          int           // Consecutive failed requests
+	PolitenessDelay   time.Duration // Current gap enforced between requests
+	BackoffUntil      time.Time     // Set while the host asked us to back off
+}
+
+// Stats is a snapshot of server statistics.
+type Stats struct {
+	QueueDepth   int
+	Paused       bool     // Whether the whole queue is paused
+	PausedHosts  []string // Hosts whose jobs are parked
+	DrainedHosts []string // Drained hosts and wildcards
+	ParkedJobs   int      // Jobs parked for paused or drained hosts
+	DelayedJobs  int      // Jobs waiting for their notBefore time
+	FetchRate    float64  // Limit on requests per second, 0 for none
+	Hosts        []HostStats
+	QueueWaits   []QueueWaitStats // Time jobs spent in the queue, per tenant
+	Connections  ConnectionStats
+	Shedding     string // Why new jobs are refused, "" if they are not
+	ShedJobs     int64  // Jobs refused since the server started
+	Pools        []PoolStats
+}
+
+var hostStatsMu sync.Mutex
+var hostStats = map[string]*HostStats{}
+
+// GetStats returns a snapshot of the server statistics.
+func GetStats() Stats {
+	// Asking a broker for the queue length may take a while.
+	s := Stats{QueueDepth: queueDepth(), FetchRate: FetchRate(), DelayedJobs: delayedJobs(), QueueWaits: queueWaitStats()}
+	s.Connections = connectionStats()
+	s.Pools = poolStats()
+	s.Shedding, s.ShedJobs = sheddingStats()
+	hostStatsMu.Lock()
+	defer hostStatsMu.Unlock()
+	s.Paused, s.PausedHosts, s.DrainedHosts, s.ParkedJobs = pauseStats()
+	circuits := circuitStates()
+	hosts := map[string]HostStats{}
+	for host, h := range hostStats {
+		hosts[host] = *h
+	}
+	for host := range circuits {
+		hosts[host] = HostStats{Host: host}
+	}
+	pacesMu.Lock()
+	for host := range paces {
+		if _, ok := hosts[host]; !ok {
+			hosts[host] = HostStats{Host: host}
+		}
+	}
+	pacesMu.Unlock()
+	for host, h := range hosts {
+		h.Circuit = circuitClosed
+		if c, ok := circuits[host]; ok {
+			h.Circuit, h.Failures = c.state, c.failures
+		}
+		h.PolitenessDelay, h.BackoffUntil = paceStats(host)
+		s.Hosts = append(s.Hosts, h)
+	}
+	sort.Slice(s.Hosts, func(i, j int) bool { return s.Hosts[i].Host < s.Hosts[j].Host })
+	return s
+}
+
+// StatsFor returns the server statistics the caller in ctx may see: only
+// the hosts of the jobs it may see, and the queue waits of the tenants it
+// may see.
+func StatsFor(ctx context.Context) Stats {
+	s := GetStats()
+	visible := hostFilter(ctx)
+	hosts := s.Hosts[:0]
+	for _, h := range s.Hosts {
+		if visible(h.Host) {
+			hosts = append(hosts, h)
+		}
+	}
+	s.Hosts = hosts
+	s.PausedHosts = filterStrings(s.PausedHosts, visible)
+	s.DrainedHosts = filterStrings(s.DrainedHosts, visible)
+	waits := s.QueueWaits[:0]
+	for _, w := range s.QueueWaits {
+		if CanViewTenant(ctx, w.Tenant) {
+			waits = append(waits, w)
+		}
+	}
+	s.QueueWaits = waits
+	return s
+}
+
+func filterStrings(values []string, keep func(string) bool) []string {
+	kept := values[:0:0]
+	for _, v := range values {
+		if keep(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// withConnTrace returns a context that records connection statistics for
+// requests to the URL's host.
+func withConnTrace(ctx context.Context, rawURL string) context.Context {
+	host := hostOf(rawURL)
+	update := func(f func(h *HostStats)) {
+		hostStatsMu.Lock()
+		defer hostStatsMu.Unlock()
+		h, ok := hostStats[host]
+		if !ok {
+			h = &HostStats{Host: host}
+			hostStats[host] = h
+		}
+		f(h)
+	}
+
+	// The hooks may run concurrently: Happy Eyeballs dials several
+	// addresses at once, so connect starts are kept per address.
+	var mu sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStarts := map[string]time.Time{}
+	since := func(start *time.Time) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*start)
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			d := since(&dnsStart)
+			update(func(h *HostStats) { h.DNSLookups++; h.DNSTime += d })
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStarts[network+" "+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			start, ok := connectStarts[network+" "+addr]
+			delete(connectStarts, network+" "+addr)
+			mu.Unlock()
+			if !ok {
+				return
+			}
+			d := time.Since(start)
+			update(func(h *HostStats) { h.Connects++; h.ConnectTime += d })
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			d := since(&tlsStart)
+			update(func(h *HostStats) { h.TLSHandshakes++; h.TLSHandshakeTime += d })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			update(func(h *HostStats) {
+				h.Requests++
+				if info.Reused {
+					h.ReusedConnections++
+				} else {
+					h.NewConnections++
+				}
+			})
+		},
+	})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func millis(total time.Duration, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count) / float64(time.Millisecond)
+}
+
+func statsType() *graphql.Object {
+	hostStatsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "HostStats",
+		Fields: graphql.Fields{
+			"host": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Target host name",
+			},
+			"requests": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of requests sent to the host",
+			},
+			"reusedConnections": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Requests that reused an idle pooled connection",
+			},
+			"newConnections": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Requests that had to open a new connection",
+			},
+			"avgDnsMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Average DNS lookup time in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					h := p.Source.(HostStats)
+					return millis(h.DNSTime, h.DNSLookups), nil
+				},
+			},
+			"avgConnectMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Average TCP connect time in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					h := p.Source.(HostStats)
+					return millis(h.ConnectTime, h.Connects), nil
+				},
+			},
+			"avgTlsHandshakeMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Average TLS handshake time in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					h := p.Source.(HostStats)
+					return millis(h.TLSHandshakeTime, h.TLSHandshakes), nil
+				},
+			},
+			"circuit": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Circuit breaker state: closed, open or half-open",
+			},
+			"failures": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Consecutive failed requests to the host",
+			},
+			"politenessDelayMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Current gap enforced between requests to the host, in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					h := p.Source.(HostStats)
+					return millis(h.PolitenessDelay, 1), nil
+				},
+			},
+			"backoffUntil": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When requests resume, if the host asked us to back off",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					h := p.Source.(HostStats)
+					if h.BackoffUntil.IsZero() {
+						return nil, nil
+					}
+					return h.BackoffUntil, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"queueDepth": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs waiting in the queue, and those of the worker pools",
+			},
+			"paused": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the whole queue is paused",
+			},
+			"pausedHosts": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Hosts whose jobs are held back",
+			},
+			"drainedHosts": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Hosts and wildcards that are drained",
+			},
+			"parkedJobs": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs held back for paused or drained hosts",
+			},
+			"delayedJobs": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs scheduled to run later",
+			},
+			"fetchRate": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Limit on requests per second across all workers, null if there is none",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if r := p.Source.(Stats).FetchRate; r > 0 {
+						return r, nil
+					}
+					return nil, nil
+				},
+			},
+			"hosts": &graphql.Field{
+				Type:        graphql.NewList(hostStatsType),
+				Description: "Connection statistics per target host",
+			},
+			"queueWaits": &graphql.Field{
+				Type:        graphql.NewList(queueWaitStatsType()),
+				Description: "How long jobs waited in the queue for a worker, per tenant",
+			},
+			"connections": &graphql.Field{
+				Type:        connectionStatsType(),
+				Description: "Outbound connections and file descriptors open",
+			},
+			"pools": &graphql.Field{
+				Type:        graphql.NewList(poolStatsType()),
+				Description: "Worker pools besides the default workers",
+			},
+			"shedding": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Why new jobs are refused with RETRY_LATER errors, null if they are not",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if r := p.Source.(Stats).Shedding; r != "" {
+						return r, nil
+					}
+					return nil, nil
+				},
+			},
+			"shedJobs": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Jobs refused while shedding load since the server started",
+			},
+		},
+	})
+}
+
+// CollectMetrics returns the server statistics as Prometheus metrics.
+func CollectMetrics() []metrics.Family {
+	s := GetStats()
+	queue := metrics.Family{
+		Name: "urlfetcher_queue_depth", Help: "Number of jobs waiting in the queue.", Type: metrics.Gauge,
+		Samples: []metrics.Sample{{Value: float64(s.QueueDepth)}},
+	}
+	conns := metrics.Family{
+		Name: "urlfetcher_connections_total", Help: "Connections used for requests, by whether they were reused.", Type: metrics.Counter,
+	}
+	dns := metrics.Family{
+		Name: "urlfetcher_dns_lookup_seconds", Help: "Time spent resolving target hosts.", Type: metrics.Summary,
+	}
+	connect := metrics.Family{
+		Name: "urlfetcher_connect_seconds", Help: "Time spent establishing TCP connections.", Type: metrics.Summary,
+	}
+	handshake := metrics.Family{
+		Name: "urlfetcher_tls_handshake_seconds", Help: "Time spent in TLS handshakes.", Type: metrics.Summary,
+	}
+	summary := func(f *metrics.Family, host string, total time.Duration, count int64) {
+		labels := map[string]string{"host": host}
+		f.Samples = append(f.Samples,
+			metrics.Sample{Suffix: "_sum", Labels: labels, Value: total.Seconds()},
+			metrics.Sample{Suffix: "_count", Labels: labels, Value: float64(count)})
+	}
+	circuit := metrics.Family{
+		Name: "urlfetcher_circuit_open", Help: "Whether the circuit breaker for a host is open.", Type: metrics.Gauge,
+	}
+	for _, h := range s.Hosts {
+		circuit.Samples = append(circuit.Samples,
+			metrics.Sample{Labels: map[string]string{"host": h.Host}, Value: boolValue(h.Circuit != circuitClosed)})
+		conns.Samples = append(conns.Samples,
+			metrics.Sample{Labels: map[string]string{"host": h.Host, "reused": "true"}, Value: float64(h.ReusedConnections)},
+			metrics.Sample{Labels: map[string]string{"host": h.Host, "reused": "false"}, Value: float64(h.NewConnections)})
+		summary(&dns, h.Host, h.DNSTime, h.DNSLookups)
+		summary(&connect, h.Host, h.ConnectTime, h.Connects)
+		summary(&handshake, h.Host, h.TLSHandshakeTime, h.TLSHandshakes)
+	}
+	paused := metrics.Family{
+		Name: "urlfetcher_queue_paused", Help: "Whether the whole queue is paused.", Type: metrics.Gauge,
+		Samples: []metrics.Sample{{Value: boolValue(s.Paused)}},
+	}
+	parked := metrics.Family{
+		Name: "urlfetcher_parked_jobs", Help: "Jobs held back for paused or drained hosts.", Type: metrics.Gauge,
+		Samples: []metrics.Sample{{Value: float64(s.ParkedJobs)}},
+	}
+	shedding := metrics.Family{
+		Name: "urlfetcher_load_shedding", Help: "Whether new jobs are refused to shed load.", Type: metrics.Gauge,
+		Samples: []metrics.Sample{{Value: boolValue(s.Shedding != "")}},
+	}
+	shed := metrics.Family{
+		Name: "urlfetcher_shed_jobs_total", Help: "Jobs refused to shed load.", Type: metrics.Counter,
+		Samples: []metrics.Sample{{Value: float64(s.ShedJobs)}},
+	}
+	families := []metrics.Family{queue, paused, parked, shedding, shed, circuit, conns, dns, connect, handshake, queueWaitMetrics()}
+	families = append(families, poolMetrics(s.Pools)...)
+	return append(families, connectionMetrics(s.Connections)...)
+}
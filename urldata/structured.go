@@ -0,0 +1,312 @@
+package urldata
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Most structured data items kept of a response.
+const maxStructuredItems = 100
+
+// StructuredItem is an item of schema.org structured data embedded in an
+// HTML page, such as a product, an article or an event.
+type StructuredItem struct {
+	Format string `json:"format"` // "json-ld" or "microdata"
+	// Type is the schema.org type of the item, such as "Product", without
+	// the schema.org prefix; empty if the item has none.
+	Type string `json:"type"`
+	// Data holds the properties of the item as decoded from JSON. Microdata
+	// items are converted to the same shape: a property with a single value
+	// holds it, one with several a list, and nested items are maps.
+	Data map[string]interface{} `json:"data"`
+}
+
+// Prefixes stripped from the types of items.
+var schemaPrefixes = []string{"https://schema.org/", "http://schema.org/"}
+
+// extractStructuredData returns the JSON-LD and microdata items of an HTML
+// body, whose URLs are relative to base.
+func extractStructuredData(base string, header http.Header, body []byte) []StructuredItem {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+	doc, err := html.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		return nil
+	}
+	var items []StructuredItem
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if len(items) >= maxStructuredItems || n.Type != html.ElementNode && n.Type != html.DocumentNode {
+			return
+		}
+		if n.DataAtom == atom.Script && strings.EqualFold(strings.TrimSpace(attr(n, "type")), "application/ld+json") {
+			items = append(items, jsonLDItems(textContent(n))...)
+			return
+		}
+		if hasAttribute(n, "itemscope") && !hasAttribute(n, "itemprop") {
+			data := microdataItem(n, baseURL)
+			items = append(items, StructuredItem{Format: "microdata", Type: itemType(data["@type"]), Data: data})
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if len(items) > maxStructuredItems {
+		items = items[:maxStructuredItems]
+	}
+	return items
+}
+
+// jsonLDItems returns the items of a JSON-LD script: the object it holds,
+// each object of a list, or each object of an @graph.
+func jsonLDItems(text string) []StructuredItem {
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return nil
+	}
+	var objects []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		objects = v
+	case map[string]interface{}:
+		if graph, ok := v["@graph"].([]interface{}); ok {
+			objects = graph
+		} else {
+			objects = []interface{}{v}
+		}
+	}
+	var items []StructuredItem
+	for _, o := range objects {
+		if data, ok := o.(map[string]interface{}); ok {
+			items = append(items, StructuredItem{Format: "json-ld", Type: itemType(data["@type"]), Data: data})
+		}
+	}
+	return items
+}
+
+// itemType returns the first of the types of an item, without the
+// schema.org prefix.
+func itemType(v interface{}) string {
+	t := ""
+	switch v := v.(type) {
+	case string:
+		t = v
+	case []interface{}:
+		if len(v) > 0 {
+			t, _ = v[0].(string)
+		}
+	}
+	if fields := strings.Fields(t); len(fields) > 0 {
+		t = fields[0]
+	}
+	for _, prefix := range schemaPrefixes {
+		t = strings.TrimPrefix(t, prefix)
+	}
+	return t
+}
+
+// microdataItem returns the properties of the microdata item n is the
+// scope of, with its itemtype as @type.
+func microdataItem(n *html.Node, base *url.URL) map[string]interface{} {
+	data := map[string]interface{}{}
+	if t := attr(n, "itemtype"); t != "" {
+		data["@type"] = t
+	}
+	values := map[string][]interface{}{}
+	var names []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			props := strings.Fields(attr(c, "itemprop"))
+			if len(props) == 0 {
+				// A nested item without itemprop is an item of its own.
+				if !hasAttribute(c, "itemscope") {
+					walk(c)
+				}
+				continue
+			}
+			var value interface{}
+			if hasAttribute(c, "itemscope") {
+				value = microdataItem(c, base)
+			} else {
+				value = microdataValue(c, base)
+				walk(c)
+			}
+			for _, name := range props {
+				if _, ok := values[name]; !ok {
+					names = append(names, name)
+				}
+				values[name] = append(values[name], value)
+			}
+		}
+	}
+	walk(n)
+	for _, name := range names {
+		if len(values[name]) == 1 {
+			data[name] = values[name][0]
+		} else {
+			data[name] = values[name]
+		}
+	}
+	return data
+}
+
+// microdataValue returns the value of a microdata property element that is
+// not an item itself.
+func microdataValue(n *html.Node, base *url.URL) string {
+	urlValue := func(name string) string {
+		if u, err := base.Parse(strings.TrimSpace(attr(n, name))); err == nil {
+			return u.String()
+		}
+		return ""
+	}
+	switch n.DataAtom {
+	case atom.Meta:
+		return attr(n, "content")
+	case atom.Audio, atom.Embed, atom.Iframe, atom.Img, atom.Source, atom.Track, atom.Video:
+		return urlValue("src")
+	case atom.A, atom.Area, atom.Link:
+		return urlValue("href")
+	case atom.Object:
+		return urlValue("data")
+	case atom.Data, atom.Meter:
+		return attr(n, "value")
+	case atom.Time:
+		if hasAttribute(n, "datetime") {
+			return attr(n, "datetime")
+		}
+	}
+	return strings.Join(strings.Fields(textContent(n)), " ")
+}
+
+// attr returns the value of an attribute of n, or "".
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hasAttribute reports whether n has an attribute, with or without a value.
+func hasAttribute(n *html.Node, name string) bool {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// textContent returns the text inside n.
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// selectStructuredData returns the items of the given type, or all of them
+// if typ is empty.
+func selectStructuredData(items []StructuredItem, typ string) []StructuredItem {
+	if typ == "" {
+		return items
+	}
+	selected := []StructuredItem{}
+	for _, item := range items {
+		if item.Type == typ {
+			selected = append(selected, item)
+		}
+	}
+	return selected
+}
+
+func structuredItemType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name:        "StructuredItem",
+		Description: "An item of schema.org structured data embedded in an HTML page",
+		Fields: graphql.Fields{
+			"format": &graphql.Field{
+				Type:        graphql.String,
+				Description: "json-ld or microdata",
+			},
+			"type": &graphql.Field{
+				Type:        graphql.String,
+				Description: "schema.org type of the item, such as Product, without the schema.org prefix",
+			},
+			"data": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The properties of the item as a JSON object, microdata converted to the shape of JSON-LD",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					b, err := json.Marshal(p.Source.(StructuredItem).Data)
+					if err != nil {
+						return nil, err
+					}
+					return string(b), nil
+				},
+			},
+			"property": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "The values of a property of the item; nested items and other non-string values are given as JSON",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					v, ok := p.Source.(StructuredItem).Data[p.Args["name"].(string)]
+					if !ok {
+						return nil, nil
+					}
+					list, ok := v.([]interface{})
+					if !ok {
+						list = []interface{}{v}
+					}
+					values := []string{}
+					for _, v := range list {
+						if s, ok := v.(string); ok {
+							values = append(values, s)
+							continue
+						}
+						b, err := json.Marshal(v)
+						if err != nil {
+							return nil, err
+						}
+						values = append(values, string(b))
+					}
+					return values, nil
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,172 @@
+package urldata
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TargetPolicy limits the URLs jobs may fetch to some schemes and ports,
+// and the addresses they may connect to to public ones, so that they cannot
+// be used to probe other services, such as SSH on port 22 or a cloud
+// metadata endpoint, or to speak other protocols, such as gopher.
+type TargetPolicy struct {
+	Schemes []string
+	Ports   []int // 0 allows any port
+	// Networks that may be connected to although they are not public, such
+	// as 10.0.0.0/8. Loopback, private, link-local, multicast and
+	// unspecified addresses are not.
+	Networks []*net.IPNet
+}
+
+var defaultTargetPolicy = TargetPolicy{Schemes: []string{"http", "https"}, Ports: []int{80, 443}}
+
+// Ports used by URLs of the schemes that have one, when they give none.
+var schemePorts = map[string]int{"http": 80, "https": 443, "ws": 80, "wss": 443, "ftp": 21, "gopher": 70}
+
+// ErrTargetPolicy is wrapped by the errors for URLs the target policy
+// refuses.
+var ErrTargetPolicy = errors.New("refused by the target policy")
+
+// Guards targetPolicy and tenantTargets.
+var targetsMu sync.RWMutex
+var targetPolicy = defaultTargetPolicy
+var tenantTargets = map[string]TargetPolicy{}
+
+// SetTargetPolicy sets the schemes, ports and networks jobs may fetch
+// from, and those of the jobs of trusted tenants. Empty fields of policy
+// keep the defaults, http and https on ports 80 and 443 of public
+// addresses, and those of a tenant's policy policy's.
+func SetTargetPolicy(policy TargetPolicy, tenants map[string]TargetPolicy) {
+	policy = policy.orDefaults(defaultTargetPolicy)
+	byTenant := map[string]TargetPolicy{}
+	for tenant, p := range tenants {
+		byTenant[tenant] = p.orDefaults(policy)
+	}
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	targetPolicy = policy
+	tenantTargets = byTenant
+}
+
+func (p TargetPolicy) orDefaults(defaults TargetPolicy) TargetPolicy {
+	if len(p.Schemes) == 0 {
+		p.Schemes = defaults.Schemes
+	}
+	if len(p.Ports) == 0 {
+		p.Ports = defaults.Ports
+	}
+	if len(p.Networks) == 0 {
+		p.Networks = defaults.Networks
+	}
+	return p
+}
+
+// targetPolicyFor returns the target policy of the jobs of tenant.
+func targetPolicyFor(tenant string) TargetPolicy {
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+	if p, ok := tenantTargets[tenant]; ok {
+		return p
+	}
+	return targetPolicy
+}
+
+// hasOwnTargetPolicy reports whether tenant is a trusted tenant with its
+// own target policy.
+func hasOwnTargetPolicy(tenant string) bool {
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+	_, ok := tenantTargets[tenant]
+	return ok
+}
+
+// checkTarget returns an error if the target policy of tenant does not
+// allow fetching rawURL.
+func checkTarget(rawURL, tenant string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	policy := targetPolicyFor(tenant)
+	scheme := strings.ToLower(u.Scheme)
+	if !policy.allowsScheme(scheme) {
+		return fmt.Errorf("scheme %q %w", scheme, ErrTargetPolicy)
+	}
+	port, known := schemePorts[scheme]
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		known = true
+	}
+	if known && !policy.allowsPort(port) {
+		return fmt.Errorf("port %d %w", port, ErrTargetPolicy)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !policy.allowsAddress(ip) {
+		return fmt.Errorf("address %s %w", ip, ErrTargetPolicy)
+	}
+	return nil
+}
+
+// CheckJobTarget returns an error if the target policy of the job's tenant
+// does not allow fetching url, or connecting to the job's ConnectAddress.
+func CheckJobTarget(url string, opts JobOptions) error {
+	if err := checkTarget(url, opts.Tenant); err != nil {
+		return err
+	}
+	if opts.ConnectAddress == "" {
+		return nil
+	}
+	policy := targetPolicyFor(opts.Tenant)
+	host := opts.ConnectAddress
+	if h, p, err := net.SplitHostPort(opts.ConnectAddress); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid connect address port %q", p)
+		}
+		if !policy.allowsPort(port) {
+			return fmt.Errorf("port %d %w", port, ErrTargetPolicy)
+		}
+		host = h
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil && !policy.allowsAddress(ip) {
+		return fmt.Errorf("address %s %w", ip, ErrTargetPolicy)
+	}
+	return nil
+}
+
+func (p TargetPolicy) allowsScheme(scheme string) bool {
+	for _, s := range p.Schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddress reports whether ip is public, or in one of the networks
+// the policy allows.
+func (p TargetPolicy) allowsAddress(ip net.IP) bool {
+	for _, n := range p.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func (p TargetPolicy) allowsPort(port int) bool {
+	for _, allowed := range p.Ports {
+		if allowed == 0 || allowed == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package urldata
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+// Largest image, in pixels, thumbnails are made of, so that a small
+// compressed body cannot take up gigabytes once decoded.
+const maxThumbnailSource = 40 << 20
+
+// Samples taken across each side of the area of the source that makes up a
+// pixel of the thumbnail.
+const thumbnailSamples = 4
+
+var thumbnailsMu sync.Mutex
+var thumbnailSize int
+
+// SetThumbnailSize enables making thumbnails of PNG, JPEG and GIF responses
+// that fit in a square of size pixels, or disables it if size is 0. The
+// thumbnails are kept in the blob store.
+func SetThumbnailSize(size int) {
+	thumbnailsMu.Lock()
+	defer thumbnailsMu.Unlock()
+	thumbnailSize = size
+}
+
+// makeThumbnail stores a thumbnail of an image response in the blob store
+// and returns its key, or "" if thumbnails are disabled or the response is
+// no image that can be decoded.
+func makeThumbnail(r *Response) string {
+	thumbnailsMu.Lock()
+	size := thumbnailSize
+	thumbnailsMu.Unlock()
+	if size <= 0 || r.StatusCode < 200 || r.StatusCode > 299 {
+		return ""
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(r.Body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/png", "image/jpeg", "image/gif":
+	default:
+		return ""
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(r.Body))
+	if err != nil || config.Width*config.Height > maxThumbnailSource {
+		return ""
+	}
+	src, _, err := image.Decode(bytes.NewReader(r.Body))
+	if err != nil {
+		return ""
+	}
+	thumb := scaleImage(src, size)
+	var buf bytes.Buffer
+	ext := "jpg"
+	if o, ok := src.(interface{ Opaque() bool }); ok && o.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		ext = "png"
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return ""
+	}
+	// Keyed by the body, so that the same image fetched from several URLs
+	// has a single thumbnail.
+	key := fmt.Sprintf("thumbnails/%s-%d.%s", r.Checksums.SHA256, size, ext)
+	if err := blobStore().Put(key, buf.Bytes()); err != nil {
+		fmt.Println("failed to store thumbnail of", RedactURL(r.URL), err)
+		return ""
+	}
+	return key
+}
+
+// scaleImage returns src scaled down to fit in a square of size pixels,
+// keeping its aspect ratio. Each pixel is the average of samples across the
+// area of src it stands for. Images that already fit are only copied.
+func scaleImage(src image.Image, size int) *image.NRGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for _, sy := range samples(y0, y1) {
+				for _, sx := range samples(x0, x1) {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// samples returns up to thumbnailSamples coordinates spread across
+// [from, to), or from itself if the range is empty.
+func samples(from, to int) []int {
+	if to <= from {
+		return []int{from}
+	}
+	n := to - from
+	if n > thumbnailSamples {
+		n = thumbnailSamples
+	}
+	s := make([]int, n)
+	for i := range s {
+		s[i] = from + (2*i+1)*(to-from)/(2*n)
+	}
+	return s
+}
+
+// ThumbnailURL returns the link to the thumbnail of a response, relative to
+// the server unless its public URL is known, or "" if it has none.
+func ThumbnailURL(r *Response) string {
+	if r.Thumbnail == "" {
+		return ""
+	}
+	path := "/api/" + r.Thumbnail
+	if link := apiLink(path); link != "" {
+		return link
+	}
+	return path
+}
@@ -0,0 +1,304 @@
+package urldata
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/credentials"
+)
+
+// Credential store that job options and host rules refer to.
+var creds = credentials.NewStore()
+
+// Client certificate selection. Values are credential names.
+var defaultClientCert string
+var hostClientCerts = map[string]string{}
+
+// PoolConfig configures the outbound connection pool. Zero values keep the
+// net/http defaults.
+type PoolConfig struct {
+	MaxIdleConns        int           // Idle connections kept across all hosts
+	MaxIdleConnsPerHost int           // Idle connections kept per host
+	MaxConnsPerHost     int           // Limit on connections per host, 0 for none
+	IdleConnTimeout     time.Duration // How long idle connections are kept
+	// FallbackDelay is how long a Happy Eyeballs dial waits for the
+	// preferred address family before racing the other one.
+	FallbackDelay time.Duration
+}
+
+var pool PoolConfig
+
+// SetConnectionPool configures the outbound connection pool.
+func SetConnectionPool(c PoolConfig) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	pool = c
+	clients = map[clientKey]*http.Client{}
+}
+
+// clientKey identifies the transport settings an HTTP client was built with.
+type clientKey struct {
+	clientCert     string
+	serverName     string
+	connectAddress string
+	tunnel         string
+	egress         string
+}
+
+// HTTP clients keyed by their transport settings.
+var clientsMu sync.Mutex
+var clients = map[clientKey]*http.Client{}
+
+// SetCredentials sets the credential store used to resolve credential names.
+func SetCredentials(store *credentials.Store) {
+	creds = store
+	clientsMu.Lock()
+	clients = map[clientKey]*http.Client{}
+	clientsMu.Unlock()
+}
+
+// SetClientCertificates configures which client certificate is presented to
+// servers that request one. defaultCert applies to every host, and hosts
+// maps host names (or "*.domain" wildcards) to certificates for specific
+// hosts. A certificate named in the job options takes precedence over both.
+func SetClientCertificates(defaultCert string, hosts map[string]string) {
+	defaultClientCert = defaultCert
+	hostClientCerts = hosts
+}
+
+// clientCertFor returns the name of the client certificate for the job.
+func clientCertFor(job *Job) string {
+	if job.Options.ClientCert != "" {
+		return job.Options.ClientCert
+	}
+	if u, err := url.Parse(job.URL); err == nil {
+		if name, ok := lookupHost(hostClientCerts, u.Hostname()); ok {
+			return name
+		}
+	}
+	return defaultClientCert
+}
+
+// hostOf returns the lower cased host name of a URL, or "" if it cannot be parsed.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// lookupHost finds the entry for host in a map keyed by host names or
+// "*.domain" wildcards, preferring an exact match and then the longest,
+// most specific, wildcard.
+func lookupHost(m map[string]string, host string) (string, bool) {
+	host = strings.ToLower(host)
+	if v, ok := m[host]; ok {
+		return v, true
+	}
+	best, found := "", false
+	for pattern := range m {
+		if MatchesHost(pattern, host) && (!found || len(pattern) > len(best)) {
+			best, found = pattern, true
+		}
+	}
+	return m[best], found
+}
+
+// MatchesHost reports whether host matches a host name or "*.domain" wildcard.
+func MatchesHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// Fetcher sends the HTTP requests for jobs. *http.Client implements it.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetcher that replaces the configured HTTP clients, if set. Guarded by
+// fetcherMu, since tests swap it while workers run.
+var fetcherMu sync.RWMutex
+var fetcher Fetcher
+
+// SetFetcher makes all jobs send their requests through f instead of the
+// HTTP clients built from the server's transport settings. Tests use it to
+// avoid real network calls. Passing nil restores the default behaviour.
+func SetFetcher(f Fetcher) {
+	fetcherMu.Lock()
+	defer fetcherMu.Unlock()
+	fetcher = f
+}
+
+// fetcherFor returns the fetcher that sends the job's request.
+func fetcherFor(job *Job) (Fetcher, error) {
+	fetcherMu.RLock()
+	f := fetcher
+	fetcherMu.RUnlock()
+	if f != nil {
+		return f, nil
+	}
+	return clientFor(job)
+}
+
+// clientFor returns the HTTP client used to fetch the job's URL.
+func clientFor(job *Job) (*http.Client, error) {
+	key := clientKey{
+		clientCert:     clientCertFor(job),
+		serverName:     job.Options.ServerName,
+		connectAddress: job.Options.ConnectAddress,
+		tunnel:         tunnelFor(job),
+		egress:         egressFor(job),
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if client, ok := clients[key]; ok {
+		return client, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if pool.MaxIdleConns != 0 {
+		transport.MaxIdleConns = pool.MaxIdleConns
+	}
+	if pool.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	}
+	if pool.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = pool.IdleConnTimeout
+	}
+	transport.MaxConnsPerHost = pool.MaxConnsPerHost
+	transport.MaxResponseHeaderBytes = maxHeaderBytes
+	transport.TLSClientConfig = &tls.Config{ServerName: key.serverName}
+	if key.clientCert != "" {
+		cert, err := creds.Certificate(key.clientCert)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: pool.FallbackDelay,
+		Resolver:      dnsResolver(),
+	}
+	// Connect to the addresses the target policy allows, the same ones for
+	// the whole fetch. Through tunnels and proxies, hosts are resolved by
+	// the far side.
+	dial := pinnedDial(dialer.DialContext, dialer.Resolver)
+	if key.tunnel != "" {
+		t, ok := tunnels[key.tunnel]
+		if !ok {
+			return nil, fmt.Errorf("unknown tunnel %q", key.tunnel)
+		}
+		dial = t.DialContext
+		// Proxies are not reachable from the far side of the tunnel.
+		transport.Proxy = nil
+	}
+	if key.egress != "" {
+		if key.connectAddress != "" {
+			return nil, fmt.Errorf("egress %q cannot be combined with connectAddress", key.egress)
+		}
+		proxy, err := egressProxy(key.egress)
+		if err != nil {
+			return nil, err
+		}
+		// Through a tunnel, the proxy is dialed from its far side.
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if transport.Proxy != nil {
+		transport.Proxy = recordProxies(transport.Proxy)
+	}
+	transport.DialContext = countedDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if key.connectAddress != "" {
+			addr = connectAddr(key.connectAddress, addr)
+		}
+		return dial(ctx, network, addr)
+	})
+	client := &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+	clients[key] = client
+	return client, nil
+}
+
+var errTooManyRedirects = errors.New("stopped after 10 redirects")
+
+// checkRedirect records redirects on the job's timeline and applies the
+// same limit as the net/http default policy.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	tenant := ""
+	if job := jobFromContext(req.Context()); job != nil {
+		recordEvent(job, "redirect", "redirected to %s", RedactURL(req.URL.String()))
+		tenant = job.Tenant
+	}
+	if rec := recorderFromContext(req.Context()); rec != nil {
+		rec.redirected(req.Response, req.URL.String())
+	}
+	if len(via) >= 10 {
+		return errTooManyRedirects
+	}
+	if err := checkTarget(req.URL.String(), tenant); err != nil {
+		return err
+	}
+	return waitForFetchRate(req.Context())
+}
+
+// connectAddr returns the address to dial instead of addr. override is an
+// IP or host, optionally with a port; the port of addr is kept if it has none.
+func connectAddr(override, addr string) string {
+	if _, _, err := net.SplitHostPort(override); err == nil {
+		return override
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return override
+	}
+	return net.JoinHostPort(strings.Trim(override, "[]"), port)
+}
+
+// bypassesCache reports whether the job neither sees nor replaces cached
+// responses: it is pinned to another origin, fetches with a client
+// certificate or through a tunnel, or belongs to a tenant with its own
+// target policy, whose responses must not be served to callers who could
+// not have fetched them, and which must not be served what its policy
+// refuses.
+func bypassesCache(job *Job) bool {
+	return job.Options.pinsOrigin() || clientCertFor(job) != "" || tunnelFor(job) != "" ||
+		hasOwnTargetPolicy(job.Tenant)
+}
+
+// pinsOrigin reports whether the options route the request to an origin
+// other than the one the URL would normally reach, or reach it from another
+// vantage point.
+func (o JobOptions) pinsOrigin() bool {
+	return o.HostHeader != "" || o.ServerName != "" || o.ConnectAddress != "" || o.Egress != ""
+}
+
+// newRequest builds the GET request for the job, applying its header overrides,
+// the URL rewrite rules and the headers of its host profile.
+func newRequest(ctx context.Context, job *Job) (*http.Request, error) {
+	target, err := rewriteURL(job.URL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyProfileHeaders(req, hostOf(job.URL)); err != nil {
+		return nil, err
+	}
+	if job.Options.HostHeader != "" {
+		req.Host = job.Options.HostHeader
+	}
+	return req, nil
+}
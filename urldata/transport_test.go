@@ -0,0 +1,35 @@
+package urldata
+
+import "testing"
+
+func TestLookupHost(t *testing.T) {
+	m := map[string]string{
+		"*.example.com":   "wide",
+		"*.b.example.com": "narrow",
+		"a.example.com":   "exact",
+	}
+	tests := []struct {
+		host  string
+		want  string
+		found bool
+	}{
+		{"a.example.com", "exact", true},
+		{"A.Example.com", "exact", true},
+		{"a.b.example.com", "narrow", true},
+		{"x.y.b.example.com", "narrow", true},
+		{"c.example.com", "wide", true},
+		{"b.example.com", "wide", true},
+		{"example.com", "", false},
+		{"example.org", "", false},
+	}
+	for _, tt := range tests {
+		// Map iteration order changes between runs, so look each host up
+		// a few times.
+		for i := 0; i < 20; i++ {
+			got, found := lookupHost(m, tt.host)
+			if got != tt.want || found != tt.found {
+				t.Fatalf("lookupHost(%q) = %q, %t; want %q, %t", tt.host, got, found, tt.want, tt.found)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package urldata
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultTrashRetention is how long deleted jobs can be restored unless
+// configured otherwise.
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// How often deleted jobs past their retention are purged.
+const trashPurgeInterval = time.Minute
+
+// Guards trash and trashRetention. Deleted jobs are kept out of jobs, so
+// that nothing else sees them until they are restored.
+var trashMu sync.Mutex
+var trash = map[int64]*Job{}
+var trashRetention = defaultTrashRetention
+var trashPurging sync.Once
+
+// SetTrashRetention sets how long deleted jobs can be restored before they
+// are purged for good, and starts purging them. 0 keeps the default of
+// seven days.
+func SetTrashRetention(d time.Duration) {
+	if d == 0 {
+		d = defaultTrashRetention
+	}
+	trashMu.Lock()
+	trashRetention = d
+	trashMu.Unlock()
+	trashPurging.Do(func() {
+		go func() {
+			for {
+				<-clock.After(trashPurgeInterval)
+				PurgeTrash()
+			}
+		}()
+	})
+}
+
+// DeleteJobs moves jobs to the trash, from where RestoreJob can bring them
+// back until the trash retention has passed. Unfinished jobs are not run
+// while deleted. It returns the jobs that were deleted; unknown IDs are
+// ignored.
+func DeleteJobs(ids []int64) []*Job {
+	now := clock.Now()
+	var deleted []*Job
+	jobsMu.Lock()
+	trashMu.Lock()
+	for _, id := range ids {
+		job, ok := jobs[id]
+		if !ok {
+			continue
+		}
+		delete(jobs, id)
+		job.DeletedAt = now
+		trash[id] = job
+		deleted = append(deleted, job)
+	}
+	trashMu.Unlock()
+	jobsMu.Unlock()
+	for _, job := range deleted {
+		touch(job)
+	}
+	return deleted
+}
+
+// RestoreJob takes a job out of the trash and queues it again if it had
+// not finished. The job must still be at the given version. It returns nil
+// if the job is not in the trash.
+func RestoreJob(id int64, version int64) (*Job, error) {
+	PurgeTrash()
+	jobsMu.Lock()
+	trashMu.Lock()
+	job, ok := trash[id]
+	var err error
+	if ok {
+		err = claimVersion(job, version)
+	}
+	if ok && err == nil {
+		delete(trash, id)
+		job.DeletedAt = time.Time{}
+		jobs[id] = job
+	}
+	trashMu.Unlock()
+	jobsMu.Unlock()
+	if !ok || err != nil {
+		return nil, err
+	}
+	runningMu.Lock()
+	busy := running[id]
+	runningMu.Unlock()
+	if Finished(jobStatus(job)) || busy {
+		persist(job)
+		return job, nil
+	}
+	// Whatever was going to run the job skipped it while it was deleted.
+	setStatus(job, "waiting")
+	recordEvent(job, "queued", "queued again after being restored from the trash")
+	go enqueue(id)
+	return job, nil
+}
+
+// GetDeletedJob returns the job with the given ID if it is in the trash,
+// or nil.
+func GetDeletedJob(id int64) *Job {
+	PurgeTrash()
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	return trash[id]
+}
+
+// GetTrash returns the deleted jobs that can still be restored, most
+// recently deleted first.
+func GetTrash() []*Job {
+	PurgeTrash()
+	trashMu.Lock()
+	deleted := []*Job{}
+	for _, job := range trash {
+		deleted = append(deleted, job)
+	}
+	trashMu.Unlock()
+	sort.Slice(deleted, func(i, j int) bool {
+		if !deleted[i].DeletedAt.Equal(deleted[j].DeletedAt) {
+			return deleted[i].DeletedAt.After(deleted[j].DeletedAt)
+		}
+		return deleted[i].ID < deleted[j].ID
+	})
+	return deleted
+}
+
+// PurgeTrash drops the deleted jobs whose retention has passed.
+func PurgeTrash() {
+	trashMu.Lock()
+	cutoff := clock.Now().Add(-trashRetention)
+	var purged []int64
+	for id, job := range trash {
+		if !job.DeletedAt.After(cutoff) {
+			delete(trash, id)
+			purged = append(purged, id)
+		}
+	}
+	trashMu.Unlock()
+	for _, id := range purged {
+		persistPurged(id)
+	}
+	if len(purged) > 0 {
+		fmt.Println("purged", len(purged), "deleted jobs")
+	}
+}
+
+// persistPurged records in the journal that a deleted job was purged.
+func persistPurged(id int64) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	delete(journaledMarks, id)
+	if journal == nil {
+		return
+	}
+	line, _ := json.Marshal(journalEntry{Purged: id})
+	if _, err := journal.Write(append(line, '\n')); err != nil {
+		fmt.Println("failed to write journal:", err)
+	}
+}
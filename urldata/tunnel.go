@@ -0,0 +1,122 @@
+package urldata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Tunnel describes an SSH jump host that requests can be routed through.
+type Tunnel struct {
+	Name           string
+	Address        string   // host:port of the SSH server
+	Credential     string   // Credential holding the username and private key
+	KnownHostsFile string   // known_hosts file used to verify the server's host key
+	Hosts          []string // Hosts (or "*.domain" wildcards) always fetched through this tunnel
+	Tenants        []string // Tenants whose callers may name the tunnel for a job; only admins may if empty
+}
+
+// sshTunnel is a configured tunnel and its lazily established connection.
+type sshTunnel struct {
+	Tunnel
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+var tunnels = map[string]*sshTunnel{}
+var hostTunnels = map[string]string{}
+
+// SetTunnels configures the SSH tunnels available to jobs. A job uses a
+// tunnel if it names one in its options, or if its host matches one of the
+// tunnel's Hosts.
+func SetTunnels(configured []Tunnel) {
+	tunnels = map[string]*sshTunnel{}
+	hostTunnels = map[string]string{}
+	for _, t := range configured {
+		tunnels[t.Name] = &sshTunnel{Tunnel: t}
+		for _, host := range t.Hosts {
+			hostTunnels[host] = t.Name
+		}
+	}
+}
+
+// tunnelFor returns the name of the tunnel the job is fetched through, or
+// "" for a direct connection.
+func tunnelFor(job *Job) string {
+	if job.Options.Tunnel != "" {
+		return job.Options.Tunnel
+	}
+	if u, err := url.Parse(job.URL); err == nil {
+		if name, ok := lookupHost(hostTunnels, u.Hostname()); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// DialContext connects to addr from the far side of the tunnel.
+func (t *sshTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		// The SSH connection may have dropped; reconnect on the next dial.
+		t.mu.Lock()
+		if t.client == client {
+			t.client.Close()
+			t.client = nil
+		}
+		t.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (t *sshTunnel) connect() (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	cred, ok := creds.Get(t.Credential)
+	if !ok {
+		return nil, fmt.Errorf("tunnel %s: unknown credential %q", t.Name, t.Credential)
+	}
+	if cred.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("tunnel %s: credential %q has no private key", t.Name, t.Credential)
+	}
+	pem, err := os.ReadFile(cred.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, err
+	}
+	if t.KnownHostsFile == "" {
+		return nil, errors.New("tunnel " + t.Name + ": knownHostsFile is required to verify the server")
+	}
+	hostKeyCallback, err := knownhosts.New(t.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", t.Address, &ssh.ClientConfig{
+		User:            cred.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tunnel %s: %v", t.Name, err)
+	}
+	t.client = client
+	return client, nil
+}
@@ -0,0 +1,305 @@
+package urldata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsoo/urlfetcher/notify"
+	"github.com/graphql-go/graphql"
+)
+
+// uptimeRetention is how long uptime checks and incidents are kept, and so
+// the longest window availability can be computed over.
+const uptimeRetention = 90 * 24 * time.Hour
+
+// UptimeCheck is the outcome of one check by an uptime monitor.
+type UptimeCheck struct {
+	Time       time.Time
+	JobID      int64
+	Up         bool
+	StatusCode int           // 0 if there was no response
+	Latency    time.Duration // From sending the request until the job finished
+}
+
+// Incident is a period during which a URL was down, from the first failed
+// check until the next successful one.
+type Incident struct {
+	URL     string
+	Started time.Time
+	Ended   time.Time // Zero while the incident is ongoing
+	Cause   string    // Error of the check that started the incident
+	Checks  int       // Failed checks during the incident
+}
+
+// Uptime summarizes the checks of a URL within a window.
+type Uptime struct {
+	URL       string
+	Window    time.Duration
+	Checks    []UptimeCheck
+	Incidents []Incident // Incidents that overlap the window
+}
+
+var uptimeMu sync.Mutex
+var uptimeChecks = map[string][]UptimeCheck{} // Keyed by URL, oldest first
+var incidents = map[string][]*Incident{}      // Keyed by URL, oldest first
+
+// recordUptimeCheck records whether an uptime monitor's job found its URL
+// up, opening or closing an incident when that changes, and tells notifier.
+func recordUptimeCheck(job *Job, notifier string) {
+	now := clock.Now()
+	check := UptimeCheck{Time: now, JobID: job.ID, Up: job.Status == "done", Latency: requestLatency(job)}
+	if job.Response != nil {
+		check.StatusCode = job.Response.StatusCode
+	}
+
+	uptimeMu.Lock()
+	checks := append(uptimeChecks[job.URL], check)
+	keep := 0
+	for keep < len(checks) && now.Sub(checks[keep].Time) > uptimeRetention {
+		keep++
+	}
+	uptimeChecks[job.URL] = checks[keep:]
+	list := incidents[job.URL]
+	keep = 0
+	for keep < len(list) && !list[keep].Ended.IsZero() && now.Sub(list[keep].Ended) > uptimeRetention {
+		keep++
+	}
+	list = list[keep:]
+	var open *Incident
+	if len(list) > 0 && list[len(list)-1].Ended.IsZero() {
+		open = list[len(list)-1]
+	}
+	var started, ended *Incident
+	switch {
+	case !check.Up && open == nil:
+		cause := job.Status
+		if job.Error != nil {
+			cause = job.Error.Error()
+		}
+		open = &Incident{URL: job.URL, Started: now, Cause: cause, Checks: 1}
+		list = append(list, open)
+		snapshot := *open
+		started = &snapshot
+	case !check.Up:
+		open.Checks++
+	case open != nil:
+		open.Ended = now
+		snapshot := *open
+		ended = &snapshot
+	}
+	incidents[job.URL] = list
+	uptimeMu.Unlock()
+
+	if notifier == "" {
+		return
+	}
+	if started != nil {
+		notifyAll([]string{notifier}, notify.Message{
+			Title:  fmt.Sprintf("%s is down", job.URL),
+			Text:   started.Cause,
+			Fields: map[string]string{"job": strconv.FormatInt(job.ID, 10)},
+			Link:   resultLink(fmt.Sprintf(`{ uptime(url: %q) { availability incidents { started cause } } }`, job.URL)),
+		})
+	}
+	if ended != nil {
+		notifyAll([]string{notifier}, notify.Message{
+			Title: fmt.Sprintf("%s is back up", job.URL),
+			Text: fmt.Sprintf("It was down for %v, failing %d checks.",
+				ended.Ended.Sub(ended.Started).Round(time.Second), ended.Checks),
+			Fields: map[string]string{"cause": ended.Cause},
+		})
+	}
+}
+
+// requestLatency returns how long ago the job last sent its request, or 0
+// if it never did.
+func requestLatency(job *Job) time.Duration {
+	events := jobEvents(job)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == "request" {
+			return clock.Now().Sub(events[i].Time)
+		}
+	}
+	return 0
+}
+
+// GetUptime returns the checks of url and its incidents within the window
+// up to now.
+func GetUptime(url string, window time.Duration) *Uptime {
+	since := clock.Now().Add(-window)
+	u := &Uptime{URL: url, Window: window}
+	uptimeMu.Lock()
+	defer uptimeMu.Unlock()
+	for _, c := range uptimeChecks[url] {
+		if !c.Time.Before(since) {
+			u.Checks = append(u.Checks, c)
+		}
+	}
+	for _, i := range incidents[url] {
+		if i.Ended.IsZero() || !i.Ended.Before(since) {
+			u.Incidents = append(u.Incidents, *i)
+		}
+	}
+	return u
+}
+
+// parseWindow parses a window given as a Go duration or a number of days
+// such as "7d".
+func parseWindow(s string) (time.Duration, error) {
+	var window time.Duration
+	if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		window = time.Duration(days) * 24 * time.Hour
+	} else if window, err = time.ParseDuration(s); err != nil {
+		return 0, fmt.Errorf("invalid window: %v", err)
+	}
+	if window <= 0 || window > uptimeRetention {
+		return 0, fmt.Errorf("window must be positive and at most %d days", uptimeRetention/(24*time.Hour))
+	}
+	return window, nil
+}
+
+// Availability returns the percentage of checks that found the URL up, or
+// false if there were none.
+func (u *Uptime) Availability() (float64, bool) {
+	if len(u.Checks) == 0 {
+		return 0, false
+	}
+	up := 0
+	for _, c := range u.Checks {
+		if c.Up {
+			up++
+		}
+	}
+	return 100 * float64(up) / float64(len(u.Checks)), true
+}
+
+// AverageLatency returns the mean latency of the checks that found the URL
+// up, or false if there were none.
+func (u *Uptime) AverageLatency() (time.Duration, bool) {
+	var total time.Duration
+	up := 0
+	for _, c := range u.Checks {
+		if c.Up {
+			total += c.Latency
+			up++
+		}
+	}
+	if up == 0 {
+		return 0, false
+	}
+	return total / time.Duration(up), true
+}
+
+func uptimeType() *graphql.Object {
+	checkType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UptimeCheck",
+		Fields: graphql.Fields{
+			"time": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the check finished",
+			},
+			"jobId": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the job that made the check",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(UptimeCheck).JobID, nil
+				},
+			},
+			"up": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the URL responded successfully",
+			},
+			"statusCode": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "HTTP status code of the response, if there was one",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if code := p.Source.(UptimeCheck).StatusCode; code != 0 {
+						return code, nil
+					}
+					return nil, nil
+				},
+			},
+			"latencyMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Time from sending the request until the response was read, in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return float64(p.Source.(UptimeCheck).Latency) / float64(time.Millisecond), nil
+				},
+			},
+		},
+	})
+	incidentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Incident",
+		Fields: graphql.Fields{
+			"started": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the first failed check finished",
+			},
+			"ended": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the URL was found up again, null while the incident is ongoing",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := p.Source.(Incident).Ended; !t.IsZero() {
+						return t, nil
+					}
+					return nil, nil
+				},
+			},
+			"cause": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Error of the check that started the incident",
+			},
+			"checks": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of failed checks during the incident",
+			},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Uptime",
+		Fields: graphql.Fields{
+			"url": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The URL checked",
+			},
+			"window": &graphql.Field{
+				Type:        graphql.String,
+				Description: "How far back checks are counted",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Uptime).Window.String(), nil
+				},
+			},
+			"checks": &graphql.Field{
+				Type:        graphql.NewList(checkType),
+				Description: "Checks within the window, oldest first",
+			},
+			"availability": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Percentage of the checks within the window that found the URL up, null without checks",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if a, ok := p.Source.(*Uptime).Availability(); ok {
+						return a, nil
+					}
+					return nil, nil
+				},
+			},
+			"avgLatencyMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Mean latency of the successful checks within the window, in milliseconds",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if l, ok := p.Source.(*Uptime).AverageLatency(); ok {
+						return float64(l) / float64(time.Millisecond), nil
+					}
+					return nil, nil
+				},
+			},
+			"incidents": &graphql.Field{
+				Type:        graphql.NewList(incidentType),
+				Description: "Incidents that overlap the window, oldest first",
+			},
+		},
+	})
+}
@@ -1,29 +1,155 @@
 package urldata
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/dsoo/urlfetcher/auth"
+	"github.com/dsoo/urlfetcher/queue"
 	"github.com/graphql-go/graphql"
 )
 
 // Response represents data retrieved from an URL.
 type Response struct {
-	URL       string
-	Body      string
-	Timestamp time.Time
+	URL        string
+	StatusCode int
+	Body       []byte // Only converted to a string when a query asks for it
+	Header     http.Header
+	Timestamp  time.Time
+	Checksums  Checksums // Digests of Body, computed when it was fetched
+	Links      []string  // Absolute URLs the body links to, if it is HTML
+	// Resolver names the resolver that looked up the host: a DoH endpoint,
+	// "system", or empty if the host was not resolved here.
+	Resolver string
+	// Exchanges are the requests sent and responses received, one per
+	// redirect, for exporting as HAR.
+	Exchanges []Exchange
+	// Findings are what the processors found in the response.
+	Findings []Finding
+	// Language is the natural language of an HTML or text body, nil if it
+	// could not be told.
+	Language *Language
+	// Canonical is the URL the response declared canonical, or the one it
+	// was redirected to; empty if that is URL itself.
+	Canonical string
+	// StructuredData is the schema.org JSON-LD and microdata of an HTML
+	// body.
+	StructuredData []StructuredItem
+	// Thumbnail is the blob store key of the thumbnail of an image, if
+	// thumbnails are enabled.
+	Thumbnail string
+	// Snapshot is the URL of the capture of the page by a web archive, set
+	// once it has been archived if snapshots are enabled.
+	Snapshot string
+	// DroppedHeaders names the headers some values of which were dropped
+	// from Header as malformed.
+	DroppedHeaders []string
+
+	// Set when the body, read back from the journal or an archive, did not
+	// match its checksums.
+	corrupt bool
 }
 
-// Job represents an individual job request
+// Job represents an individual job request. The fields that change while
+// the job runs are guarded by stateMu; read them with GetJobState.
 type Job struct {
 	ID       int64
 	URL      string
-	Status   string    // Enum of status - waiting, success, error
+	Status   string    // Enum of status - waiting, parked, success, error
 	Response *Response // The result data for the job
+	Tenant   string    // Tenant of the caller that created the job
+	Owner    string    // Owner of the job, taken from the caller's identity
+	Options  JobOptions
+	Events   []Event // Timeline of the job, guarded by eventsMu
+	WorkerID int     // Worker that processed the job, 0 until dequeued
+	Attempts int     // Retries after retryable failures
+	// QueueWait is how long the job last waited in the queue for a worker.
+	QueueWait time.Duration
+	// LookupWait is how long the job's last fetch waited for DNS lookups
+	// to start, with SetMaxLookups lookups in progress.
+	LookupWait time.Duration
+	Error      *JobError // Why the job failed, nil unless its status is error
+	// BudgetExceeded names the budget, maxBytes or maxDuration, that the
+	// job was aborted for exceeding.
+	BudgetExceeded string
+	// Redeliveries counts the times the job was started again after its
+	// worker was lost mid-fetch.
+	Redeliveries int
+	// Debug is what was captured of the last run of a job with the debug
+	// option, nil for other jobs.
+	Debug *DebugInfo
+	// Instance is the base URL of the cluster instance the job was
+	// forwarded to, empty if it runs here.
+	Instance string
+	// Certificate is what a certificate job found, nil for other jobs.
+	Certificate *CertificateCheck
+	// DeletedAt is when the job was moved to the trash, zero unless it is
+	// there.
+	DeletedAt time.Time
+	// Version counts the changes to the job. Changes requested by clients
+	// must name the version they are based on.
+	Version int64
+}
+
+// JobOptions holds optional parameters for a new job.
+type JobOptions struct {
+	Type       string // JobFetch or JobCertificate
+	Tenant     string
+	Owner      string
+	ClientCert string // Name of the credential holding a TLS client certificate
+
+	// Connection overrides, e.g. to reach a specific origin behind a load balancer.
+	HostHeader     string // Host header to send instead of the URL's host
+	ServerName     string // TLS server name (SNI) to send and verify
+	ConnectAddress string // IP or host[:port] to connect to instead of the URL's host
+	Tunnel         string // Name of an SSH tunnel to fetch through
+	Egress         string // Name of an egress route (proxy) to fetch through
+
+	// Budgets, the job is aborted when it exceeds one. Zero means no limit.
+	MaxBytes    int64         // Largest response body accepted
+	MaxDuration time.Duration // Longest time the request may take
+
+	// Deadline is when the job should have run by. Queues scheduling by
+	// deadline run the jobs with the earliest deadlines first.
+	Deadline time.Time
+	// NotBefore delays the job until this time.
+	NotBefore time.Time
+	// Priority orders the jobs of a tenant in the memory queue, higher
+	// first. Routing rules set it.
+	Priority int
+	// Pool is the worker pool that runs the job, "" for the default
+	// workers.
+	Pool string
+	// Preset is the preset the options started from, if any.
+	Preset string
+
+	Notify  string   // Notifier told when the job has finished
+	Batch   int64    // Batch the job was submitted in, 0 for none
+	Monitor int64    // Monitor the job checks for, 0 for none
+	Replay  int64    // Job whose request this one replays, 0 for none
+	Tags    []string // Free-form labels for filtering
+	// Metadata holds client-defined key/values, given with the job and
+	// changed later by Annotate.
+	Metadata map[string]string
+	// Scripts are evaluated for the job, as given by its preset or host
+	// profile.
+	Scripts *Scripts
+
+	NoCache bool // Always fetch, even if a fresh response is cached
+	Debug   bool // Capture the requests, redirects and transport log
+	// CrawlDepth is the number of links followed from the start of the
+	// job's crawl to its URL.
+	CrawlDepth int
+	LinkCheck  bool // Only checks a link of the crawl, without following its links
 }
 
 // SchemaConfig configures the graphql schema and callbacks
@@ -35,13 +161,198 @@ func SchemaConfig() graphql.SchemaConfig {
 				Type:        graphql.String,
 				Description: "The URL that was retrieved using HTTP GET",
 			},
+			"statusCode": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "The HTTP status code of the response",
+			},
 			"body": &graphql.Field{
 				Type:        graphql.String,
 				Description: "The body of the HTTP response",
+				Args: graphql.FieldConfigArgument{
+					"maxBytes": &graphql.ArgumentConfig{
+						Description: "Return at most this many bytes of the body",
+						Type:        graphql.Int,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					max, ok := p.Args["maxBytes"].(int)
+					if !ok {
+						max = -1
+					}
+					return truncateBody(p.Source.(*Response).Body, max), nil
+				},
+			},
+			"resolver": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Resolver that looked up the host: a DNS-over-HTTPS endpoint, system, or null if the host was not resolved by this server",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if r := p.Source.(*Response).Resolver; r != "" {
+						return r, nil
+					}
+					return nil, nil
+				},
+			},
+			"links": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Absolute URLs the body links to, if it is HTML",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Response).Links, nil
+				},
+			},
+			"bodyLength": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Size of the body in bytes",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return len(p.Source.(*Response).Body), nil
+				},
+			},
+			"bodyPreview": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The start of the body on a single line, for list views",
+				Args: graphql.FieldConfigArgument{
+					"chars": &graphql.ArgumentConfig{
+						Description: "Number of characters to return, 200 by default",
+						Type:        graphql.Int,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					chars, ok := p.Args["chars"].(int)
+					if !ok {
+						chars = defaultPreviewChars
+					}
+					return bodyPreview(p.Source.(*Response).Body, chars), nil
+				},
+			},
+			"previewHTML": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The body of an HTML response sanitized for display: without scripts, frames or plugins, and with a Content-Security-Policy blocking them. Show it in a sandboxed iframe. Null for other responses",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if preview := previewHTML(p.Source.(*Response)); preview != nil {
+						return string(preview), nil
+					}
+					return nil, nil
+				},
+			},
+			"canonical": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL the response declared canonical or was redirected to, null if that is its own URL",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if c := p.Source.(*Response).Canonical; c != "" {
+						return c, nil
+					}
+					return nil, nil
+				},
+			},
+			"snapshotURL": &graphql.Field{
+				Type:        graphql.String,
+				Description: "URL of the capture of the page by a web archive, null until it has been archived",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if s := p.Source.(*Response).Snapshot; s != "" {
+						return s, nil
+					}
+					return nil, nil
+				},
+			},
+			"thumbnailURL": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Link to a thumbnail of an image response, null if thumbnails are disabled or it is no image",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if u := ThumbnailURL(p.Source.(*Response)); u != "" {
+						return u, nil
+					}
+					return nil, nil
+				},
+			},
+			"language": &graphql.Field{
+				Type:        languageType(),
+				Description: "Natural language of an HTML or text body, null if it could not be told",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if l := p.Source.(*Response).Language; l != nil {
+						return l, nil
+					}
+					return nil, nil
+				},
+			},
+			"findings": &graphql.Field{
+				Type:        graphql.NewList(findingType()),
+				Description: "What the processors found in the response, such as email addresses and word counts",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{
+						Description: "Only return the findings of this name",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					name, _ := p.Args["name"].(string)
+					return selectFindings(p.Source.(*Response).Findings, name), nil
+				},
+			},
+			"structuredData": &graphql.Field{
+				Type:        graphql.NewList(structuredItemType()),
+				Description: "The schema.org JSON-LD and microdata items of an HTML body, such as products, articles and events",
+				Args: graphql.FieldConfigArgument{
+					"type": &graphql.ArgumentConfig{
+						Description: "Only return the items of this schema.org type, such as Product",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					typ, _ := p.Args["type"].(string)
+					return selectStructuredData(p.Source.(*Response).StructuredData, typ), nil
+				},
+			},
+			"headers": &graphql.Field{
+				Type:        graphql.NewList(headerFieldType()),
+				Description: "The headers of the HTTP response",
+				Args: graphql.FieldConfigArgument{
+					"names": &graphql.ArgumentConfig{
+						Description: "Only return these headers",
+						Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return selectHeaders(p.Source.(*Response).Header, stringList(p.Args["names"])), nil
+				},
+			},
+			"droppedHeaders": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Names of the headers some values of which were dropped as malformed: with control characters or invalid UTF-8, or too long",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Response).DroppedHeaders, nil
+				},
+			},
+			"sha256": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Hex encoded SHA-256 checksum of the body",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Response).Checksums.SHA256, nil
+				},
+			},
+			"blake3": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Hex encoded BLAKE3 checksum of the body, if enabled on the server",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Response).Checksums.BLAKE3, nil
+				},
+			},
+			"corrupt": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "True if the stored body no longer matches its checksums",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Response).Corrupt(), nil
+				},
 			},
 		},
 	})
 
+	errorType := jobErrorType()
+	metadataType := metadataEntryType()
+	// Fields that change while the job runs are read under its lock.
+	state := func(get func(s JobState) interface{}) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			return get(GetJobState(jobOf(p.Source))), nil
+		}
+	}
 	jobType := graphql.NewObject(graphql.ObjectConfig{
 		Name: "Job",
 		Fields: graphql.Fields{
@@ -55,195 +366,1695 @@ func SchemaConfig() graphql.SchemaConfig {
 			},
 			"status": &graphql.Field{
 				Type:        graphql.String,
-				Description: "Simple status string for the job. Can be waiting, fetching, done, done - cached",
+				Description: "Simple status string for the job. Can be scheduled, waiting, parked, fetching, done, done - cached or error",
+				Resolve:     state(func(s JobState) interface{} { return s.Status }),
 			},
 			"response": &graphql.Field{
 				Type:        responseType,
 				Description: "Response data from the URL to be retrieved. May be cached.",
+				Resolve:     state(func(s JobState) interface{} { return s.Response }),
+			},
+			"bodyDownloadURL": bodyDownloadURLField(),
+			"type": &graphql.Field{
+				Type:        graphql.String,
+				Description: "What the job does: fetch the URL, or only check the certificates of its host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := jobOf(p.Source).Options.Type; t != JobFetch {
+						return t, nil
+					}
+					return "fetch", nil
+				},
+			},
+			"certificate": &graphql.Field{
+				Type:        certificateCheckType(),
+				Description: "The TLS certificates of the host, for certificate jobs",
+				Resolve:     state(func(s JobState) interface{} { return s.Certificate }),
+			},
+			"tenant": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Tenant of the caller that created the job",
+			},
+			"owner": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Owner of the job, taken from the authenticated caller",
+			},
+			"workerId": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the worker that processed the job",
+				Resolve:     state(func(s JobState) interface{} { return s.WorkerID }),
+			},
+			"queueWaitMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "How long the job last waited in the queue for a worker, in milliseconds",
+				Resolve:     state(func(s JobState) interface{} { return millis(s.QueueWait, 1) }),
+			},
+			"lookupWaitMs": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "How long the job's last fetch waited for DNS lookups to start, while the most allowed at once were in progress, in milliseconds",
+				Resolve:     state(func(s JobState) interface{} { return millis(s.LookupWait, 1) }),
+			},
+			"attempts": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of times the job was retried after a retryable failure",
+				Resolve:     state(func(s JobState) interface{} { return s.Attempts }),
+			},
+			"redeliveries": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of times the job was started again after its worker was lost mid-fetch",
+				Resolve:     state(func(s JobState) interface{} { return s.Redeliveries }),
+			},
+			"error": &graphql.Field{
+				Type:        errorType,
+				Description: "Why the job failed, if it did",
+				Resolve:     state(func(s JobState) interface{} { return s.Error }),
+			},
+			"events": &graphql.Field{
+				Type:        graphql.NewList(eventType()),
+				Description: "Timeline of the job from queueing to completion",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if job := jobOf(p.Source); job.Instance != "" {
+						return nil, nil // Kept by the instance running the job
+					}
+					if job := GetJob(jobOf(p.Source).ID); job != nil {
+						return jobEvents(job), nil
+					}
+					// Archived jobs are no longer in memory.
+					return jobEvents(jobOf(p.Source)), nil
+				},
+			},
+			"instance": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Base URL of the cluster instance the job was forwarded to, null if it runs on this one",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if job := jobOf(p.Source); job.Instance != "" {
+						return job.Instance, nil
+					}
+					return nil, nil
+				},
+			},
+			"clientCert": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Name of the client certificate credential requested for the job",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.ClientCert, nil
+				},
+			},
+			"hostHeader": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Host header sent instead of the URL's host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.HostHeader, nil
+				},
+			},
+			"serverName": &graphql.Field{
+				Type:        graphql.String,
+				Description: "TLS server name (SNI) sent instead of the URL's host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.ServerName, nil
+				},
+			},
+			"connectAddress": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Address connected to instead of resolving the URL's host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.ConnectAddress, nil
+				},
+			},
+			"tunnel": &graphql.Field{
+				Type:        graphql.String,
+				Description: "SSH tunnel requested for the job",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.Tunnel, nil
+				},
+			},
+			"egress": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Egress route the job is fetched through, requested or matched by its host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if name := egressFor(jobOf(p.Source)); name != "" {
+						return name, nil
+					}
+					return nil, nil
+				},
+			},
+			"maxBytes": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Largest response body the job accepts, if limited",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if n := jobOf(p.Source).Options.MaxBytes; n > 0 {
+						return n, nil
+					}
+					return nil, nil
+				},
+			},
+			"maxDuration": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Longest time the job's request may take, if limited",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if d := jobOf(p.Source).Options.MaxDuration; d > 0 {
+						return d.String(), nil
+					}
+					return nil, nil
+				},
+			},
+			"notBefore": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Time before which the job is not run, if it was delayed",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := jobOf(p.Source).Options.NotBefore; !t.IsZero() {
+						return t.Format(time.RFC3339), nil
+					}
+					return nil, nil
+				},
+			},
+			"deadline": &graphql.Field{
+				Type:        graphql.String,
+				Description: "When the job should have run by, if it has a deadline",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if d := jobOf(p.Source).Options.Deadline; !d.IsZero() {
+						return d.Format(time.RFC3339), nil
+					}
+					return nil, nil
+				},
+			},
+			"pool": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Worker pool that runs the job, null for the default workers",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if pool := jobOf(p.Source).Options.Pool; pool != "" {
+						return pool, nil
+					}
+					return nil, nil
+				},
+			},
+			"priority": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Priority of the job in the queue, set by routing rules; higher goes first",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.Priority, nil
+				},
+			},
+			"budgetExceeded": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The budget, maxBytes or maxDuration, the job was aborted for exceeding",
+				Resolve:     state(func(s JobState) interface{} { return s.BudgetExceeded }),
+			},
+			"debug": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Whether the job captures debugInfo",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.Debug, nil
+				},
+			},
+			"debugInfo": &graphql.Field{
+				Type:        debugInfoType(),
+				Description: "The requests, redirects and transport log of the job's last run, if it was added with debug set",
+				Resolve: state(func(s JobState) interface{} {
+					if s.Debug == nil {
+						return nil
+					}
+					return s.Debug
+				}),
+			},
+			"notify": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Notifier told when the job has finished",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.Notify, nil
+				},
+			},
+			"tags": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Labels given to the job when it was added",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return jobOf(p.Source).Options.Tags, nil
+				},
+			},
+			"version": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of changes to the job, to pass to mutations changing it",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return atomic.LoadInt64(&jobOf(p.Source).Version), nil
+				},
+			},
+			"deletedAt": &graphql.Field{
+				Type:        graphql.DateTime,
+				Description: "When the job was moved to the trash, null unless it is there",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if t := jobOf(p.Source).DeletedAt; !t.IsZero() {
+						return t, nil
+					}
+					return nil, nil
+				},
+			},
+			"metadata": &graphql.Field{
+				Type:        graphql.NewList(metadataType),
+				Description: "Key/value pairs the client attached to the job, ordered by key",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return metadataEntries(jobOf(p.Source).Options.Metadata), nil
+				},
+			},
+			"batchId": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the batch the job was submitted in, if any",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := jobOf(p.Source).Options.Batch; id != 0 {
+						return id, nil
+					}
+					return nil, nil
+				},
+			},
+			"monitorId": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the monitor the job checks for, if any",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := jobOf(p.Source).Options.Monitor; id != 0 {
+						return id, nil
+					}
+					return nil, nil
+				},
+			},
+			"replayOf": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the job whose request this one replays, if any",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if id := jobOf(p.Source).Options.Replay; id != 0 {
+						return id, nil
+					}
+					return nil, nil
+				},
 			},
 		},
 	})
+	batchType := batchType(jobType)
+	monitorType := monitorType(jobType)
+	presetType := presetType()
 	rootQuery := graphql.NewObject(graphql.ObjectConfig{
 		Name: "Query",
 		Fields: graphql.Fields{
 			"jobs": &graphql.Field{
 				Type:        graphql.NewList(jobType),
 				Description: "Retrieve information about all jobs on the server",
+				Args: graphql.FieldConfigArgument{
+					"metadata": &graphql.ArgumentConfig{
+						Description: "Only jobs with all these metadata entries, any value matching those without one",
+						Type:        graphql.NewList(graphql.NewNonNull(metadataInput)),
+					},
+					"findings": &graphql.ArgumentConfig{
+						Description: "Only jobs whose response has all these findings, any value matching those without one",
+						Type:        graphql.NewList(graphql.NewNonNull(findingInput)),
+					},
+				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					return GetJobs(), nil
+					filter, err := parseMetadata(p.Args["metadata"])
+					if err != nil {
+						return nil, err
+					}
+					findings, err := parseFindingFilter(p.Args["findings"])
+					if err != nil {
+						return nil, err
+					}
+					matching := []*Job{}
+					for _, job := range GetJobs() {
+						if MatchesMetadata(job, filter) && MatchesFindings(job, findings) {
+							matching = append(matching, job)
+						}
+					}
+					return matching, nil
+				},
+			},
+			"job": &graphql.Field{
+				Type:        jobType,
+				Description: "Retrieve parameters of a job, given the ID of the job",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the job",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"waitSeconds": &graphql.ArgumentConfig{
+						Description: "Hold the request until the job's status changes or this many seconds have passed, at most 300",
+						Type:        graphql.Int,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(p.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if wait := waitDuration(p.Args["waitSeconds"], 0); wait > 0 {
+						return WaitForJobChange(p.Context, int64(id), wait), nil
+					}
+					return GetJob(int64(id)), nil
+				},
+			},
+			"trash": &graphql.Field{
+				Type:        graphql.NewList(jobType),
+				Description: "Retrieve the deleted jobs that can still be restored, most recently deleted first",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return GetTrash(), nil
+				},
+			},
+			"waitForJobs": &graphql.Field{
+				Type:        graphql.NewList(jobType),
+				Description: "Wait until all the given jobs have finished, or the timeout has passed, and retrieve them",
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{
+						Description: "ids of the jobs",
+						Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+					"timeoutSeconds": &graphql.ArgumentConfig{
+						Description: "How long to wait at most, 30 seconds by default and 300 at most",
+						Type:        graphql.Int,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var ids []int64
+					for _, s := range stringList(p.Args["ids"]) {
+						id, err := strconv.Atoi(s)
+						if err != nil {
+							return nil, err
+						}
+						ids = append(ids, int64(id))
+					}
+					return WaitForJobs(p.Context, ids, waitDuration(p.Args["timeoutSeconds"], defaultJobWait)), nil
+				},
+			},
+			"batch": &graphql.Field{
+				Type:        batchType,
+				Description: "Retrieve a batch of jobs, given the ID of the batch",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the batch",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(p.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if b := GetBatch(int64(id)); b != nil && CanViewTenant(p.Context, b.Tenant) {
+						return b, nil
+					}
+					return nil, nil
+				},
+			},
+			"monitor": &graphql.Field{
+				Type:        monitorType,
+				Description: "Retrieve a monitor, given its ID",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the monitor",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(p.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if m := GetMonitor(int64(id)); m != nil && CanViewTenant(p.Context, m.Tenant) {
+						return m, nil
+					}
+					return nil, nil
+				},
+			},
+			"linkGraph": &graphql.Field{
+				Type:        linkGraphType(),
+				Description: "Retrieve the links between the pages fetched by a batch, such as a crawl",
+				Args: graphql.FieldConfigArgument{
+					"batchId": &graphql.ArgumentConfig{
+						Description: "id of the batch",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(p.Args["batchId"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if !CanViewBatch(p.Context, int64(id)) {
+						return nil, nil
+					}
+					if g := GetLinkGraph(int64(id)); g != nil {
+						return g, nil
+					}
+					return nil, nil
+				},
+			},
+			"linkReport": &graphql.Field{
+				Type:        linkReportType(errorType),
+				Description: "Retrieve the broken links found by a batch, such as a crawl that checks links",
+				Args: graphql.FieldConfigArgument{
+					"batchId": &graphql.ArgumentConfig{
+						Description: "id of the batch",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(p.Args["batchId"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if !CanViewBatch(p.Context, int64(id)) {
+						return nil, nil
+					}
+					if r := GetLinkReport(int64(id)); r != nil {
+						return r, nil
+					}
+					return nil, nil
+				},
+			},
+			"monitors": &graphql.Field{
+				Type:        graphql.NewList(monitorType),
+				Description: "Retrieve all monitors, stopped ones included",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					visible := []*Monitor{}
+					for _, m := range GetMonitors() {
+						if CanViewTenant(p.Context, m.Tenant) {
+							visible = append(visible, m)
+						}
+					}
+					return visible, nil
+				},
+			},
+			"presets": &graphql.Field{
+				Type:        graphql.NewList(presetType),
+				Description: "Retrieve the job option presets, ordered by name",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return GetPresets(), nil
+				},
+			},
+			"uptime": &graphql.Field{
+				Type:        uptimeType(),
+				Description: "Retrieve the availability of a URL checked by an uptime monitor",
+				Args: graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"window": &graphql.ArgumentConfig{
+						Description: "How far back to count checks, e.g. \"7d\" or \"24h\", 24h by default and 90d at most",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					window := 24 * time.Hour
+					if s, ok := p.Args["window"].(string); ok {
+						var err error
+						if window, err = parseWindow(s); err != nil {
+							return nil, err
+						}
+					}
+					url := p.Args["url"].(string)
+					if !CanViewURL(p.Context, url) {
+						return nil, nil
+					}
+					return GetUptime(url, window), nil
+				},
+			},
+			"archivedJobs": &graphql.Field{
+				Type:        graphql.NewList(jobType),
+				Description: "Search the jobs archived after finishing. This reads the whole archive, so it is slow.",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the job",
+						Type:        graphql.String,
+					},
+					"url": &graphql.ArgumentConfig{
+						Description: "Only jobs for this URL",
+						Type:        graphql.String,
+					},
+					"status": &graphql.ArgumentConfig{
+						Description: "Only jobs with this status",
+						Type:        graphql.String,
+					},
+					"limit": &graphql.ArgumentConfig{
+						Description: "Return at most this many of the latest matching jobs, 100 by default",
+						Type:        graphql.Int,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					f := ArchiveFilter{Limit: 100}
+					if s, ok := p.Args["id"].(string); ok {
+						id, err := strconv.Atoi(s)
+						if err != nil {
+							return nil, err
+						}
+						f.ID = int64(id)
+					}
+					f.URL, _ = p.Args["url"].(string)
+					f.Status, _ = p.Args["status"].(string)
+					if n, ok := p.Args["limit"].(int); ok {
+						f.Limit = n
+					}
+					return GetArchivedJobs(f)
+				},
+			},
+			"responses": &graphql.Field{
+				Type:        graphql.NewList(responseType),
+				Description: "Retrieve information about all responses on the server",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					visible := urlFilter(p.Context)
+					list := []*Response{}
+					for _, r := range GetResponses() {
+						if r != nil && visible(r.URL) {
+							list = append(list, r)
+						}
+					}
+					return list, nil
+				},
+			},
+			"workers": &graphql.Field{
+				Type:        graphql.NewList(workerType()),
+				Description: "Retrieve the state and statistics of each worker",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return GetWorkers(), nil
+				},
+			},
+			"stats": &graphql.Field{
+				Type:        statsType(),
+				Description: "Retrieve queue and per-host connection statistics",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return StatsFor(p.Context), nil
+				},
+			},
+			"alerts": &graphql.Field{
+				Type:        graphql.NewList(alertType()),
+				Description: "Retrieve the alert rules currently firing, per host",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					visible := hostFilter(p.Context)
+					alerts := []Alert{}
+					for _, a := range GetAlerts() {
+						if visible(a.Host) {
+							alerts = append(alerts, a)
+						}
+					}
+					return alerts, nil
+				},
+			},
+			"response": &graphql.Field{
+				Type:        responseType,
+				Description: "Retrieve response data for a particular URL.",
+				Args: graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Description: "url that we requested",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"followAliases": &graphql.ArgumentConfig{
+						Description: "If the URL has no cached response, return the one of its canonical URL or another alias",
+						Type:        graphql.Boolean,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					url := p.Args["url"].(string)
+					visible := urlFilter(p.Context)
+					if !visible(url) {
+						return nil, nil
+					}
+					if follow, _ := p.Args["followAliases"].(bool); follow {
+						return responseViaAliases(url, visible), nil
+					}
+					return GetResponse(url), nil
+				},
+			},
+			"aliases":      aliasesField(),
+			"duplicatesOf": duplicatesOfField(),
+		},
+	})
+
+	rootMutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"addJob": &graphql.Field{
+				Type:        jobType,
+				Description: "Add a new urlfetch job to the queue.",
+				Args: withJobOptionArgs(graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				}),
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					opts := JobOptions{}
+					if err := parseJobOptions(params.Context, params.Args, &opts); err != nil {
+						return nil, err
+					}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					return SubmitJob(params.Context, params.Args["url"].(string), opts)
+				},
+			},
+			"cloneJob":     cloneJobField(jobType),
+			"replayJob":    replayJobField(jobType),
+			"compareFetch": rateLimit(30, time.Minute, compareFetchField()),
+			"deleteJobs": &graphql.Field{
+				Type:        graphql.NewList(jobType),
+				Description: "Move jobs to the trash, from where restoreJob can bring them back until the trash retention has passed.",
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{
+						Description: "ids of the jobs",
+						Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					var ids []int64
+					for _, s := range stringList(params.Args["ids"]) {
+						id, err := strconv.Atoi(s)
+						if err != nil {
+							return nil, err
+						}
+						if job := GetJob(int64(id)); job == nil || CanChange(params.Context, job) {
+							ids = append(ids, int64(id))
+						}
+					}
+					return DeleteJobs(ids), nil
+				},
+			},
+			"restoreJob": &graphql.Field{
+				Type:        jobType,
+				Description: "Take a deleted job out of the trash, queueing it again if it had not finished.",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the job",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"version": &graphql.ArgumentConfig{
+						Description: "Version of the job the change is based on; it fails if the job has changed since",
+						Type:        graphql.NewNonNull(graphql.Int),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(params.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if job := GetDeletedJob(int64(id)); job != nil {
+						if !CanView(params.Context, job) {
+							return nil, fmt.Errorf("job %d is not in the trash", id)
+						}
+						if err := errCannotChange(params.Context, job); err != nil {
+							return nil, err
+						}
+					}
+					job, err := RestoreJob(int64(id), int64(params.Args["version"].(int)))
+					if err != nil {
+						return nil, err
+					}
+					if job == nil {
+						return nil, fmt.Errorf("job %d is not in the trash", id)
+					}
+					return job, nil
+				},
+			},
+			"annotate": &graphql.Field{
+				Type:        jobType,
+				Description: "Set metadata on a job, e.g. to track how far it has been processed downstream.",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Description: "id of the job",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"metadata": &graphql.ArgumentConfig{
+						Description: "Entries to set; those without a value are removed",
+						Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(metadataInput))),
+					},
+					"version": &graphql.ArgumentConfig{
+						Description: "Version of the job the change is based on; it fails if the job has changed since",
+						Type:        graphql.NewNonNull(graphql.Int),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					id, err := strconv.Atoi(params.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					metadata, err := parseMetadata(params.Args["metadata"])
+					if err != nil {
+						return nil, err
+					}
+					if job := GetJob(int64(id)); job != nil {
+						if !CanView(params.Context, job) {
+							return nil, fmt.Errorf("job %d not found", id)
+						}
+						if err := errCannotChange(params.Context, job); err != nil {
+							return nil, err
+						}
+					}
+					job, err := Annotate(int64(id), int64(params.Args["version"].(int)), metadata)
+					if err != nil {
+						return nil, err
+					}
+					if job == nil {
+						return nil, fmt.Errorf("job %d not found", id)
+					}
+					return job, nil
 				},
 			},
-			"job": &graphql.Field{
-				Type:        jobType,
-				Description: "Retrieve parameters of a job, given the ID of the job",
+			"addBatch": &graphql.Field{
+				Type:        batchType,
+				Description: "Add a job for each URL, tracked together as a batch.",
 				Args: graphql.FieldConfigArgument{
-					"id": &graphql.ArgumentConfig{
-						Description: "id of the job",
+					"urls": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					},
+					"notify": &graphql.ArgumentConfig{
+						Description: "Name of a notifier configured on the server to tell when the whole batch has finished",
+						Type:        graphql.String,
+					},
+					"tags": &graphql.ArgumentConfig{
+						Description: "Labels given to every job of the batch",
+						Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					opts := JobOptions{}
+					opts.Notify, _ = params.Args["notify"].(string)
+					if opts.Notify != "" && !HasNotifier(opts.Notify) {
+						return nil, fmt.Errorf("unknown notifier %q", opts.Notify)
+					}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					opts.Tags = stringList(params.Args["tags"])
+					return AddBatch(stringList(params.Args["urls"]), opts)
+				},
+			},
+			"crawl": rateLimit(10, time.Minute, &graphql.Field{
+				Type:        batchType,
+				Description: "Fetch a URL and follow its links on the same host, as a batch.",
+				Args: graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"maxPages": &graphql.ArgumentConfig{
+						Description: "Stop adding pages after this many, 100 by default",
+						Type:        graphql.Int,
+					},
+					"maxDepth": &graphql.ArgumentConfig{
+						Description: "Follow at most this many links from the URL, 3 by default",
+						Type:        graphql.Int,
+					},
+					"checkLinks": &graphql.ArgumentConfig{
+						Description: "Also fetch the links not followed, such as those to other hosts, to find broken links",
+						Type:        graphql.Boolean,
+					},
+					"maxLinks": &graphql.ArgumentConfig{
+						Description: "Check at most this many links that are not followed, 1000 by default",
+						Type:        graphql.Int,
+					},
+					"notify": &graphql.ArgumentConfig{
+						Description: "Name of a notifier configured on the server to tell when the crawl has finished",
+						Type:        graphql.String,
+					},
+					"tags": &graphql.ArgumentConfig{
+						Description: "Labels given to every job of the crawl",
+						Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					opts := JobOptions{}
+					opts.Notify, _ = params.Args["notify"].(string)
+					if opts.Notify != "" && !HasNotifier(opts.Notify) {
+						return nil, fmt.Errorf("unknown notifier %q", opts.Notify)
+					}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					opts.Tags = stringList(params.Args["tags"])
+					c := CrawlOptions{MaxDepth: defaultCrawlDepth}
+					c.MaxPages, _ = params.Args["maxPages"].(int)
+					if d, ok := params.Args["maxDepth"].(int); ok {
+						c.MaxDepth = d
+					}
+					c.CheckLinks, _ = params.Args["checkLinks"].(bool)
+					c.MaxLinks, _ = params.Args["maxLinks"].(int)
+					return Crawl(params.Args["url"].(string), c, opts)
+				},
+			}),
+			"monitorURL": &graphql.Field{
+				Type:        monitorType,
+				Description: "Fetch a URL at an interval, and notify when its content changes.",
+				Args: graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"interval": &graphql.ArgumentConfig{
+						Description: "How often to fetch the URL, e.g. \"15m\", at least 10s",
 						Type:        graphql.NewNonNull(graphql.String),
 					},
+					"notify": &graphql.ArgumentConfig{
+						Description: "Name of a notifier configured on the server to tell when the content changes",
+						Type:        graphql.String,
+					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					id, err := strconv.Atoi(p.Args["id"].(string))
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					interval, err := time.ParseDuration(params.Args["interval"].(string))
 					if err != nil {
-						return nil, err
+						return nil, fmt.Errorf("invalid interval: %v", err)
 					}
-					return GetJob(int64(id)), nil
+					notifier, _ := params.Args["notify"].(string)
+					opts := JobOptions{}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					return MonitorURL(params.Args["url"].(string), interval, notifier, opts)
 				},
 			},
-			"responses": &graphql.Field{
-				Type:        graphql.NewList(responseType),
-				Description: "Retrieve information about all responses on the server",
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					return GetResponses(), nil
+			"monitorUptime": &graphql.Field{
+				Type:        monitorType,
+				Description: "Check a URL at an interval, recording whether it is up, and notify when it goes down or comes back.",
+				Args: graphql.FieldConfigArgument{
+					"url": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"interval": &graphql.ArgumentConfig{
+						Description: "How often to check the URL, e.g. \"1m\", at least 10s",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"notify": &graphql.ArgumentConfig{
+						Description: "Name of a notifier configured on the server to tell about incidents",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					interval, err := time.ParseDuration(params.Args["interval"].(string))
+					if err != nil {
+						return nil, fmt.Errorf("invalid interval: %v", err)
+					}
+					notifier, _ := params.Args["notify"].(string)
+					opts := JobOptions{}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					return MonitorUptime(params.Args["url"].(string), interval, notifier, opts)
 				},
 			},
-			"response": &graphql.Field{
-				Type:        responseType,
-				Description: "Retrieve response data for a particular URL.",
+			"monitorCertificate": &graphql.Field{
+				Type:        monitorType,
+				Description: "Check the TLS certificates of a URL's host at an interval, and warn before they expire.",
 				Args: graphql.FieldConfigArgument{
 					"url": &graphql.ArgumentConfig{
-						Description: "url that we requested",
+						Description: "An https URL of the host",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"interval": &graphql.ArgumentConfig{
+						Description: "How often to check, e.g. \"12h\", at least 10s",
 						Type:        graphql.NewNonNull(graphql.String),
 					},
+					"warnDays": &graphql.ArgumentConfig{
+						Description: "Warn when a certificate expires within this many days, 14 by default",
+						Type:        graphql.Int,
+					},
+					"notify": &graphql.ArgumentConfig{
+						Description: "Name of a notifier configured on the server to warn",
+						Type:        graphql.String,
+					},
 				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					url := p.Args["url"].(string)
-					return GetResponse(url), nil
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					interval, err := time.ParseDuration(params.Args["interval"].(string))
+					if err != nil {
+						return nil, fmt.Errorf("invalid interval: %v", err)
+					}
+					warnDays, ok := params.Args["warnDays"].(int)
+					if !ok {
+						warnDays = defaultWarnDays
+					}
+					notifier, _ := params.Args["notify"].(string)
+					opts := JobOptions{}
+					if id := auth.FromContext(params.Context); id != nil {
+						opts.Tenant = id.Tenant
+						opts.Owner = id.Owner
+					}
+					return MonitorCertificate(params.Args["url"].(string), interval, warnDays, notifier, opts)
 				},
 			},
-		},
-	})
-
-	rootMutation := graphql.NewObject(graphql.ObjectConfig{
-		Name: "Mutation",
-		Fields: graphql.Fields{
-			"addJob": &graphql.Field{
-				Type:        jobType,
-				Description: "Add a new urlfetch job to the queue.",
+			"stopMonitor": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Stop a monitor. A check that is already scheduled still runs.",
 				Args: graphql.FieldConfigArgument{
-					"url": &graphql.ArgumentConfig{
+					"id": &graphql.ArgumentConfig{
 						Type: graphql.NewNonNull(graphql.String),
 					},
 				},
 				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-					job := AddJob(params.Args["url"].(string))
-					return job, nil
+					id, err := strconv.Atoi(params.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					m := GetMonitor(int64(id))
+					if m == nil || !CanViewTenant(params.Context, m.Tenant) {
+						return nil, errors.New("no such monitor")
+					}
+					if err := errCannotChangeOwned(params.Context, m.Tenant, m.Owner); err != nil {
+						return nil, err
+					}
+					if err := StopMonitor(int64(id)); err != nil {
+						return nil, err
+					}
+					return true, nil
 				},
 			},
+			"pauseQueue": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Stop starting jobs, globally or for one host, without dropping queued jobs.",
+				Args: graphql.FieldConfigArgument{
+					"host": &graphql.ArgumentConfig{
+						Description: "Only pause jobs for this host",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if host, ok := params.Args["host"].(string); ok {
+						PauseHost(strings.ToLower(host))
+					} else {
+						PauseQueue()
+					}
+					return true, nil
+				},
+			}),
+			"drainHost": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Block a host (or *.domain wildcard). Its jobs are parked, not failed, until it is undrained.",
+				Args: graphql.FieldConfigArgument{
+					"host": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					DrainHost(strings.ToLower(params.Args["host"].(string)))
+					return true, nil
+				},
+			}),
+			"undrainHost": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Unblock a drained host and requeue its parked jobs.",
+				Args: graphql.FieldConfigArgument{
+					"host": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					UndrainHost(strings.ToLower(params.Args["host"].(string)))
+					return true, nil
+				},
+			}),
+			"setPreset": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        presetType,
+				Description: "Add or replace a named set of job options that addJob can refer to as its preset.",
+				Args:        presetArgs(),
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					var opts JobOptions
+					if err := parseJobOptions(params.Context, params.Args, &opts); err != nil {
+						return nil, err
+					}
+					name := params.Args["name"].(string)
+					SetPreset(name, opts)
+					return Preset{Name: name, Options: opts}, nil
+				},
+			}),
+			"deletePreset": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Remove a preset. Jobs that started from it keep their options.",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					return DeletePreset(params.Args["name"].(string)), nil
+				},
+			}),
+			"setFetchRate": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Limit the requests sent by all workers together, e.g. to stay within an egress limit.",
+				Args: graphql.FieldConfigArgument{
+					"perSecond": &graphql.ArgumentConfig{
+						Description: "Requests per second, 0 to remove the limit",
+						Type:        graphql.NewNonNull(graphql.Float),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					perSecond := params.Args["perSecond"].(float64)
+					if perSecond < 0 {
+						return nil, fmt.Errorf("perSecond must not be negative")
+					}
+					SetFetchRate(perSecond)
+					return perSecond, nil
+				},
+			}),
+			"resumeQueue": requiresRole(auth.RoleAdmin, &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Resume starting jobs, globally or for one host.",
+				Args: graphql.FieldConfigArgument{
+					"host": &graphql.ArgumentConfig{
+						Description: "Only resume jobs for this host",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if host, ok := params.Args["host"].(string); ok {
+						ResumeHost(strings.ToLower(host))
+					} else {
+						ResumeQueue()
+					}
+					return true, nil
+				},
+			}),
 		},
 	})
 
+	addCustomFields(responseType, jobType)
+	guardMutations(rootMutation)
+	guardRoles(rootQuery, rootMutation, jobType, batchType, monitorType)
+
 	schemaConfig := graphql.SchemaConfig{Query: rootQuery,
-		Mutation: rootMutation}
+		Mutation: rootMutation, Directives: schemaDirectives()}
 
 	return schemaConfig
 }
 
+// withJobOptionArgs adds the arguments setting job options to args.
+func withJobOptionArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	for name, arg := range jobOptionArgs() {
+		args[name] = arg
+	}
+	return args
+}
+
+// jobOptionArgs returns the arguments that set job options.
+func jobOptionArgs() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"preset": &graphql.ArgumentConfig{
+			Description: "Name of a preset to take the options from, overridden by the other arguments",
+			Type:        graphql.String,
+		},
+		"type": &graphql.ArgumentConfig{
+			Description: "\"certificate\" to only record the TLS certificates of the URL's host instead of fetching it",
+			Type:        graphql.String,
+		},
+		"clientCert": &graphql.ArgumentConfig{
+			Description: "Name of a credential holding a TLS client certificate to present",
+			Type:        graphql.String,
+		},
+		"hostHeader": &graphql.ArgumentConfig{
+			Description: "Host header to send instead of the URL's host",
+			Type:        graphql.String,
+		},
+		"serverName": &graphql.ArgumentConfig{
+			Description: "TLS server name (SNI) to send and verify instead of the URL's host",
+			Type:        graphql.String,
+		},
+		"connectAddress": &graphql.ArgumentConfig{
+			Description: "IP or host[:port] to connect to instead of resolving the URL's host",
+			Type:        graphql.String,
+		},
+		"tunnel": &graphql.ArgumentConfig{
+			Description: "Name of an SSH tunnel configured on the server to fetch through",
+			Type:        graphql.String,
+		},
+		"egress": &graphql.ArgumentConfig{
+			Description: "Name of an egress route configured on the server to fetch through, e.g. a proxy in another region",
+			Type:        graphql.String,
+		},
+		"pool": &graphql.ArgumentConfig{
+			Description: "Name of a worker pool configured on the server to run the job",
+			Type:        graphql.String,
+		},
+		"debug": &graphql.ArgumentConfig{
+			Description: "Capture the requests as sent, the redirect responses and a transport log in debugInfo",
+			Type:        graphql.Boolean,
+		},
+		"maxBytes": &graphql.ArgumentConfig{
+			Description: "Abort the job if the response body is larger than this",
+			Type:        graphql.Int,
+		},
+		"maxDuration": &graphql.ArgumentConfig{
+			Description: "Abort the job if the request takes longer than this, e.g. \"30s\"",
+			Type:        graphql.String,
+		},
+		"notBefore": &graphql.ArgumentConfig{
+			Description: "RFC 3339 time before which the job must not run",
+			Type:        graphql.String,
+		},
+		"deadline": &graphql.ArgumentConfig{
+			Description: "RFC 3339 time the job should have run by, used when the server schedules jobs by deadline",
+			Type:        graphql.String,
+		},
+		"notify": &graphql.ArgumentConfig{
+			Description: "Name of a notifier configured on the server to tell when the job has finished",
+			Type:        graphql.String,
+		},
+		"tags": &graphql.ArgumentConfig{
+			Description: "Labels to filter the job's events by",
+			Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+		},
+		"metadata": &graphql.ArgumentConfig{
+			Description: "Key/value pairs to attach to the job, for the client's own use",
+			Type:        graphql.NewList(graphql.NewNonNull(metadataInput)),
+		},
+	}
+}
+
+// parseJobOptions sets the options given in args, leaving the others as
+// they are, after checking the caller in ctx may name the client
+// certificate and tunnel they give.
+func parseJobOptions(ctx context.Context, args map[string]interface{}, opts *JobOptions) error {
+	set := func(name string, field *string) {
+		if v, ok := args[name].(string); ok {
+			*field = v
+		}
+	}
+	if name, ok := args["preset"].(string); ok {
+		preset, err := WithPreset(name, JobOptions{})
+		if err != nil {
+			return err
+		}
+		// The preset replaces the options it sets; the other arguments
+		// then override it.
+		overlayOptions(opts, preset)
+		opts.Preset = name
+	}
+	set("type", &opts.Type)
+	if opts.Type == "fetch" {
+		opts.Type = JobFetch
+	}
+	if opts.Type != JobFetch && opts.Type != JobCertificate {
+		return fmt.Errorf("unknown job type %q", opts.Type)
+	}
+	set("clientCert", &opts.ClientCert)
+	set("hostHeader", &opts.HostHeader)
+	set("serverName", &opts.ServerName)
+	set("connectAddress", &opts.ConnectAddress)
+	set("tunnel", &opts.Tunnel)
+	set("egress", &opts.Egress)
+	set("pool", &opts.Pool)
+	clientCert, _ := args["clientCert"].(string)
+	tunnel, _ := args["tunnel"].(string)
+	if err := CheckJobCredentials(ctx, clientCert, tunnel); err != nil {
+		return err
+	}
+	if opts.Pool != "" && !HasPool(opts.Pool) {
+		return fmt.Errorf("unknown worker pool %q", opts.Pool)
+	}
+	if debug, ok := args["debug"].(bool); ok {
+		opts.Debug = debug
+	}
+	if n, ok := args["maxBytes"].(int); ok {
+		opts.MaxBytes = int64(n)
+	}
+	if d, ok := args["maxDuration"].(string); ok {
+		var err error
+		if opts.MaxDuration, err = time.ParseDuration(d); err != nil {
+			return fmt.Errorf("invalid maxDuration: %v", err)
+		}
+	}
+	if t, ok := args["notBefore"].(string); ok {
+		var err error
+		if opts.NotBefore, err = time.Parse(time.RFC3339, t); err != nil {
+			return fmt.Errorf("invalid notBefore: %v", err)
+		}
+	}
+	if d, ok := args["deadline"].(string); ok {
+		var err error
+		if opts.Deadline, err = time.Parse(time.RFC3339, d); err != nil {
+			return fmt.Errorf("invalid deadline: %v", err)
+		}
+	}
+	set("notify", &opts.Notify)
+	if opts.Notify != "" && !HasNotifier(opts.Notify) {
+		return fmt.Errorf("unknown notifier %q", opts.Notify)
+	}
+	if _, ok := args["tags"]; ok {
+		opts.Tags = stringList(args["tags"])
+	}
+	if _, ok := args["metadata"]; ok {
+		metadata, err := parseMetadata(args["metadata"])
+		if err != nil {
+			return err
+		}
+		opts.Metadata = withoutEmpty(metadata)
+	}
+	return nil
+}
+
+// stringList converts a list argument to a slice of strings.
+func stringList(arg interface{}) []string {
+	var list []string
+	values, _ := arg.([]interface{})
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// jobOf returns the job from a GraphQL source value, which holds either a
+// Job or a *Job.
+func jobOf(source interface{}) *Job {
+	if job, ok := source.(Job); ok {
+		return &job
+	}
+	return source.(*Job)
+}
+
 // "Global" state for the package representing data and jobs
-var jobQueue = make(chan int64, 1000)
+var jobQueue queue.Queue = queue.NewMemory(0)
+var jobsMu sync.Mutex // Guards jobs
 var jobs = make(map[int64]*Job)
+var responsesMu sync.RWMutex // Guards responses
 var responses = make(map[string]*Response)
 var curJobID = int64(0)
 
+// How long a fetched response is served from the cache.
+var cacheTTL = time.Hour
+
+// SetQueue replaces the in-memory job queue, e.g. with one kept by a
+// message broker. It must be called before any job is added and before
+// the workers are started.
+func SetQueue(q queue.Queue) {
+	jobQueue = q
+}
+
+// enqueue puts a job on the queue, retrying until the queue accepts it so
+// that a broker outage delays jobs rather than losing them.
+func enqueue(id int64) {
+	item := queue.Item{JobID: id}
+	q := jobQueue
+	if job := GetJob(id); job != nil {
+		item.Tenant = job.Tenant
+		item.Deadline = job.Options.Deadline
+		item.Priority = job.Options.Priority
+		q = queueFor(job)
+	}
+	markEnqueued(id, item.Tenant)
+	for {
+		err := q.Enqueue(context.Background(), item)
+		if err == nil {
+			return
+		}
+		fmt.Println("failed to queue job", id, "retrying:", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// Reset discards all jobs, responses and statistics, and drops any jobs
+// still waiting in the queue. It is meant for tests.
+func Reset() {
+	if q, ok := jobQueue.(*queue.Memory); ok {
+		q.Purge()
+	}
+	for _, p := range sortedPools() {
+		if q, ok := p.Queue.(*queue.Memory); ok {
+			q.Purge()
+		}
+	}
+	jobsMu.Lock()
+	jobs = make(map[int64]*Job)
+	jobsMu.Unlock()
+	trashMu.Lock()
+	trash = map[int64]*Job{}
+	trashMu.Unlock()
+	journalMu.Lock()
+	journaledMarks = map[int64]jobMark{}
+	journalMu.Unlock()
+	responsesMu.Lock()
+	responses = make(map[string]*Response)
+	responsesMu.Unlock()
+	resetDuplicates()
+	resetAliases()
+	hostStatsMu.Lock()
+	hostStats = map[string]*HostStats{}
+	hostStatsMu.Unlock()
+	circuitsMu.Lock()
+	circuits = map[string]*circuit{}
+	circuitsMu.Unlock()
+	pacesMu.Lock()
+	paces = map[string]*hostPace{}
+	pacesMu.Unlock()
+	alertsMu.Lock()
+	outcomes = nil
+	firing = map[string]*Alert{}
+	alertsMu.Unlock()
+	batchesMu.Lock()
+	batches = map[int64]*Batch{}
+	batchesMu.Unlock()
+	rateWindowsMu.Lock()
+	rateWindows = map[string]*rateWindow{}
+	rateWindowsMu.Unlock()
+	monitorsMu.Lock()
+	monitors = map[int64]*Monitor{}
+	monitorsMu.Unlock()
+	uptimeMu.Lock()
+	uptimeChecks = map[string][]UptimeCheck{}
+	incidents = map[string][]*Incident{}
+	uptimeMu.Unlock()
+	delayMu.Lock()
+	delayed = nil
+	delayMu.Unlock()
+	resetQueueWaits()
+	subscribersMu.Lock()
+	recent, recentStart = recent[:0], 0
+	subscribersMu.Unlock()
+}
+
 // AddJob adds a new job to the work queue
 func AddJob(url string) Job {
+	return AddJobWithOptions(url, JobOptions{})
+}
+
+// AddJobWithOptions adds a new job with the given options to the work queue
+func AddJobWithOptions(url string, opts JobOptions) Job {
+	opts = withPool(withHostProfile(url, withRoutingRules(url, opts)))
 	jobID := atomic.AddInt64(&curJobID, 1)
 	job := Job{
 		ID:       jobID,
 		URL:      url,
 		Status:   "waiting",
 		Response: nil,
+		Tenant:   opts.Tenant,
+		Owner:    opts.Owner,
+		Options:  opts,
 	}
+	jobsMu.Lock()
 	jobs[jobID] = &job
+	jobsMu.Unlock()
+	if delayJob(&job) {
+		return snapshotJob(&job)
+	}
+	recordEvent(&job, "queued", "queued for %s", RedactURL(url))
+	if parkIfHeld(&job) {
+		return snapshotJob(&job)
+	}
 
-	jobQueue <- job.ID
-	return job
+	// Once queued, a worker may change the job while it is copied.
+	queued := snapshotJob(&job)
+	enqueue(job.ID)
+	return queued
 }
 
 // GetJob returns the job associated with the ID
 func GetJob(id int64) *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
 	return jobs[id]
 }
 
-// GetJobs returns all jobs stored by this server as a slice
+// GetJobs returns all jobs stored by this server as a slice, ordered by ID
 func GetJobs() []*Job {
+	jobsMu.Lock()
 	sliceJobs := []*Job{}
 	for _, job := range jobs {
 		sliceJobs = append(sliceJobs, job)
 	}
+	jobsMu.Unlock()
+	// A stable order keeps repeated queries byte for byte identical, so
+	// their ETags match.
+	sort.Slice(sliceJobs, func(i, j int) bool { return sliceJobs[i].ID < sliceJobs[j].ID })
 	return sliceJobs
 }
 
 // GetResponse returns the response data associated with the URL
 func GetResponse(url string) *Response {
-	return responses[url]
+	return lookupResponse(cacheKey(url))
+}
+
+// lookupResponse returns the response cached under key, or nil.
+func lookupResponse(key string) *Response {
+	responsesMu.RLock()
+	defer responsesMu.RUnlock()
+	return responses[key]
+}
+
+// cacheResponse stores a response in the cache under key, and indexes it
+// for finding duplicates and aliases.
+func cacheResponse(key string, r *Response) {
+	responsesMu.Lock()
+	responses[key] = r
+	responsesMu.Unlock()
+	indexContent(r)
+	indexAliases(r)
+}
+
+// cacheNewerResponse caches r under key unless a response fetched no
+// earlier is cached already, as when restoring the cache from jobs.
+func cacheNewerResponse(key string, r *Response) {
+	responsesMu.Lock()
+	if cached, ok := responses[key]; ok && !cached.Timestamp.Before(r.Timestamp) {
+		responsesMu.Unlock()
+		return
+	}
+	responses[key] = r
+	responsesMu.Unlock()
+	indexContent(r)
+	indexAliases(r)
+}
+
+// replaceResponse caches r under key in place of old, unless another
+// response has replaced old in the meantime.
+func replaceResponse(key string, old, r *Response) {
+	responsesMu.Lock()
+	if responses[key] != old {
+		responsesMu.Unlock()
+		return
+	}
+	responses[key] = r
+	responsesMu.Unlock()
+	indexContent(r)
+	indexAliases(r)
 }
 
 // GetResponses returns all responses stored by this server as a slice
 func GetResponses() []*Response {
-	sliceResponses := []*Response{}
+	responsesMu.RLock()
+	cached := make([]*Response, 0, len(responses))
 	for _, response := range responses {
+		cached = append(cached, response)
+	}
+	responsesMu.RUnlock()
+	sliceResponses := []*Response{}
+	for _, response := range cached {
 		sliceResponses = append(sliceResponses, response)
 	}
 	return sliceResponses
 }
 
-func doJob(jobID int64) {
+func doJob(workerID int, jobID int64) {
 	// Check if we already have data in the cache - if so, we can fill it right away
 	// and skip adding it to the work queue.
 	// Returns the URL data associated with the URL, returning the cached
 	// data.
 	// FIXME: Optimize to reduce impact of rapid concurrent requests for the same URL.
 	fmt.Println("Fetching job", jobID)
-	job := jobs[jobID]
+	job := GetJob(jobID)
+	if job == nil {
+		// The job was discarded by Reset after it was queued.
+		return
+	}
+	updateJob(job, func(job *Job) { job.WorkerID = workerID })
+	recordEvent(job, "dequeued", "dequeued by worker %d", workerID)
+	defer func() {
+		// A job left fetching was interrupted by a panic and will be
+		// handed out again.
+		if status := jobStatus(job); Finished(status) {
+			recordEvent(job, "completed", "finished with status %q", status)
+			jobFinished(job)
+		}
+	}()
 
+	// Cached responses were fetched under the same target policy, which
+	// may have changed since.
+	if err := CheckJobTarget(job.URL, job.Options); err != nil {
+		failJob(nil, job, policyError("%v", err))
+		return
+	}
 	// Check the cache
-	response, ok := responses[job.URL]
-	if ok && (time.Now().Sub(response.Timestamp).Hours() < 1.0) {
-		// Immediately fill with cache and finish the job.
-		job.Response = response
-		job.Status = "done - cached"
-	} else {
+	if response := cachedResponse(job); response != nil {
+		// Immediately fill with cache and finish the job, failing it like
+		// the fetch that cached an error response.
+		e := cachedError(response)
+		updateJob(job, func(job *Job) {
+			job.Response = response
+			job.Error = e
+			job.Status = "done - cached"
+			if e != nil {
+				job.Status = "error"
+			}
+		})
+		return
+	}
+
+	updateJob(job, func(job *Job) {
 		job.Status = "fetching"
-		resp, err := http.Get(job.URL)
-		if err != nil {
-			job.Response = nil
-			job.Status = "error - error with GET"
-			return
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			job.Response = nil
-			job.Status = "error - error reading body"
+		job.Response = nil
+		job.Error = nil
+		job.LookupWait = 0
+	})
+	client, err := fetcherFor(job)
+	if err != nil {
+		failJob(nil, job, policyError("bad transport settings: %v", err))
+		return
+	}
+	ctx, cancel := withBudget(withJob(withAddressPins(withConnTrace(context.Background(), job.URL)), job), job)
+	defer cancel()
+	ctx, exchanges := withExchangeRecorder(ctx, job.URL)
+	if job.Options.Debug {
+		var debug *debugRecorder
+		ctx, debug = withDebugRecorder(ctx)
+		client = debug.wrap(client)
+		// Failed fetches are the ones most worth debugging.
+		defer func() {
+			info := debug.captured()
+			updateJob(job, func(job *Job) { job.Debug = info })
+		}()
+	}
+	req, err := newRequest(ctx, job)
+	if err != nil {
+		failJob(nil, job, policyError("invalid request: %v", err))
+		return
+	}
+	if err := waitForFetchRate(ctx); err != nil {
+		failJob(ctx, job, classifyError(err))
+		return
+	}
+	if job.Options.Type == JobCertificate {
+		checkCertificate(ctx, job)
+		return
+	}
+	recordEvent(job, "request", "GET %s", RedactURL(job.URL))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		// The rewritten URL may hold secrets from the rewrite rules.
+		if ue, ok := err.(*url.Error); ok && ue.URL == req.URL.String() {
+			ue.URL = job.URL
 		}
-		response := &Response{
-			URL:       job.URL,
-			Body:      string(body),
-			Timestamp: time.Now(),
+		circuitRecord(hostOf(job.URL), false)
+		failJob(ctx, job, classifyError(err))
+		return
+	}
+	defer resp.Body.Close()
+	dropped := sanitizeHeader(resp.Header)
+	if len(dropped) > 0 {
+		recordEvent(job, "headers", "dropped malformed values of %s", strings.Join(dropped, ", "))
+	}
+	body, err := readBody(job, resp.Body)
+	if err == errTooLarge {
+		circuitRecord(hostOf(job.URL), resp.StatusCode < 500)
+		failJob(ctx, job, exceedBudget(job, budgetBytes))
+		return
+	}
+	if err != nil {
+		circuitRecord(hostOf(job.URL), false)
+		failJob(ctx, job, &JobError{Category: ErrBodyRead, Message: err.Error(), Retryable: true})
+		return
+	}
+	circuitRecord(hostOf(job.URL), resp.StatusCode < 500)
+	if throttled(resp) {
+		backOff(hostOf(job.URL), resp)
+	} else {
+		recordResponse(hostOf(job.URL), time.Since(start))
+	}
+	// Links are relative to the URL the job asked for unless redirected.
+	base := job.URL
+	if resp.Request.URL.String() != req.URL.String() {
+		base = resp.Request.URL.String()
+	}
+	response := &Response{
+		URL:        job.URL,
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		Header:     resp.Header,
+		Timestamp:  clock.Now(),
+		Checksums:  computeChecksums(body),
+		Links:      extractLinks(base, resp.Header, body),
+		Resolver:   resolverFor(job, req),
+		Canonical:  canonicalURL(job.URL, base, resp.Header, body),
+	}
+	response.DroppedHeaders = dropped
+	response.StructuredData = extractStructuredData(base, resp.Header, body)
+	response.Thumbnail = makeThumbnail(response)
+	exchanges.finish(resp)
+	response.Exchanges = exchanges.recorded()
+	response.Findings = runProcessors(response, routedProcessors(job, response))
+	response.Findings = append(response.Findings, scriptFindings(job, response)...)
+	response.Language = detectLanguage(response)
+	sanitizeResponse(response)
+	updateJob(job, func(job *Job) { job.Response = response })
+	if e := httpError(resp); e != nil {
+		// Keep the error response on the job, but only cache it if
+		// asking again would not help.
+		if !e.Retryable && !bypassesCache(job) {
+			cacheResponse(cacheKey(job.URL), response)
 		}
-		responses[job.URL] = response
-		job.Response = response
-		job.Status = "done"
+		failJob(ctx, job, e)
+		return
+	}
+	if !bypassesCache(job) {
+		cacheResponse(cacheKey(job.URL), response)
+	}
+	setStatus(job, "done")
+}
+
+// jobFinished runs the hooks for a job that has reached its final status.
+func jobFinished(job *Job) {
+	recordOutcome(job)
+	notifyJob(job)
+	crawlJobFinished(job)
+	batchJobFinished(job)
+	monitorJobFinished(job)
+	snapshotJobFinished(job)
+}
+
+// cachedResponse returns a fresh, intact cached response for the job, or
+// nil if it has to be fetched. Jobs for which bypassesCache holds bypass
+// the cache entirely, so they neither see nor replace what other jobs
+// fetched through the normal route. Jobs with NoCache set still replace
+// what is cached, and certificate jobs have no use for responses.
+func cachedResponse(job *Job) *Response {
+	if bypassesCache(job) || job.Options.NoCache || job.Options.Type != JobFetch {
+		return nil
+	}
+	response := lookupResponse(cacheKey(job.URL))
+	if response == nil || clock.Now().Sub(response.Timestamp) >= cacheTTL {
+		return nil
 	}
+	if response.Corrupt() {
+		return nil
+	}
+	return response
 }
 
-func fetchWorker(jobQueue chan int64) {
-	// Continually fetch jobIDs off the channel and
+func fetchWorker(workerID int, q queue.Queue) {
+	// Continually fetch jobIDs off the queue and
 	// fetch/update their URL data.
-	fmt.Println("running worker")
+	fmt.Println("running worker", workerID)
 	for {
-		jobID := <-jobQueue
-		doJob(jobID)
+		d, err := q.Dequeue(context.Background())
+		if err != nil {
+			fmt.Println("worker", workerID, "failed to dequeue:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if job := claim(d); job != nil {
+			runJob(workerID, job, d)
+		}
 	}
 }
 
-// RunWorkers runs numWorkers workers that pull jobs off the queue.
+// RunWorkers runs numWorkers workers that pull jobs off the queue, and the
+// workers of the worker pools.
 func RunWorkers(numWorkers int) {
 	// Initialize the job queue channel
 	// Instantiate a bunch of works.
 
 	for i := 0; i < numWorkers; i++ {
-		go fetchWorker(jobQueue)
+		go fetchWorker(newWorker(""), jobQueue)
 	}
+	runPools()
 }
@@ -0,0 +1,29 @@
+package urldata
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrStaleVersion is returned for a change to a job based on a version
+// other than its current one, i.e. made by a client that has not seen the
+// job's latest state.
+var ErrStaleVersion = errors.New("stale job version")
+
+// touch records a change to the job other than by an event, such as moving
+// it to the trash: it bumps the job's version and saves the job to the
+// journal.
+func touch(job *Job) {
+	atomic.AddInt64(&job.Version, 1)
+	persist(job)
+}
+
+// claimVersion bumps the job's version if it is still expected, so that a
+// change based on it can go ahead, and returns ErrStaleVersion otherwise.
+func claimVersion(job *Job, expected int64) error {
+	if !atomic.CompareAndSwapInt64(&job.Version, expected, expected+1) {
+		return fmt.Errorf("%w: job %d is at version %d, not %d", ErrStaleVersion, job.ID, atomic.LoadInt64(&job.Version), expected)
+	}
+	return nil
+}
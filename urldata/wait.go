@@ -0,0 +1,98 @@
+package urldata
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Limits on how long a query may block waiting for jobs.
+const defaultJobWait = 30 * time.Second
+const maxJobWait = 5 * time.Minute
+
+// Finished reports whether a job with the given status has reached a final
+// state.
+func Finished(status string) bool {
+	return status == "error" || strings.HasPrefix(status, "done")
+}
+
+// WaitForJobs blocks until every job in ids has finished, timeout has
+// passed or ctx is done, and returns the jobs in the order of ids. Unknown
+// IDs give nil entries.
+func WaitForJobs(ctx context.Context, ids []int64, timeout time.Duration) []*Job {
+	pending := map[int64]bool{}
+	for _, id := range ids {
+		pending[id] = true
+	}
+	// Subscribe before looking at the jobs so no completion is missed.
+	sub := Subscribe(func(e JobEvent) bool {
+		return e.Type == "completed" && pending[e.JobID]
+	})
+	defer Unsubscribe(sub)
+
+	result := func() []*Job {
+		found := make([]*Job, len(ids))
+		for i, id := range ids {
+			found[i] = GetJob(id)
+		}
+		return found
+	}
+	unfinished := func() int {
+		n := 0
+		for _, job := range result() {
+			if job != nil && !Finished(jobStatus(job)) {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := clock.After(timeout)
+	for unfinished() > 0 {
+		select {
+		case <-sub.C:
+		case <-deadline:
+			return result()
+		case <-ctx.Done():
+			return result()
+		}
+	}
+	return result()
+}
+
+// WaitForJobChange blocks until the status of the job changes, timeout has
+// passed or ctx is done, and returns the job. Finished jobs are returned
+// straight away, as are unknown IDs as nil.
+func WaitForJobChange(ctx context.Context, id int64, timeout time.Duration) *Job {
+	sub := Subscribe(func(e JobEvent) bool { return e.JobID == id })
+	defer Unsubscribe(sub)
+	job := GetJob(id)
+	if job == nil || Finished(jobStatus(job)) {
+		return job
+	}
+	status := jobStatus(job)
+	deadline := clock.After(timeout)
+	for jobStatus(job) == status {
+		select {
+		case <-sub.C:
+		case <-deadline:
+			return job
+		case <-ctx.Done():
+			return job
+		}
+	}
+	return job
+}
+
+// waitDuration converts a waitSeconds style argument to a duration, applying
+// the default if it is missing and capping it.
+func waitDuration(arg interface{}, def time.Duration) time.Duration {
+	seconds, ok := arg.(int)
+	if !ok {
+		return def
+	}
+	d := time.Duration(seconds) * time.Second
+	if d > maxJobWait {
+		d = maxJobWait
+	}
+	return d
+}
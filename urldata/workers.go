@@ -0,0 +1,118 @@
+package urldata
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+)
+
+// WorkerInfo describes a worker and what it has done so far.
+type WorkerInfo struct {
+	ID            int
+	Pool          string // Worker pool, "" for the default workers
+	State         string // idle or busy
+	CurrentJob    int64  // ID of the job being processed, 0 when idle
+	JobsCompleted int64
+	Errors        int64 // Jobs that finished with an error status
+}
+
+var workersMu sync.Mutex
+var workers []*WorkerInfo
+
+// newWorker registers a worker of pool and returns its ID.
+func newWorker(pool string) int {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	w := &WorkerInfo{ID: len(workers) + 1, Pool: pool, State: "idle"}
+	workers = append(workers, w)
+	return w.ID
+}
+
+// workerBusy marks the worker as processing the job.
+func workerBusy(workerID int, jobID int64) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	w := workers[workerID-1]
+	w.State = "busy"
+	w.CurrentJob = jobID
+}
+
+// workerIdle marks the worker as idle after finishing a job with status.
+func workerIdle(workerID int, status string) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	w := workers[workerID-1]
+	w.State = "idle"
+	w.CurrentJob = 0
+	w.JobsCompleted++
+	if strings.HasPrefix(status, "error") {
+		w.Errors++
+	}
+}
+
+// GetWorkers returns a snapshot of all workers.
+func GetWorkers() []WorkerInfo {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	snapshot := make([]WorkerInfo, len(workers))
+	for i, w := range workers {
+		snapshot[i] = *w
+	}
+	return snapshot
+}
+
+func workerType() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Worker",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Worker ID, also recorded on the jobs it processes",
+			},
+			"pool": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Worker pool, null for the default workers",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if w := p.Source.(WorkerInfo); w.Pool != "" {
+						return w.Pool, nil
+					}
+					return nil, nil
+				},
+			},
+			"state": &graphql.Field{
+				Type:        graphql.String,
+				Description: "idle or busy",
+			},
+			"currentJob": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "ID of the job being processed, null when idle",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if w := p.Source.(WorkerInfo); w.CurrentJob != 0 {
+						return w.CurrentJob, nil
+					}
+					return nil, nil
+				},
+			},
+			"jobsCompleted": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of jobs the worker has finished",
+			},
+			"errors": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Number of finished jobs that ended in an error",
+			},
+			"errorRate": &graphql.Field{
+				Type:        graphql.Float,
+				Description: "Fraction of finished jobs that ended in an error",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					w := p.Source.(WorkerInfo)
+					if w.JobsCompleted == 0 {
+						return 0.0, nil
+					}
+					return float64(w.Errors) / float64(w.JobsCompleted), nil
+				},
+			},
+		},
+	})
+}
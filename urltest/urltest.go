@@ -0,0 +1,244 @@
+// Package urltest runs an in-process urlfetcher service for integration
+// tests, with a fake fetcher and clock so tests never touch the network.
+//
+// The urldata package keeps its state in package variables, so only one
+// test service may run at a time; tests using it must not call t.Parallel.
+package urltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dsoo/urlfetcher/urldata"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+)
+
+// Service is a running urlfetcher GraphQL endpoint backed by fakes.
+type Service struct {
+	URL     string // URL of the GraphQL endpoint
+	Server  *httptest.Server
+	Fetcher *FakeFetcher
+	Clock   *Clock
+
+	t testing.TB
+}
+
+var startWorkers sync.Once
+
+// NewTestService starts a service and registers cleanup with t. All jobs
+// are fetched through the returned service's Fetcher, and cache freshness
+// is judged by its Clock.
+func NewTestService(t testing.TB) *Service {
+	t.Helper()
+	startWorkers.Do(func() { urldata.RunWorkers(2) })
+	urldata.Reset()
+
+	s := &Service{
+		Fetcher: NewFakeFetcher(),
+		Clock:   NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		t:       t,
+	}
+	urldata.SetFetcher(s.Fetcher)
+	urldata.SetClock(s.Clock)
+
+	schema, err := graphql.NewSchema(urldata.SchemaConfig())
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", handler.New(&handler.Config{Schema: &schema}))
+	s.Server = httptest.NewServer(mux)
+	s.URL = s.Server.URL + "/graphql"
+
+	t.Cleanup(func() {
+		s.Server.Close()
+		urldata.SetFetcher(nil)
+		urldata.SetClock(nil)
+		urldata.Reset()
+	})
+	return s
+}
+
+// Query runs a GraphQL query against the service and returns its data,
+// failing the test if the request or the query fails.
+func (s *Service) Query(query string, variables map[string]interface{}) map[string]interface{} {
+	s.t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	resp, err := http.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("query failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		s.t.Fatalf("decoding query result failed: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		s.t.Fatalf("query returned errors: %v", result.Errors)
+	}
+	return result.Data
+}
+
+// AddJob submits a job for url and returns its ID.
+func (s *Service) AddJob(url string) int64 {
+	s.t.Helper()
+	data := s.Query(`mutation($url: String!) { addJob(url: $url) { id } }`,
+		map[string]interface{}{"url": url})
+	return int64(data["addJob"].(map[string]interface{})["id"].(float64))
+}
+
+// WaitForJob polls until the job has finished and returns its final status,
+// failing the test after timeout. Scheduled, waiting, parked and fetching
+// jobs have not finished.
+func (s *Service) WaitForJob(id int64, timeout time.Duration) string {
+	s.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if job := urldata.GetJob(id); job != nil {
+			if status := urldata.GetJobState(job).Status; urldata.Finished(status) {
+				return status
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.t.Fatalf("job %d did not finish within %v", id, timeout)
+	return ""
+}
+
+// FakeResponse is a canned reply served by a FakeFetcher.
+type FakeResponse struct {
+	Status int
+	Header http.Header
+	Body   string
+	Err    error // Returned instead of a response if set
+}
+
+// FakeFetcher answers requests from canned responses keyed by URL, and
+// records every URL it is asked for.
+type FakeFetcher struct {
+	mu        sync.Mutex
+	responses map[string]FakeResponse
+	requests  []string
+}
+
+// ErrNotFound is returned by a FakeFetcher for URLs it has no response for.
+var ErrNotFound = errors.New("urltest: no fake response for URL")
+
+// NewFakeFetcher returns a fetcher with no canned responses.
+func NewFakeFetcher() *FakeFetcher {
+	return &FakeFetcher{responses: map[string]FakeResponse{}}
+}
+
+// Handle registers a 200 response with the given body for url.
+func (f *FakeFetcher) Handle(url, body string) {
+	f.HandleResponse(url, FakeResponse{Status: http.StatusOK, Body: body})
+}
+
+// HandleResponse registers a response for url.
+func (f *FakeFetcher) HandleResponse(url string, r FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[url] = r
+}
+
+// Requests returns the URLs requested so far, in order.
+func (f *FakeFetcher) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// Do implements urldata.Fetcher.
+func (f *FakeFetcher) Do(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	f.mu.Lock()
+	f.requests = append(f.requests, url)
+	r, ok := f.responses[url]
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, url)
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	header := r.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(r.Body))),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Clock is a manually advanced clock implementing urldata.Clock. Time only
+// moves when Advance is called, which also fires any waiters that fall due.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewClock returns a clock stopped at t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements urldata.Clock.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing waiters that fall due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+}